@@ -0,0 +1,71 @@
+package core
+
+import "github.com/sderkacs/go-exi/utils"
+
+/*
+	objectArena implementation
+*/
+
+// objectArena allocates the runtime QNameContexts, StartElements and
+// built-in grammars of a coder from blocks allocated up front. Blocks are
+// recycled by reset, i.e. for each run of the coder. Once the blocks of a
+// kind are used up the arena falls back to regular allocation.
+//
+// A nil arena allocates regularly.
+type objectArena struct {
+	qnameContexts    []QNameContext
+	startElements    []startElementBlock
+	startTags        []builtInStartTagBlock
+	nextQNameContext int
+	nextStartElement int
+	nextStartTag     int
+}
+
+func newObjectArena(size int) *objectArena {
+	return &objectArena{
+		qnameContexts:    make([]QNameContext, size),
+		startElements:    make([]startElementBlock, size),
+		startTags:        make([]builtInStartTagBlock, size),
+		nextQNameContext: 0,
+		nextStartElement: 0,
+		nextStartTag:     0,
+	}
+}
+
+// reset makes all blocks available again. Objects allocated before must not
+// be used anymore.
+func (a *objectArena) reset() {
+	if a == nil {
+		return
+	}
+	a.nextQNameContext = 0
+	a.nextStartElement = 0
+	a.nextStartTag = 0
+}
+
+func (a *objectArena) newQNameContext(namespaceUriID int, localNameID int, qName utils.QName) *QNameContext {
+	if a == nil || a.nextQNameContext == len(a.qnameContexts) {
+		return NewQNameContext(namespaceUriID, localNameID, qName)
+	}
+	qnc := &a.qnameContexts[a.nextQNameContext]
+	a.nextQNameContext++
+	return qnc.init(namespaceUriID, localNameID, qName)
+}
+
+func (a *objectArena) newStartElement(qnc *QNameContext) *StartElement {
+	if a == nil || a.nextStartElement == len(a.startElements) {
+		return NewStartElement(qnc)
+	}
+	b := &a.startElements[a.nextStartElement]
+	a.nextStartElement++
+	return b.init(qnc)
+}
+
+func (a *objectArena) newBuiltInStartTag() *BuiltInStartTag {
+	if a == nil || a.nextStartTag == len(a.startTags) {
+		return NewBuiltInStartTag()
+	}
+	b := &a.startTags[a.nextStartTag]
+	a.nextStartTag++
+	return b.init()
+}
@@ -49,7 +49,7 @@ type AttributeListImpl struct {
 
 	// options
 	isSchemaInformed       bool
-	isCanonical            bool
+	sortAttributes         bool // Canonical EXI or OptionSortAttributes
 	preserveSchemaLocation bool
 	preservePrefixes       bool
 
@@ -76,7 +76,7 @@ type AttributeListImpl struct {
 func NewAttributeListImpl(exiFactory EXIFactory) *AttributeListImpl {
 	return &AttributeListImpl{
 		isSchemaInformed:       exiFactory.GetGrammars().IsSchemaInformed(),
-		isCanonical:            exiFactory.GetEncodingOptions().IsOptionEnabled(OptionCanonicalExi),
+		sortAttributes:         isSortingAttributes(exiFactory.GetEncodingOptions()),
 		preserveSchemaLocation: exiFactory.GetEncodingOptions().IsOptionEnabled(OptionIncludeXsiSchemaLocation),
 		preservePrefixes:       exiFactory.GetFidelityOptions().IsFidelityEnabled(FeaturePrefix),
 		hasXsiType:             false,
@@ -93,6 +93,10 @@ func NewAttributeListImpl(exiFactory EXIFactory) *AttributeListImpl {
 	}
 }
 
+func isSortingAttributes(options *EncodingOptions) bool {
+	return options.IsOptionEnabled(OptionCanonicalExi) || options.IsOptionEnabled(OptionSortAttributes)
+}
+
 func (list *AttributeListImpl) Clear() {
 	list.hasXsiType = false
 	list.hasXsiNil = false
@@ -160,7 +164,7 @@ func (list *AttributeListImpl) GetAttributeValue(index int) *string {
 }
 
 func (list *AttributeListImpl) GetAttributePrefix(index int) *string {
-	return &list.attributeValue[index]
+	return &list.attributePrefix[index]
 }
 
 func (list *AttributeListImpl) setXsiType(rawType *string, xsiPrefix *string) {
@@ -180,7 +184,7 @@ func (list *AttributeListImpl) setXsiNil(rawNil, xsiPrefix *string) {
 func (list *AttributeListImpl) AddNamespaceDeclaration(uri string, prefix *string) {
 	// Canonical EXI defines that namespace declarations MUST be sorted
 	// lexicographically according to the NS prefix
-	if len(list.nsDecls) == 0 || !list.isCanonical {
+	if len(list.nsDecls) == 0 || !list.sortAttributes {
 		list.nsDecls = append(list.nsDecls, NewNamespaceDeclarationContainer(uri, prefix))
 	} else {
 		i := len(list.nsDecls)
@@ -242,7 +246,7 @@ func (list *AttributeListImpl) AddAttributeByQName(at utils.QName, value string)
 }
 
 func (list *AttributeListImpl) insertAttribute(uri *string, localName string, prefix *string, value string) {
-	if list.isSchemaInformed || list.isCanonical {
+	if list.isSchemaInformed || list.sortAttributes {
 		// sorted attributes
 		i := len(list.attributeURI)
 
@@ -265,7 +269,7 @@ func (list *AttributeListImpl) insertAttribute(uri *string, localName string, pr
 }
 
 func (list *AttributeListImpl) isGreaterNS(nsIndex int, prefix *string) bool {
-	compPrefix := strings.Compare(*list.GetNamespaceDeclaration(nsIndex).Prefix, *prefix)
+	compPrefix := strings.Compare(utils.AsValue(list.GetNamespaceDeclaration(nsIndex).Prefix), utils.AsValue(prefix))
 
 	return compPrefix > 0
 }
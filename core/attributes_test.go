@@ -0,0 +1,116 @@
+package core
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/sderkacs/go-exi/utils"
+)
+
+func TestAttributeList(t *testing.T) {
+	list := NewAttributeListImpl(NewDefaultEXIFactory())
+	list.AddNamespaceDeclaration("urn:p", utils.AsPtr("p"))
+	list.AddAttribute(utils.AsPtr("urn:p"), "b", utils.AsPtr("p"), "2")
+	list.AddAttribute(nil, "a", nil, "1")
+	list.AddAttribute(utils.AsPtr(XMLSchemaInstanceNS_URI), XSINil, utils.AsPtr("xsi"), "true")
+
+	if n := list.GetNumberOfNamespaceDeclarations(); n != 1 {
+		t.Errorf("got %d namespace declarations, want 1", n)
+	}
+	if !list.HasXsiNil() || *list.GetXsiNil() != "true" || *list.GetXsiNilPrefix() != "xsi" {
+		t.Errorf("xsi:nil not kept apart from the attributes")
+	}
+
+	// schema-less lists keep the order attributes were added in
+	want := []struct{ uri, localName, prefix, value string }{
+		{"urn:p", "b", "p", "2"},
+		{"", "a", "", "1"},
+	}
+	if n := list.GetNumberOfAttributes(); n != len(want) {
+		t.Fatalf("got %d attributes, want %d", n, len(want))
+	}
+	for i, at := range want {
+		got := []string{*list.GetAttributeURI(i), *list.GetAttributeLocalName(i), *list.GetAttributePrefix(i), *list.GetAttributeValue(i)}
+		if got[0] != at.uri || got[1] != at.localName || got[2] != at.prefix || got[3] != at.value {
+			t.Errorf("attribute %d: got %q, want %+v", i, got, at)
+		}
+	}
+}
+
+// warnings records the warnings of a coder.
+type warnings []string
+
+func (w *warnings) Warning(err error) { *w = append(*w, err.Error()) }
+func (w *warnings) Error(err error)   {}
+
+func TestEncodeAttributeListPrefixes(t *testing.T) {
+	tests := []struct {
+		name string
+		add  func(list *AttributeListImpl)
+		want string
+	}{
+		{"declaration", func(list *AttributeListImpl) { list.AddNamespaceDeclaration("urn:p", nil) },
+			"namespace declaration of 'urn:p' lacks a prefix"},
+		{"attribute", func(list *AttributeListImpl) { list.AddAttribute(utils.AsPtr("urn:p"), "a", nil, "1") },
+			"attribute {urn:p}a lacks a prefix"},
+		{"xsi:nil", func(list *AttributeListImpl) {
+			list.AddAttribute(utils.AsPtr(XMLSchemaInstanceNS_URI), XSINil, utils.AsPtr(""), "true")
+		}, "attribute {" + XMLSchemaInstanceNS_URI + "}nil lacks a prefix"},
+	}
+	for _, test := range tests {
+		for _, require := range []bool{false, true} {
+			factory := NewDefaultEXIFactory()
+			if err := factory.GetFidelityOptions().SetFidelity(FeaturePrefix, true); err != nil {
+				t.Fatal(err)
+			}
+			if require {
+				if err := factory.GetEncodingOptions().SetOption(OptionRequirePrefixes); err != nil {
+					t.Fatal(err)
+				}
+			}
+			encoder, err := factory.CreateEXIBodyEncoder()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var w warnings
+			encoder.SetErrorHandler(&w)
+			if err := encoder.SetOutputStream(bufio.NewWriter(io.Discard)); err != nil {
+				t.Fatal(err)
+			}
+			list := NewAttributeListImpl(factory)
+			test.add(list)
+			err = encodeAll(
+				encoder.EncodeStartDocument,
+				func() error { return encoder.EncodeStartElement("", "r", utils.AsPtr("")) },
+				func() error { return encoder.EncodeAttributeList(list) },
+			)
+			if require {
+				if err == nil || err.Error() != test.want {
+					t.Errorf("%s: got error %v, want %q", test.name, err, test.want)
+				}
+				continue
+			}
+			// without the option a declaration without prefix is a warning
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			}
+			if test.name == "declaration" && (len(w) != 1 || !strings.HasPrefix(w[0], MisuseOfPreservePrefixes)) {
+				t.Errorf("%s: got warnings %q", test.name, w)
+			}
+		}
+	}
+
+	// canonical EXI sorts declarations, a missing prefix sorts as empty
+	factory := NewDefaultEXIFactory()
+	if err := factory.GetEncodingOptions().SetOption(OptionCanonicalExi); err != nil {
+		t.Fatal(err)
+	}
+	list := NewAttributeListImpl(factory)
+	list.AddNamespaceDeclaration("urn:b", utils.AsPtr("b"))
+	list.AddNamespaceDeclaration("urn:a", nil)
+	if ns := list.GetNamespaceDeclaration(0); ns.NamespaceURI != "urn:a" {
+		t.Errorf("canonical order starts with %s, want urn:a", ns.NamespaceURI)
+	}
+}
@@ -2,9 +2,11 @@ package core
 
 import (
 	"bufio"
+	"compress/flate"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"math/big"
 
 	"github.com/sderkacs/go-exi/utils"
@@ -13,6 +15,11 @@ import (
 const (
 	/* long == 64 bits, 9 * 7bits = 63 bits */
 	MaxOctetsForLong int = 9
+
+	// Upper bound for buffers sized by lengths read from the stream, larger
+	// values are read incrementally so that malformed lengths fail on EOS
+	// instead of allocating
+	maxPreallocatedLength int = 4096
 )
 
 type DecoderChannel interface {
@@ -23,9 +30,23 @@ type DecoderChannel interface {
 	// already at such a boundary
 	Align() error
 
+	// Returns whether the stream is at a byte-aligned boundary, i.e. no bits
+	// of the current byte are left unread
+	IsByteAligned() bool
+
+	// Returns the number of bits of the current byte not read yet, which are
+	// discarded by Align
+	PendingBits() int
+
 	// Skips over and discards <code>n</code> bytes of data from this channel.
 	Skip(n int64) error
 
+	// Returns the next n bytes without consuming them. The stream must be
+	// byte-aligned. If fewer than n bytes are available, the available bytes
+	// are returned together with an error. The bytes may only be valid until
+	// the next read.
+	Peek(n int) ([]byte, error)
+
 	// Decodes and returns an n-bit unsigned integer.
 	DecodeNBitUnsignedInteger(n int) (int, error)
 	DecodeNBitUnsignedIntegerValue(n int) (*IntegerValue, error)
@@ -38,6 +59,10 @@ type DecoderChannel interface {
 	// Decode a binary value as a length-prefixed sequence of octets.
 	DecodeBinary() ([]byte, error)
 
+	// Decode a binary value like DecodeBinary but copy the octets to w in
+	// chunks instead of collecting them. Returns the number of octets.
+	DecodeBinaryTo(w io.Writer) (int, error)
+
 	// Decode a string as a length-prefixed sequence of UCS codepoints, each of
 	// which is encoded as an integer.
 	DecodeString() ([]rune, error)
@@ -74,6 +99,56 @@ type DecoderChannel interface {
 	// Decode Date-Time as sequence of values representing the individual
 	// components of the Date-Time.
 	DecodeDateTimeValue(kind DateTimeType) (*DateTimeValue, error)
+
+	// Decode a Duration as sign followed by the years, months, days, hours
+	// and minutes as Unsigned Integers and the seconds as Unsigned Integers
+	// of the integral and reversed fractional portion (see DecodeDecimalValue).
+	DecodeDurationValue() (*DurationValue, error)
+
+	// Limits the number of decimal digits of arbitrary precision integers.
+	// A negative value indicates no limit.
+	SetMaxIntegerDigits(digits int)
+}
+
+// RawRecordingDecoderChannel is implemented by decoder channels that can
+// record the bytes they consume, e.g. to report the encoded form of values.
+type RawRecordingDecoderChannel interface {
+	// Starts recording the consumed bytes, dropping any previous recording.
+	StartRawRecording()
+
+	// Stops recording and returns the bytes consumed since recording started.
+	StopRawRecording() []byte
+}
+
+// CountingDecoderChannel is implemented by decoder channels that count the
+// bytes they consume.
+type CountingDecoderChannel interface {
+	// Returns the number of bytes read, including a partially read byte.
+	GetLength() int
+}
+
+// rawRecorder collects consumed bytes while recording.
+type rawRecorder struct {
+	recording bool
+	recorded  []byte
+}
+
+func (r *rawRecorder) start(partial ...byte) {
+	r.recording = true
+	r.recorded = append([]byte{}, partial...)
+}
+
+func (r *rawRecorder) record(b ...byte) {
+	if r.recording {
+		r.recorded = append(r.recorded, b...)
+	}
+}
+
+func (r *rawRecorder) stop() []byte {
+	recorded := r.recorded
+	r.recording = false
+	r.recorded = nil
+	return recorded
 }
 
 type EncoderChannel interface {
@@ -86,6 +161,15 @@ type EncoderChannel interface {
 	// Align to next byte-aligned boundary in the stream if it is not
 	// already at such a boundary
 	Align() error
+
+	// Returns whether the stream is at a byte-aligned boundary, i.e. no bits
+	// of a partial byte are pending
+	IsByteAligned() bool
+
+	// Returns the number of bits of the current partial byte written so far,
+	// which Align completes with padding bits
+	PendingBits() int
+
 	Encode(b int) error
 	EncodeBytes(b []byte, offset, length int) error
 	EncodeNBitUnsignedInteger(b, n int) error
@@ -135,6 +219,10 @@ type EncoderChannel interface {
 	// The Date-Time datatype representation is a sequence of values
 	// representing the individual components of the Date-Time
 	EncodeDateTime(cal *DateTimeValue) error
+
+	// The Duration representation is a sign followed by the components of
+	// the duration, see DecoderChannel.DecodeDurationValue
+	EncodeDuration(duration *DurationValue) error
 }
 
 /*
@@ -145,14 +233,21 @@ type AbstractDecoderChannel struct {
 	DecoderChannel
 	/* buffer for reading arbitrary large integer values */
 	maskedOctets []int
+	/* maximum number of decimal digits for big integers, negative for unbounded */
+	maxIntegerDigits int
 }
 
 func NewAbstractDecoderChannel() *AbstractDecoderChannel {
 	return &AbstractDecoderChannel{
-		maskedOctets: make([]int, MaxOctetsForLong),
+		maskedOctets:     make([]int, MaxOctetsForLong),
+		maxIntegerDigits: DefaultMaxIntegerDigits,
 	}
 }
 
+func (c *AbstractDecoderChannel) SetMaxIntegerDigits(digits int) {
+	c.maxIntegerDigits = digits
+}
+
 func (c *AbstractDecoderChannel) DecodeBooleanValue() (*BooleanValue, error) {
 	b, err := c.DecodeBoolean()
 	if err != nil {
@@ -174,7 +269,10 @@ func (c *AbstractDecoderChannel) DecodeString() ([]rune, error) {
 }
 
 func (c *AbstractDecoderChannel) DecodeStringOnly(length int) ([]rune, error) {
-	ca := make([]rune, length)
+	if length < 0 {
+		return []rune{}, fmt.Errorf("invalid string length: %d", length)
+	}
+	ca := make([]rune, 0, min(length, maxPreallocatedLength))
 
 	for i := 0; i < length; i++ {
 		codePoint, err := c.DecodeUnsignedInteger()
@@ -187,7 +285,7 @@ func (c *AbstractDecoderChannel) DecodeStringOnly(length int) ([]rune, error) {
 		// if codePoint < 0 || codePoint > 0x10FFFF {
 		// 	return nil, fmt.Errorf("invalid Unicode code point U+%X at index %d", codePoint, i)
 		// }
-		ca[i] = rune(codePoint)
+		ca = append(ca, rune(codePoint))
 	}
 
 	return ca, nil
@@ -214,6 +312,10 @@ func (c *AbstractDecoderChannel) DecodeUnsignedInteger() (int, error) {
 		var b int
 
 		for {
+			if mShift >= 63 {
+				return -1, errors.New("unsigned integer exceeds int range")
+			}
+
 			// 1. Read the next octet
 			b, err = c.Decode()
 			if err != nil {
@@ -387,8 +489,19 @@ func (c *AbstractDecoderChannel) decodeUnsignedIntegerValue(negative bool) (*Int
 		multiplier = multiplier.Lsh(multiplier, 7)
 	}
 
+	// Each decimal digit needs at least log2(10) bits, stop reading octets
+	// as soon as the value can no longer fit the digit limit.
+	maxBits := -1
+	if c.maxIntegerDigits >= 0 {
+		maxBits = int(math.Ceil(float64(c.maxIntegerDigits)*math.Log2(10))) + 7
+	}
+
 	// read new bytes
 	for {
+		if maxBits >= 0 && multiplier.BitLen() > maxBits {
+			return nil, fmt.Errorf("integer exceeds maximum of %d digits", c.maxIntegerDigits)
+		}
+
 		// 1. Read the next octet
 		b, err = c.Decode()
 		if err != nil {
@@ -413,6 +526,10 @@ func (c *AbstractDecoderChannel) decodeUnsignedIntegerValue(negative bool) (*Int
 		bResult = bResult.Add(bResult, big.NewInt(1)).Neg(bResult)
 	}
 
+	if c.maxIntegerDigits >= 0 && len(new(big.Int).Abs(bResult).String()) > c.maxIntegerDigits {
+		return nil, fmt.Errorf("integer exceeds maximum of %d digits", c.maxIntegerDigits)
+	}
+
 	return IntegerValueOfBig(*bResult), nil
 }
 
@@ -559,6 +676,38 @@ func (c *AbstractDecoderChannel) DecodeDateTimeValue(kind DateTimeType) (*DateTi
 	return NewDateTimeValue(kind, year, monthDay, time, fractionalSecs, presenceTimezone, timezone), nil
 }
 
+/**
+ * Decode a Duration as sign followed by the years, months, days, hours and
+ * minutes as Unsigned Integers and the seconds as integral and reversed
+ * fractional portion.
+ */
+func (c *AbstractDecoderChannel) DecodeDurationValue() (*DurationValue, error) {
+	negative, err := c.DecodeBoolean()
+	if err != nil {
+		return nil, err
+	}
+
+	var components [5]*IntegerValue // years, months, days, hours, minutes
+	for i := range components {
+		components[i], err = c.DecodeUnsignedIntegerValue()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	integral, err := c.decodeUnsignedIntegerValue(false)
+	if err != nil {
+		return nil, err
+	}
+	revFractional, err := c.decodeUnsignedIntegerValue(false)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewDurationValue(negative, components[0], components[1], components[2], components[3], components[4],
+		NewDecimalValue(false, integral, revFractional)), nil
+}
+
 /*
 	AbstractEncoderChannel implementation
 */
@@ -818,7 +967,9 @@ func (c *AbstractEncoderChannel) EncodeFloat(fv *FloatValue) error {
 func (c *AbstractEncoderChannel) EncodeDateTime(datetime *DateTimeValue) error {
 	switch datetime.kind {
 	case DateTimeGYear: // Year, [Time-Zone]
-		return c.EncodeInteger(datetime.year - DateTimeValue_YearOffset)
+		if err := c.EncodeInteger(datetime.year - DateTimeValue_YearOffset); err != nil {
+			return err
+		}
 	case DateTimeGYearMonth, DateTimeDate: // Year, MonthDay, [TimeZone]
 		if err := c.EncodeInteger(datetime.year - DateTimeValue_YearOffset); err != nil {
 			return err
@@ -846,7 +997,7 @@ func (c *AbstractEncoderChannel) EncodeDateTime(datetime *DateTimeValue) error {
 				return err
 			}
 		} else {
-			if err := c.EncodeBoolean(true); err != nil {
+			if err := c.EncodeBoolean(false); err != nil {
 				return err
 			}
 		}
@@ -869,6 +1020,26 @@ func (c *AbstractEncoderChannel) EncodeDateTime(datetime *DateTimeValue) error {
 	}
 }
 
+/**
+ * Encode a Duration as sign followed by the years, months, days, hours and
+ * minutes as Unsigned Integers and the seconds as integral and reversed
+ * fractional portion.
+ */
+func (c *AbstractEncoderChannel) EncodeDuration(duration *DurationValue) error {
+	if err := c.EncodeBoolean(duration.negative); err != nil {
+		return err
+	}
+	for _, n := range []*IntegerValue{duration.years, duration.months, duration.days, duration.hours, duration.minutes} {
+		if err := c.EncodeUnsignedIntegerValue(n); err != nil {
+			return err
+		}
+	}
+	if err := c.EncodeUnsignedIntegerValue(duration.seconds.integral); err != nil {
+		return err
+	}
+	return c.EncodeUnsignedIntegerValue(duration.seconds.revFractional)
+}
+
 /*
 	BitDecoderChannel implementation
 */
@@ -896,14 +1067,42 @@ func (c *BitDecoderChannel) Align() error {
 	return c.reader.Align()
 }
 
+func (c *BitDecoderChannel) IsByteAligned() bool {
+	return c.reader.IsByteAligned()
+}
+
+func (c *BitDecoderChannel) PendingBits() int {
+	return c.reader.PendingBits()
+}
+
 func (c *BitDecoderChannel) LookAhead() (int, error) {
 	return c.reader.LookAhead()
 }
 
+func (c *BitDecoderChannel) Peek(n int) ([]byte, error) {
+	return c.reader.Peek(n)
+}
+
 func (c *BitDecoderChannel) Skip(n int64) error {
 	return c.reader.Skip(n)
 }
 
+func (c *BitDecoderChannel) GetLength() int {
+	return (c.reader.GetBitLength() + BufferCapacity - 1) / BufferCapacity
+}
+
+// Note: bit-packed values rarely start or end at byte boundaries. The
+// recording starts with the partially consumed current byte, if any, and ends
+// with the byte holding the last bit read, i.e. the first and last byte may
+// hold bits of neighboring events.
+func (c *BitDecoderChannel) StartRawRecording() {
+	c.reader.startRawRecording()
+}
+
+func (c *BitDecoderChannel) StopRawRecording() []byte {
+	return c.reader.raw.stop()
+}
+
 /**
  * Decodes and returns an n-bit unsigned integer.
  */
@@ -936,16 +1135,41 @@ func (c *BitDecoderChannel) DecodeBoolean() (bool, error) {
 func (c *BitDecoderChannel) DecodeBinary() ([]byte, error) {
 	length, err := c.DecodeUnsignedInteger()
 	if err != nil {
-		return []byte{}, nil
+		return []byte{}, err
 	}
-	result := make([]byte, length)
+	result := make([]byte, 0, min(length, maxPreallocatedLength))
+	buffer := make([]byte, min(length, maxPreallocatedLength))
 
-	if err := c.reader.ReadToBuffer(result, 0, length); err != nil {
-		return []byte{}, err
+	for len(result) < length {
+		n := min(length-len(result), len(buffer))
+		if err := c.reader.ReadToBuffer(buffer, 0, n); err != nil {
+			return []byte{}, err
+		}
+		result = append(result, buffer[:n]...)
 	}
 	return result, nil
 }
 
+func (c *BitDecoderChannel) DecodeBinaryTo(w io.Writer) (int, error) {
+	length, err := c.DecodeUnsignedInteger()
+	if err != nil {
+		return 0, err
+	}
+	buffer := make([]byte, min(length, maxPreallocatedLength))
+
+	for copied := 0; copied < length; {
+		n := min(length-copied, len(buffer))
+		if err := c.reader.ReadToBuffer(buffer, 0, n); err != nil {
+			return copied, err
+		}
+		if _, err := w.Write(buffer[:n]); err != nil {
+			return copied, err
+		}
+		copied += n
+	}
+	return length, nil
+}
+
 /*
 	BitEncoderChannel implementation
 */
@@ -984,6 +1208,14 @@ func (c *BitEncoderChannel) Align() error {
 	return c.writer.Align()
 }
 
+func (c *BitEncoderChannel) IsByteAligned() bool {
+	return c.writer.IsByteAligned()
+}
+
+func (c *BitEncoderChannel) PendingBits() int {
+	return c.writer.GetBitsInByffer()
+}
+
 func (c *BitEncoderChannel) Encode(b int) error {
 	return c.writer.WriteBits(b, 8)
 }
@@ -1028,6 +1260,9 @@ func (c *BitEncoderChannel) EncodeBoolean(b bool) error {
 type ByteDecoderChannel struct {
 	*AbstractDecoderChannel
 	reader *bufio.Reader
+	raw    rawRecorder
+	// number of bytes read
+	length int
 }
 
 func NewByteDecoderChannel(reader *bufio.Reader) *ByteDecoderChannel {
@@ -1035,7 +1270,9 @@ func NewByteDecoderChannel(reader *bufio.Reader) *ByteDecoderChannel {
 	bdc := &ByteDecoderChannel{
 		AbstractDecoderChannel: adc,
 		reader:                 reader,
+		raw:                    rawRecorder{},
 	}
+	adc.DecoderChannel = bdc
 	return bdc
 }
 
@@ -1043,6 +1280,22 @@ func (c *ByteDecoderChannel) GetReader() *bufio.Reader {
 	return c.reader
 }
 
+// recoveryReader returns the reader underlying channel at a byte-aligned
+// position, for skipping over corrupt input.
+func recoveryReader(channel DecoderChannel) (*bufio.Reader, error) {
+	switch c := channel.(type) {
+	case *ByteDecoderChannel:
+		return c.reader, nil
+	case *BitDecoderChannel:
+		if err := c.Align(); err != nil {
+			return nil, err
+		}
+		return c.reader.reader, nil
+	default:
+		return nil, errors.New("decoder channel does not support recovery")
+	}
+}
+
 func (c *ByteDecoderChannel) Decode() (int, error) {
 	b, err := c.reader.ReadByte()
 	if err == io.EOF {
@@ -1051,6 +1304,8 @@ func (c *ByteDecoderChannel) Decode() (int, error) {
 	if err != nil {
 		return -1, err
 	}
+	c.raw.record(b)
+	c.length++
 	return int(b), nil
 }
 
@@ -1058,9 +1313,30 @@ func (c *ByteDecoderChannel) Align() error {
 	return nil
 }
 
+func (c *ByteDecoderChannel) IsByteAligned() bool {
+	return true
+}
+
+func (c *ByteDecoderChannel) PendingBits() int {
+	return 0
+}
+
+func (c *ByteDecoderChannel) StartRawRecording() {
+	c.raw.start()
+}
+
+func (c *ByteDecoderChannel) StopRawRecording() []byte {
+	return c.raw.stop()
+}
+
+func (c *ByteDecoderChannel) Peek(n int) ([]byte, error) {
+	return c.reader.Peek(n)
+}
+
 func (c *ByteDecoderChannel) Skip(n int64) error {
 	for n != 0 {
 		skipped, err := c.reader.Discard(int(n))
+		c.length += skipped
 		if err != nil {
 			return err
 		}
@@ -1069,6 +1345,10 @@ func (c *ByteDecoderChannel) Skip(n int64) error {
 	return nil
 }
 
+func (c *ByteDecoderChannel) GetLength() int {
+	return c.length
+}
+
 /**
  * Decodes and returns an n-bit unsigned integer using the minimum number of
  * bytes required for n bits.
@@ -1114,23 +1394,51 @@ func (c *ByteDecoderChannel) DecodeBinary() ([]byte, error) {
 		return []byte{}, err
 	}
 
-	result := make([]byte, length)
+	result := make([]byte, 0, min(length, maxPreallocatedLength))
+	buffer := make([]byte, min(length, maxPreallocatedLength))
 
-	readBytes := 0
-	for readBytes < length {
-		read, err := c.reader.Read(result[readBytes : readBytes+(length-readBytes)])
+	for len(result) < length {
+		read, err := c.reader.Read(buffer[:min(length-len(result), len(buffer))])
 		if err == io.EOF {
 			return []byte{}, errors.New("premature EOS found while reading data")
 		}
 		if err != nil {
 			return []byte{}, err
 		}
-		readBytes += read
+		c.raw.record(buffer[:read]...)
+		c.length += read
+		result = append(result, buffer[:read]...)
 	}
 
 	return result, nil
 }
 
+func (c *ByteDecoderChannel) DecodeBinaryTo(w io.Writer) (int, error) {
+	length, err := c.DecodeUnsignedInteger()
+	if err != nil {
+		return 0, err
+	}
+	buffer := make([]byte, min(length, maxPreallocatedLength))
+
+	for copied := 0; copied < length; {
+		read, err := c.reader.Read(buffer[:min(length-copied, len(buffer))])
+		if err == io.EOF {
+			return copied, errors.New("premature EOS found while reading data")
+		}
+		if err != nil {
+			return copied, err
+		}
+		c.raw.record(buffer[:read]...)
+		c.length += read
+		if _, err := w.Write(buffer[:read]); err != nil {
+			return copied, err
+		}
+		copied += read
+	}
+
+	return length, nil
+}
+
 /*
 	ByteEncoderChannel implementation
 */
@@ -1148,6 +1456,7 @@ func NewByteEncoderChannel(writer *bufio.Writer) *ByteEncoderChannel {
 		writer:                 writer,
 		len:                    0,
 	}
+	aec.EncoderChannel = bec
 	return bec
 }
 
@@ -1167,6 +1476,14 @@ func (c *ByteEncoderChannel) Align() error {
 	return nil
 }
 
+func (c *ByteEncoderChannel) IsByteAligned() bool {
+	return true
+}
+
+func (c *ByteEncoderChannel) PendingBits() int {
+	return 0
+}
+
 func (c *ByteEncoderChannel) Encode(b int) error {
 	if err := c.writer.WriteByte(byte(b & 0xFF)); err != nil {
 		return err
@@ -1230,3 +1547,87 @@ func (c *ByteEncoderChannel) EncodeNBitUnsignedInteger(b, n int) error {
 
 	return nil
 }
+
+/*
+	DeflateDecoderChannel implementation
+*/
+
+// DeflateDecoderChannel is a byte-aligned channel that reads from a sequence
+// of DEFLATE streams, as produced by the compression coding mode.
+type DeflateDecoderChannel struct {
+	*ByteDecoderChannel
+	input    *bufio.Reader
+	inflater io.ReadCloser
+}
+
+func NewDeflateDecoderChannel(reader *bufio.Reader) *DeflateDecoderChannel {
+	// Note: bufio.Reader is an io.ByteReader, hence the inflater does not
+	// read beyond the end of a DEFLATE stream
+	inflater := flate.NewReader(reader)
+	bdc := NewByteDecoderChannel(bufio.NewReader(inflater))
+	return &DeflateDecoderChannel{
+		ByteDecoderChannel: bdc,
+		input:              reader,
+		inflater:           inflater,
+	}
+}
+
+// FinishStream skips what is left of the current DEFLATE stream and prepares
+// the channel for reading the next one.
+func (c *DeflateDecoderChannel) FinishStream() error {
+	if _, err := io.Copy(io.Discard, c.reader); err != nil {
+		return err
+	}
+	if err := c.inflater.(flate.Resetter).Reset(c.input, nil); err != nil {
+		return err
+	}
+	c.reader.Reset(c.inflater)
+	return nil
+}
+
+/*
+	DeflateEncoderChannel implementation
+*/
+
+// DeflateEncoderChannel is a byte-aligned channel that compresses its output
+// using DEFLATE. FinishStream terminates the current DEFLATE stream, data
+// written afterwards starts a new one.
+type DeflateEncoderChannel struct {
+	*ByteEncoderChannel
+	output   *bufio.Writer
+	deflater *flate.Writer
+}
+
+func NewDeflateEncoderChannel(writer *bufio.Writer) (*DeflateEncoderChannel, error) {
+	deflater, err := flate.NewWriter(writer, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	bec := NewByteEncoderChannel(bufio.NewWriter(deflater))
+	return &DeflateEncoderChannel{
+		ByteEncoderChannel: bec,
+		output:             writer,
+		deflater:           deflater,
+	}, nil
+}
+
+// Flush writes pending data to the compressor and flushes the underlying
+// writer. It does not terminate the current DEFLATE stream.
+func (c *DeflateEncoderChannel) Flush() error {
+	if err := c.writer.Flush(); err != nil {
+		return err
+	}
+	return c.output.Flush()
+}
+
+// FinishStream terminates the current DEFLATE stream.
+func (c *DeflateEncoderChannel) FinishStream() error {
+	if err := c.writer.Flush(); err != nil {
+		return err
+	}
+	if err := c.deflater.Close(); err != nil {
+		return err
+	}
+	c.deflater.Reset(c.output)
+	return nil
+}
@@ -0,0 +1,233 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+// unsignedInteger returns the EXI Unsigned Integer octets of the n octets
+// long value with all value bits set.
+func unsignedInteger(n int) []byte {
+	octets := bytes.Repeat([]byte{0xff}, n-1)
+	return append(octets, 0x7f)
+}
+
+func TestMaxIntegerDigits(t *testing.T) {
+	// 3000 octets of 7 bits each, about 6300 decimal digits
+	crafted := unsignedInteger(3000)
+
+	reader := bytes.NewReader(crafted)
+	channel := NewBitDecoderChannel(bufio.NewReaderSize(reader, 16))
+	channel.SetMaxIntegerDigits(100)
+	if _, err := channel.DecodeUnsignedIntegerValue(); err == nil {
+		t.Fatal("want error")
+	}
+	// decoding stops at the limit instead of reading the whole integer
+	if read := len(crafted) - reader.Len(); read > 100 {
+		t.Errorf("%d octets read", read)
+	}
+
+	channel = NewBitDecoderChannel(bufio.NewReader(bytes.NewReader(crafted)))
+	iv, err := channel.DecodeUnsignedIntegerValue()
+	if err != nil {
+		t.Fatalf("unbounded: %v", err)
+	}
+	if s := iv.String(); len(s) < 6000 {
+		t.Errorf("unbounded: %d digits", len(s))
+	}
+
+	// 2^70-1 has 22 digits
+	for _, test := range []struct {
+		maxDigits int
+		ok        bool
+	}{
+		{22, true},
+		{21, false},
+	} {
+		channel := NewBitDecoderChannel(bufio.NewReader(bytes.NewReader(unsignedInteger(10))))
+		channel.SetMaxIntegerDigits(test.maxDigits)
+		iv, err := channel.DecodeUnsignedIntegerValue()
+		if test.ok && err != nil {
+			t.Errorf("%d digits: %v", test.maxDigits, err)
+		}
+		if !test.ok && (err == nil || !strings.Contains(err.Error(), "digits")) {
+			t.Errorf("%d digits: got %v, want error", test.maxDigits, iv)
+		}
+	}
+}
+
+func TestBitChannelAlignment(t *testing.T) {
+	var buf bytes.Buffer
+	writer := bufio.NewWriter(&buf)
+	encoder := NewBitEncoderChannel(writer)
+	checkEncoder := func(step string, pending int) {
+		t.Helper()
+		if got := encoder.PendingBits(); got != pending {
+			t.Errorf("encoder %s: PendingBits() = %d, want %d", step, got, pending)
+		}
+		if got := encoder.IsByteAligned(); got != (pending == 0) {
+			t.Errorf("encoder %s: IsByteAligned() = %v", step, got)
+		}
+	}
+
+	checkEncoder("start", 0)
+	if err := encoder.EncodeNBitUnsignedInteger(5, 3); err != nil {
+		t.Fatal(err)
+	}
+	checkEncoder("3 bits", 3)
+	if err := encoder.EncodeNBitUnsignedInteger(1, 5); err != nil {
+		t.Fatal(err)
+	}
+	checkEncoder("8 bits", 0)
+	if err := encoder.EncodeNBitUnsignedInteger(0x1ff, 9); err != nil {
+		t.Fatal(err)
+	}
+	checkEncoder("17 bits", 1)
+	if err := encoder.Align(); err != nil {
+		t.Fatal(err)
+	}
+	checkEncoder("aligned", 0)
+	if err := encoder.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	decoder := NewBitDecoderChannel(bufio.NewReader(&buf))
+	checkDecoder := func(step string, pending int) {
+		t.Helper()
+		if got := decoder.PendingBits(); got != pending {
+			t.Errorf("decoder %s: PendingBits() = %d, want %d", step, got, pending)
+		}
+		if got := decoder.IsByteAligned(); got != (pending == 0) {
+			t.Errorf("decoder %s: IsByteAligned() = %v", step, got)
+		}
+	}
+
+	checkDecoder("start", 0)
+	if n, err := decoder.DecodeNBitUnsignedInteger(3); err != nil || n != 5 {
+		t.Fatalf("got %d, %v", n, err)
+	}
+	checkDecoder("3 bits", 5)
+	if n, err := decoder.DecodeNBitUnsignedInteger(5); err != nil || n != 1 {
+		t.Fatalf("got %d, %v", n, err)
+	}
+	checkDecoder("8 bits", 0)
+	if n, err := decoder.DecodeNBitUnsignedInteger(9); err != nil || n != 0x1ff {
+		t.Fatalf("got %d, %v", n, err)
+	}
+	checkDecoder("17 bits", 7)
+	if err := decoder.Align(); err != nil {
+		t.Fatal(err)
+	}
+	checkDecoder("aligned", 0)
+}
+
+func TestByteChannelAlignment(t *testing.T) {
+	var buf bytes.Buffer
+	writer := bufio.NewWriter(&buf)
+	encoder := NewByteEncoderChannel(writer)
+	if err := encoder.EncodeNBitUnsignedInteger(5, 3); err != nil {
+		t.Fatal(err)
+	}
+	if !encoder.IsByteAligned() || encoder.PendingBits() != 0 {
+		t.Errorf("encoder: IsByteAligned() = %v, PendingBits() = %d", encoder.IsByteAligned(), encoder.PendingBits())
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	decoder := NewByteDecoderChannel(bufio.NewReader(&buf))
+	if _, err := decoder.DecodeNBitUnsignedInteger(3); err != nil {
+		t.Fatal(err)
+	}
+	if !decoder.IsByteAligned() || decoder.PendingBits() != 0 {
+		t.Errorf("decoder: IsByteAligned() = %v, PendingBits() = %d", decoder.IsByteAligned(), decoder.PendingBits())
+	}
+}
+
+func TestBitDecoderChannelPeek(t *testing.T) {
+	data := []byte{0xa5, 0x01, 0x02, 0x03}
+	channel := NewBitDecoderChannel(bufio.NewReader(bytes.NewReader(data)))
+
+	if b, err := channel.Peek(2); err != nil || !bytes.Equal(b, data[:2]) {
+		t.Errorf("Peek(2) = % x, %v", b, err)
+	}
+	// a byte looked ahead at is part of the peeked bytes
+	if b, err := channel.LookAhead(); err != nil || b != 0xa5 {
+		t.Fatalf("LookAhead() = %x, %v", b, err)
+	}
+	if b, err := channel.Peek(3); err != nil || !bytes.Equal(b, data[:3]) {
+		t.Errorf("after LookAhead: Peek(3) = % x, %v", b, err)
+	}
+
+	if n, err := channel.DecodeNBitUnsignedInteger(3); err != nil || n != 5 {
+		t.Fatalf("got %d, %v", n, err)
+	}
+	if _, err := channel.Peek(1); err == nil {
+		t.Error("Peek with pending bits: want error")
+	}
+	if err := channel.Align(); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := channel.Peek(8); err == nil || !bytes.Equal(b, data[1:]) {
+		t.Errorf("Peek(8) = % x, %v, want the available bytes and an error", b, err)
+	}
+	if b, err := channel.Decode(); err != nil || b != 0x01 {
+		t.Errorf("Decode() = %x, %v", b, err)
+	}
+}
+
+func TestDecoderChannelLength(t *testing.T) {
+	data := []byte{0xa5, 0x03, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06}
+
+	bit := NewBitDecoderChannel(bufio.NewReader(bytes.NewReader(data)))
+	// a byte looked ahead at is not read yet, a partially read byte is
+	if _, err := bit.LookAhead(); err != nil {
+		t.Fatal(err)
+	}
+	if n := bit.GetLength(); n != 0 {
+		t.Errorf("bit channel after LookAhead: length %d, want 0", n)
+	}
+	if _, err := bit.DecodeNBitUnsignedInteger(3); err != nil {
+		t.Fatal(err)
+	}
+	if n := bit.GetLength(); n != 1 {
+		t.Errorf("bit channel after 3 bits: length %d, want 1", n)
+	}
+	if err := bit.Align(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bit.DecodeBinary(); err != nil {
+		t.Fatal(err)
+	}
+	if err := bit.Skip(2); err != nil {
+		t.Fatal(err)
+	}
+	if n := bit.GetLength(); n != 7 {
+		t.Errorf("bit channel: length %d, want 7", n)
+	}
+
+	// a byte, two binary values of 2 and 1 bytes and a byte to skip
+	data = []byte{0xa5, 0x02, 0x01, 0x02, 0x01, 0x03, 0x04}
+	byteChannel := NewByteDecoderChannel(bufio.NewReader(bytes.NewReader(data)))
+	if _, err := byteChannel.Decode(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := byteChannel.DecodeBinary(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := byteChannel.DecodeBinaryTo(io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if n := byteChannel.GetLength(); n != 6 {
+		t.Errorf("byte channel: length %d, want 6", n)
+	}
+	if err := byteChannel.Skip(1); err != nil {
+		t.Fatal(err)
+	}
+	if n := byteChannel.GetLength(); n != 7 {
+		t.Errorf("byte channel after Skip(1): length %d, want 7", n)
+	}
+}
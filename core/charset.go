@@ -39,7 +39,7 @@ func newAbstractRestrictedCharacterSet() *AbstractRestrictedCharacterSet {
 }
 
 func (cs *AbstractRestrictedCharacterSet) GetCodePoint(code int) (int, error) {
-	if code < len(cs.codePointList)-1 {
+	if code >= 0 && code < len(cs.codePointList) {
 		return cs.codePointList[code], nil
 	}
 	return -1, utils.ErrorIndexOutOfBounds
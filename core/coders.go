@@ -2,11 +2,17 @@ package core
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"slices"
+	"strconv"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 
 	"github.com/sderkacs/go-exi/utils"
 )
@@ -32,6 +38,10 @@ type EXIBodyDecoder interface {
 	// Sets input channel and resets all internal states
 	SetInputChannel(channel DecoderChannel) error
 
+	// Sets the input reader and resets all internal states. Readers other
+	// than *bufio.Reader are wrapped into one.
+	SetInput(reader io.Reader) error
+
 	// Sets the input stream and does not reset internal states
 	UpdateInputStream(reader *bufio.Reader) error
 
@@ -42,6 +52,10 @@ type EXIBodyDecoder interface {
 	// EXI event is available.
 	Next() (EventType, bool, error)
 
+	// Like Next() but fails with the context error once ctx is done. The
+	// decoder is not usable after such an error.
+	NextWithContext(ctx context.Context) (EventType, bool, error)
+
 	// Indicates the beginning of a set of XML events
 	DecodeStartDocument() error
 
@@ -61,6 +75,10 @@ type EXIBodyDecoder interface {
 	// UnprefixedName ::= LocalPart
 	GetElementQNameAsString() string
 
+	// Returns qualified name context of current element, including namespace
+	// URI and local-name IDs.
+	GetElementQNameContext() *QNameContext
+
 	// Reads EXI a self-contained start element.
 	DecodeStartSelfContainedFragment() error
 
@@ -86,6 +104,10 @@ type EXIBodyDecoder interface {
 	// UnprefixedName ::= LocalPart
 	GetAttributeQNameAsString() string
 
+	// Returns qualified name context of (last) attribute, including namespace
+	// URI and local-name IDs.
+	GetAttributeQNameContext() *QNameContext
+
 	// Provides attribute value
 	GetAttributeValue() Value
 
@@ -98,6 +120,12 @@ type EXIBodyDecoder interface {
 	// Decodes characters and reports them.
 	DecodeCharacters() (Value, error)
 
+	// Decodes characters like DecodeCharacters but copies the octets of
+	// base64Binary and hexBinary values to w in chunks instead of holding
+	// them in memory, 'nil' is returned for these. Other values are returned
+	// as by DecodeCharacters and not written.
+	DecodeCharactersTo(w io.Writer) (Value, error)
+
 	// Parses DOCTYPE with information items (name, publicID, systemID, text).
 	DecodeDocType() (*DocTypeContainer, error)
 
@@ -107,20 +135,117 @@ type EXIBodyDecoder interface {
 	// Parses comment with associated characters and provides comment text.
 	DecodeComment() ([]rune, error)
 
+	// Parses comment with associated characters and provides comment text as
+	// container, analogous to DecodeProcessingInstruction.
+	DecodeCommentContainer() (CommentContainer, error)
+
 	// Parses processing instruction with associated target and data.
 	DecodeProcessingInstruction() (ProcessingInstructionContainer, error)
+
+	// Reports whether the decoded stream respected the EXI profile parameters
+	// limiting grammar learning. Returns 'nil' until end document has been
+	// decoded.
+	GetConformanceReport() *ConformanceReport
+
+	// Returns how the value string table filled up while decoding the
+	// current, or the last, document.
+	GetStringTableStats() StringTableStats
+
+	// Returns the coding mode (alignment) the EXI body is decoded with, i.e.,
+	// the one of the EXI header options if present.
+	GetCodingMode() CodingMode
+
+	// Returns the block size the EXI body is decoded with. The block size
+	// only applies to (pre-)compression.
+	GetBlockSize() int
+
+	// Sets the observer called whenever grammar learning occurs, 'nil'
+	// removes it. Helps finding the elements causing grammar evolution.
+	SetGrammarLearningObserver(observer GrammarLearningObserver)
+
+	// Sets the observer called with the raw bytes of each typed value after
+	// it has been read, 'nil' removes it. Channels that cannot record their
+	// input report no bytes.
+	SetRawValueObserver(observer RawValueObserver)
+
+	// Sets the handler receiving warnings, e.g., about values of unsupported
+	// datatype representations that are decoded as strings instead.
+	SetErrorHandler(handler ErrorHandler)
+
+	// Reads the next EXI event including its content, built on Next() and the
+	// according Decode* method. Returns 'false' if no more EXI event is
+	// available.
+	DecodeEvent() (*DecodedEvent, bool, error)
+
+	// Attempts to resynchronize after a decode error so that decoding can
+	// go on with the next element, e.g. the next record of a log file. The
+	// decoder returns to the content of the document element (the top level
+	// of fragments) and skips input bytes up to the next position that
+	// looks like the start of an already known element. Until that element
+	// and the event following it are decoded, events that would need grammar
+	// learning are errors, and recovering again scans once more behind the
+	// position found before.
+	//
+	// Recovery is a best-effort heuristic: string table entries of the
+	// corrupt part are lost or bogus, so later values may decode wrongly,
+	// which mostly hurts schema-less streams. Only byte-aligned positions are
+	// tried, which makes recovery unreliable in bit-packed mode.
+	// (Pre-)compression is not supported.
+	RecoverToNextElement() error
 }
 
 type EXIBodyEncoder interface {
 	SetOutputStream(writer *bufio.Writer) error
 
+	// Sets the output writer. Writers other than *bufio.Writer are wrapped
+	// into one, Flush() pushes buffered bytes through to the writer.
+	SetOutput(writer io.Writer) error
+
 	SetOutputChannel(channel EncoderChannel) error
 
 	WriteValue(qnc *QNameContext) error
 
 	// Flushes (possibly) remaining bit(s) to output stream
+	//
+	// In (pre-)compression mode EncodeEndDocument writes the value channels
+	// of the last block and finishes all DEFLATE streams, Flush only pushes
+	// them to the output. Flushing before the end of the document does not
+	// close the current block, i.e. the output is not decodable yet.
 	Flush() error
 
+	// Clears all per-document state so that the encoder can be reused for
+	// another document of the same factory. The output is dropped as well
+	// and has to be set again before encoding.
+	//
+	// Encoders are not safe for concurrent use.
+	Reset() error
+
+	// Stops the evolution of the built-in grammars learned so far, e.g. after
+	// a first record established the grammars of all further records. See
+	// AbstractEXIBodyEncoder.FreezeGrammars.
+	FreezeGrammars()
+
+	// Enables or disables recording the encoded size of typed values per
+	// qname, e.g. to find the values dominating the size of a stream. Stats
+	// are cleared at the beginning of each document.
+	SetCollectingStats(collect bool)
+
+	// Returns the value stats per qname of the current document, 'nil' if
+	// collecting stats is disabled. Values of attributes are recorded for the
+	// attribute qname, values of characters for the element qname.
+	Stats() map[utils.QName]*ValueStats
+
+	// Returns how the value string table filled up while encoding the
+	// current, or the last, document.
+	GetStringTableStats() StringTableStats
+
+	// Sets the handler called when the grammar learning budget of the EXI
+	// profile (maxBuiltInElementGrammars, maxBuiltInProductions) is
+	// exhausted, i.e. when the encoder first inserts xsi:type or ghost
+	// productions to stop grammar learning. It is called at most once per
+	// document, 'nil' removes it.
+	SetGrammarBudgetExhaustedHandler(handler func())
+
 	SetErrorHandler(handler ErrorHandler)
 
 	// Reports the beginning of a set of XML events
@@ -163,6 +288,12 @@ type EXIBodyEncoder interface {
 	// Supplies characters as Value.
 	EncodeCharacters(chars Value) error
 
+	// Turns whitespace preservation on or off for the current element and
+	// its descendants, as an xml:space attribute of "preserve" or "default"
+	// would, without encoding such an attribute. Call it after the start
+	// tag and before the content of the element.
+	SetPreserveWhitespace(preserve bool)
+
 	// Supplies content items to represent a DOCTYPE definition
 	EncodeDocType(name, publicID, systemID, text string) error
 
@@ -179,10 +310,14 @@ type EXIBodyEncoder interface {
 type EXIStreamDecoder interface {
 	GetBodyOnlyDecoder(reader *bufio.Reader) (EXIBodyDecoder, error)
 	DecodeHeader(reader *bufio.Reader) (EXIBodyDecoder, error)
+	// HeaderBitLength returns the number of bits of the header decoded last.
+	HeaderBitLength() int
 }
 
 type EXIStreamEncoder interface {
 	EncodeHeader(writer *bufio.Writer) (EXIBodyEncoder, error)
+	// HeaderBitLength returns the number of bits of the header encoded last.
+	HeaderBitLength() int
 }
 
 /*
@@ -211,7 +346,8 @@ func NewElementContext(qnc *QNameContext, gr Grammar) *ElementContext {
 
 func (c *ElementContext) GetQNameAsString(preservePrefix bool) string {
 	if c.sqname == "" {
-		if preservePrefix {
+		if preservePrefix || c.prefix != nil {
+			// Note: default prefixes may have been replaced by preferred ones
 			c.sqname = utils.GetQualifiedName(c.qnc.GetLocalName(), c.prefix)
 		} else {
 			c.sqname = c.qnc.GetDefaultQNameAsString()
@@ -247,6 +383,10 @@ type RuntimeUriContext struct {
 
 	qnames   []*QNameContext
 	prefixes []string
+
+	// limits of runtime entries, negative for unbounded
+	maxQNames   int
+	maxPrefixes int
 }
 
 func NewRuntimeUriContext(namespaceUriID int, namespaceURI string) *RuntimeUriContext {
@@ -260,6 +400,8 @@ func NewRuntimeUriContextWithContext(guc *GrammarUriContext, namespaceUriID int,
 		guc:            guc,
 		qnames:         []*QNameContext{},
 		prefixes:       []string{},
+		maxQNames:      DefaultMaxStringTableEntries,
+		maxPrefixes:    DefaultMaxStringTableEntries,
 	}
 }
 
@@ -302,7 +444,7 @@ func (c *RuntimeUriContext) GetQNameContextByLocalName(localName string) *QNameC
 	return qnc
 }
 
-func (c *RuntimeUriContext) GetQNameContextByLocalNameID(localNameID int) *QNameContext {
+func (c *RuntimeUriContext) GetQNameContextByLocalNameID(localNameID int) (*QNameContext, error) {
 	var qnc *QNameContext = nil
 	sub := 0
 	if c.guc != nil {
@@ -311,16 +453,14 @@ func (c *RuntimeUriContext) GetQNameContextByLocalNameID(localNameID int) *QName
 	}
 	if qnc == nil {
 		// check runtime qnames
-		if len(c.qnames) != 0 {
-			localNameID -= sub
-			if localNameID < 0 || localNameID >= len(c.qnames) {
-				panic("index out of bounds")
-			}
-			qnc = c.qnames[localNameID]
+		localNameID -= sub
+		if localNameID < 0 || localNameID >= len(c.qnames) {
+			return nil, fmt.Errorf("local-name id %d out of bounds for uri '%s'", localNameID+sub, c.namespaceURI)
 		}
+		qnc = c.qnames[localNameID]
 	}
 
-	return qnc
+	return qnc, nil
 }
 
 func (c *RuntimeUriContext) GetNumberOfQNames() int {
@@ -332,13 +472,27 @@ func (c *RuntimeUriContext) GetNumberOfQNames() int {
 	return n
 }
 
-func (c *RuntimeUriContext) AddQNameContext(localName string) *QNameContext {
+// SetLimits limits the number of local names and prefixes that may be added
+// at runtime, see EXIFactory.SetMaxLocalNamesPerURI.
+func (c *RuntimeUriContext) SetLimits(maxQNames, maxPrefixes int) {
+	c.maxQNames = maxQNames
+	c.maxPrefixes = maxPrefixes
+}
+
+func (c *RuntimeUriContext) AddQNameContext(localName string) (*QNameContext, error) {
+	return c.addQNameContext(nil, localName)
+}
+
+func (c *RuntimeUriContext) addQNameContext(arena *objectArena, localName string) (*QNameContext, error) {
+	if c.maxQNames >= 0 && len(c.qnames) >= c.maxQNames {
+		return nil, fmt.Errorf("maximum number of local names %d exceeded for uri '%s'", c.maxQNames, c.namespaceURI)
+	}
 	localNameID := c.GetNumberOfQNames()
 	qName := utils.QName{Space: c.namespaceURI, Local: localName}
-	qnc := NewQNameContext(c.namespaceUriID, localNameID, qName)
+	qnc := arena.newQNameContext(c.namespaceUriID, localNameID, qName)
 	c.qnames = append(c.qnames, qnc)
 
-	return qnc
+	return qnc, nil
 }
 
 func (c *RuntimeUriContext) GetNumberOfPrefixes() int {
@@ -352,8 +506,12 @@ func (c *RuntimeUriContext) GetNumberOfPrefixes() int {
 	return pfs
 }
 
-func (c *RuntimeUriContext) addPrefix(prefix string) {
+func (c *RuntimeUriContext) addPrefix(prefix string) error {
+	if c.maxPrefixes >= 0 && len(c.prefixes) >= c.maxPrefixes {
+		return fmt.Errorf("maximum number of prefixes %d exceeded for uri '%s'", c.maxPrefixes, c.namespaceURI)
+	}
 	c.prefixes = append(c.prefixes, prefix)
+	return nil
 }
 
 func (c *RuntimeUriContext) getPrefixID(prefix string) int {
@@ -375,7 +533,7 @@ func (c *RuntimeUriContext) getPrefixID(prefix string) int {
 	return id
 }
 
-func (c *RuntimeUriContext) GetPrefix(prefixID int) *string {
+func (c *RuntimeUriContext) GetPrefix(prefixID int) (*string, error) {
 	//TODO: checks for preservePrefix
 	var prefix *string = nil
 	sub := 0
@@ -387,12 +545,12 @@ func (c *RuntimeUriContext) GetPrefix(prefixID int) *string {
 	if prefix == nil {
 		prefixID -= sub
 		if prefixID < 0 || prefixID >= len(c.prefixes) {
-			panic("index out of bounds")
+			return nil, fmt.Errorf("prefix id %d out of bounds for uri '%s'", prefixID+sub, c.namespaceURI)
 		}
 		prefix = &c.prefixes[prefixID]
 	}
 
-	return prefix
+	return prefix, nil
 }
 
 func (c *RuntimeUriContext) SetNamespaceUri(namespaceURI string) {
@@ -407,6 +565,20 @@ func (c *RuntimeUriContext) GetNamespaceUriID() int {
 	return c.namespaceUriID
 }
 
+// Clone returns a copy of c whose runtime local names and prefixes are
+// independent of c. The grammar uri context is shared, it does not change.
+func (c *RuntimeUriContext) Clone() *RuntimeUriContext {
+	clone := *c
+	clone.qnames = make([]*QNameContext, len(c.qnames))
+	for i, qnc := range c.qnames {
+		// Note: QNameContexts may be recycled by the object arena
+		q := *qnc
+		clone.qnames[i] = &q
+	}
+	clone.prefixes = slices.Clone(c.prefixes)
+	return &clone
+}
+
 /*
 	AbstractEXIBodyCoder implementation
 */
@@ -428,6 +600,7 @@ type AbstractEXIBodyCoder struct {
 	elementContext            *ElementContext   // element-context and rule (stack) while traversing the EXI document
 	elementContextStack       []*ElementContext // cached context to avoid heavy array lookup
 	elementContextStackIndex  int
+	depthOffset               int                                  // elements enclosing a self-contained fragment
 	runtimeGlobalElements     map[QNameContextMapKey]*StartElement // runtime global elements
 	runtimeURIs               []*RuntimeUriContext
 	xsiTypeContext            *QNameContext
@@ -438,6 +611,7 @@ type AbstractEXIBodyCoder struct {
 	maxBuiltInElementGrammars int
 	maxBuiltInProductions     int
 	learnedProductions        int
+	arena                     *objectArena // nil unless enabled by the factory
 }
 
 func NewAbstractEXIBodyCoder(exiFactory EXIFactory) (*AbstractEXIBodyCoder, error) {
@@ -453,6 +627,7 @@ func NewAbstractEXIBodyCoder(exiFactory EXIFactory) (*AbstractEXIBodyCoder, erro
 	for i := range gURIs {
 		ctx := grammarContext.GetGrammarUriContextByID(i)
 		runtimeURIs[i] = RuntimeUriContextFromContext(ctx)
+		runtimeURIs[i].SetLimits(exiFactory.GetMaxLocalNamesPerURI(), exiFactory.GetMaxPrefixesPerURI())
 	}
 
 	var maxBuiltInElementGrammars int
@@ -469,6 +644,11 @@ func NewAbstractEXIBodyCoder(exiFactory EXIFactory) (*AbstractEXIBodyCoder, erro
 		limitGrammarLearning = false
 	}
 
+	var arena *objectArena
+	if size := exiFactory.GetObjectArenaSize(); size > 0 {
+		arena = newObjectArena(size)
+	}
+
 	return &AbstractEXIBodyCoder{
 		exiFactory:                exiFactory,
 		grammar:                   grammar,
@@ -479,7 +659,7 @@ func NewAbstractEXIBodyCoder(exiFactory EXIFactory) (*AbstractEXIBodyCoder, erro
 		errorHandler:              NewDefaultErrorHandler(),
 		booleanDatatype:           NewBooleanDatatype(nil),
 		elementContext:            nil,
-		elementContextStack:       make([]*ElementContext, ElementContextsInitialStackSize),
+		elementContextStack:       make([]*ElementContext, exiFactory.GetInitialElementStackSize()),
 		elementContextStackIndex:  0,
 		runtimeGlobalElements:     map[QNameContextMapKey]*StartElement{},
 		runtimeURIs:               runtimeURIs,
@@ -491,6 +671,7 @@ func NewAbstractEXIBodyCoder(exiFactory EXIFactory) (*AbstractEXIBodyCoder, erro
 		maxBuiltInElementGrammars: maxBuiltInElementGrammars,
 		maxBuiltInProductions:     maxBuiltInProductions,
 		learnedProductions:        0,
+		arena:                     arena,
 	}, nil
 }
 
@@ -501,6 +682,15 @@ func (c *AbstractEXIBodyCoder) getXsiTypeContext() *QNameContext {
 	return c.xsiTypeContext
 }
 
+// charactersDatatype returns the datatype for characters of the current
+// element, i.e. datatype unless a ValueCodec is registered for the element.
+func (c *AbstractEXIBodyCoder) charactersDatatype(datatype Datatype) Datatype {
+	if codec := c.exiFactory.GetElementCodec(c.getElementContext().qnc.GetQName()); codec != nil {
+		return newValueCodecDatatype(codec)
+	}
+	return datatype
+}
+
 func (c *AbstractEXIBodyCoder) getXsiNilContext() *QNameContext {
 	if c.xsiNilContext == nil {
 		c.xsiNilContext = c.grammarContext.GetGrammarUriContextByID(2).GetQNameContextByLocalNameID(0)
@@ -535,13 +725,13 @@ func (c *AbstractEXIBodyCoder) getGlobalStartElement(qnc *QNameContext) *StartEl
 		se = c.runtimeGlobalElements[qnc.GetMapKey()]
 		if se == nil {
 			// no global runtime grammar yet
-			se = NewStartElement(qnc)
+			se = c.arena.newStartElement(qnc)
 			//TODO: which grammar to pick if no schema-information are available?
 			if c.grammar.IsSchemaInformed() && c.exiFactory.IsUsingNonEvolvingGrammars() {
 				sig := c.grammar.(*SchemaInformedGrammars)
 				se.SetGrammar(sig.GetSchemaInformedElementFragmentGrammar())
 			} else {
-				se.SetGrammar(NewBuiltInStartTag())
+				se.SetGrammar(c.arena.newBuiltInStartTag())
 			}
 
 			c.runtimeGlobalElements[qnc.GetMapKey()] = se
@@ -575,6 +765,7 @@ func (c *AbstractEXIBodyCoder) SetErrorHandler(handler ErrorHandler) {
 func (c *AbstractEXIBodyCoder) InitForEachRun() error {
 	// clear runtime data
 	c.runtimeGlobalElements = map[QNameContextMapKey]*StartElement{}
+	c.arena.reset()
 	for i := range c.nextUriID {
 		c.runtimeURIs[i].clear(c.preservePrefix)
 	}
@@ -646,14 +837,20 @@ func (c *AbstractEXIBodyCoder) getPrefix(uri string) *string {
 	return nil
 }
 
-func (c *AbstractEXIBodyCoder) pushElement(updContextGrammar Grammar, se *StartElement) {
+func (c *AbstractEXIBodyCoder) pushElement(updContextGrammar Grammar, se *StartElement) error {
+	// Note: coders of self-contained fragments count the enclosing elements
+	// of the parent coders as well
+	if maxDepth := c.exiFactory.GetMaxElementDepth(); maxDepth >= 0 && c.depthOffset+c.elementContextStackIndex >= maxDepth {
+		return fmt.Errorf("element %s exceeds maximum element depth %d", se.GetQNameContext().GetLocalName(), maxDepth)
+	}
+
 	// update "rule" item of current peak (for popElement() later on)
 	c.elementContext.gr = updContextGrammar
 
 	// check element context array size
 	c.elementContextStackIndex++
 	if len(c.elementContextStack) == c.elementContextStackIndex {
-		elementContextStackNew := make([]*ElementContext, len(c.elementContextStack)<<2)
+		elementContextStackNew := make([]*ElementContext, len(c.elementContextStack)<<1)
 		copy(elementContextStackNew, c.elementContextStack)
 		c.elementContextStack = elementContextStackNew
 	}
@@ -661,6 +858,8 @@ func (c *AbstractEXIBodyCoder) pushElement(updContextGrammar Grammar, se *StartE
 	// create new stack item & push it
 	c.elementContext = NewElementContext(se.GetQNameContext(), se.GetGrammar())
 	c.elementContextStack[c.elementContextStackIndex] = c.elementContext
+
+	return nil
 }
 
 func (c *AbstractEXIBodyCoder) popElement() *ElementContext {
@@ -690,6 +889,7 @@ func (c *AbstractEXIBodyCoder) addUri(uri string) *RuntimeUriContext {
 	} else {
 		// create new uri entry
 		ruc = NewRuntimeUriContext(uriID, uri)
+		ruc.SetLimits(c.exiFactory.GetMaxLocalNamesPerURI(), c.exiFactory.GetMaxPrefixesPerURI())
 		c.runtimeURIs = append(c.runtimeURIs, ruc)
 	}
 
@@ -722,6 +922,156 @@ func (c *AbstractEXIBodyCoder) emitWarning(message string) {
 	c.errorHandler.Warning(fmt.Errorf("%s, options = %+v", message, c.fidelityOptions))
 }
 
+// Snapshot returns the current runtime state of the coder: the runtime uris,
+// local names and prefixes, the learned built-in grammars and the element
+// stack. Value string tables and the channel position are not part of it.
+// Take snapshots between events; a snapshot becomes invalid once the coder
+// is initialized for another run.
+func (c *AbstractEXIBodyCoder) Snapshot() *CoderSnapshot {
+	s := &CoderSnapshot{
+		runtimeURIs:           make([]*RuntimeUriContext, c.nextUriID),
+		nextUriID:             c.nextUriID,
+		runtimeGlobalElements: maps.Clone(c.runtimeGlobalElements),
+		grammars:              []builtInGrammarState{},
+		elementContextStack:   make([]ElementContext, c.elementContextStackIndex+1),
+		learnedProductions:    c.learnedProductions,
+	}
+	for i := range c.nextUriID {
+		s.runtimeURIs[i] = c.runtimeURIs[i].Clone()
+	}
+
+	seen := map[Grammar]bool{}
+	for _, se := range c.runtimeGlobalElements {
+		s.addGrammar(se.GetGrammar(), seen)
+	}
+	for i := range s.elementContextStack {
+		ec := c.elementContextStack[i]
+		s.elementContextStack[i] = *ec
+		s.elementContextStack[i].nsDeclarations = slices.Clone(ec.nsDeclarations)
+		s.addGrammar(ec.gr, seen)
+	}
+
+	return s
+}
+
+// Restore resets the runtime state of the coder to the one of snapshot, see
+// Snapshot. A snapshot can be restored repeatedly.
+func (c *AbstractEXIBodyCoder) Restore(snapshot *CoderSnapshot) {
+	for i, ruc := range snapshot.runtimeURIs {
+		if i < len(c.runtimeURIs) {
+			c.runtimeURIs[i] = ruc.Clone()
+		} else {
+			c.runtimeURIs = append(c.runtimeURIs, ruc.Clone())
+		}
+	}
+	c.nextUriID = snapshot.nextUriID
+	c.runtimeGlobalElements = maps.Clone(snapshot.runtimeGlobalElements)
+	for i := range snapshot.grammars {
+		snapshot.grammars[i].restore()
+	}
+
+	c.elementContextStackIndex = len(snapshot.elementContextStack) - 1
+	if len(c.elementContextStack) <= c.elementContextStackIndex {
+		c.elementContextStack = make([]*ElementContext, len(snapshot.elementContextStack)<<1)
+	}
+	for i := range c.elementContextStack {
+		if i > c.elementContextStackIndex {
+			c.elementContextStack[i] = nil
+			continue
+		}
+		ec := snapshot.elementContextStack[i]
+		ec.nsDeclarations = slices.Clone(ec.nsDeclarations)
+		c.elementContextStack[i] = &ec
+	}
+	c.elementContext = c.elementContextStack[c.elementContextStackIndex]
+	c.learnedProductions = snapshot.learnedProductions
+}
+
+/*
+	CoderSnapshot implementation
+*/
+
+// CoderSnapshot holds the runtime state of an EXI body coder, see
+// AbstractEXIBodyCoder.Snapshot.
+type CoderSnapshot struct {
+	runtimeURIs           []*RuntimeUriContext
+	nextUriID             int
+	runtimeGlobalElements map[QNameContextMapKey]*StartElement
+	grammars              []builtInGrammarState
+	elementContextStack   []ElementContext
+	learnedProductions    int
+
+	// decoders only
+	nextEvent     Event
+	nextGrammar   Grammar
+	nextEventType EventType
+}
+
+// addGrammar records the state of g and of the grammars it learns into if g
+// is a built-in grammar. Schema-informed grammars do not change at runtime.
+func (s *CoderSnapshot) addGrammar(g Grammar, seen map[Grammar]bool) {
+	if g == nil || seen[g] {
+		return
+	}
+	seen[g] = true
+
+	switch bg := g.(type) {
+	case *BuiltInStartTag:
+		s.grammars = append(s.grammars, newBuiltInGrammarState(bg.AbstractBuiltInGrammar, bg.AbstractBuiltInContent, bg))
+		s.addGrammar(bg.elementContent, seen)
+	case *BuiltInElement:
+		s.grammars = append(s.grammars, newBuiltInGrammarState(bg.AbstractBuiltInGrammar, bg.AbstractBuiltInContent, nil))
+	case *BuiltInFragmentContent:
+		s.grammars = append(s.grammars, newBuiltInGrammarState(bg.AbstractBuiltInGrammar, nil, nil))
+	}
+}
+
+// builtInGrammarState holds what a built-in grammar has learned. Productions
+// are only ever appended, so the number of productions is sufficient.
+type builtInGrammarState struct {
+	grammar                   *AbstractBuiltInGrammar
+	numberOfEvents            int
+	ec1Length                 int
+	stopLearningContainerSize int
+	content                   *AbstractBuiltInContent // nil unless content grammar
+	learnedCH                 bool
+	startTag                  *BuiltInStartTag // nil unless start tag grammar
+	learnedEE                 bool
+	learnedXsiType            bool
+}
+
+func newBuiltInGrammarState(g *AbstractBuiltInGrammar, content *AbstractBuiltInContent, startTag *BuiltInStartTag) builtInGrammarState {
+	s := builtInGrammarState{
+		grammar:                   g,
+		numberOfEvents:            len(g.containers),
+		ec1Length:                 g.ec1Length,
+		stopLearningContainerSize: g.stopLearningContainerSize,
+		content:                   content,
+		startTag:                  startTag,
+	}
+	if content != nil {
+		s.learnedCH = content.learnedCH
+	}
+	if startTag != nil {
+		s.learnedEE = startTag.learnedEE
+		s.learnedXsiType = startTag.learnedXsiType
+	}
+	return s
+}
+
+func (s *builtInGrammarState) restore() {
+	s.grammar.containers = s.grammar.containers[:s.numberOfEvents]
+	s.grammar.ec1Length = s.ec1Length
+	s.grammar.stopLearningContainerSize = s.stopLearningContainerSize
+	if s.content != nil {
+		s.content.learnedCH = s.learnedCH
+	}
+	if s.startTag != nil {
+		s.startTag.learnedEE = s.learnedEE
+		s.startTag.learnedXsiType = s.learnedXsiType
+	}
+}
+
 /*
 	AbstractEXIBodyDecoder implementation
 */
@@ -738,6 +1088,11 @@ type AbstractEXIBodyDecoder struct {
 	attributeQNameContext *QNameContext
 	attributePrefix       *string
 	attributeValue        Value
+	conformanceReport     *ConformanceReport // grammar-learning conformance of the last decoded stream
+	preferredPrefixes     map[string]string  // namespace URI to prefix replacing default prefixes
+	learningObserver      GrammarLearningObserver
+	rawValueObserver      RawValueObserver
+	coerceValues          bool // report values as lexical strings
 }
 
 func NewAbstractEXIBodyDecoder(exiFactory EXIFactory) (*AbstractEXIBodyDecoder, error) {
@@ -762,21 +1117,65 @@ func NewAbstractEXIBodyDecoder(exiFactory EXIFactory) (*AbstractEXIBodyDecoder,
 		attributeQNameContext: nil,
 		attributePrefix:       nil,
 		attributeValue:        nil,
+		conformanceReport:     nil,
+		preferredPrefixes:     exiFactory.GetPreferredPrefixes(),
+		learningObserver:      nil,
+		rawValueObserver:      nil,
+		coerceValues:          exiFactory.GetDecodingOptions().IsOptionEnabled(OptionCoerceValuesToStrings),
 	}, nil
 }
 
-func (d *AbstractEXIBodyDecoder) pushElement(updContextGrammar Grammar, se *StartElement) {
-	d.AbstractEXIBodyCoder.pushElement(updContextGrammar, se)
+// getDefaultPrefix returns the preferred prefix of uri if there is one and
+// defaultPrefix otherwise.
+func (d *AbstractEXIBodyDecoder) getDefaultPrefix(uri string, defaultPrefix string) string {
+	if prefix, ok := d.preferredPrefixes[uri]; ok {
+		return prefix
+	}
+	return defaultPrefix
+}
+
+// pushElement declares the prefixes of all schema-known namespaces on the
+// root element if prefixes are not preserved. Elements and attributes of
+// these namespaces use the same (generated or preferred) prefix throughout the
+// document, e.g. ns4 for the first target namespace.
+func (d *AbstractEXIBodyDecoder) pushElement(updContextGrammar Grammar, se *StartElement) error {
+	if err := d.AbstractEXIBodyCoder.pushElement(updContextGrammar, se); err != nil {
+		return err
+	}
 
 	if !d.preservePrefix && d.elementContextStackIndex == 1 {
 		// Note: can be done several times due to multiple root elements in fragments.
 		gc := d.grammar.GetGrammarContext()
 		for i := 2; i < gc.GetNumberOfGrammarUriContexts(); i++ {
 			guc := gc.GetGrammarUriContextByID(i)
-			prefix := guc.GetDefaultPrefix()
+			prefix := d.getDefaultPrefix(guc.GetNamespaceUri(), guc.GetDefaultPrefix())
 			d.declarePrefix(&prefix, guc.GetNamespaceUri())
 		}
 	}
+
+	return nil
+}
+
+func (d *AbstractEXIBodyDecoder) SetErrorHandler(handler ErrorHandler) {
+	d.AbstractEXIBodyCoder.SetErrorHandler(handler)
+	setTypeDecoderErrorHandler(d.typeDecoder, handler)
+}
+
+// Snapshot additionally records the event decoded last, see
+// AbstractEXIBodyCoder.Snapshot.
+func (d *AbstractEXIBodyDecoder) Snapshot() *CoderSnapshot {
+	s := d.AbstractEXIBodyCoder.Snapshot()
+	s.nextEvent = d.nextEvent
+	s.nextGrammar = d.nextGrammar
+	s.nextEventType = d.nextEventType
+	return s
+}
+
+func (d *AbstractEXIBodyDecoder) Restore(snapshot *CoderSnapshot) {
+	d.AbstractEXIBodyCoder.Restore(snapshot)
+	d.nextEvent = snapshot.nextEvent
+	d.nextGrammar = snapshot.nextGrammar
+	d.nextEventType = snapshot.nextEventType
 }
 
 func (d *AbstractEXIBodyDecoder) InitForEachRun() error {
@@ -784,9 +1183,13 @@ func (d *AbstractEXIBodyDecoder) InitForEachRun() error {
 		return err
 	}
 
+	d.learnedProductions = 0
+	d.conformanceReport = nil
 	d.stringDecoder.Clear()
 	if d.exiFactory.GetSharedStrings() != nil {
-		d.stringDecoder.SetSharedStrings(*d.exiFactory.GetSharedStrings())
+		if err := d.stringDecoder.SetSharedStrings(*d.exiFactory.GetSharedStrings()); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -822,6 +1225,9 @@ func (d *AbstractEXIBodyDecoder) decodeURI(channel DecoderChannel) (*RuntimeUriC
 		// string value found
 		// ==> value(i+1) is encoded as n-bit unsigned integer
 		uriID--
+		if uriID >= d.GetNumberOfURIs() {
+			return nil, fmt.Errorf("uri id %d out of bounds", uriID)
+		}
 		ruc = d.GetURIByNamespaceID(uriID)
 	}
 
@@ -845,7 +1251,10 @@ func (d *AbstractEXIBodyDecoder) decodeLocalName(ruc *RuntimeUriContext, channel
 		}
 		// After encoding the string value, it is added to the string table
 		// partition and assigned the next available compact identifier.
-		qnc = ruc.AddQNameContext(string(runes))
+		qnc, err = ruc.addQNameContext(d.arena, string(runes))
+		if err != nil {
+			return nil, err
+		}
 	} else {
 		// string value found in local partition
 		// ==> string value is represented as zero (0) encoded as an
@@ -857,7 +1266,10 @@ func (d *AbstractEXIBodyDecoder) decodeLocalName(ruc *RuntimeUriContext, channel
 		if err != nil {
 			return nil, err
 		}
-		qnc = ruc.GetQNameContextByLocalNameID(localNameID)
+		qnc, err = ruc.GetQNameContextByLocalNameID(localNameID)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return qnc, nil
@@ -880,7 +1292,11 @@ func (d *AbstractEXIBodyDecoder) decodeQNamePrefix(ruc *RuntimeUriContext, chann
 				id = tmp
 			}
 
-			prefix = ruc.GetPrefix(id)
+			tmp, err := ruc.GetPrefix(id)
+			if err != nil {
+				return nil, err
+			}
+			prefix = tmp
 		} else {
 			// no previous NS mapping in charge
 			// Note: should only happen for SE events where NS appears afterwards.
@@ -909,11 +1325,16 @@ func (d *AbstractEXIBodyDecoder) decodeNamespacePrefix(ruc *RuntimeUriContext, c
 		}
 		prefix = utils.AsPtr(string(runes))
 
-		ruc.addPrefix(string(runes))
+		if err := ruc.addPrefix(string(runes)); err != nil {
+			return nil, err
+		}
 	} else {
 		// string value found
 		// ==> value(i+1) is encoded as n-bit unsigned integer
-		prefix = ruc.GetPrefix(pfxID - 1)
+		prefix, err = ruc.GetPrefix(pfxID - 1)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return prefix, nil
@@ -979,13 +1400,17 @@ func (d *AbstractEXIBodyDecoder) GetAttributePrefix() *string {
 }
 
 func (d *AbstractEXIBodyDecoder) GetAttributeQNameAsString() string {
-	if d.preservePrefix {
+	if d.preservePrefix || d.attributePrefix != nil {
 		return utils.GetQualifiedName(d.attributeQNameContext.GetLocalName(), d.attributePrefix)
 	} else {
 		return d.attributeQNameContext.GetDefaultQNameAsString()
 	}
 }
 
+func (d *AbstractEXIBodyDecoder) GetAttributeQNameContext() *QNameContext {
+	return d.attributeQNameContext
+}
+
 func (d *AbstractEXIBodyDecoder) GetAttributeValue() Value {
 	return d.attributeValue
 }
@@ -1048,55 +1473,162 @@ func (d *AbstractEXIBodyDecoder) decode3rdLevelEventCode() (int, error) {
 
 func (d *AbstractEXIBodyDecoder) decodeStartDocumentStructure() error {
 	d.updateCurrentRule(d.getCurrentGrammar().GetProductionByEventCode(0).GetNextGrammar())
+
+	if d.exiFactory.IsFidelityMismatchDetection() {
+		marker, err := d.channel.DecodeNBitUnsignedInteger(fidelityMarkerBits)
+		if err != nil {
+			return err
+		}
+		return d.fidelityOptions.checkMarker(marker)
+	}
+
 	return nil
 }
 
 func (d *AbstractEXIBodyDecoder) decodeEndDocumentStructure() error {
-	if d.limitGrammarLearning {
-		if d.maxBuiltInElementGrammars != -1 {
-			evolvedGrs := 0
-
-			for _, se := range d.runtimeGlobalElements {
-				stg := se.GetGrammar()
-				if stg.GetGrammarType() != GrammarTypeBuiltInStartTagContent {
-					return fmt.Errorf("invalid start element grammar type: %d", stg.GetGrammarType())
-				}
-				ecg := stg.GetElementContentGrammar()
-				if ecg.GetGrammarType() != GrammarTypeBuiltInElementContent {
-					return fmt.Errorf("invalid built-in element content grammar type: %d", ecg.GetGrammarType())
-				}
+	report := &ConformanceReport{
+		MaxBuiltInElementGrammars: d.maxBuiltInElementGrammars,
+		MaxBuiltInProductions:     d.maxBuiltInProductions,
+		BuiltInElementGrammars:    0,
+		LearnedProductions:        d.learnedProductions,
+	}
+
+	if d.limitGrammarLearning && d.maxBuiltInElementGrammars != -1 {
+		report.BuiltInElementGrammars = d.countEvolvedBuiltInElementGrammars()
+	}
+	d.conformanceReport = report
+
+	if !report.IsElementGrammarsConformant() {
+		return fmt.Errorf("EXI profile stream does not respect parameter maxBuiltInElementGrammars. Expected %d but was %d", d.maxBuiltInElementGrammars, report.BuiltInElementGrammars)
+	}
+
+	return nil
+}
+
+// Returns the number of built-in element grammars that have evolved, i.e.
+// learned productions other than AT(xsi:type). Runtime elements without a
+// built-in grammar, e.g. with the schema-informed element fragment grammar
+// of non-evolving grammars, are skipped.
+func (d *AbstractEXIBodyDecoder) countEvolvedBuiltInElementGrammars() int {
+	evolvedGrs := 0
+
+	for _, se := range d.runtimeGlobalElements {
+		stg := se.GetGrammar()
+		if stg.GetGrammarType() != GrammarTypeBuiltInStartTagContent {
+			continue
+		}
+		ecg := stg.GetElementContentGrammar()
+		if ecg.GetGrammarType() != GrammarTypeBuiltInElementContent {
+			continue
+		}
 
-				if ecg.GetNumberOfEvents() != 1 {
-					// BuiltIn Element Content grammar has EE per default
+		if ecg.GetNumberOfEvents() != 1 {
+			// BuiltIn Element Content grammar has EE per default
+			evolvedGrs++
+		} else {
+			if stg.GetNumberOfEvents() > 1 {
+				evolvedGrs++
+			} else if stg.GetNumberOfEvents() == 1 {
+				// check for AT(xsi:type)
+				if !d.isBuiltInStartTagGrammarWithAtXsiTypeOnly(stg) {
 					evolvedGrs++
-				} else {
-					if stg.GetNumberOfEvents() > 1 {
-						evolvedGrs++
-					} else if stg.GetNumberOfEvents() == 1 {
-						// check for AT(xsi:type)
-						if !d.isBuiltInStartTagGrammarWithAtXsiTypeOnly(stg) {
-							evolvedGrs++
-						}
-					}
 				}
 			}
-
-			if evolvedGrs > d.maxBuiltInElementGrammars {
-				return fmt.Errorf("EXI profile stream does not respect parameter maxBuiltInElementGrammars. Expected %d but was %d", d.maxBuiltInElementGrammars, evolvedGrs)
-			}
 		}
 	}
 
-	return nil
+	return evolvedGrs
+}
+
+// Counts the productions grammar g learned since it had numberOfEvents events
+func (d *AbstractEXIBodyDecoder) productionLearningCounting(g Grammar, numberOfEvents int) {
+	// Note: no counting for schema-informed grammars and
+	// BuiltInFragmentGrammar
+	if !g.IsSchemaInformed() && g.GetGrammarType() != GrammarTypeBuiltInFragmentContent {
+		d.learnedProductions += g.GetNumberOfEvents() - numberOfEvents
+	}
+}
+
+// Reports learned productions of grammar g, which had numberOfEvents events
+// before learning, to the learning observer
+func (d *AbstractEXIBodyDecoder) observeLearning(g Grammar, numberOfEvents int, qnc *QNameContext, what string) {
+	if d.learningObserver != nil && g.GetNumberOfEvents() > numberOfEvents {
+		d.learningObserver(qnc.GetQName(), what)
+	}
+}
+
+func (d *AbstractEXIBodyDecoder) SetGrammarLearningObserver(observer GrammarLearningObserver) {
+	d.learningObserver = observer
+}
+
+func (d *AbstractEXIBodyDecoder) SetRawValueObserver(observer RawValueObserver) {
+	d.rawValueObserver = observer
+}
+
+// Reads a value of datatype using typeDecoder and reports the bytes consumed
+// to the raw value observer. Values deferred by typeDecoder (nil) are not
+// reported until they are actually read.
+func (d *AbstractEXIBodyDecoder) readValue(typeDecoder TypeDecoder, datatype Datatype, qnc *QNameContext) (Value, error) {
+	if d.rawValueObserver == nil {
+		return typeDecoder.ReadValue(datatype, qnc, d.channel, d.stringDecoder)
+	}
+
+	recorder, recording := d.channel.(RawRecordingDecoderChannel)
+	if recording {
+		recorder.StartRawRecording()
+	}
+	value, err := typeDecoder.ReadValue(datatype, qnc, d.channel, d.stringDecoder)
+	var raw []byte
+	if recording {
+		raw = recorder.StopRawRecording()
+	}
+	if err == nil && value != nil {
+		d.rawValueObserver(qnc, datatype, raw)
+	}
+	return value, err
+}
+
+// Returns value as it is surfaced to the caller, i.e. converted to a
+// StringValue of its lexical form if values are coerced to strings.
+func (d *AbstractEXIBodyDecoder) surfaceValue(value Value, err error) (Value, error) {
+	if err != nil || !d.coerceValues || value == nil {
+		return value, err
+	}
+	if _, ok := value.(*StringValue); ok {
+		return value, nil
+	}
+	s, err := value.ToString()
+	if err != nil {
+		return nil, err
+	}
+	return NewStringValueFromString(s), nil
+}
+
+func (d *AbstractEXIBodyDecoder) GetStringTableStats() StringTableStats {
+	return d.stringDecoder.Stats()
+}
+
+func (d *AbstractEXIBodyDecoder) GetConformanceReport() *ConformanceReport {
+	return d.conformanceReport
+}
+
+func (d *AbstractEXIBodyDecoder) GetCodingMode() CodingMode {
+	return d.exiFactory.GetCodingMode()
+}
+
+func (d *AbstractEXIBodyDecoder) GetBlockSize() int {
+	return d.exiFactory.GetBlockSize()
 }
 
 func (d *AbstractEXIBodyDecoder) decodeStartElementStructure() (*QNameContext, error) {
 	if d.nextEventType != EventTypeStartElement {
-		return nil, fmt.Errorf("next event type is not start element: %d", d.nextEventType)
+		return nil, fmt.Errorf("next event type is not start element: %s", d.nextEventType)
 	}
 	se := d.nextEvent.(*StartElement)
 	// push element
-	d.pushElement(d.nextGrammar, se)
+	if err := d.pushElement(d.nextGrammar, se); err != nil {
+		return nil, err
+	}
 	// handle element prefix
 	qnc := se.GetQNameContext()
 	if err := d.handleElementPrefix(qnc); err != nil {
@@ -1108,7 +1640,7 @@ func (d *AbstractEXIBodyDecoder) decodeStartElementStructure() (*QNameContext, e
 
 func (d *AbstractEXIBodyDecoder) decodeStartElementNSStructure() (*QNameContext, error) {
 	if d.nextEventType != EventTypeStartElementNS {
-		return nil, fmt.Errorf("next event type is not start element NS: %d", d.nextEventType)
+		return nil, fmt.Errorf("next event type is not start element NS: %s", d.nextEventType)
 	}
 
 	seNS := d.nextEvent.(*StartElementNS)
@@ -1123,7 +1655,9 @@ func (d *AbstractEXIBodyDecoder) decodeStartElementNSStructure() (*QNameContext,
 	nextSE := d.getGlobalStartElement(qnc)
 
 	// push element
-	d.pushElement(d.nextGrammar, nextSE)
+	if err := d.pushElement(d.nextGrammar, nextSE); err != nil {
+		return nil, err
+	}
 	// handle element prefix
 	if err := d.handleElementPrefix(qnc); err != nil {
 		return nil, err
@@ -1134,7 +1668,7 @@ func (d *AbstractEXIBodyDecoder) decodeStartElementNSStructure() (*QNameContext,
 
 func (d *AbstractEXIBodyDecoder) decodeStartElementGenericStructure() (*QNameContext, error) {
 	if d.nextEventType != EventTypeStartElementGeneric {
-		return nil, fmt.Errorf("next event type is not start element generic: %d", d.nextEventType)
+		return nil, fmt.Errorf("next event type is not start element generic: %s", d.nextEventType)
 	}
 
 	qnc, err := d.decodeQName(d.channel)
@@ -1145,9 +1679,15 @@ func (d *AbstractEXIBodyDecoder) decodeStartElementGenericStructure() (*QNameCon
 	nextSE := d.getGlobalStartElement(qnc)
 
 	// learn start-element, necessary for FragmentContent grammar
-	d.getCurrentGrammar().LearnStartElement(nextSE)
+	currentGrammar := d.getCurrentGrammar()
+	numberOfEvents := currentGrammar.GetNumberOfEvents()
+	currentGrammar.LearnStartElement(nextSE)
+	d.productionLearningCounting(currentGrammar, numberOfEvents)
+	d.observeLearning(currentGrammar, numberOfEvents, qnc, "SE")
 	// push element
-	d.pushElement(d.nextGrammar.GetElementContentGrammar(), nextSE)
+	if err := d.pushElement(d.nextGrammar.GetElementContentGrammar(), nextSE); err != nil {
+		return nil, err
+	}
 
 	// handle element prefix
 	if err := d.handleElementPrefix(qnc); err != nil {
@@ -1159,7 +1699,7 @@ func (d *AbstractEXIBodyDecoder) decodeStartElementGenericStructure() (*QNameCon
 
 func (d *AbstractEXIBodyDecoder) decodeStartElementGenericUndeclaredStructure() (*QNameContext, error) {
 	if d.nextEventType != EventTypeStartElementGenericUndeclared {
-		return nil, fmt.Errorf("next event type is not start element generic undeclared: %d", d.nextEventType)
+		return nil, fmt.Errorf("next event type is not start element generic undeclared: %s", d.nextEventType)
 	}
 
 	qnc, err := d.decodeQName(d.channel)
@@ -1171,10 +1711,15 @@ func (d *AbstractEXIBodyDecoder) decodeStartElementGenericUndeclaredStructure()
 
 	// learn start-element ?
 	currentGrammar := d.getCurrentGrammar()
+	numberOfEvents := currentGrammar.GetNumberOfEvents()
 	currentGrammar.LearnStartElement(nextSE)
+	d.productionLearningCounting(currentGrammar, numberOfEvents)
+	d.observeLearning(currentGrammar, numberOfEvents, qnc, "SE")
 
 	// push element
-	d.pushElement(d.nextGrammar.GetElementContentGrammar(), nextSE)
+	if err := d.pushElement(currentGrammar.GetElementContentGrammar(), nextSE); err != nil {
+		return nil, err
+	}
 
 	// handle element prefix
 	if err := d.handleElementPrefix(qnc); err != nil {
@@ -1189,7 +1734,11 @@ func (d *AbstractEXIBodyDecoder) decodeEndElementStructure() (*ElementContext, e
 }
 
 func (d *AbstractEXIBodyDecoder) decodeEndElementUndeclaredStructure() (*ElementContext, error) {
-	d.getCurrentGrammar().LearnEndElement()
+	currentGrammar := d.getCurrentGrammar()
+	numberOfEvents := currentGrammar.GetNumberOfEvents()
+	currentGrammar.LearnEndElement()
+	d.productionLearningCounting(currentGrammar, numberOfEvents)
+	d.observeLearning(currentGrammar, numberOfEvents, d.getElementContext().qnc, "EE")
 	return d.popElement(), nil
 }
 
@@ -1203,7 +1752,7 @@ func (d *AbstractEXIBodyDecoder) decodeAttributeXsiNilStructure() error {
 
 	if d.preserveLexicalValues {
 		// as string
-		value, err := d.typeDecoder.ReadValue(d.booleanDatatype, d.getXsiNilContext(), d.channel, d.stringDecoder)
+		value, err := d.readValue(d.typeDecoder, d.booleanDatatype, d.getXsiNilContext())
 		if err != nil {
 			return err
 		}
@@ -1236,6 +1785,8 @@ func (d *AbstractEXIBodyDecoder) decodeAttributeXsiNilStructure() error {
 			bv = BooleanValueParse(s)
 			if bv != nil {
 				xsiNil = bv.ToBoolean()
+			} else {
+				d.emitWarning(fmt.Sprintf("invalid xsi:nil value '%s' treated as false", s))
 			}
 		}
 	}
@@ -1266,7 +1817,7 @@ func (d *AbstractEXIBodyDecoder) decodeAttributeXsiTypeStructure() error {
 	// read xsi:type content
 	if d.preserveLexicalValues {
 		// assert(preservePrefix); // Note: requirement
-		tmp, err := d.typeDecoder.ReadValue(BuiltInGetDefaultDatatype(), d.getXsiTypeContext(), d.channel, d.stringDecoder)
+		tmp, err := d.readValue(d.typeDecoder, BuiltInGetDefaultDatatype(), d.getXsiTypeContext())
 		if err != nil {
 			return err
 		}
@@ -1280,14 +1831,20 @@ func (d *AbstractEXIBodyDecoder) decodeAttributeXsiTypeStructure() error {
 		// extract prefix
 		qncTypePrefix := utils.GetPrefixPart(sType)
 
-		// URI
+		// URI, nil for prefixes not in scope
 		qnameURI := d.getURI(&qncTypePrefix)
-		ruc := d.GetURI(*qnameURI)
+		var ruc *RuntimeUriContext
+		if qnameURI != nil {
+			ruc = d.GetURI(*qnameURI)
+		}
 		if ruc != nil {
 			// local-name
 			qnameLocalName := utils.GetLocalPart(sType)
 			qnc = ruc.GetQNameContextByLocalName(qnameLocalName)
 		}
+		if qnc == nil {
+			d.emitWarning(fmt.Sprintf("xsi:type '%s' cannot be resolved, type grammar not applied", sType))
+		}
 	} else {
 		// typed
 		tmp, err := d.decodeQName(d.channel)
@@ -1305,7 +1862,7 @@ func (d *AbstractEXIBodyDecoder) decodeAttributeXsiTypeStructure() error {
 			qncTypePrefix = tmp
 		} else {
 			d.checkDefaultPrefixNamespaceDeclaration(qnc)
-			qncTypePrefix = utils.AsPtr(qnc.GetDefaultPrefix())
+			qncTypePrefix = utils.AsPtr(d.getDefaultPrefix(qnc.GetNamespaceUri(), qnc.GetDefaultPrefix()))
 		}
 		d.attributeValue = NewQNameValue(qnc.GetNamespaceUri(), qnc.GetLocalName(), qncTypePrefix)
 	}
@@ -1332,7 +1889,7 @@ func (d *AbstractEXIBodyDecoder) handleElementPrefix(qnc *QNameContext) error {
 	} else {
 		// element prefix
 		d.checkDefaultPrefixNamespaceDeclaration(qnc)
-		pfx = utils.AsPtr(qnc.GetDefaultPrefix())
+		pfx = utils.AsPtr(d.getDefaultPrefix(qnc.GetNamespaceUri(), qnc.GetDefaultPrefix()))
 	}
 
 	d.getElementContext().SetPrefix(pfx)
@@ -1346,27 +1903,31 @@ func (d *AbstractEXIBodyDecoder) handleAttributePrefix(qnc *QNameContext) error
 		if err != nil {
 			return err
 		}
+		if tmp == nil {
+			// Note: unlike elements, attributes are not followed by NS events
+			d.emitWarning(fmt.Sprintf("no prefix in scope for attribute namespace '%s'", qnc.GetNamespaceUri()))
+		}
 		d.attributePrefix = tmp
 	} else {
 		d.checkDefaultPrefixNamespaceDeclaration(qnc)
-		d.attributePrefix = utils.AsPtr(qnc.GetDefaultPrefix())
+		d.attributePrefix = utils.AsPtr(d.getDefaultPrefix(qnc.GetNamespaceUri(), qnc.GetDefaultPrefix()))
 	}
 	return nil
 }
 
 func (d *AbstractEXIBodyDecoder) checkDefaultPrefixNamespaceDeclaration(qnc *QNameContext) {
 	if d.preservePrefix {
-		panic("preserve prefix is not permitted")
+		d.emitWarning("default prefix namespace declaration requested while preserving prefixes")
+		return
 	}
 
 	if qnc.GetNamespaceUriID() < d.numberOfUriContexts {
 		// schema-known grammar uris/prefixes have been declared in root element
 	} else {
 		uri := qnc.GetNamespaceUri()
-		pfx := d.getPrefix(uri)
-
-		if pfx != nil {
-			pfx = utils.AsPtr(qnc.GetDefaultPrefix())
+		if d.getPrefix(uri) == nil {
+			// not declared in scope yet
+			pfx := utils.AsPtr(d.getDefaultPrefix(uri, qnc.GetDefaultPrefix()))
 			d.declarePrefix(pfx, uri)
 		}
 	}
@@ -1429,9 +1990,13 @@ func (d *AbstractEXIBodyDecoder) decodeAttributeGenericUndeclaredStructure() err
 	if err := d.decodeAttributeGenericStructureOnly(); err != nil {
 		return err
 	}
-	if err := d.getCurrentGrammar().LearnAttribute(NewAttribute(d.attributeQNameContext)); err != nil {
+	currentGrammar := d.getCurrentGrammar()
+	numberOfEvents := currentGrammar.GetNumberOfEvents()
+	if err := currentGrammar.LearnAttribute(NewAttribute(d.attributeQNameContext)); err != nil {
 		return err
 	}
+	d.productionLearningCounting(currentGrammar, numberOfEvents)
+	d.observeLearning(currentGrammar, numberOfEvents, d.attributeQNameContext, "AT")
 	return nil
 }
 
@@ -1453,7 +2018,7 @@ func (d *AbstractEXIBodyDecoder) decodeAttributeGenericStructureOnly() error {
 
 func (d *AbstractEXIBodyDecoder) decodeCharactersStructure() (Datatype, error) {
 	if d.nextEventType != EventTypeCharacters {
-		return nil, fmt.Errorf("next event type is not characters: %d", d.nextEventType)
+		return nil, fmt.Errorf("next event type is not characters: %s", d.nextEventType)
 	}
 
 	// update current rule
@@ -1463,7 +2028,7 @@ func (d *AbstractEXIBodyDecoder) decodeCharactersStructure() (Datatype, error) {
 
 func (d *AbstractEXIBodyDecoder) decodeCharactersGenericStructure() error {
 	if d.nextEventType != EventTypeCharactersGeneric {
-		return fmt.Errorf("next event type is not characters generic: %d", d.nextEventType)
+		return fmt.Errorf("next event type is not characters generic: %s", d.nextEventType)
 	}
 
 	// update current rule
@@ -1473,12 +2038,15 @@ func (d *AbstractEXIBodyDecoder) decodeCharactersGenericStructure() error {
 
 func (d *AbstractEXIBodyDecoder) decodeCharactersGenericUndeclaredStructure() error {
 	if d.nextEventType != EventTypeCharactersGenericUndeclared {
-		return fmt.Errorf("next event type is not characters generic undeclared: %d", d.nextEventType)
+		return fmt.Errorf("next event type is not characters generic undeclared: %s", d.nextEventType)
 	}
 
 	// learn character event ?
 	currentGrammar := d.getCurrentGrammar()
+	numberOfEvents := currentGrammar.GetNumberOfEvents()
 	currentGrammar.LearnCharacters()
+	d.productionLearningCounting(currentGrammar, numberOfEvents)
+	d.observeLearning(currentGrammar, numberOfEvents, d.getElementContext().qnc, "CH")
 
 	// update current rule
 	d.updateCurrentRule(currentGrammar.GetElementContentGrammar())
@@ -1601,7 +2169,8 @@ type AbstractEXIBodyEncoder struct {
 	*AbstractEXIBodyCoder
 	exiHeader          EXIHeaderEncoder
 	sePrefix           *string // prefix of previous start element (relevant for preserving prefixes)
-	seUri              *string // URI of previous start element (relevant for preserving prefixes)
+	seUri              string  // URI of previous start element (relevant for preserving prefixes)
+	hasSeUri           bool    // whether seUri has been set by a start element
 	channel            EncoderChannel
 	typeEncoder        TypeEncoder
 	stringEncoder      StringEncoder
@@ -1611,6 +2180,19 @@ type AbstractEXIBodyEncoder struct {
 	lastEvent          EventType
 	cbuffer            []rune // character buffer for CH trimming, replacing, collapsing
 	debug              bool
+
+	// Canonical EXI, see OptionCanonicalExi
+	isCanonical        bool
+	lastPrefix         string // prefix of previous NS event
+	lastAttributeURI   string // URI of previous AT event
+	lastAttributeLocal string // local-name of previous AT event
+
+	prefixNamespaces map[string]struct{} // namespaces preserving prefixes, nil for all
+
+	stats map[utils.QName]*ValueStats // value stats per qname, nil if disabled
+
+	budgetExhaustedHandler func()
+	budgetExhausted        bool // whether grammar learning has been disabled in this document
 }
 
 func NewAbstractEXIBodyEncoder(exiFactory EXIFactory) (*AbstractEXIBodyEncoder, error) {
@@ -1622,12 +2204,20 @@ func NewAbstractEXIBodyEncoder(exiFactory EXIFactory) (*AbstractEXIBodyEncoder,
 	if err != nil {
 		return nil, err
 	}
+	var prefixNamespaces map[string]struct{}
+	if namespaces := exiFactory.GetPrefixPreservationNamespaces(); namespaces != nil {
+		prefixNamespaces = map[string]struct{}{}
+		for _, uri := range namespaces {
+			prefixNamespaces[uri] = struct{}{}
+		}
+	}
 
 	return &AbstractEXIBodyEncoder{
 		AbstractEXIBodyCoder: aec,
 		exiHeader:            EXIHeaderEncoder{}, //TODO: IMPLEMENTATION!!!
 		sePrefix:             nil,
-		seUri:                nil,
+		seUri:                "",
+		hasSeUri:             false,
 		channel:              nil,
 		typeEncoder:          typeEncoder,
 		stringEncoder:        exiFactory.CreateStringEncoder(),
@@ -1637,6 +2227,8 @@ func NewAbstractEXIBodyEncoder(exiFactory EXIFactory) (*AbstractEXIBodyEncoder,
 		lastEvent:            -1,
 		cbuffer:              []rune{},
 		debug:                false,
+		isCanonical:          exiFactory.GetEncodingOptions().IsOptionEnabled(OptionCanonicalExi),
+		prefixNamespaces:     prefixNamespaces,
 	}, nil
 }
 
@@ -1654,10 +2246,105 @@ func (e *AbstractEXIBodyEncoder) InitForEachRun() error {
 	}
 	e.bChars = []Value{}
 	e.isXMLSpacePreserve = false
+	if e.stats != nil {
+		e.stats = map[utils.QName]*ValueStats{}
+	}
+	e.budgetExhausted = false
+
+	return nil
+}
+
+// Reset clears runtime grammars and URIs, the string table, character buffers
+// and the element stack. Allocated buffers are kept for the next document.
+func (e *AbstractEXIBodyEncoder) Reset() error {
+	if err := e.InitForEachRun(); err != nil {
+		return err
+	}
+
+	// release element contexts of the previous document
+	clear(e.elementContextStack[1:])
+
+	e.channel = nil
+	e.sePrefix = nil
+	e.seUri = ""
+	e.hasSeUri = false
+	e.lastEvent = -1
+	// Note: cbuffer is kept as is, its contents are only read up to the
+	// length of the current characters
+
+	return nil
+}
+
+// FreezeGrammars calls StopLearning on the grammars of all elements seen so
+// far and on the grammars of the open elements. Events covered by productions
+// learned before are encoded as usual, other events use undeclared
+// productions from then on. As with the grammar learning limits of the EXI
+// profile, frozen grammars still add ghost productions the decoder learns as
+// well, so the stream remains decodable by any EXI decoder. Grammars of
+// elements that first occur after freezing keep learning.
+func (e *AbstractEXIBodyEncoder) FreezeGrammars() {
+	for _, se := range e.runtimeGlobalElements {
+		stg := se.GetGrammar()
+		stg.StopLearning()
+		stg.GetElementContentGrammar().StopLearning()
+	}
+	for i := 0; i <= e.elementContextStackIndex; i++ {
+		if ec := e.elementContextStack[i]; ec != nil && ec.gr != nil {
+			ec.gr.StopLearning()
+		}
+	}
+}
+
+func (e *AbstractEXIBodyEncoder) SetCollectingStats(collect bool) {
+	if !collect {
+		e.stats = nil
+	} else if e.stats == nil {
+		e.stats = map[utils.QName]*ValueStats{}
+	}
+}
+
+func (e *AbstractEXIBodyEncoder) Stats() map[utils.QName]*ValueStats {
+	return e.stats
+}
+
+func (e *AbstractEXIBodyEncoder) SetGrammarBudgetExhaustedHandler(handler func()) {
+	e.budgetExhaustedHandler = handler
+}
+
+func (e *AbstractEXIBodyEncoder) GetStringTableStats() StringTableStats {
+	return e.stringEncoder.Stats()
+}
+
+// Writes the value last validated by typeEncoder and records its encoded
+// size for qnc if collecting stats is enabled.
+func (e *AbstractEXIBodyEncoder) writeValue(typeEncoder TypeEncoder, qnc *QNameContext) error {
+	if e.stats == nil {
+		return typeEncoder.WriteValue(qnc, e.channel, e.stringEncoder)
+	}
+
+	start := e.bitPosition()
+	if err := typeEncoder.WriteValue(qnc, e.channel, e.stringEncoder); err != nil {
+		return err
+	}
+	qname := qnc.GetQName()
+	stats, exists := e.stats[qname]
+	if !exists {
+		stats = &ValueStats{}
+		e.stats[qname] = stats
+	}
+	stats.add(e.bitPosition() - start)
 
 	return nil
 }
 
+// Returns the number of bits written to the channel so far.
+func (e *AbstractEXIBodyEncoder) bitPosition() int {
+	if channel, ok := e.channel.(*BitEncoderChannel); ok {
+		return channel.GetLength()*BitsInByte + channel.GetWriter().GetBitsInByffer()
+	}
+	return e.channel.GetLength() * BitsInByte
+}
+
 func (e *AbstractEXIBodyEncoder) encodeQName(namespaceURI, localName string, channel EncoderChannel) (*QNameContext, error) {
 	// uri
 	ruc, err := e.encodeURI(namespaceURI, channel)
@@ -1708,6 +2395,7 @@ func (e *AbstractEXIBodyEncoder) encodeQNamePrefix(qnc *QNameContext, prefix *st
 		// default namespace --> DEFAULT_NS_PREFIX
 	} else {
 		ruc := e.GetURIByNamespaceID(namespaceUriID)
+		prefix = e.encodedPrefix(ruc, prefix)
 		numberOfPrefixes := ruc.GetNumberOfPrefixes()
 
 		switch numberOfPrefixes {
@@ -1743,7 +2431,7 @@ func (e *AbstractEXIBodyEncoder) encodeLocalName(localName string, ruc *RuntimeU
 		// string value was not found in local partition
 		// ==> string literal is encoded as a String
 		// with the length of the string incremented by one
-		if err := channel.EncodeUnsignedInteger(len(localName) + 1); err != nil {
+		if err := channel.EncodeUnsignedInteger(utf8.RuneCountInString(localName) + 1); err != nil {
 			return nil, err
 		}
 		if err := channel.EncodeStringOnly(localName); err != nil {
@@ -1752,7 +2440,11 @@ func (e *AbstractEXIBodyEncoder) encodeLocalName(localName string, ruc *RuntimeU
 		// After encoding the string value, it is added to the string
 		// table partition and assigned the next available compact
 		// identifier.
-		qnc = ruc.AddQNameContext(localName)
+		tmp, err := ruc.addQNameContext(e.arena, localName)
+		if err != nil {
+			return nil, err
+		}
+		qnc = tmp
 	} else {
 		// string value found in local partition
 		// ==> string value is represented as zero (0) encoded as an
@@ -1771,7 +2463,27 @@ func (e *AbstractEXIBodyEncoder) encodeLocalName(localName string, ruc *RuntimeU
 	return qnc, nil
 }
 
+// encodedPrefix returns the prefix written for ruc. Prefixes of namespaces
+// not listed by EXIFactory.SetPrefixPreservationNamespaces are replaced by
+// the default prefix "ns" + namespace URI ID. Empty prefixes and prefixes of
+// the XML namespace are always kept.
+func (e *AbstractEXIBodyEncoder) encodedPrefix(ruc *RuntimeUriContext, prefix *string) *string {
+	if e.prefixNamespaces == nil || prefix == nil || *prefix == "" || ruc.GetNamespaceUri() == XML_NS_URI {
+		return prefix
+	}
+	if _, ok := e.prefixNamespaces[ruc.GetNamespaceUri()]; ok {
+		return prefix
+	}
+	return utils.AsPtr("ns" + strconv.Itoa(ruc.GetNamespaceUriID()))
+}
+
 func (e *AbstractEXIBodyEncoder) encodeNamespacePrefix(ruc *RuntimeUriContext, prefix *string, channel EncoderChannel) error {
+	if prefix == nil {
+		e.emitWarning(MisuseOfPreservePrefixes)
+		// Note: fall back to the default prefix
+		prefix = utils.AsPtr(XMLDefaultNSPrefix)
+	}
+	prefix = e.encodedPrefix(ruc, prefix)
 	nPfx := utils.GetCodingLength(ruc.GetNumberOfPrefixes() + 1)
 	pfxID := ruc.getPrefixID(*prefix)
 
@@ -1782,11 +2494,13 @@ func (e *AbstractEXIBodyEncoder) encodeNamespacePrefix(ruc *RuntimeUriContext, p
 		if err := channel.EncodeNBitUnsignedInteger(0, nPfx); err != nil {
 			return err
 		}
-		if err := channel.EncodeStringOnly(*prefix); err != nil {
+		if err := channel.EncodeString(*prefix); err != nil {
 			return err
 		}
 		// after encoding string value is added to table
-		ruc.addPrefix(*prefix)
+		if err := ruc.addPrefix(*prefix); err != nil {
+			return err
+		}
 	} else {
 		// string value found
 		// ==> value(i+1) is encoded as n-bit unsigned integer
@@ -1798,7 +2512,11 @@ func (e *AbstractEXIBodyEncoder) encodeNamespacePrefix(ruc *RuntimeUriContext, p
 	return nil
 }
 
-func (e *AbstractEXIBodyEncoder) Flush() error {
+func (e *AbstractEXIBodyEncoder) SetOutput(writer io.Writer) error {
+	return e.EXIBodyEncoder.SetOutputStream(bufio.NewWriter(writer))
+}
+
+func (e *AbstractEXIBodyEncoder) Flush() error {
 	return e.channel.Flush()
 }
 
@@ -1887,6 +2605,10 @@ func (e *AbstractEXIBodyEncoder) EncodeStartDocument() error {
 	e.updateCurrentRule(ei.GetNextGrammar())
 	e.lastEvent = EventTypeStartDocument
 
+	if e.exiFactory.IsFidelityMismatchDetection() {
+		return e.channel.EncodeNBitUnsignedInteger(e.fidelityOptions.getMarker(), fidelityMarkerBits)
+	}
+
 	return nil
 }
 
@@ -1895,6 +2617,12 @@ func (e *AbstractEXIBodyEncoder) EncodeEndDocument() error {
 		fmt.Printf("[DEBUG] EncodeEndDocument\n")
 	}
 
+	// Note: pending characters are thus outside of the root element and get
+	// rejected by checkPendingCharacters unless they are whitespace
+	if e.elementContextStackIndex > 0 {
+		return fmt.Errorf("end document with %d unclosed element(s), innermost element: %s", e.elementContextStackIndex, e.getElementContext().GetQNameAsString(e.preservePrefix))
+	}
+
 	if err := e.checkPendingCharacters(EventTypeEndDocument); err != nil {
 		return err
 	}
@@ -1919,7 +2647,7 @@ func (e *AbstractEXIBodyEncoder) EncodeStartElementByQName(se utils.QName) error
 		fmt.Printf("[DEBUG] EncodeStartElementByQName, se: %+v\n", se)
 	}
 
-	return e.EncodeStartElement(se.Space, se.Local, se.Prefix)
+	return e.EXIBodyEncoder.EncodeStartElement(se.Space, se.Local, se.Prefix)
 }
 
 func (e *AbstractEXIBodyEncoder) EncodeStartElement(uri, localName string, prefix *string) error {
@@ -1931,8 +2659,13 @@ func (e *AbstractEXIBodyEncoder) EncodeStartElement(uri, localName string, prefi
 		return err
 	}
 
-	e.sePrefix = prefix
-	e.seUri = &uri
+	// Note: copy values, the caller may re-use the prefix variable
+	e.sePrefix = nil
+	if prefix != nil {
+		e.sePrefix = utils.AsPtr(*prefix)
+	}
+	e.seUri = uri
+	e.hasSeUri = true
 
 	var ei Production
 	var updContextRule Grammar
@@ -2064,7 +2797,9 @@ func (e *AbstractEXIBodyEncoder) EncodeStartElement(uri, localName string, prefi
 		}
 	}
 
-	e.pushElement(updContextRule, nextSE)
+	if err := e.pushElement(updContextRule, nextSE); err != nil {
+		return err
+	}
 	e.lastEvent = EventTypeStartElement
 
 	return nil
@@ -2113,6 +2848,13 @@ func (e *AbstractEXIBodyEncoder) limitGrammars() ProfileDisablingMechanism {
 		}
 	}
 
+	if retVal != ProfileDisablingMechanismNone && !e.budgetExhausted {
+		e.budgetExhausted = true
+		if e.budgetExhaustedHandler != nil {
+			e.budgetExhaustedHandler()
+		}
+	}
+
 	return retVal
 }
 
@@ -2144,6 +2886,14 @@ func (e *AbstractEXIBodyEncoder) EncodeNamespaceDeclaration(uri string, prefix *
 	e.declarePrefix(prefix, uri)
 
 	if e.preservePrefix {
+		// Canonical EXI: namespace declarations MUST be sorted
+		// lexicographically according to the NS prefix
+		pfx := utils.AsValue(prefix)
+		if e.isCanonical && e.lastEvent == EventTypeNamespaceDeclaration && e.lastPrefix > pfx {
+			return fmt.Errorf("canonical EXI requires sorted namespace declarations, prefix '%s' follows '%s'", pfx, e.lastPrefix)
+		}
+		e.lastPrefix = pfx
+
 		// event code
 		currentGrammar := e.getCurrentGrammar()
 		ec2 := e.fidelityOptions.Get2ndLevelEventCode(EventTypeNamespaceDeclaration, currentGrammar)
@@ -2169,11 +2919,11 @@ func (e *AbstractEXIBodyEncoder) EncodeNamespaceDeclaration(uri string, prefix *
 			// the prefix was not properly reported
 			e.emitWarning(MisuseOfPreservePrefixes)
 			// try to fix that issue by checking URI
-			if err := e.channel.EncodeBoolean(e.seUri != nil && *e.seUri == uri); err != nil {
+			if err := e.channel.EncodeBoolean(e.hasSeUri && e.seUri == uri); err != nil {
 				return err
 			}
 		} else {
-			if err := e.channel.EncodeBoolean(*prefix == *e.sePrefix); err != nil {
+			if err := e.channel.EncodeBoolean(prefix != nil && *prefix == *e.sePrefix); err != nil {
 				return err
 			}
 		}
@@ -2272,32 +3022,40 @@ func (e *AbstractEXIBodyEncoder) EncodeEndElement() error {
 	return nil
 }
 
+// Note: events are dispatched through EXIBodyEncoder so that encoders
+// wrapping this one (e.g., self-contained elements) receive them
 func (e *AbstractEXIBodyEncoder) EncodeAttributeList(attributes AttributeList) error {
+	if e.preservePrefix && e.encodingOptions.IsOptionEnabled(OptionRequirePrefixes) {
+		if err := checkAttributeListPrefixes(attributes); err != nil {
+			return err
+		}
+	}
+
 	// 1. NS
 	for i := range attributes.GetNumberOfNamespaceDeclarations() {
 		ns := attributes.GetNamespaceDeclaration(i)
-		if err := e.EncodeNamespaceDeclaration(ns.NamespaceURI, ns.Prefix); err != nil {
+		if err := e.EXIBodyEncoder.EncodeNamespaceDeclaration(ns.NamespaceURI, ns.Prefix); err != nil {
 			return err
 		}
 	}
 
 	// 2. XSI-Type
 	if attributes.HasXsiType() {
-		if err := e.EncodeAttributeXsiType(NewStringValueFromString(*attributes.GetXsiTypeRaw()), attributes.GetXsiTypePrefix()); err != nil {
+		if err := e.EXIBodyEncoder.EncodeAttributeXsiType(NewStringValueFromString(*attributes.GetXsiTypeRaw()), attributes.GetXsiTypePrefix()); err != nil {
 			return err
 		}
 	}
 
 	// 2. XSI-Nil
 	if attributes.HasXsiNil() {
-		if err := e.EncodeAttributeXsiNil(NewStringValueFromString(*attributes.GetXsiNil()), attributes.GetXsiNilPrefix()); err != nil {
+		if err := e.EXIBodyEncoder.EncodeAttributeXsiNil(NewStringValueFromString(*attributes.GetXsiNil()), attributes.GetXsiNilPrefix()); err != nil {
 			return err
 		}
 	}
 
 	// 4. Remaining Attributes
-	for i := range attributes.GetNumberOfAttributes() {
-		if err := e.EncodeAttribute(*attributes.GetAttributeURI(i), *attributes.GetAttributeLocalName(i),
+	for _, i := range e.attributeOrder(attributes) {
+		if err := e.EXIBodyEncoder.EncodeAttribute(*attributes.GetAttributeURI(i), *attributes.GetAttributeLocalName(i),
 			attributes.GetAttributePrefix(i), NewStringValueFromString(*attributes.GetAttributeValue(i))); err != nil {
 			return err
 		}
@@ -2306,6 +3064,79 @@ func (e *AbstractEXIBodyEncoder) EncodeAttributeList(attributes AttributeList) e
 	return nil
 }
 
+// attributeOrder returns the indices of the remaining attributes in the order
+// they are encoded. With OptionSchemaOrderAttributes and a schema-informed
+// current grammar, attributes follow the declared attribute productions, so
+// none of them falls back to generic productions because of list order.
+func (e *AbstractEXIBodyEncoder) attributeOrder(attributes AttributeList) []int {
+	pending := make([]int, attributes.GetNumberOfAttributes())
+	for i := range pending {
+		pending[i] = i
+	}
+
+	g := e.getCurrentGrammar()
+	if !e.encodingOptions.IsOptionEnabled(OptionSchemaOrderAttributes) || g == nil || !g.IsSchemaInformed() {
+		return pending
+	}
+
+	order := make([]int, 0, len(pending))
+	for g != nil && len(pending) > 0 {
+		// the pending attribute with the first declared production
+		next := -1
+		var ei Production
+		for j, i := range pending {
+			p := g.GetAttributeProduction(*attributes.GetAttributeURI(i), *attributes.GetAttributeLocalName(i))
+			if p != nil && (ei == nil || p.GetEventCode() < ei.GetEventCode()) {
+				next, ei = j, p
+			}
+		}
+		if ei == nil {
+			break
+		}
+		order = append(order, pending[next])
+		pending = slices.Delete(pending, next, next+1)
+		g = ei.GetNextGrammar()
+	}
+
+	return append(order, pending...)
+}
+
+func (e *AbstractEXIBodyEncoder) SetPreserveWhitespace(preserve bool) {
+	// same as xml:space, reverted by EncodeEndElement
+	e.isXMLSpacePreserve = preserve
+	e.getElementContext().SetXMLSpacePreserve(utils.AsPtr(preserve))
+}
+
+// checkAttributeListPrefixes fails for namespace declarations without prefix
+// and for attributes in a namespace without prefix, see
+// OptionRequirePrefixes.
+func checkAttributeListPrefixes(attributes AttributeList) error {
+	for i := range attributes.GetNumberOfNamespaceDeclarations() {
+		ns := attributes.GetNamespaceDeclaration(i)
+		if ns.Prefix == nil {
+			return fmt.Errorf("namespace declaration of '%s' lacks a prefix", ns.NamespaceURI)
+		}
+	}
+
+	lacksPrefix := func(uri string, prefix *string) bool {
+		return uri != XMLNullNS_URI && (prefix == nil || *prefix == XMLDefaultNSPrefix)
+	}
+	if attributes.HasXsiType() && lacksPrefix(XMLSchemaInstanceNS_URI, attributes.GetXsiTypePrefix()) {
+		return fmt.Errorf("attribute {%s}%s lacks a prefix", XMLSchemaInstanceNS_URI, XSIType)
+	}
+	if attributes.HasXsiNil() && lacksPrefix(XMLSchemaInstanceNS_URI, attributes.GetXsiNilPrefix()) {
+		return fmt.Errorf("attribute {%s}%s lacks a prefix", XMLSchemaInstanceNS_URI, XSINil)
+	}
+	for i := range attributes.GetNumberOfAttributes() {
+		uri := *attributes.GetAttributeURI(i)
+		if lacksPrefix(uri, attributes.GetAttributePrefix(i)) {
+			return fmt.Errorf("attribute {%s}%s lacks a prefix", uri, *attributes.GetAttributeLocalName(i))
+		}
+	}
+
+	return nil
+}
+
 func (e *AbstractEXIBodyEncoder) EncodeAttributeXsiType(kind Value, pfx *string) error {
 	if e.debug {
 		fmt.Printf("[DEBUG] EncodeAttributeXsiType, kind: %+v, pfx: %s\n", kind, utils.AsValue(pfx))
@@ -2359,7 +3190,7 @@ func (e *AbstractEXIBodyEncoder) encodeAttributeXsiTypeWithForce2ndLP(kind Value
 	ec2 := e.fidelityOptions.Get2ndLevelEventCode(EventTypeAttributeXsiType, currentGrammar)
 
 	if ec2 != NotFound {
-		if e.fidelityOptions.Get2ndLevelEventType(ec2, currentGrammar) == EventTypeAttributeXsiType {
+		if e.fidelityOptions.Get2ndLevelEventType(ec2, currentGrammar) != EventTypeAttributeXsiType {
 			return errors.New("2nd level event code do not match event type EventTypeAttributeXsiType")
 		}
 
@@ -2456,7 +3287,7 @@ func (e *AbstractEXIBodyEncoder) encodeAttributeXsiTypeWithForce2ndLP(kind Value
 		if _, err := e.typeEncoder.IsValid(BuiltInGetDefaultDatatype(), kind); err != nil {
 			return err
 		}
-		if err := e.typeEncoder.WriteValue(e.getXsiTypeContext(), e.channel, e.stringEncoder); err != nil {
+		if err := e.writeValue(e.typeEncoder, e.getXsiTypeContext()); err != nil {
 			return err
 		}
 
@@ -2546,7 +3377,7 @@ func (e *AbstractEXIBodyEncoder) EncodeAttributeXsiNil(nilValue Value, pfx *stri
 					if _, err := e.typeEncoder.IsValid(e.booleanDatatype, nilValue); err != nil {
 						return err
 					}
-					if err := e.typeEncoder.WriteValue(e.getXsiTypeContext(), e.channel, e.stringEncoder); err != nil {
+					if err := e.writeValue(e.typeEncoder, e.getXsiTypeContext()); err != nil {
 						return err
 					}
 				} else {
@@ -2590,7 +3421,7 @@ func (e *AbstractEXIBodyEncoder) EncodeAttributeXsiNil(nilValue Value, pfx *stri
 						if _, err := e.typeEncoder.IsValid(e.booleanDatatype, nilValue); err != nil {
 							return err
 						}
-						if err := e.typeEncoder.WriteValue(e.getXsiNilContext(), e.channel, e.stringEncoder); err != nil {
+						if err := e.writeValue(e.typeEncoder, e.getXsiNilContext()); err != nil {
 							return err
 						}
 					} else {
@@ -2658,6 +3489,10 @@ func (e *AbstractEXIBodyEncoder) encodeSchemaInvalidAttributeEventCode(eventCode
 	currentGrammar := e.getCurrentGrammar()
 	// schema-invalid AT
 	ec2ATDeviated := e.fidelityOptions.Get2ndLevelEventCode(EventTypeAttributeInvalidValue, currentGrammar)
+	if ec2ATDeviated == NotFound {
+		// e.g. strict
+		return errors.New("schema-invalid attribute value cannot be encoded")
+	}
 	if err := e.encode2ndLevelEventCode(ec2ATDeviated); err != nil {
 		return err
 	}
@@ -2677,7 +3512,7 @@ func (e *AbstractEXIBodyEncoder) EncodeAttributeByQName(at utils.QName, value Va
 		fmt.Printf("[DEBUG] EncodeAttributeByQName, at: %+v, value: %+v\n", at, value)
 	}
 
-	return e.EncodeAttribute(at.Space, at.Local, at.Prefix, value)
+	return e.EXIBodyEncoder.EncodeAttribute(at.Space, at.Local, at.Prefix, value)
 }
 
 func (e *AbstractEXIBodyEncoder) EncodeAttribute(uri, localName string, prefix *string, value Value) error {
@@ -2685,6 +3520,14 @@ func (e *AbstractEXIBodyEncoder) EncodeAttribute(uri, localName string, prefix *
 		fmt.Printf("[DEBUG] EncodeAttribute, uri: %s, localName: %s, prefix: %s, value: %+v\n", uri, localName, utils.AsValue(prefix), value)
 	}
 
+	// Canonical EXI: attributes MUST be sorted lexicographically, first by
+	// local-name then by URI
+	if e.isCanonical && e.lastEvent == EventTypeAttribute {
+		if c := strings.Compare(e.lastAttributeLocal, localName); c > 0 || c == 0 && e.lastAttributeURI > uri {
+			return fmt.Errorf("canonical EXI requires sorted attributes, {%s}%s follows {%s}%s", uri, localName, e.lastAttributeURI, e.lastAttributeLocal)
+		}
+	}
+
 	var ei Production
 	var qnc *QNameContext
 	var next Grammar
@@ -2879,6 +3722,8 @@ func (e *AbstractEXIBodyEncoder) EncodeAttribute(uri, localName string, prefix *
 		}
 	}
 
+	e.lastAttributeURI = uri
+	e.lastAttributeLocal = localName
 	e.lastEvent = EventTypeAttribute
 
 	return nil
@@ -2997,8 +3842,9 @@ func (e *AbstractEXIBodyEncoder) replace(runes []rune, len int) {
 	}
 }
 
+// shiftLeft removes the rune at pos from the first len runes.
 func (e *AbstractEXIBodyEncoder) shiftLeft(runes []rune, pos, len int) {
-	copy(runes[pos:], runes[pos+1:pos+len])
+	copy(runes[pos:len], runes[pos+1:len])
 }
 
 func (e *AbstractEXIBodyEncoder) collapse(runes []rune, len int) int {
@@ -3019,7 +3865,7 @@ func (e *AbstractEXIBodyEncoder) collapse(runes []rune, len int) int {
 
 			if thisRune == ' ' && nextRune == ' ' {
 				// eliminate one space
-				e.shiftLeft(runes, i, newLen-1)
+				e.shiftLeft(runes, i, newLen)
 				newLen--
 			} else {
 				i++
@@ -3056,7 +3902,7 @@ func (e *AbstractEXIBodyEncoder) trimSpaces(runes []rune, len int) int {
 
 // EXI spec (section 4.3.3) and XML define whitespace strictly as space/tab/cr/lf.
 func (e *AbstractEXIBodyEncoder) isWS(r rune) bool {
-	return r == ' ' || r == '\n' || r == '\r' || r == 't'
+	return r == ' ' || r == '\n' || r == '\r' || r == '\t'
 }
 
 func (e *AbstractEXIBodyEncoder) isSolelyWS(runes []rune, length int) bool {
@@ -3127,7 +3973,9 @@ func (e *AbstractEXIBodyEncoder) checkPendingCharacters(nextEvent EventType) err
 	if numberOfValues > 0 {
 		if numberOfValues == 1 && e.bChars[0].GetValueType() != ValueTypeString {
 			// typed data uses its own whitespace rules
-			return e.encodeCharactersForce(e.bChars[0])
+			err := e.encodeCharactersForce(e.bChars[0])
+			e.bChars = []Value{}
+			return err
 		} else {
 			// else: string or multiple typed values
 			ws, ok := e.getDatatypeWhiteSpace()
@@ -3150,6 +3998,14 @@ func (e *AbstractEXIBodyEncoder) checkPendingCharacters(nextEvent EventType) err
 					// and leading and trailing #x20's are removed.
 					e.replace(e.cbuffer, cbufLen)
 					cbufLen = e.collapse(e.cbuffer, cbufLen)
+				} else if currentGrammar := e.getCurrentGrammar(); currentGrammar.IsSchemaInformed() {
+					// schema-informed complex data
+					// Whitespace is character data in mixed content only,
+					// element-only content never holds simple data.
+					mixed := currentGrammar.GetProduction(EventTypeCharacters) != nil || currentGrammar.GetProduction(EventTypeCharactersGeneric) != nil
+					if !mixed && e.isSolelyWS(e.cbuffer, cbufLen) {
+						cbufLen = 0
+					}
 				} else {
 					// schema-less, no datatype
 					// https://lists.w3.org/Archives/Public/public-exi/2015Oct/0008.html
@@ -3231,7 +4087,7 @@ func (e *AbstractEXIBodyEncoder) encodeCharactersForce(chars Value) error {
 
 	if ei != nil {
 		// valid value and valid event-code ?
-		valid, err := e.isTypeValid((ei.GetEvent().(DatatypeEvent)).GetDatatype(), chars)
+		valid, err := e.isTypeValid(e.charactersDatatype((ei.GetEvent().(DatatypeEvent)).GetDatatype()), chars)
 		if err != nil {
 			return err
 		}
@@ -3262,7 +4118,7 @@ func (e *AbstractEXIBodyEncoder) encodeCharactersForce(chars Value) error {
 			return err
 		}
 		// encode schema-invalid content as string
-		if _, err := e.isTypeValid(BuiltInGetDefaultDatatype(), chars); err != nil {
+		if _, err := e.isTypeValid(e.charactersDatatype(BuiltInGetDefaultDatatype()), chars); err != nil {
 			return err
 		}
 		//TODO: Check!!!
@@ -3276,24 +4132,18 @@ func (e *AbstractEXIBodyEncoder) encodeCharactersForce(chars Value) error {
 		ecCHUndeclared := e.fidelityOptions.Get2ndLevelEventCode(EventTypeCharactersGenericUndeclared, currentGrammar)
 
 		if ecCHUndeclared == NotFound {
+			charsS, err := chars.ToString()
+			if err != nil {
+				return err
+			}
+
 			if e.exiFactory.IsFragment() {
 				// characters in "outer" fragment element
 				e.emitWarning("skip ch")
-			} else if !e.isXMLSpacePreserve && e.fidelityOptions.IsStrict() {
-				charsS, err := chars.ToString()
-				if err != nil {
-					return err
-				}
-				if len(strings.TrimSpace(charsS)) == 0 {
-					e.emitWarning("skip ch: " + charsS)
-				}
+			} else if !e.isXMLSpacePreserve && e.fidelityOptions.IsStrict() && len(strings.TrimSpace(charsS)) == 0 {
+				e.emitWarning("skip ch: " + charsS)
 			} else {
-				charsS, err := chars.ToString()
-				if err != nil {
-					return err
-				}
-
-				return fmt.Errorf("characters cannot be encoded: %+v", []rune(charsS))
+				return fmt.Errorf("characters cannot be encoded: %q", charsS)
 			}
 		} else {
 			var updContextRule Grammar
@@ -3329,7 +4179,7 @@ func (e *AbstractEXIBodyEncoder) encodeCharactersForce(chars Value) error {
 			}
 
 			// content as string
-			if _, err := e.isTypeValid(BuiltInGetDefaultDatatype(), chars); err != nil {
+			if _, err := e.isTypeValid(e.charactersDatatype(BuiltInGetDefaultDatatype()), chars); err != nil {
 				return err
 			}
 			//TODO: Check!!!
@@ -3537,6 +4387,10 @@ func (d *EXIStreamDecoderImpl) DecodeHeader(reader *bufio.Reader) (EXIBodyDecode
 	return d.exiBody, nil
 }
 
+func (d *EXIStreamDecoderImpl) HeaderBitLength() int {
+	return d.exiHeader.HeaderBitLength()
+}
+
 /*
 	EXIStreamEncoderImpl implementation
 */
@@ -3574,8 +4428,7 @@ func (e *EXIStreamEncoderImpl) EncodeHeader(writer *bufio.Writer) (EXIBodyEncode
 			return nil, err
 		}
 	} else {
-		channel := NewByteEncoderChannel(writer)
-		if err := e.exiBody.SetOutputChannel(channel); err != nil {
+		if err := e.exiBody.SetOutputStream(writer); err != nil {
 			return nil, err
 		}
 	}
@@ -3583,12 +4436,17 @@ func (e *EXIStreamEncoderImpl) EncodeHeader(writer *bufio.Writer) (EXIBodyEncode
 	return e.exiBody, nil
 }
 
+func (e *EXIStreamEncoderImpl) HeaderBitLength() int {
+	return e.exiHeader.HeaderBitLength()
+}
+
 /*
 	EXIBodyDecoderInOrder implementation
 */
 
 type EXIBodyDecoderInOrder struct {
 	*AbstractEXIBodyDecoder
+	recovery *recoveryInput // input since the last recovery position
 }
 
 func NewEXIBodyDecoderInOrder(exiFactory EXIFactory) (*EXIBodyDecoderInOrder, error) {
@@ -3599,6 +4457,7 @@ func NewEXIBodyDecoderInOrder(exiFactory EXIFactory) (*EXIBodyDecoderInOrder, er
 
 	return &EXIBodyDecoderInOrder{
 		AbstractEXIBodyDecoder: abd,
+		recovery:               nil,
 	}, nil
 }
 
@@ -3609,6 +4468,10 @@ func (d *EXIBodyDecoderInOrder) SetInputStream(reader *bufio.Reader) error {
 	return d.InitForEachRun()
 }
 
+func (d *EXIBodyDecoderInOrder) SetInput(reader io.Reader) error {
+	return d.SetInputStream(bufio.NewReader(reader))
+}
+
 func (d *EXIBodyDecoderInOrder) SetInputChannel(channel DecoderChannel) error {
 	if err := d.UpdateInputChannel(channel); err != nil {
 		return err
@@ -3639,6 +4502,7 @@ func (d *EXIBodyDecoderInOrder) UpdateInputStream(reader *bufio.Reader) error {
 }
 
 func (d *EXIBodyDecoderInOrder) UpdateInputChannel(channel DecoderChannel) error {
+	channel.SetMaxIntegerDigits(d.exiFactory.GetMaxIntegerDigits())
 	d.channel = channel
 	return nil
 }
@@ -3654,6 +4518,7 @@ func (d *EXIBodyDecoderInOrder) InitForEachRun() error {
 
 	d.nextEvent = nil
 	d.nextEventType = EventTypeStartDocument
+	d.recovery = nil
 
 	return nil
 }
@@ -3666,6 +4531,17 @@ func (d *EXIBodyDecoderInOrder) Next() (EventType, bool, error) {
 		if err != nil {
 			return -1, false, err
 		}
+		if d.recovery != nil {
+			if d.nextEvent == nil {
+				// Note: 2nd and 3rd level events while recovering likely stem
+				// from corrupt input and would learn from it
+				return -1, false, fmt.Errorf("implausible event while recovering: %s", ec)
+			}
+			if d.recovery.decoded {
+				// recovered element and next event decoded, recovery succeeded
+				d.recovery = nil
+			}
+		}
 		return ec, true, nil
 	}
 }
@@ -3689,7 +4565,7 @@ func (d *EXIBodyDecoderInOrder) DecodeStartElement() (*QNameContext, error) {
 	case EventTypeStartElementGenericUndeclared:
 		return d.decodeStartElementGenericUndeclaredStructure()
 	default:
-		return nil, fmt.Errorf("invalid decode state: %d", d.nextEventType)
+		return nil, fmt.Errorf("invalid decode state: %s", d.nextEventType)
 	}
 }
 
@@ -3701,6 +4577,10 @@ func (d *EXIBodyDecoderInOrder) GetElementQNameAsString() string {
 	return d.getElementContext().GetQNameAsString(d.preservePrefix)
 }
 
+func (d *EXIBodyDecoderInOrder) GetElementQNameContext() *QNameContext {
+	return d.getElementContext().qnc
+}
+
 func (d *EXIBodyDecoderInOrder) DecodeEndElement() (*QNameContext, error) {
 	var ec *ElementContext
 	var err error
@@ -3716,7 +4596,11 @@ func (d *EXIBodyDecoderInOrder) DecodeEndElement() (*QNameContext, error) {
 			return nil, err
 		}
 	default:
-		return nil, fmt.Errorf("invalid decode state: %d", d.nextEventType)
+		return nil, fmt.Errorf("invalid decode state: %s", d.nextEventType)
+	}
+
+	if d.recovery != nil && d.elementContextStackIndex <= d.recovery.level {
+		d.recovery.decoded = true
 	}
 
 	return ec.qnc, nil
@@ -3746,7 +4630,7 @@ func (d *EXIBodyDecoderInOrder) DecodeAttributeXsiType() (*QNameContext, error)
 }
 
 func (d *EXIBodyDecoderInOrder) readAttributeContentWithDatatype(dt Datatype) error {
-	value, err := d.typeDecoder.ReadValue(dt, d.attributeQNameContext, d.channel, d.stringDecoder)
+	value, err := d.surfaceValue(d.readValue(d.typeDecoder, dt, d.attributeQNameContext))
 	if err != nil {
 		return err
 	}
@@ -3761,7 +4645,10 @@ func (d *EXIBodyDecoderInOrder) readAttributeContent() error {
 			if err := d.decodeAttributeXsiTypeStructure(); err != nil {
 				return err
 			}
-		} else if localNameID == d.getXsiTypeContext().GetLocalNameID() && d.getCurrentGrammar().IsSchemaInformed() { //TODO: Weird condition. XSI:NIL?
+		} else if localNameID == d.getXsiNilContext().GetLocalNameID() && d.getCurrentGrammar().IsSchemaInformed() {
+			// Note: schema-informed grammars encode xsi:nil as boolean even
+			// if represented by AT(*). Schema-less grammars have no
+			// typeEmpty to jump to, xsi:nil is an ordinary (string) attribute.
 			if err := d.decodeAttributeXsiNilStructure(); err != nil {
 				return err
 			}
@@ -3839,7 +4726,7 @@ func (d *EXIBodyDecoderInOrder) DecodeAttribute() (*QNameContext, error) {
 			return nil, err
 		}
 	default:
-		return nil, fmt.Errorf("invalid decode state: %d", d.nextEventType)
+		return nil, fmt.Errorf("invalid decode state: %s", d.nextEventType)
 	}
 
 	return d.attributeQNameContext, nil
@@ -3854,6 +4741,30 @@ func (d *EXIBodyDecoderInOrder) GetDeclaredPrefixDeclarations() []NamespaceDecla
 }
 
 func (d *EXIBodyDecoderInOrder) DecodeCharacters() (Value, error) {
+	dt, err := d.decodeCharactersDatatype()
+	if err != nil {
+		return nil, err
+	}
+	return d.surfaceValue(d.readValue(d.typeDecoder, dt, d.getElementContext().qnc))
+}
+
+func (d *EXIBodyDecoderInOrder) DecodeCharactersTo(w io.Writer) (Value, error) {
+	dt, err := d.decodeCharactersDatatype()
+	if err != nil {
+		return nil, err
+	}
+	if bd, ok := d.typeDecoder.(binaryTypeDecoder); ok {
+		copied, err := bd.ReadBinaryValueTo(dt, d.channel, w)
+		if err != nil || copied {
+			return nil, err
+		}
+	}
+	return d.surfaceValue(d.readValue(d.typeDecoder, dt, d.getElementContext().qnc))
+}
+
+// decodeCharactersDatatype decodes the structure of the next characters event
+// and returns the datatype of its value.
+func (d *EXIBodyDecoderInOrder) decodeCharactersDatatype() (Datatype, error) {
 	var dt Datatype
 	var err error
 
@@ -3876,10 +4787,10 @@ func (d *EXIBodyDecoderInOrder) DecodeCharacters() (Value, error) {
 		}
 		dt = BuiltInGetDefaultDatatype()
 	default:
-		return nil, fmt.Errorf("invalid decode state: %d", d.nextEventType)
+		return nil, fmt.Errorf("invalid decode state: %s", d.nextEventType)
 	}
 
-	return d.typeDecoder.ReadValue(dt, d.getElementContext().qnc, d.channel, d.stringDecoder)
+	return d.charactersDatatype(dt), nil
 }
 
 func (d *EXIBodyDecoderInOrder) DecodeDocType() (*DocTypeContainer, error) {
@@ -3894,10 +4805,399 @@ func (d *EXIBodyDecoderInOrder) DecodeComment() ([]rune, error) {
 	return d.decodeCommentStructure()
 }
 
+func (d *EXIBodyDecoderInOrder) DecodeCommentContainer() (CommentContainer, error) {
+	text, err := d.decodeCommentStructure()
+	if err != nil {
+		return CommentContainer{}, err
+	}
+	return CommentContainer{
+		Text: string(text),
+	}, nil
+}
+
 func (d *EXIBodyDecoderInOrder) DecodeProcessingInstruction() (ProcessingInstructionContainer, error) {
 	return d.decodeProcessingInstructionStructure()
 }
 
+func (d *EXIBodyDecoderInOrder) DecodeEvent() (*DecodedEvent, bool, error) {
+	return decodeEvent(d)
+}
+
+// EventReader hands out the events of a decoder like DecodeEvent, but reads
+// each start tag as a whole first, so that its SE event carries the element
+// prefix of the start tag. Decoder accessors such as GetElementPrefix may
+// therefore be ahead of the last event handed out.
+type EventReader struct {
+	decoder EXIBodyDecoder
+	events  []DecodedEvent
+	// index of the SE event of the start tag being read, or -1
+	startElement int
+}
+
+func NewEventReader(decoder EXIBodyDecoder) *EventReader {
+	return &EventReader{
+		decoder:      decoder,
+		startElement: -1,
+	}
+}
+
+// Next returns the next event, or false after the last one.
+func (r *EventReader) Next() (*DecodedEvent, bool, error) {
+	for len(r.events) == 0 || r.startElement != -1 {
+		ev, exists, err := r.decoder.DecodeEvent()
+		if err != nil {
+			return nil, false, err
+		}
+		if !exists {
+			r.startElement = -1
+			break
+		}
+
+		switch ev.EventType {
+		case EventTypeStartElement, EventTypeStartElementNS, EventTypeStartElementGeneric, EventTypeStartElementGenericUndeclared:
+			r.startElement = len(r.events)
+		case EventTypeNamespaceDeclaration:
+			// Note: the element prefix may be determined by local-element-ns
+			if r.startElement != -1 {
+				r.events[r.startElement].Prefix = r.decoder.GetElementPrefix()
+			}
+		case EventTypeAttributeXsiNil, EventTypeAttributeXsiType, EventTypeAttribute,
+			EventTypeAttributeNS, EventTypeAttributeGeneric, EventTypeAttributeGenericUndeclared,
+			EventTypeAttributeInvalidValue, EventTypeAttributeAnyInvalidValue, EventTypeSelfContained:
+			// still in the start tag
+		default:
+			r.startElement = -1
+		}
+		r.events = append(r.events, *ev)
+	}
+
+	if len(r.events) == 0 {
+		return nil, false, nil
+	}
+	ev := r.events[0]
+	r.events = r.events[1:]
+	return &ev, true, nil
+}
+
+// DecodeToEventLog decodes all remaining events of decoder into a slice
+// that can be inspected, transformed and replayed with ReplayEventLog.
+func DecodeToEventLog(decoder EXIBodyDecoder) ([]DecodedEvent, error) {
+	log := []DecodedEvent{}
+	reader := NewEventReader(decoder)
+
+	for {
+		ev, exists, err := reader.Next()
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return log, nil
+		}
+		log = append(log, *ev)
+	}
+}
+
+// DecodeFragment decodes an EXI fragment, i.e. a stream encoded with
+// EXIFactory.SetFragment(true), and calls handle for each of its root-level
+// items in stream order: the events of a root element from SE to the
+// matching EE, or a single CM or PI event. Other than a document, a fragment
+// may hold any number of root elements (and no DOCTYPE). SD and ED are not
+// handed out, decoding stops after ED or with the first error of handle.
+//
+// decoder must be created by a fragment factory; for documents DecodeFragment
+// hands out the single root element.
+func DecodeFragment(decoder EXIBodyDecoder, handle func(events []DecodedEvent) error) error {
+	events := []DecodedEvent{}
+	depth := 0
+	reader := NewEventReader(decoder)
+
+	for {
+		ev, exists, err := reader.Next()
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return nil
+		}
+
+		switch ev.EventType {
+		case EventTypeStartDocument:
+			continue
+		case EventTypeEndDocument:
+			return nil
+		case EventTypeStartElement, EventTypeStartElementNS, EventTypeStartElementGeneric, EventTypeStartElementGenericUndeclared:
+			depth++
+		case EventTypeEndElement, EventTypeEndElementUndeclared:
+			depth--
+		}
+		events = append(events, *ev)
+
+		if depth == 0 {
+			// root element closed or root-level CM/PI
+			if err := handle(events); err != nil {
+				return err
+			}
+			events = []DecodedEvent{}
+		}
+	}
+}
+
+// ReplayEventLog encodes the events of log, as recorded by DecodeToEventLog,
+// with encoder. Flushing the encoder is left to the caller.
+func ReplayEventLog(log []DecodedEvent, encoder EXIBodyEncoder) error {
+	for i := range log {
+		ev := &log[i]
+
+		var err error
+		switch ev.EventType {
+		case EventTypeStartDocument:
+			err = encoder.EncodeStartDocument()
+		case EventTypeEndDocument:
+			err = encoder.EncodeEndDocument()
+		case EventTypeStartElement, EventTypeStartElementNS, EventTypeStartElementGeneric, EventTypeStartElementGenericUndeclared:
+			err = encoder.EncodeStartElement(ev.QNameContext.GetNamespaceUri(), ev.QNameContext.GetLocalName(), ev.Prefix)
+		case EventTypeEndElement, EventTypeEndElementUndeclared:
+			err = encoder.EncodeEndElement()
+		case EventTypeNamespaceDeclaration:
+			err = encoder.EncodeNamespaceDeclaration(ev.NamespaceDeclaration.NamespaceURI, ev.NamespaceDeclaration.Prefix)
+		case EventTypeAttributeXsiType:
+			err = encoder.EncodeAttributeXsiType(ev.Value, ev.Prefix)
+		case EventTypeAttributeXsiNil:
+			err = encoder.EncodeAttributeXsiNil(ev.Value, ev.Prefix)
+		case EventTypeAttribute,
+			EventTypeAttributeNS,
+			EventTypeAttributeGeneric,
+			EventTypeAttributeGenericUndeclared,
+			EventTypeAttributeInvalidValue,
+			EventTypeAttributeAnyInvalidValue:
+			uri, localName := ev.QNameContext.GetNamespaceUri(), ev.QNameContext.GetLocalName()
+			// Note: learned xsi:type and xsi:nil productions are reported as AT
+			if uri == XMLSchemaInstanceNS_URI && localName == XSIType {
+				err = encoder.EncodeAttributeXsiType(ev.Value, ev.Prefix)
+			} else if uri == XMLSchemaInstanceNS_URI && localName == XSINil {
+				err = encoder.EncodeAttributeXsiNil(ev.Value, ev.Prefix)
+			} else {
+				err = encoder.EncodeAttribute(uri, localName, ev.Prefix, ev.Value)
+			}
+		case EventTypeCharacters, EventTypeCharactersGeneric, EventTypeCharactersGenericUndeclared:
+			err = encoder.EncodeCharacters(ev.Value)
+		case EventTypeDocType:
+			err = encoder.EncodeDocType(string(ev.DocType.Name), string(ev.DocType.PublicID), string(ev.DocType.SystemID), string(ev.DocType.Text))
+		case EventTypeEntityReference:
+			err = encoder.EncodeEntityReference(string(ev.EntityReference))
+		case EventTypeComment:
+			ch := []rune(ev.Comment.Text)
+			err = encoder.EncodeComment(ch, 0, len(ch))
+		case EventTypeProcessingInstruction:
+			err = encoder.EncodeProcessingInstruction(ev.ProcessingInstruction.Target, ev.ProcessingInstruction.Data)
+		case EventTypeSelfContained:
+			// Note: the encoder starts self-contained elements on its own
+		default:
+			err = fmt.Errorf("unexpected EXI event: %s", ev.EventType)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *EXIBodyDecoderInOrder) NextWithContext(ctx context.Context) (EventType, bool, error) {
+	return nextWithContext(ctx, d)
+}
+
+// bytes looked at for deciding whether an element starts at a position
+const recoveryWindowSize = 16
+
+// bytes kept after a recovery position for scanning them again
+const recoveryRetentionSize = 1 << 16
+
+// recoveryInput retains the bytes read from source since a recovery position
+// so that the next recovery, e.g. after a false positive, can scan them again.
+// Recovery is on trial until the element found there and the next event
+// have been decoded.
+type recoveryInput struct {
+	source    *bufio.Reader
+	level     int // element context stack index of the found element's parent
+	decoded   bool
+	retained  []byte
+	retaining bool // stops at recoveryRetentionSize
+}
+
+func (r *recoveryInput) Write(p []byte) (int, error) {
+	if r.retaining {
+		if len(r.retained)+len(p) > recoveryRetentionSize {
+			r.retaining = false
+			r.retained = nil
+		} else {
+			r.retained = append(r.retained, p...)
+		}
+	}
+	return len(p), nil
+}
+
+func (d *EXIBodyDecoderInOrder) RecoverToNextElement() error {
+	reader, err := recoveryReader(d.channel)
+	if err != nil {
+		return err
+	}
+	if d.recovery != nil && d.recovery.retaining && len(d.recovery.retained) > 0 {
+		// Note: scan again behind the previous recovery position
+		reader = bufio.NewReader(io.MultiReader(bytes.NewReader(d.recovery.retained[1:]), d.recovery.source))
+	}
+
+	// Note: elements are resynchronized as children of the document element
+	level := 1
+	if d.exiFactory.IsFragment() {
+		level = 0
+	}
+	if d.elementContextStackIndex < level {
+		return errors.New("cannot recover before the document element")
+	}
+	for d.elementContextStackIndex > level {
+		d.popElement()
+	}
+	d.nextEvent = nil
+	d.nextGrammar = nil
+	d.nextEventType = EventTypeStartElement
+
+	for {
+		window, err := reader.Peek(recoveryWindowSize)
+		if len(window) == 0 {
+			if err == io.EOF {
+				return errors.New("no element found to recover with before end of stream")
+			}
+			return err
+		}
+		if d.isRecoveryStartElement(window) {
+			break
+		}
+		if _, err := reader.Discard(1); err != nil {
+			return err
+		}
+	}
+
+	d.recovery = &recoveryInput{
+		source:    reader,
+		level:     level,
+		decoded:   false,
+		retained:  nil,
+		retaining: true,
+	}
+	return d.UpdateInputStream(bufio.NewReader(io.TeeReader(reader, d.recovery)))
+}
+
+// isRecoveryStartElement reports whether window plausibly starts with a known
+// SE event of the current grammar followed by a 1st level event code of the
+// element's grammar. Decoding state is not changed.
+func (d *EXIBodyDecoderInOrder) isRecoveryStartElement(window []byte) bool {
+	var channel DecoderChannel
+	if d.exiFactory.GetCodingMode() == CodingModeBitPacked {
+		channel = NewBitDecoderChannel(bufio.NewReader(bytes.NewReader(window)))
+	} else {
+		channel = NewByteDecoderChannel(bufio.NewReader(bytes.NewReader(window)))
+	}
+
+	parent := d.getCurrentGrammar()
+	ec, err := channel.DecodeNBitUnsignedInteger(d.fidelityOptions.Get1stLevelEventCodeLength(parent))
+	if err != nil || ec >= parent.GetNumberOfEvents() {
+		return false
+	}
+	se, ok := parent.GetProductionByEventCode(ec).GetEvent().(*StartElement)
+	if !ok || se.GetEventType() != EventTypeStartElement {
+		return false
+	}
+
+	startTag := se.GetGrammar()
+	if startTag.GetNumberOfEvents() == 0 {
+		return true
+	}
+	ec, err = channel.DecodeNBitUnsignedInteger(d.fidelityOptions.Get1stLevelEventCodeLength(startTag))
+	return err == nil && ec < startTag.GetNumberOfEvents()
+}
+
+// nextWithContext checks ctx once per event before reading the next event
+// code of decoder.
+func nextWithContext(ctx context.Context, decoder EXIBodyDecoder) (EventType, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return -1, false, err
+	}
+	return decoder.Next()
+}
+
+// decodeEvent dispatches the next event of decoder to the matching Decode*
+// method and collects the outcome.
+func decodeEvent(decoder EXIBodyDecoder) (*DecodedEvent, bool, error) {
+	eventType, exists, err := decoder.Next()
+	if err != nil || !exists {
+		return nil, false, err
+	}
+
+	ev := &DecodedEvent{
+		EventType: eventType,
+	}
+
+	switch eventType {
+	case EventTypeStartDocument:
+		err = decoder.DecodeStartDocument()
+	case EventTypeEndDocument:
+		err = decoder.DecodeEndDocument()
+	case EventTypeAttributeXsiNil:
+		ev.QNameContext, err = decoder.DecodeAttributeXsiNil()
+	case EventTypeAttributeXsiType:
+		ev.QNameContext, err = decoder.DecodeAttributeXsiType()
+	case EventTypeAttribute,
+		EventTypeAttributeNS,
+		EventTypeAttributeGeneric,
+		EventTypeAttributeGenericUndeclared,
+		EventTypeAttributeInvalidValue,
+		EventTypeAttributeAnyInvalidValue:
+		ev.QNameContext, err = decoder.DecodeAttribute()
+	case EventTypeNamespaceDeclaration:
+		ev.NamespaceDeclaration, err = decoder.DecodeNamespaceDeclaration()
+	case EventTypeSelfContained:
+		err = decoder.DecodeStartSelfContainedFragment()
+	case EventTypeStartElement,
+		EventTypeStartElementNS,
+		EventTypeStartElementGeneric,
+		EventTypeStartElementGenericUndeclared:
+		ev.QNameContext, err = decoder.DecodeStartElement()
+		ev.Prefix = decoder.GetElementPrefix()
+	case EventTypeEndElement, EventTypeEndElementUndeclared:
+		ev.QNameContext, err = decoder.DecodeEndElement()
+	case EventTypeCharacters, EventTypeCharactersGeneric, EventTypeCharactersGenericUndeclared:
+		ev.Value, err = decoder.DecodeCharacters()
+	case EventTypeDocType:
+		ev.DocType, err = decoder.DecodeDocType()
+	case EventTypeEntityReference:
+		ev.EntityReference, err = decoder.DecodeEntityReference()
+	case EventTypeComment:
+		var com CommentContainer
+		com, err = decoder.DecodeCommentContainer()
+		ev.Comment = &com
+	case EventTypeProcessingInstruction:
+		var pi ProcessingInstructionContainer
+		pi, err = decoder.DecodeProcessingInstruction()
+		ev.ProcessingInstruction = &pi
+	default:
+		return nil, false, fmt.Errorf("unexpected EXI event: %s", eventType)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	switch eventType {
+	case EventTypeAttributeXsiNil, EventTypeAttributeXsiType, EventTypeAttribute,
+		EventTypeAttributeNS, EventTypeAttributeGeneric, EventTypeAttributeGenericUndeclared,
+		EventTypeAttributeInvalidValue, EventTypeAttributeAnyInvalidValue:
+		ev.Prefix = decoder.GetAttributePrefix()
+		ev.Value = decoder.GetAttributeValue()
+	}
+
+	return ev, true, nil
+}
+
 /*
 	EXIBodyDecoderInOrder implementation
 */
@@ -3925,16 +5225,14 @@ func (e *EXIBodyEncoderInOrder) SetOutputStream(writer *bufio.Writer) error {
 	// setup data-stream only
 	if codingMode == CodingModeBitPacked {
 		// create new bit-aligned channel
-		e.SetOutputChannel(NewBitEncoderChannel(writer))
+		return e.SetOutputChannel(NewBitEncoderChannel(writer))
 	} else {
 		if codingMode != CodingModeBytePacked {
 			return errors.New("coding mode != byte packed")
 		}
 		// create new byte-aligned channel
-		e.SetOutputChannel(NewByteEncoderChannel(writer))
+		return e.SetOutputChannel(NewByteEncoderChannel(writer))
 	}
-
-	return nil
 }
 
 func (e *EXIBodyEncoderInOrder) SetOutputChannel(channel EncoderChannel) error {
@@ -3943,7 +5241,7 @@ func (e *EXIBodyEncoderInOrder) SetOutputChannel(channel EncoderChannel) error {
 }
 
 func (e *EXIBodyEncoderInOrder) WriteValue(qnc *QNameContext) error {
-	return e.typeEncoder.WriteValue(qnc, e.channel, e.stringEncoder)
+	return e.writeValue(e.typeEncoder, qnc)
 }
 
 /*
@@ -3979,7 +5277,10 @@ func (d *EXIBodyDecoderInOrderSC) InitForEachRun() error {
 }
 
 func (d *EXIBodyDecoderInOrderSC) SkipSCElement(skip int64) error {
-	// Note: Bytes to be skipped need to be known
+	if d.scDecoder != nil {
+		return d.scDecoder.SkipSCElement(skip)
+	}
+	// Note: Bytes to be skipped need to be known, see SkipCurrentSCElement
 	if d.nextEventType != EventTypeSelfContained {
 		return errors.New("next event type is not self contained element")
 	}
@@ -3995,6 +5296,83 @@ func (d *EXIBodyDecoderInOrderSC) SkipSCElement(skip int64) error {
 	return nil
 }
 
+// SkipCurrentSCElement skips the self-contained fragment announced by the
+// next event (SC) and returns the number of bytes skipped, including the
+// padding of both byte-aligned boundaries, or -1 if the channel does not
+// count consumed bytes. The fragment is decoded to find its end, its events
+// are not reported. Decoding continues with the event following the
+// self-contained element, and the returned length can be passed to
+// SkipSCElement when the same stream is decoded again.
+func (d *EXIBodyDecoderInOrderSC) SkipCurrentSCElement() (int64, error) {
+	if d.scDecoder != nil {
+		return d.scDecoder.SkipCurrentSCElement()
+	}
+	if d.nextEventType != EventTypeSelfContained {
+		return -1, errors.New("next event type is not self contained element")
+	}
+	if err := d.channel.Align(); err != nil {
+		return -1, err
+	}
+
+	// Note: the skipped bytes are counted, not kept
+	counter, counting := d.channel.(CountingDecoderChannel)
+	start := 0
+	if counting {
+		start = counter.GetLength()
+	}
+
+	// (SD, SE(qname), content, ED) according to the Fragment grammar
+	skipper, err := d.newSCDecoder()
+	if err != nil {
+		return -1, err
+	}
+	if err := skipper.DecodeStartDocument(); err != nil {
+		return -1, err
+	}
+	for {
+		ev, exists, err := decodeEvent(skipper)
+		if err != nil {
+			return -1, err
+		}
+		if !exists {
+			return -1, errors.New("self contained element is not closed properly")
+		}
+		if ev.EventType == EventTypeEndDocument {
+			break
+		}
+	}
+	if err := d.channel.Align(); err != nil {
+		return -1, err
+	}
+
+	skipped := int64(-1)
+	if counting {
+		skipped = int64(counter.GetLength() - start)
+	}
+	d.popElement()
+	return skipped, nil
+}
+
+// newSCDecoder returns a decoder for a self-contained fragment read from the
+// channel of d.
+func (d *EXIBodyDecoderInOrderSC) newSCDecoder() (*EXIBodyDecoderInOrderSC, error) {
+	scEXIFactory := d.exiFactory.Clone()
+	scEXIFactory.SetFragment(true)
+	decoder, err := scEXIFactory.CreateEXIBodyDecoder()
+	if err != nil {
+		return nil, err
+	}
+	scDecoder := decoder.(*EXIBodyDecoderInOrderSC)
+	scDecoder.channel = d.channel
+	// the SC element is on both stacks
+	scDecoder.depthOffset = d.depthOffset + d.elementContextStackIndex - 1
+	scDecoder.SetErrorHandler(d.errorHandler)
+	if err := scDecoder.InitForEachRun(); err != nil {
+		return nil, err
+	}
+	return scDecoder, nil
+}
+
 func (d *EXIBodyDecoderInOrderSC) Next() (EventType, bool, error) {
 	if d.scDecoder == nil {
 		return d.EXIBodyDecoderInOrder.Next()
@@ -4056,18 +5434,13 @@ func (d *EXIBodyDecoderInOrderSC) DecodeStartElement() (*QNameContext, error) {
 func (d *EXIBodyDecoderInOrderSC) DecodeStartSelfContainedFragment() error {
 	if d.scDecoder == nil {
 		// SC Factory & Decoder
-		scEXIFactory := d.exiFactory.Clone()
-		scEXIFactory.SetFragment(true)
-		decoder, err := scEXIFactory.CreateEXIBodyDecoder()
+		scDecoder, err := d.newSCDecoder()
 		if err != nil {
 			return err
 		}
-		d.scDecoder = decoder.(*EXIBodyDecoderInOrderSC)
-		d.scDecoder.channel = d.channel
-		d.scDecoder.SetErrorHandler(d.errorHandler)
-		if err := d.scDecoder.InitForEachRun(); err != nil {
-			return err
-		}
+		d.scDecoder = scDecoder
+		d.scDecoder.SetGrammarLearningObserver(d.learningObserver)
+		d.scDecoder.SetRawValueObserver(d.rawValueObserver)
 
 		// Skip to the next byte-aligned boundary in the stream if it is not
 		// already at such a boundary
@@ -4093,7 +5466,7 @@ func (d *EXIBodyDecoderInOrderSC) DecodeStartSelfContainedFragment() error {
 				return err
 			}
 		default:
-			return fmt.Errorf("unsupported EventType %d in SelfContained element", et)
+			return fmt.Errorf("unsupported EventType %s in SelfContained element", et)
 		}
 	} else {
 		if err := d.scDecoder.DecodeStartSelfContainedFragment(); err != nil {
@@ -4128,6 +5501,14 @@ func (d *EXIBodyDecoderInOrderSC) GetElementQNameAsString() string {
 	}
 }
 
+func (d *EXIBodyDecoderInOrderSC) GetElementQNameContext() *QNameContext {
+	if d.scDecoder == nil {
+		return d.EXIBodyDecoderInOrder.GetElementQNameContext()
+	} else {
+		return d.scDecoder.GetElementQNameContext()
+	}
+}
+
 func (d *EXIBodyDecoderInOrderSC) DecodeAttributeXsiNil() (*QNameContext, error) {
 	if d.scDecoder == nil {
 		return d.EXIBodyDecoderInOrder.DecodeAttributeXsiNil()
@@ -4168,6 +5549,14 @@ func (d *EXIBodyDecoderInOrderSC) GetAttributeQNameAsString() string {
 	}
 }
 
+func (d *EXIBodyDecoderInOrderSC) GetAttributeQNameContext() *QNameContext {
+	if d.scDecoder == nil {
+		return d.EXIBodyDecoderInOrder.GetAttributeQNameContext()
+	} else {
+		return d.scDecoder.GetAttributeQNameContext()
+	}
+}
+
 func (d *EXIBodyDecoderInOrderSC) GetAttributeValue() Value {
 	if d.scDecoder == nil {
 		return d.EXIBodyDecoderInOrder.GetAttributeValue()
@@ -4200,9 +5589,17 @@ func (d *EXIBodyDecoderInOrderSC) DecodeCharacters() (Value, error) {
 	}
 }
 
-func (d *EXIBodyDecoderInOrderSC) DecodeDocType() (*DocTypeContainer, error) {
+func (d *EXIBodyDecoderInOrderSC) DecodeCharactersTo(w io.Writer) (Value, error) {
 	if d.scDecoder == nil {
-		return d.EXIBodyDecoderInOrder.DecodeDocType()
+		return d.EXIBodyDecoderInOrder.DecodeCharactersTo(w)
+	} else {
+		return d.scDecoder.DecodeCharactersTo(w)
+	}
+}
+
+func (d *EXIBodyDecoderInOrderSC) DecodeDocType() (*DocTypeContainer, error) {
+	if d.scDecoder == nil {
+		return d.EXIBodyDecoderInOrder.DecodeDocType()
 	} else {
 		return d.scDecoder.DecodeDocType()
 	}
@@ -4224,6 +5621,14 @@ func (d *EXIBodyDecoderInOrderSC) DecodeComment() ([]rune, error) {
 	}
 }
 
+func (d *EXIBodyDecoderInOrderSC) DecodeCommentContainer() (CommentContainer, error) {
+	if d.scDecoder == nil {
+		return d.EXIBodyDecoderInOrder.DecodeCommentContainer()
+	} else {
+		return d.scDecoder.DecodeCommentContainer()
+	}
+}
+
 func (d *EXIBodyDecoderInOrderSC) DecodeProcessingInstruction() (ProcessingInstructionContainer, error) {
 	if d.scDecoder == nil {
 		return d.EXIBodyDecoderInOrder.DecodeProcessingInstruction()
@@ -4232,6 +5637,21 @@ func (d *EXIBodyDecoderInOrderSC) DecodeProcessingInstruction() (ProcessingInstr
 	}
 }
 
+func (d *EXIBodyDecoderInOrderSC) DecodeEvent() (*DecodedEvent, bool, error) {
+	return decodeEvent(d)
+}
+
+func (d *EXIBodyDecoderInOrderSC) RecoverToNextElement() error {
+	if d.scDecoder != nil {
+		return errors.New("cannot recover within self-contained element")
+	}
+	return d.EXIBodyDecoderInOrder.RecoverToNextElement()
+}
+
+func (d *EXIBodyDecoderInOrderSC) NextWithContext(ctx context.Context) (EventType, bool, error) {
+	return nextWithContext(ctx, d)
+}
+
 /*
 	EXIBodyEncoderInOrderSC implementation
 */
@@ -4263,6 +5683,11 @@ func (e *EXIBodyEncoderInOrderSC) InitForEachRun() error {
 	return nil
 }
 
+func (e *EXIBodyEncoderInOrderSC) Reset() error {
+	e.scEncoder = nil
+	return e.EXIBodyEncoderInOrder.Reset()
+}
+
 func (e *EXIBodyEncoderInOrderSC) SetErrorHandler(errorHandler ErrorHandler) {
 	if e.scEncoder == nil {
 		e.EXIBodyEncoderInOrder.SetErrorHandler(errorHandler)
@@ -4363,6 +5788,8 @@ func (e *EXIBodyEncoderInOrderSC) encodeStartSC(uri, localName string, prefix *s
 	}
 	e.scEncoder = encoder.(*EXIBodyEncoderInOrderSC)
 	e.scEncoder.channel = e.channel
+	// the SC element is on both stacks
+	e.scEncoder.depthOffset = e.depthOffset + e.elementContextStackIndex - 1
 	e.scEncoder.SetErrorHandler(e.errorHandler)
 
 	// Evaluate the sequence of events (SD, SE(qname), content, ED)
@@ -4370,6 +5797,9 @@ func (e *EXIBodyEncoderInOrderSC) encodeStartSC(uri, localName string, prefix *s
 	if err := e.scEncoder.EncodeStartDocument(); err != nil {
 		return err
 	}
+	// values of the fragment count towards the stats of the document
+	e.scEncoder.stats = e.stats
+	e.scEncoder.budgetExhaustedHandler = e.budgetExhaustedHandler
 	// NO SC again
 	if err := e.scEncoder.encodeStartElementNoSC(uri, localName, prefix); err != nil {
 		return err
@@ -4409,6 +5839,14 @@ func (e *EXIBodyEncoderInOrderSC) EncodeEndElement() error {
 	return nil
 }
 
+func (e *EXIBodyEncoderInOrderSC) SetPreserveWhitespace(preserve bool) {
+	if e.scEncoder == nil {
+		e.EXIBodyEncoderInOrder.SetPreserveWhitespace(preserve)
+	} else {
+		e.scEncoder.SetPreserveWhitespace(preserve)
+	}
+}
+
 func (e *EXIBodyEncoderInOrderSC) EncodeAttribute(uri, localName string, prefix *string, value Value) error {
 	if e.scEncoder == nil {
 		return e.EXIBodyEncoderInOrder.EncodeAttribute(uri, localName, prefix, value)
@@ -4488,3 +5926,691 @@ func (e *EXIBodyEncoderInOrderSC) EncodeProcessingInstruction(target, data strin
 		return e.scEncoder.EncodeProcessingInstruction(target, data)
 	}
 }
+
+/*
+	Reordered value channels implementation
+*/
+
+// reorderedValue is a value of a (pre-)compression value channel together
+// with the datatype it is represented with.
+type reorderedValue struct {
+	datatype Datatype
+	value    Value
+}
+
+// reorderedChannel holds the values of one value channel within a block.
+type reorderedChannel struct {
+	qnc    *QNameContext
+	values []*reorderedValue
+}
+
+// reorderedChannels keeps the value channels of a block in the order in
+// which their first value appeared in the structure channel.
+type reorderedChannels struct {
+	channels       []*reorderedChannel
+	index          map[QNameContextMapKey]*reorderedChannel
+	numberOfValues int
+}
+
+func newReorderedChannels() *reorderedChannels {
+	return &reorderedChannels{
+		channels:       []*reorderedChannel{},
+		index:          map[QNameContextMapKey]*reorderedChannel{},
+		numberOfValues: 0,
+	}
+}
+
+func (c *reorderedChannels) add(qnc *QNameContext, value *reorderedValue) {
+	channel, exists := c.index[qnc.GetMapKey()]
+	if !exists {
+		channel = &reorderedChannel{
+			qnc:    qnc,
+			values: []*reorderedValue{},
+		}
+		c.index[qnc.GetMapKey()] = channel
+		c.channels = append(c.channels, channel)
+	}
+	channel.values = append(channel.values, value)
+	c.numberOfValues++
+}
+
+func (c *reorderedChannels) clear() {
+	c.channels = []*reorderedChannel{}
+	c.index = map[QNameContextMapKey]*reorderedChannel{}
+	c.numberOfValues = 0
+}
+
+// streams groups the value channels of a block into streams. The first
+// stream is always preceded by the structure channel.
+//
+// Blocks with up to 100 values use a single stream. Otherwise the structure
+// channel is on its own, followed by one stream for all channels with up to
+// 100 values (if any) and one stream for each of the remaining channels.
+func (c *reorderedChannels) streams() [][]*reorderedChannel {
+	if c.numberOfValues <= MaxNumberOfValues {
+		return [][]*reorderedChannel{c.channels}
+	}
+
+	small := []*reorderedChannel{}
+	large := []*reorderedChannel{}
+	for _, channel := range c.channels {
+		if len(channel.values) <= MaxNumberOfValues {
+			small = append(small, channel)
+		} else {
+			large = append(large, channel)
+		}
+	}
+
+	streams := [][]*reorderedChannel{{}}
+	if len(small) > 0 {
+		streams = append(streams, small)
+	}
+	for _, channel := range large {
+		streams = append(streams, []*reorderedChannel{channel})
+	}
+
+	return streams
+}
+
+// Values of xsi:type and xsi:nil are part of the structure channel
+func (c *AbstractEXIBodyCoder) isStructureValue(qnc *QNameContext) bool {
+	key := qnc.GetMapKey()
+	return key == c.getXsiTypeContext().GetMapKey() || key == c.getXsiNilContext().GetMapKey()
+}
+
+/*
+	EXIBodyEncoderReordered implementation
+*/
+
+// recordingTypeEncoder remembers datatype and value of the last validity
+// check so that the value can be written once its block is complete.
+type recordingTypeEncoder struct {
+	TypeEncoder
+	lastDatatype Datatype
+	lastValue    Value
+}
+
+func (e *recordingTypeEncoder) IsValid(datatype Datatype, value Value) (bool, error) {
+	e.lastDatatype = datatype
+	e.lastValue = value
+	return e.TypeEncoder.IsValid(datatype, value)
+}
+
+// EXIBodyEncoderReordered encodes EXI bodies in the (pre-)compression coding
+// modes. Event codes and other structure items are written as they come while
+// values are collected in value channels and written once a block is complete.
+type EXIBodyEncoderReordered struct {
+	*AbstractEXIBodyEncoder
+	codingMode   CodingMode
+	blockSize    int
+	valueEncoder *recordingTypeEncoder
+	channels     *reorderedChannels
+}
+
+func NewEXIBodyEncoderReordered(exiFactory EXIFactory) (*EXIBodyEncoderReordered, error) {
+	abe, err := NewAbstractEXIBodyEncoder(exiFactory)
+	if err != nil {
+		return nil, err
+	}
+	valueEncoder := &recordingTypeEncoder{
+		TypeEncoder: abe.typeEncoder,
+	}
+	abe.typeEncoder = valueEncoder
+
+	be := &EXIBodyEncoderReordered{
+		AbstractEXIBodyEncoder: abe,
+		codingMode:             exiFactory.GetCodingMode(),
+		blockSize:              exiFactory.GetBlockSize(),
+		valueEncoder:           valueEncoder,
+		channels:               newReorderedChannels(),
+	}
+	abe.EXIBodyEncoder = be
+
+	return be, nil
+}
+
+func (e *EXIBodyEncoderReordered) SetOutputStream(writer *bufio.Writer) error {
+	switch e.codingMode {
+	case CodingModeCompression:
+		channel, err := NewDeflateEncoderChannel(writer)
+		if err != nil {
+			return err
+		}
+		return e.SetOutputChannel(channel)
+	case CodingModePreCompression:
+		return e.SetOutputChannel(NewByteEncoderChannel(writer))
+	default:
+		return fmt.Errorf("unexpected coding mode: %d", e.codingMode)
+	}
+}
+
+func (e *EXIBodyEncoderReordered) SetOutputChannel(channel EncoderChannel) error {
+	e.channel = channel
+	return nil
+}
+
+func (e *EXIBodyEncoderReordered) Reset() error {
+	e.channels.clear()
+	return e.AbstractEXIBodyEncoder.Reset()
+}
+
+func (e *EXIBodyEncoderReordered) EncodeStartDocument() error {
+	e.channels.clear()
+	return e.AbstractEXIBodyEncoder.EncodeStartDocument()
+}
+
+func (e *EXIBodyEncoderReordered) EncodeEndDocument() error {
+	if err := e.AbstractEXIBodyEncoder.EncodeEndDocument(); err != nil {
+		return err
+	}
+	return e.closeBlock()
+}
+
+func (e *EXIBodyEncoderReordered) WriteValue(qnc *QNameContext) error {
+	if e.isStructureValue(qnc) {
+		return e.writeValue(e.valueEncoder.TypeEncoder, qnc)
+	}
+
+	e.channels.add(qnc, &reorderedValue{
+		datatype: e.valueEncoder.lastDatatype,
+		value:    e.valueEncoder.lastValue,
+	})
+	if e.channels.numberOfValues == e.blockSize {
+		return e.closeBlock()
+	}
+
+	return nil
+}
+
+// closeBlock writes the value channels of the current block right after its
+// structure.
+func (e *EXIBodyEncoderReordered) closeBlock() error {
+	for _, stream := range e.channels.streams() {
+		for _, channel := range stream {
+			for _, v := range channel.values {
+				if _, err := e.valueEncoder.TypeEncoder.IsValid(v.datatype, v.value); err != nil {
+					return err
+				}
+				if err := e.writeValue(e.valueEncoder.TypeEncoder, channel.qnc); err != nil {
+					return err
+				}
+			}
+		}
+		if err := e.finishStream(); err != nil {
+			return err
+		}
+	}
+	e.channels.clear()
+
+	return nil
+}
+
+func (e *EXIBodyEncoderReordered) finishStream() error {
+	if channel, ok := e.channel.(*DeflateEncoderChannel); ok {
+		return channel.FinishStream()
+	}
+	// pre-compression: streams are simply concatenated
+	return nil
+}
+
+/*
+	EXIBodyDecoderReordered implementation
+*/
+
+// deferringTypeDecoder reads values of xsi:type and xsi:nil, which are part
+// of the structure channel, right away and defers all others until the value
+// channels of the current block are read.
+type deferringTypeDecoder struct {
+	decoder *EXIBodyDecoderReordered
+}
+
+func (t *deferringTypeDecoder) SetErrorHandler(handler ErrorHandler) {
+	setTypeDecoderErrorHandler(t.decoder.valueDecoder, handler)
+}
+
+func (t *deferringTypeDecoder) ReadValue(datatype Datatype, qnc *QNameContext, channel DecoderChannel, decoder StringDecoder) (Value, error) {
+	d := t.decoder
+	if d.isStructureValue(qnc) {
+		return d.valueDecoder.ReadValue(datatype, qnc, channel, decoder)
+	}
+
+	d.deferredValue = &reorderedValue{
+		datatype: datatype,
+		value:    nil,
+	}
+	d.channels.add(qnc, d.deferredValue)
+
+	return nil, nil
+}
+
+// reorderedEvent is an event of the current block. Events are replayed once
+// the values of the block are known.
+type reorderedEvent struct {
+	eventType              EventType
+	qnc                    *QNameContext
+	elementContext         *ElementContext
+	nsDeclarations         []NamespaceDeclarationContainer
+	attributePrefix        *string
+	attributeQNameAsString string
+	value                  *reorderedValue
+	nsDeclaration          *NamespaceDeclarationContainer
+	docType                *DocTypeContainer
+	entityReference        []rune
+	comment                []rune
+	pi                     ProcessingInstructionContainer
+}
+
+// EXIBodyDecoderReordered decodes EXI bodies in the (pre-)compression coding
+// modes. The structure of a block is decoded first, followed by its value
+// channels. Afterwards the events of the block are reported in document
+// order.
+type EXIBodyDecoderReordered struct {
+	*EXIBodyDecoderInOrder
+	codingMode    CodingMode
+	blockSize     int
+	valueDecoder  TypeDecoder
+	deferredValue *reorderedValue
+	channels      *reorderedChannels
+	events        []*reorderedEvent
+	eventIndex    int
+	currentEvent  *reorderedEvent
+	lastAttribute *reorderedEvent
+	documentEnded bool
+}
+
+func NewEXIBodyDecoderReordered(exiFactory EXIFactory) (*EXIBodyDecoderReordered, error) {
+	bd, err := NewEXIBodyDecoderInOrder(exiFactory)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &EXIBodyDecoderReordered{
+		EXIBodyDecoderInOrder: bd,
+		codingMode:            exiFactory.GetCodingMode(),
+		blockSize:             exiFactory.GetBlockSize(),
+		valueDecoder:          bd.typeDecoder,
+		deferredValue:         nil,
+		channels:              newReorderedChannels(),
+		events:                []*reorderedEvent{},
+		eventIndex:            0,
+		currentEvent:          nil,
+		lastAttribute:         nil,
+		documentEnded:         false,
+	}
+	bd.typeDecoder = &deferringTypeDecoder{
+		decoder: d,
+	}
+
+	return d, nil
+}
+
+func (d *EXIBodyDecoderReordered) SetInputStream(reader *bufio.Reader) error {
+	if err := d.UpdateInputStream(reader); err != nil {
+		return err
+	}
+	return d.InitForEachRun()
+}
+
+func (d *EXIBodyDecoderReordered) SetInput(reader io.Reader) error {
+	return d.SetInputStream(bufio.NewReader(reader))
+}
+
+func (d *EXIBodyDecoderReordered) SetInputChannel(channel DecoderChannel) error {
+	if err := d.UpdateInputChannel(channel); err != nil {
+		return err
+	}
+	return d.InitForEachRun()
+}
+
+func (d *EXIBodyDecoderReordered) UpdateInputStream(reader *bufio.Reader) error {
+	switch d.codingMode {
+	case CodingModeCompression:
+		return d.UpdateInputChannel(NewDeflateDecoderChannel(reader))
+	case CodingModePreCompression:
+		return d.UpdateInputChannel(NewByteDecoderChannel(reader))
+	default:
+		return fmt.Errorf("unexpected coding mode: %d", d.codingMode)
+	}
+}
+
+func (d *EXIBodyDecoderReordered) InitForEachRun() error {
+	if err := d.EXIBodyDecoderInOrder.InitForEachRun(); err != nil {
+		return err
+	}
+
+	d.deferredValue = nil
+	d.channels.clear()
+	d.events = []*reorderedEvent{}
+	d.eventIndex = 0
+	d.currentEvent = &reorderedEvent{
+		eventType:      -1,
+		elementContext: d.getElementContext(),
+	}
+	d.lastAttribute = &reorderedEvent{
+		eventType: -1,
+		value:     &reorderedValue{},
+	}
+	d.documentEnded = false
+
+	return nil
+}
+
+// decodeBlock decodes the structure of the next block followed by the values
+// of its value channels.
+func (d *EXIBodyDecoderReordered) decodeBlock() error {
+	d.channels.clear()
+	d.events = []*reorderedEvent{}
+	d.eventIndex = 0
+
+	for !d.documentEnded && d.channels.numberOfValues < d.blockSize {
+		ev, err := d.decodeStructureEvent()
+		if err != nil {
+			return err
+		}
+		d.events = append(d.events, ev)
+	}
+
+	for _, stream := range d.channels.streams() {
+		for _, channel := range stream {
+			for _, v := range channel.values {
+				value, err := d.surfaceValue(d.readValue(d.valueDecoder, v.datatype, channel.qnc))
+				if err != nil {
+					return err
+				}
+				v.value = value
+			}
+		}
+		if err := d.finishStream(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *EXIBodyDecoderReordered) decodeStructureEvent() (*reorderedEvent, error) {
+	eventType, exists, err := d.EXIBodyDecoderInOrder.Next()
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errors.New("premature end of EXI events")
+	}
+
+	ev := &reorderedEvent{
+		eventType: eventType,
+	}
+	isAttribute := false
+	d.deferredValue = nil
+
+	switch eventType {
+	case EventTypeStartDocument:
+		err = d.EXIBodyDecoderInOrder.DecodeStartDocument()
+	case EventTypeEndDocument:
+		err = d.EXIBodyDecoderInOrder.DecodeEndDocument()
+		d.documentEnded = true
+	case EventTypeAttributeXsiNil:
+		ev.qnc, err = d.EXIBodyDecoderInOrder.DecodeAttributeXsiNil()
+		isAttribute = true
+	case EventTypeAttributeXsiType:
+		ev.qnc, err = d.EXIBodyDecoderInOrder.DecodeAttributeXsiType()
+		isAttribute = true
+	case EventTypeAttribute,
+		EventTypeAttributeNS,
+		EventTypeAttributeGeneric,
+		EventTypeAttributeGenericUndeclared,
+		EventTypeAttributeInvalidValue,
+		EventTypeAttributeAnyInvalidValue:
+		ev.qnc, err = d.EXIBodyDecoderInOrder.DecodeAttribute()
+		isAttribute = true
+	case EventTypeNamespaceDeclaration:
+		ev.nsDeclaration, err = d.EXIBodyDecoderInOrder.DecodeNamespaceDeclaration()
+	case EventTypeStartElement,
+		EventTypeStartElementNS,
+		EventTypeStartElementGeneric,
+		EventTypeStartElementGenericUndeclared:
+		ev.qnc, err = d.EXIBodyDecoderInOrder.DecodeStartElement()
+	case EventTypeEndElement, EventTypeEndElementUndeclared:
+		ev.qnc, err = d.EXIBodyDecoderInOrder.DecodeEndElement()
+	case EventTypeCharacters, EventTypeCharactersGeneric, EventTypeCharactersGenericUndeclared:
+		_, err = d.EXIBodyDecoderInOrder.DecodeCharacters()
+	case EventTypeDocType:
+		ev.docType, err = d.EXIBodyDecoderInOrder.DecodeDocType()
+	case EventTypeEntityReference:
+		ev.entityReference, err = d.EXIBodyDecoderInOrder.DecodeEntityReference()
+	case EventTypeComment:
+		ev.comment, err = d.EXIBodyDecoderInOrder.DecodeComment()
+	case EventTypeProcessingInstruction:
+		ev.pi, err = d.EXIBodyDecoderInOrder.DecodeProcessingInstruction()
+	default:
+		return nil, fmt.Errorf("unexpected EXI event in (pre-)compressed stream: %s", eventType)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if isAttribute {
+		ev.attributePrefix = d.attributePrefix
+		ev.attributeQNameAsString = d.AbstractEXIBodyDecoder.GetAttributeQNameAsString()
+	}
+	if d.deferredValue != nil {
+		ev.value = d.deferredValue
+	} else if isAttribute {
+		ev.value = &reorderedValue{
+			datatype: nil,
+			value:    d.attributeValue,
+		}
+	}
+	ev.elementContext = d.getElementContext()
+	ev.nsDeclarations = ev.elementContext.nsDeclarations
+
+	return ev, nil
+}
+
+func (d *EXIBodyDecoderReordered) finishStream() error {
+	if channel, ok := d.channel.(*DeflateDecoderChannel); ok {
+		return channel.FinishStream()
+	}
+	// pre-compression: streams are simply concatenated
+	return nil
+}
+
+// replayEvent reports the next event of the current block
+func (d *EXIBodyDecoderReordered) replayEvent() (*reorderedEvent, error) {
+	if d.eventIndex >= len(d.events) {
+		return nil, errors.New("no more EXI events available in current block")
+	}
+
+	d.currentEvent = d.events[d.eventIndex]
+	d.eventIndex++
+
+	return d.currentEvent, nil
+}
+
+func (d *EXIBodyDecoderReordered) replayAttribute() (*QNameContext, error) {
+	ev, err := d.replayEvent()
+	if err != nil {
+		return nil, err
+	}
+	d.lastAttribute = ev
+	return ev.qnc, nil
+}
+
+func (d *EXIBodyDecoderReordered) Next() (EventType, bool, error) {
+	if d.eventIndex == len(d.events) {
+		if d.documentEnded {
+			return -1, false, nil
+		}
+		if err := d.decodeBlock(); err != nil {
+			return -1, false, err
+		}
+	}
+
+	return d.events[d.eventIndex].eventType, true, nil
+}
+
+func (d *EXIBodyDecoderReordered) DecodeStartDocument() error {
+	_, err := d.replayEvent()
+	return err
+}
+
+func (d *EXIBodyDecoderReordered) DecodeEndDocument() error {
+	_, err := d.replayEvent()
+	return err
+}
+
+func (d *EXIBodyDecoderReordered) DecodeStartElement() (*QNameContext, error) {
+	ev, err := d.replayEvent()
+	if err != nil {
+		return nil, err
+	}
+	return ev.qnc, nil
+}
+
+func (d *EXIBodyDecoderReordered) GetElementPrefix() *string {
+	return d.currentEvent.elementContext.GetPrefix()
+}
+
+func (d *EXIBodyDecoderReordered) GetElementQNameAsString() string {
+	return d.currentEvent.elementContext.GetQNameAsString(d.preservePrefix)
+}
+
+func (d *EXIBodyDecoderReordered) GetElementQNameContext() *QNameContext {
+	return d.currentEvent.elementContext.qnc
+}
+
+func (d *EXIBodyDecoderReordered) DecodeStartSelfContainedFragment() error {
+	return errors.New("(pre-)compression and selfContained elements cannot work together")
+}
+
+func (d *EXIBodyDecoderReordered) DecodeEndElement() (*QNameContext, error) {
+	ev, err := d.replayEvent()
+	if err != nil {
+		return nil, err
+	}
+	return ev.qnc, nil
+}
+
+func (d *EXIBodyDecoderReordered) DecodeAttributeXsiNil() (*QNameContext, error) {
+	return d.replayAttribute()
+}
+
+func (d *EXIBodyDecoderReordered) DecodeAttributeXsiType() (*QNameContext, error) {
+	return d.replayAttribute()
+}
+
+func (d *EXIBodyDecoderReordered) DecodeAttribute() (*QNameContext, error) {
+	return d.replayAttribute()
+}
+
+func (d *EXIBodyDecoderReordered) GetAttributePrefix() *string {
+	return d.lastAttribute.attributePrefix
+}
+
+func (d *EXIBodyDecoderReordered) GetAttributeQNameAsString() string {
+	return d.lastAttribute.attributeQNameAsString
+}
+
+func (d *EXIBodyDecoderReordered) GetAttributeQNameContext() *QNameContext {
+	return d.lastAttribute.qnc
+}
+
+func (d *EXIBodyDecoderReordered) GetAttributeValue() Value {
+	return d.lastAttribute.value.value
+}
+
+func (d *EXIBodyDecoderReordered) DecodeNamespaceDeclaration() (*NamespaceDeclarationContainer, error) {
+	ev, err := d.replayEvent()
+	if err != nil {
+		return nil, err
+	}
+	return ev.nsDeclaration, nil
+}
+
+func (d *EXIBodyDecoderReordered) GetDeclaredPrefixDeclarations() []NamespaceDeclarationContainer {
+	return d.currentEvent.nsDeclarations
+}
+
+func (d *EXIBodyDecoderReordered) DecodeCharacters() (Value, error) {
+	ev, err := d.replayEvent()
+	if err != nil {
+		return nil, err
+	}
+	if ev.value == nil {
+		return nil, fmt.Errorf("invalid decode state: %s", ev.eventType)
+	}
+	return ev.value.value, nil
+}
+
+// DecodeCharactersTo writes binary values to w like EXIBodyDecoderInOrder
+// but cannot save memory, as values are decoded per block beforehand.
+func (d *EXIBodyDecoderReordered) DecodeCharactersTo(w io.Writer) (Value, error) {
+	value, err := d.DecodeCharacters()
+	if err != nil {
+		return nil, err
+	}
+	switch v := value.(type) {
+	case *BinaryBase64Value:
+		_, err = w.Write(v.ToBytes())
+		return nil, err
+	case *BinaryHexValue:
+		_, err = w.Write(v.ToBytes())
+		return nil, err
+	default:
+		return value, nil
+	}
+}
+
+func (d *EXIBodyDecoderReordered) DecodeDocType() (*DocTypeContainer, error) {
+	ev, err := d.replayEvent()
+	if err != nil {
+		return nil, err
+	}
+	return ev.docType, nil
+}
+
+func (d *EXIBodyDecoderReordered) DecodeEntityReference() ([]rune, error) {
+	ev, err := d.replayEvent()
+	if err != nil {
+		return nil, err
+	}
+	return ev.entityReference, nil
+}
+
+func (d *EXIBodyDecoderReordered) DecodeComment() ([]rune, error) {
+	ev, err := d.replayEvent()
+	if err != nil {
+		return nil, err
+	}
+	return ev.comment, nil
+}
+
+func (d *EXIBodyDecoderReordered) DecodeCommentContainer() (CommentContainer, error) {
+	text, err := d.DecodeComment()
+	if err != nil {
+		return CommentContainer{}, err
+	}
+	return CommentContainer{
+		Text: string(text),
+	}, nil
+}
+
+func (d *EXIBodyDecoderReordered) DecodeProcessingInstruction() (ProcessingInstructionContainer, error) {
+	ev, err := d.replayEvent()
+	if err != nil {
+		return ProcessingInstructionContainer{}, err
+	}
+	return ev.pi, nil
+}
+
+func (d *EXIBodyDecoderReordered) DecodeEvent() (*DecodedEvent, bool, error) {
+	return decodeEvent(d)
+}
+
+func (d *EXIBodyDecoderReordered) RecoverToNextElement() error {
+	return errors.New("recovery is not supported in (pre-)compression mode")
+}
+
+func (d *EXIBodyDecoderReordered) NextWithContext(ctx context.Context) (EventType, bool, error) {
+	return nextWithContext(ctx, d)
+}
@@ -0,0 +1,2155 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/sderkacs/go-exi/utils"
+)
+
+func TestDecodeCommentContainer(t *testing.T) {
+	// comment texts as encoded after the CM event code
+	var buf bytes.Buffer
+	writer := bufio.NewWriter(&buf)
+	channel := NewBitEncoderChannel(writer)
+	for _, text := range []string{"a comment", "", "ünïcode"} {
+		if err := channel.EncodeString(text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := channel.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	decoder, err := NewDefaultEXIFactory().CreateEXIBodyDecoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := decoder.SetInputStream(bufio.NewReader(&buf)); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"a comment", "", "ünïcode"} {
+		comment, err := decoder.DecodeCommentContainer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if comment.Text != want {
+			t.Errorf("got %q, want %q", comment.Text, want)
+		}
+	}
+}
+
+func TestEXIStreamRoundTrip(t *testing.T) {
+	events := []string{
+		"SD", "CM head", "SE r", "AT a=1", "SE e", "CH text", "EE",
+		"PI target some data", "SE e", "CH text", "EE", "EE", "ED",
+	}
+	newFactory := func(t *testing.T, mode CodingMode, options ...string) EXIFactory {
+		factory := NewDefaultEXIFactory()
+		factory.SetCodingMode(mode)
+		for _, feature := range []string{FeatureComment, FeaturePI} {
+			if err := factory.GetFidelityOptions().SetFidelity(feature, true); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, option := range options {
+			if err := factory.GetEncodingOptions().SetOption(option); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return factory
+	}
+
+	for _, mode := range []CodingMode{CodingModeBitPacked, CodingModeBytePacked} {
+		for _, options := range [][]string{nil, {OptionIncludeCookie}, {OptionIncludeOptions}, {OptionIncludeCookie, OptionIncludeOptions}} {
+			t.Run(fmt.Sprintf("%d/%v", mode, options), func(t *testing.T) {
+				streamEncoder, err := newFactory(t, mode, options...).CreateEXIStreamEncoder()
+				if err != nil {
+					t.Fatal(err)
+				}
+				var buf bytes.Buffer
+				writer := bufio.NewWriter(&buf)
+				encoder, err := streamEncoder.EncodeHeader(writer)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := encodeEvents(encoder, events); err != nil {
+					t.Fatal(err)
+				}
+				if err := writer.Flush(); err != nil {
+					t.Fatal(err)
+				}
+
+				exi := buf.Bytes()
+				if hasCookie := bytes.HasPrefix(exi, []byte("$EXI")); hasCookie != slices.Contains(options, OptionIncludeCookie) {
+					t.Errorf("cookie present = %v", hasCookie)
+				}
+
+				// options in the header configure the decoder on their own
+				var decoderFactory EXIFactory = NewDefaultEXIFactory()
+				if !slices.Contains(options, OptionIncludeOptions) {
+					decoderFactory = newFactory(t, mode)
+				}
+				streamDecoder, err := decoderFactory.CreateEXIStreamDecoder()
+				if err != nil {
+					t.Fatal(err)
+				}
+				decoder, err := streamDecoder.DecodeHeader(bufio.NewReader(bytes.NewReader(exi)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := decodeEvents(t, decoder); !reflect.DeepEqual(got, events) {
+					t.Errorf("got %q, want %q", got, events)
+				}
+			})
+		}
+	}
+}
+
+func TestPreCompressionBlockSize(t *testing.T) {
+	// 30 values, i.e. eight blocks of 4 values
+	events := []string{"SD", "SE r"}
+	for i := range 15 {
+		events = append(events, "SE e", fmt.Sprintf("AT a=%d", i), fmt.Sprintf("CH %d", i%4), "EE")
+	}
+	events = append(events, "EE", "ED")
+
+	encode := func(blockSize int, options ...string) []byte {
+		factory := NewDefaultEXIFactory()
+		factory.SetCodingMode(CodingModePreCompression)
+		factory.SetBlockSize(blockSize)
+		for _, option := range options {
+			if err := factory.GetEncodingOptions().SetOption(option); err != nil {
+				t.Fatal(err)
+			}
+		}
+		streamEncoder, err := factory.CreateEXIStreamEncoder()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		writer := bufio.NewWriter(&buf)
+		encoder, err := streamEncoder.EncodeHeader(writer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := encodeEvents(encoder, events); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	// the block size moves the block boundaries
+	if bytes.Equal(encode(4), encode(DefaultBlockSize)) {
+		t.Error("block size 4 produces the same stream as the default block size")
+	}
+
+	// the decoding factory has the default block size, the header has 4
+	streamDecoder, err := NewDefaultEXIFactory().CreateEXIStreamDecoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exi := encode(4, OptionIncludeOptions)
+	decoder, err := streamDecoder.DecodeHeader(bufio.NewReader(bytes.NewReader(exi)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := decodeEvents(t, decoder); !reflect.DeepEqual(got, events) {
+		t.Errorf("got %q, want %q", got, events)
+	}
+}
+
+func TestEncodePreservedPrefixes(t *testing.T) {
+	factory := NewDefaultEXIFactory()
+	if err := factory.GetFidelityOptions().SetFidelity(FeaturePrefix, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// encode nested elements sharing the prefixes a and b, either with a
+	// fresh string for every prefix or re-using one variable as callers do
+	encode := func(prefixes func(p string) *string) []byte {
+		encoder, err := factory.CreateEXIBodyEncoder()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		writer := bufio.NewWriter(&buf)
+		if err := encoder.SetOutputStream(writer); err != nil {
+			t.Fatal(err)
+		}
+		err = encodeAll(
+			encoder.EncodeStartDocument,
+			func() error { return encoder.EncodeStartElement("urn:a", "r", prefixes("a")) },
+			func() error { return encoder.EncodeNamespaceDeclaration("urn:a", prefixes("a")) },
+			func() error { return encoder.EncodeNamespaceDeclaration("urn:b", prefixes("b")) },
+			func() error { return encoder.EncodeStartElement("urn:b", "e", prefixes("b")) },
+			func() error { return encoder.EncodeNamespaceDeclaration("urn:a", prefixes("a")) },
+			func() error { return encoder.EncodeNamespaceDeclaration("urn:b", prefixes("b")) },
+			encoder.EncodeEndElement,
+			encoder.EncodeEndElement,
+			encoder.EncodeEndDocument,
+			encoder.Flush,
+			writer.Flush,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	want := encode(func(p string) *string { return &p })
+	var prefix string
+	got := encode(func(p string) *string { prefix = p; return &prefix })
+	if !bytes.Equal(got, want) {
+		t.Errorf("re-used prefix variable: got % x, want % x", got, want)
+	}
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	// a repetitive document of some kilobytes
+	events := []string{"SD", "SE r"}
+	for i := range 500 {
+		events = append(events, "SE item", fmt.Sprintf("AT id=%d", i), fmt.Sprintf("CH value %d", i%10), "EE")
+	}
+	events = append(events, "EE", "ED")
+
+	newFactory := func(mode CodingMode, blockSize int) EXIFactory {
+		factory := NewDefaultEXIFactory()
+		factory.SetCodingMode(mode)
+		factory.SetBlockSize(blockSize)
+		return factory
+	}
+	bytePacked := encodeBody(t, newFactory(CodingModeBytePacked, DefaultBlockSize), events)
+
+	for _, mode := range []CodingMode{CodingModeCompression, CodingModePreCompression} {
+		for _, blockSize := range []int{DefaultBlockSize, 100} {
+			t.Run(fmt.Sprintf("%d/%d", mode, blockSize), func(t *testing.T) {
+				factory := newFactory(mode, blockSize)
+				exi := encodeBody(t, factory, events)
+				if got := decodeBody(t, factory, exi); !reflect.DeepEqual(got, events) {
+					t.Errorf("got %q, want %q", got, events)
+				}
+				if mode == CodingModeCompression && len(exi) >= len(bytePacked) {
+					t.Errorf("compressed %d bytes, byte-packed %d bytes", len(exi), len(bytePacked))
+				}
+			})
+		}
+	}
+}
+
+// attributeValues returns the events of a document with n attribute values,
+// repeated values are string table hits.
+func attributeValues(n int) []string {
+	events := []string{"SD", "SE r"}
+	for i := range n / 10 {
+		events = append(events, "SE v")
+		for j := range 10 {
+			events = append(events, fmt.Sprintf("AT a%d=%d", j, (i+j)%100))
+		}
+		events = append(events, "EE")
+	}
+	return append(events, "EE", "ED")
+}
+
+func TestPreCompressionBlockBoundaries(t *testing.T) {
+	events := attributeValues(5500)
+	streams := map[int][]byte{}
+	for _, blockSize := range []int{1000, 2000} {
+		factory := NewDefaultEXIFactory()
+		factory.SetCodingMode(CodingModePreCompression)
+		factory.SetBlockSize(blockSize)
+		exi := encodeBody(t, factory, events)
+		streams[blockSize] = exi
+		if got := decodeBody(t, factory, exi); !reflect.DeepEqual(got, events) {
+			t.Errorf("block size %d: decoded %d events, want %d", blockSize, len(got), len(events))
+		}
+
+		// the decoder depends on the block boundaries
+		misaligned := factory.Clone()
+		misaligned.SetBlockSize(blockSize - 1)
+		if err := decodeMalformed(misaligned, exi); err == nil {
+			t.Errorf("block size %d decoded with block size %d", blockSize, blockSize-1)
+		}
+	}
+	if bytes.Equal(streams[1000], streams[2000]) {
+		t.Error("block sizes produce the same stream")
+	}
+
+	if testing.Short() {
+		return
+	}
+	// more values than DefaultBlockSize
+	events = attributeValues(DefaultBlockSize + 100000)
+	factory := NewDefaultEXIFactory()
+	factory.SetCodingMode(CodingModePreCompression)
+	if got := decodeBody(t, factory, encodeBody(t, factory, events)); !reflect.DeepEqual(got, events) {
+		t.Errorf("default block size: decoded %d events, want %d", len(got), len(events))
+	}
+}
+
+// Flush after EncodeEndDocument has to leave complete DEFLATE streams, also
+// when the last block is full or holds a single value.
+func TestCompressionFlush(t *testing.T) {
+	for _, mode := range []CodingMode{CodingModeCompression, CodingModePreCompression} {
+		for _, blockSize := range []int{1, 50, 100, DefaultBlockSize} {
+			for _, n := range []int{0, 90, 100, 110, 400} {
+				events := attributeValues(n)
+				factory := NewDefaultEXIFactory()
+				factory.SetCodingMode(mode)
+				factory.SetBlockSize(blockSize)
+				if got := decodeBody(t, factory, encodeBody(t, factory, events)); !reflect.DeepEqual(got, events) {
+					t.Errorf("mode %d, block size %d, %d values: decoded %q, want %q", mode, blockSize, n, got, events)
+				}
+			}
+		}
+	}
+}
+
+// Schema-less simple data between SE and EE keeps its whitespace, complex
+// data between s+s, e+s and e+e is pruned if it is solely whitespace.
+func TestPendingCharactersWhitespace(t *testing.T) {
+	tests := []struct {
+		events, want []string
+	}{
+		// s+e
+		{[]string{"SD", "SE r", "CH  \t ", "EE", "ED"}, nil},
+		{[]string{"SD", "SE r", "AT a=1", "CH \n", "EE", "ED"}, nil},
+		// s+s
+		{[]string{"SD", "SE r", "CH \n\t", "SE e", "EE", "EE", "ED"}, []string{"SD", "SE r", "SE e", "EE", "EE", "ED"}},
+		// e+s
+		{[]string{"SD", "SE r", "SE e", "EE", "CH \r\n ", "SE e", "EE", "EE", "ED"}, []string{"SD", "SE r", "SE e", "EE", "SE e", "EE", "EE", "ED"}},
+		// e+e
+		{[]string{"SD", "SE r", "SE e", "EE", "CH \t", "EE", "ED"}, []string{"SD", "SE r", "SE e", "EE", "EE", "ED"}},
+		// not whitespace
+		{[]string{"SD", "SE r", "SE e", "EE", "CH t", "SE e", "EE", "CH  x ", "EE", "ED"}, nil},
+	}
+	for _, test := range tests {
+		want := test.want
+		if want == nil {
+			want = test.events
+		}
+		factory := NewDefaultEXIFactory()
+		if got := decodeBody(t, factory, encodeBody(t, factory, test.events)); !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: decoded %q, want %q", test.events, got, want)
+		}
+	}
+}
+
+// SetPreserveWhitespace keeps whitespace of the current element and its
+// descendants like xml:space="preserve", without encoding an attribute.
+func TestSetPreserveWhitespace(t *testing.T) {
+	events := []string{
+		"SD", "SE r", "PRESERVE true", "CH \n ", "SE e", "EE", "CH \t",
+		"SE p", "PRESERVE false", "CH  ", "SE e", "EE", "EE",
+		"CH  ", "EE", "ED",
+	}
+	// p trims again, the setting of r applies after the end of p
+	want := []string{
+		"SD", "SE r", "CH \n ", "SE e", "EE", "CH \t",
+		"SE p", "SE e", "EE", "EE",
+		"CH  ", "EE", "ED",
+	}
+	for _, mode := range []CodingMode{CodingModeBitPacked, CodingModeCompression} {
+		factory := NewDefaultEXIFactory()
+		factory.SetCodingMode(mode)
+		if got := decodeBody(t, factory, encodeBody(t, factory, events)); !reflect.DeepEqual(got, want) {
+			t.Errorf("mode %d: decoded %q, want %q", mode, got, want)
+		}
+	}
+
+	// the self-contained encoder passes the setting on to the fragment
+	factory := NewDefaultEXIFactory()
+	factory.GetFidelityOptions().SetFidelity(FeatureSC, true)
+	factory.SetSelfContainedElements([]utils.QName{{Local: "p"}})
+	events = []string{"SD", "SE r", "SE p", "PRESERVE true", "CH  ", "SE e", "EE", "EE", "EE", "ED"}
+	want = []string{"SD", "SE r", "SE p", "SC", "CH  ", "SE e", "EE", "EE", "EE", "ED"}
+	if got := decodeBody(t, factory, encodeBody(t, factory, events)); !reflect.DeepEqual(got, want) {
+		t.Errorf("self-contained: decoded %q, want %q", got, want)
+	}
+}
+
+func TestConformanceReport(t *testing.T) {
+	factory := NewDefaultEXIFactory()
+	exi := encodeBody(t, factory, []string{"SD", "SE r", "AT a=1", "SE e", "EE", "SE e", "EE", "EE", "ED"})
+	decoder, err := factory.CreateEXIBodyDecoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := decoder.SetInputStream(bufio.NewReader(bytes.NewReader(exi))); err != nil {
+		t.Fatal(err)
+	}
+	if report := decoder.GetConformanceReport(); report != nil {
+		t.Errorf("report before end document: %+v", report)
+	}
+	decodeEvents(t, decoder)
+	report := decoder.GetConformanceReport()
+	if report == nil {
+		t.Fatal("no report after end document")
+	}
+	if !report.IsConformant() || report.MaxBuiltInElementGrammars != -1 || report.MaxBuiltInProductions != -1 {
+		t.Errorf("unbounded stream: %+v", report)
+	}
+	if report.LearnedProductions == 0 {
+		t.Errorf("no learned productions counted: %+v", report)
+	}
+
+	tests := []struct {
+		report ConformanceReport
+		want   int
+	}{
+		{ConformanceReport{-1, -1, 10, 10}, 0},
+		{ConformanceReport{2, 5, 2, 5}, 0},
+		{ConformanceReport{2, 5, 3, 5}, 1},
+		{ConformanceReport{2, 5, 2, 6}, 1},
+		{ConformanceReport{0, 0, 1, 1}, 2},
+	}
+	for _, test := range tests {
+		diagnostics := test.report.Diagnostics()
+		if len(diagnostics) != test.want || test.report.IsConformant() != (test.want == 0) {
+			t.Errorf("%+v: conformant %v, diagnostics %q", test.report, test.report.IsConformant(), diagnostics)
+		}
+	}
+}
+
+func TestGrammarLearningObserver(t *testing.T) {
+	factory := NewDefaultEXIFactory()
+	exi := encodeBody(t, factory, []string{"SD", "SE r", "AT a=1", "SE e", "CH x", "EE", "SE e", "CH y", "EE", "EE", "ED"})
+	decoder, err := factory.CreateEXIBodyDecoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var learned []string
+	decoder.SetGrammarLearningObserver(func(qname utils.QName, what string) {
+		learned = append(learned, what+" "+qname.Local)
+	})
+	if err := decoder.SetInputStream(bufio.NewReader(bytes.NewReader(exi))); err != nil {
+		t.Fatal(err)
+	}
+	decodeEvents(t, decoder)
+	want := []string{"AT a", "SE e", "CH e", "SE e"}
+	if !slices.Equal(learned, want) {
+		t.Errorf("learned %q, want %q", learned, want)
+	}
+
+	// a removed observer is no longer called
+	learned = nil
+	decoder.SetGrammarLearningObserver(nil)
+	if err := decoder.SetInputStream(bufio.NewReader(bytes.NewReader(exi))); err != nil {
+		t.Fatal(err)
+	}
+	decodeEvents(t, decoder)
+	if learned != nil {
+		t.Errorf("removed observer called: %q", learned)
+	}
+}
+
+func TestFreezeGrammars(t *testing.T) {
+	record := []string{"SE r", "AT id=1", "SE name", "CH a", "EE", "EE"}
+	extended := []string{"SE r", "AT id=2", "AT v=x", "SE name", "CH b", "EE", "SE note", "CH n", "EE", "EE"}
+	for _, freeze := range []bool{false, true} {
+		events := slices.Concat([]string{"SD", "SE records"}, record)
+		if freeze {
+			events = append(events, "FREEZE")
+		}
+		events = slices.Concat(events, extended, extended, []string{"EE", "ED"})
+
+		factory := NewDefaultEXIFactory()
+		encoder, err := NewEXIBodyEncoderInOrder(factory)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		writer := bufio.NewWriter(&buf)
+		if err := encoder.SetOutputStream(writer); err != nil {
+			t.Fatal(err)
+		}
+		if err := encodeEvents(encoder, events); err != nil {
+			t.Fatalf("freeze %t: encode: %v", freeze, err)
+		}
+		if err := writer.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		got := decodeBody(t, factory, buf.Bytes())
+		if want := slices.DeleteFunc(events, func(event string) bool { return event == "FREEZE" }); !reflect.DeepEqual(got, want) {
+			t.Errorf("freeze %t: got %q, want %q", freeze, got, want)
+		}
+
+		// the frozen grammar of r did not learn AT(v) and SE(note), the
+		// grammar of note first seen after freezing did learn CH
+		var r, note Grammar
+		for _, se := range encoder.runtimeGlobalElements {
+			switch se.GetQName().Local {
+			case "r":
+				r = se.GetGrammar()
+			case "note":
+				note = se.GetGrammar()
+			}
+		}
+		if learned := r.GetAttributeProduction("", "v") != nil; learned == freeze {
+			t.Errorf("freeze %t: r learned AT(v) %t", freeze, learned)
+		}
+		if learned := r.GetElementContentGrammar().GetStartElementProduction("", "note") != nil; learned == freeze {
+			t.Errorf("freeze %t: r learned SE(note) %t", freeze, learned)
+		}
+		if note.GetProduction(EventTypeCharacters) == nil {
+			t.Errorf("freeze %t: note did not learn CH", freeze)
+		}
+	}
+}
+
+func TestQNameContextAccessors(t *testing.T) {
+	headerGrammars, err := NewEXIOptionsHeaderGrammars()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mode := range []CodingMode{CodingModeBitPacked, CodingModeCompression} {
+		factory := NewDefaultEXIFactory()
+		factory.SetCodingMode(mode)
+		exi := encodeBody(t, factory, []string{"SD", "SE r", "AT a=1", "SE e", "CH x", "EE", "EE", "ED"})
+		want := []string{"SE r @ :r", "AT a @ :a", "SE e @ :e", "CH @ :e", "EE", "EE"}
+		if got := decodeQNameContexts(t, factory, exi); !slices.Equal(got, want) {
+			t.Errorf("schema-less mode %d: got %q, want %q", mode, got, want)
+		}
+
+		// schema-informed, the EXI namespace has URI ID 4
+		factory.SetGrammars(headerGrammars)
+		var buf bytes.Buffer
+		encoder, err := factory.CreateEXIBodyEncoder()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := encoder.SetOutput(&buf); err != nil {
+			t.Fatal(err)
+		}
+		err = encodeAll(
+			encoder.EncodeStartDocument,
+			func() error { return encoder.EncodeStartElement(W3C_EXI_NS_URI, "header", nil) },
+			func() error { return encoder.EncodeStartElement(W3C_EXI_NS_URI, "strict", nil) },
+			encoder.EncodeEndElement,
+			encoder.EncodeEndElement,
+			encoder.EncodeEndDocument,
+			encoder.Flush,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = []string{"SE header @ 4:header", "SE strict @ 4:strict", "EE", "EE"}
+		if got := decodeQNameContexts(t, factory, buf.Bytes()); !slices.Equal(got, want) {
+			t.Errorf("schema-informed mode %d: got %q, want %q", mode, got, want)
+		}
+	}
+}
+
+// decodeQNameContexts decodes exi and lists the element and attribute
+// events with the qname context returned by the accessors, as
+// "<event> @ <URI ID>:<local name>" with the URI ID omitted for the empty
+// namespace.
+func decodeQNameContexts(t *testing.T, factory EXIFactory, exi []byte) []string {
+	t.Helper()
+	decoder, err := factory.CreateEXIBodyDecoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := decoder.SetInputStream(bufio.NewReader(bytes.NewReader(exi))); err != nil {
+		t.Fatal(err)
+	}
+	format := func(qnc *QNameContext) string {
+		if qnc.GetNamespaceUriID() == 0 {
+			return ":" + qnc.GetLocalName()
+		}
+		return fmt.Sprintf("%d:%s", qnc.GetNamespaceUriID(), qnc.GetLocalName())
+	}
+
+	var got []string
+	for {
+		eventType, exists, err := decoder.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !exists {
+			return got
+		}
+		event, err := decodeNext(decoder, eventType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch code, name, _ := strings.Cut(event, " "); code {
+		case "SE":
+			got = append(got, event+" @ "+format(decoder.GetElementQNameContext()))
+		case "AT":
+			name, _, _ = strings.Cut(name, "=")
+			got = append(got, "AT "+name+" @ "+format(decoder.GetAttributeQNameContext()))
+		case "CH":
+			got = append(got, "CH @ "+format(decoder.GetElementQNameContext()))
+		case "EE":
+			got = append(got, event)
+		}
+	}
+}
+
+func TestEncodeEndDocumentUnclosed(t *testing.T) {
+	tests := []struct {
+		events []string
+		err    string // empty if no error is expected
+	}{
+		{[]string{"SD", "SE r", "EE", "ED"}, ""},
+		{[]string{"SD", "SE r", "SE e", "ED"}, "2 unclosed element(s), innermost element: e"},
+		{[]string{"SD", "SE r", "CH x", "ED"}, "1 unclosed element(s), innermost element: r"},
+		{[]string{"SD", "SE r", "EE", "CH \n", "ED"}, ""},
+		{[]string{"SD", "SE r", "EE", "CH x", "ED"}, "characters"},
+	}
+	for _, mode := range []CodingMode{CodingModeBitPacked, CodingModeCompression} {
+		for _, test := range tests {
+			factory := NewDefaultEXIFactory()
+			factory.SetCodingMode(mode)
+			encoder, err := factory.CreateEXIBodyEncoder()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := encoder.SetOutput(io.Discard); err != nil {
+				t.Fatal(err)
+			}
+			err = encodeEvents(encoder, test.events)
+			if test.err == "" && err != nil {
+				t.Errorf("mode %d %q: %v", mode, test.events, err)
+			} else if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("mode %d %q: error %v, want %q", mode, test.events, err, test.err)
+			}
+		}
+	}
+}
+
+func TestEncodeCharactersWithoutProduction(t *testing.T) {
+	headerGrammars, err := NewEXIOptionsHeaderGrammars()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the strict element of the options header has an empty content
+	tests := []struct {
+		strict bool
+		chars  string
+		want   []string // nil if an error is expected
+	}{
+		{false, "x", []string{"SD", "SE header", "SE strict", "CH x", "EE", "EE", "ED"}},
+		{true, " \n", []string{"SD", "SE header", "SE strict", "EE", "EE", "ED"}},
+		{true, "x", nil},
+	}
+	for _, test := range tests {
+		factory := NewDefaultEXIFactory()
+		factory.SetGrammars(headerGrammars)
+		if test.strict {
+			factory.SetFidelityOptions(NewStrictFidelityOptions())
+		}
+		encoder, err := factory.CreateEXIBodyEncoder()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := encoder.SetOutput(&buf); err != nil {
+			t.Fatal(err)
+		}
+		err = encodeAll(
+			encoder.EncodeStartDocument,
+			func() error { return encoder.EncodeStartElement(W3C_EXI_NS_URI, "header", nil) },
+			func() error { return encoder.EncodeStartElement(W3C_EXI_NS_URI, "strict", nil) },
+			func() error { return encoder.EncodeCharacters(NewStringValueFromString(test.chars)) },
+			encoder.EncodeEndElement,
+			encoder.EncodeEndElement,
+			encoder.EncodeEndDocument,
+			encoder.Flush,
+		)
+		if test.want == nil {
+			if err == nil || !strings.Contains(err.Error(), "characters cannot be encoded") {
+				t.Errorf("strict %v %q: error %v, want characters cannot be encoded", test.strict, test.chars, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("strict %v %q: %v", test.strict, test.chars, err)
+			continue
+		}
+		if got := decodeBody(t, factory, buf.Bytes()); !slices.Equal(got, test.want) {
+			t.Errorf("strict %v %q: decoded %q, want %q", test.strict, test.chars, got, test.want)
+		}
+	}
+}
+
+func TestDecoderCodingMode(t *testing.T) {
+	tests := []struct {
+		mode      CodingMode
+		blockSize int
+	}{
+		{CodingModeBitPacked, DefaultBlockSize},
+		{CodingModeBytePacked, DefaultBlockSize},
+		{CodingModePreCompression, DefaultBlockSize},
+		{CodingModeCompression, DefaultBlockSize},
+		{CodingModePreCompression, 100},
+		{CodingModeCompression, 100},
+	}
+	for _, test := range tests {
+		factory := NewDefaultEXIFactory()
+		factory.SetCodingMode(test.mode)
+		factory.SetBlockSize(test.blockSize)
+		if err := factory.GetEncodingOptions().SetOption(OptionIncludeOptions); err != nil {
+			t.Fatal(err)
+		}
+		streamEncoder, err := factory.CreateEXIStreamEncoder()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		writer := bufio.NewWriter(&buf)
+		encoder, err := streamEncoder.EncodeHeader(writer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := encodeEvents(encoder, []string{"SD", "SE r", "CH text", "EE", "ED"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		// the header options replace the settings of the decoding factory
+		streamDecoder, err := NewDefaultEXIFactory().CreateEXIStreamDecoder()
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoder, err := streamDecoder.DecodeHeader(bufio.NewReader(&buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoder.GetCodingMode() != test.mode || decoder.GetBlockSize() != test.blockSize {
+			t.Errorf("mode %d, block size %d: decoder reports mode %d, block size %d",
+				test.mode, test.blockSize, decoder.GetCodingMode(), decoder.GetBlockSize())
+		}
+		decodeEvents(t, decoder)
+	}
+
+	// without header options, the settings of the decoding factory apply
+	factory := NewDefaultEXIFactory()
+	factory.SetCodingMode(CodingModeBytePacked)
+	decoder, err := factory.CreateEXIBodyDecoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoder.GetCodingMode() != CodingModeBytePacked || decoder.GetBlockSize() != DefaultBlockSize {
+		t.Errorf("decoder reports mode %d, block size %d", decoder.GetCodingMode(), decoder.GetBlockSize())
+	}
+}
+
+// DecodeHeader selects the reordered decoder for streams announcing
+// (pre-)compression in their header.
+func TestDecodeHeaderReordered(t *testing.T) {
+	events := []string{"SD", "SE records"}
+	for i := range 300 {
+		events = append(events, "SE record", fmt.Sprintf("AT id=%d", i), "SE name", fmt.Sprintf("CH name %d", i%7), "EE", "EE")
+	}
+	events = append(events, "EE", "ED")
+
+	for _, mode := range []CodingMode{CodingModeCompression, CodingModePreCompression} {
+		for _, blockSize := range []int{100, 1000, 1000000} {
+			factory := NewDefaultEXIFactory()
+			factory.SetCodingMode(mode)
+			factory.SetBlockSize(blockSize)
+			if err := factory.GetEncodingOptions().SetOption(OptionIncludeOptions); err != nil {
+				t.Fatal(err)
+			}
+			streamEncoder, err := factory.CreateEXIStreamEncoder()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			writer := bufio.NewWriter(&buf)
+			encoder, err := streamEncoder.EncodeHeader(writer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := encodeEvents(encoder, events); err != nil {
+				t.Fatal(err)
+			}
+			if err := writer.Flush(); err != nil {
+				t.Fatal(err)
+			}
+
+			streamDecoder, err := NewDefaultEXIFactory().CreateEXIStreamDecoder()
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoder, err := streamDecoder.DecodeHeader(bufio.NewReader(&buf))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := decoder.(*EXIBodyDecoderReordered); !ok {
+				t.Errorf("mode %d, block size %d: got %T", mode, blockSize, decoder)
+				continue
+			}
+			if got := decodeEvents(t, decoder); !slices.Equal(got, events) {
+				t.Errorf("mode %d, block size %d: decoded %d events, want %d", mode, blockSize, len(got), len(events))
+			}
+		}
+	}
+}
+
+func TestEncodeTypedCharactersOnce(t *testing.T) {
+	headerGrammars, err := NewEXIOptionsHeaderGrammars()
+	if err != nil {
+		t.Fatal(err)
+	}
+	factory := NewDefaultEXIFactory()
+	factory.SetGrammars(headerGrammars)
+	encoder, err := factory.CreateEXIBodyEncoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := encoder.SetOutput(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// each typed value is pending until the following EE and must not be
+	// encoded again with the next characters
+	err = encodeAll(
+		encoder.EncodeStartDocument,
+		func() error { return encoder.EncodeStartElement(W3C_EXI_NS_URI, EXIHeader_Header, nil) },
+		func() error { return encoder.EncodeStartElement(W3C_EXI_NS_URI, EXIHeader_LessCommon, nil) },
+		func() error { return encoder.EncodeStartElement(W3C_EXI_NS_URI, EXIHeader_Uncommon, nil) },
+		func() error { return encoder.EncodeStartElement(W3C_EXI_NS_URI, EXIHeader_ValueMaxLength, nil) },
+		func() error { return encoder.EncodeCharacters(NewIntegerValue32(5)) },
+		encoder.EncodeEndElement,
+		func() error { return encoder.EncodeStartElement(W3C_EXI_NS_URI, EXIHeader_ValuePartitionCapacity, nil) },
+		func() error { return encoder.EncodeCharacters(NewIntegerValue32(7)) },
+		encoder.EncodeEndElement,
+		encoder.EncodeEndElement,
+		encoder.EncodeEndElement,
+		encoder.EncodeEndElement,
+		encoder.EncodeEndDocument,
+		encoder.Flush,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"SD", "SE header", "SE lesscommon", "SE uncommon", "SE valueMaxLength", "CH 5", "EE",
+		"SE valuePartitionCapacity", "CH 7", "EE", "EE", "EE", "EE", "ED"}
+	if got := decodeBody(t, factory, buf.Bytes()); !slices.Equal(got, want) {
+		t.Errorf("decoded %q, want %q", got, want)
+	}
+}
+
+func TestSetOutputFlush(t *testing.T) {
+	events := []string{"SD", "SE r", "CH text", "EE", "ED"}
+	for _, mode := range []CodingMode{CodingModeBitPacked, CodingModeBytePacked, CodingModeCompression} {
+		t.Run(fmt.Sprint(mode), func(t *testing.T) {
+			factory := NewDefaultEXIFactory()
+			factory.SetCodingMode(mode)
+			encoder, err := factory.CreateEXIBodyEncoder()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			if err := encoder.SetOutput(&buf); err != nil {
+				t.Fatal(err)
+			}
+			// encodeEvents ends with Flush, there is no writer to flush
+			if err := encodeEvents(encoder, events); err != nil {
+				t.Fatal(err)
+			}
+			if buf.Len() == 0 {
+				t.Fatal("no bytes written after Flush")
+			}
+
+			decoder, err := factory.CreateEXIBodyDecoder()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := decoder.SetInput(&buf); err != nil {
+				t.Fatal(err)
+			}
+			if got := decodeEvents(t, decoder); !reflect.DeepEqual(got, events) {
+				t.Errorf("got %q, want %q", got, events)
+			}
+		})
+	}
+}
+
+func TestSpecificationStreams(t *testing.T) {
+	// <r>t</r> schema-less with default options, worked out by hand from the
+	// EXI 1.0 specification: header 10 0 00000, SE(*) with uri hit "" (2
+	// bits) and local-name miss "r", CH (0.3) with value miss "t", EE (0).
+	// Pre-compression has the byte-aligned structure channel, followed by
+	// the value channel of r as there are less than 100 values.
+	events := []string{"SD", "SE r", "CH t", "EE", "ED"}
+	encode := func(mode CodingMode) []byte {
+		factory := NewDefaultEXIFactory()
+		factory.SetCodingMode(mode)
+		streamEncoder, err := factory.CreateEXIStreamEncoder()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		writer := bufio.NewWriter(&buf)
+		encoder, err := streamEncoder.EncodeHeader(writer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := encodeEvents(encoder, events); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	decode := func(mode CodingMode, exi []byte) {
+		factory := NewDefaultEXIFactory()
+		factory.SetCodingMode(mode)
+		streamDecoder, err := factory.CreateEXIStreamDecoder()
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoder, err := streamDecoder.DecodeHeader(bufio.NewReader(bytes.NewReader(exi)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := decodeEvents(t, decoder); !reflect.DeepEqual(got, events) {
+			t.Errorf("mode %d: decoded %q, want %q", mode, got, events)
+		}
+	}
+
+	tests := []struct {
+		mode CodingMode
+		exi  []byte
+	}{
+		{CodingModeBitPacked, []byte{0x80, 0x40, 0x9c, 0xb0, 0x37, 0x40}},
+		{CodingModeBytePacked, []byte{0x80, 0x01, 0x02, 0x72, 0x03, 0x03, 0x74, 0x00}},
+		{CodingModePreCompression, []byte{0x80, 0x01, 0x02, 0x72, 0x03, 0x00, 0x03, 0x74}},
+	}
+	for _, test := range tests {
+		if exi := encode(test.mode); !bytes.Equal(exi, test.exi) {
+			t.Errorf("mode %d: encoded % x, want % x", test.mode, exi, test.exi)
+		}
+		decode(test.mode, test.exi)
+	}
+
+	// Compression deflates the channels of pre-compression. How they are
+	// deflated is up to the compressor, so the encoded body is compared
+	// inflated, and the decoder reads them from a single stored block.
+	preCompressed := tests[2].exi
+	exi := encode(CodingModeCompression)
+	body, err := io.ReadAll(flate.NewReader(bytes.NewReader(exi[1:])))
+	if err != nil || exi[0] != 0x80 || !bytes.Equal(body, preCompressed[1:]) {
+		t.Errorf("compression: encoded % x, inflated body % x, %v", exi, body, err)
+	}
+	stored := []byte{0x80, 0x01, 0x07, 0x00, 0xf8, 0xff}
+	decode(CodingModeCompression, append(stored, preCompressed[1:]...))
+}
+
+func TestDecodeEvent(t *testing.T) {
+	events := []string{
+		"SD", "CM head", "SE r", "AT a=1", "SE e", "CH text", "EE",
+		"PI target some data", "SE e", "AT b=2", "EE", "CH tail", "EE", "ED",
+	}
+	for _, mode := range []CodingMode{CodingModeBitPacked, CodingModeBytePacked, CodingModeCompression} {
+		factory := NewDefaultEXIFactory()
+		factory.SetCodingMode(mode)
+		for _, feature := range []string{FeatureComment, FeaturePI} {
+			if err := factory.GetFidelityOptions().SetFidelity(feature, true); err != nil {
+				t.Fatal(err)
+			}
+		}
+		exi := encodeBody(t, factory, events)
+
+		decoder, err := factory.CreateEXIBodyDecoder()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := decoder.SetInputStream(bufio.NewReader(bytes.NewReader(exi))); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for {
+			ev, exists, err := decoder.DecodeEvent()
+			if err != nil {
+				t.Fatalf("mode %d: %v", mode, err)
+			}
+			if !exists {
+				break
+			}
+			var value string
+			if ev.Value != nil {
+				if value, err = ev.Value.ToString(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			switch ev.EventType {
+			case EventTypeStartDocument:
+				got = append(got, "SD")
+			case EventTypeEndDocument:
+				got = append(got, "ED")
+			case EventTypeStartElementGeneric, EventTypeStartElementGenericUndeclared, EventTypeStartElement:
+				got = append(got, "SE "+ev.QNameContext.GetLocalName())
+			case EventTypeEndElement, EventTypeEndElementUndeclared:
+				got = append(got, "EE")
+			case EventTypeAttributeGenericUndeclared, EventTypeAttribute:
+				got = append(got, "AT "+ev.QNameContext.GetLocalName()+"="+value)
+			case EventTypeCharactersGenericUndeclared, EventTypeCharacters:
+				got = append(got, "CH "+value)
+			case EventTypeComment:
+				got = append(got, "CM "+ev.Comment.Text)
+			case EventTypeProcessingInstruction:
+				got = append(got, "PI "+ev.ProcessingInstruction.Target+" "+ev.ProcessingInstruction.Data)
+			default:
+				t.Fatalf("mode %d: unexpected event %+v", mode, ev)
+			}
+		}
+		if !reflect.DeepEqual(got, events) {
+			t.Errorf("mode %d: got %q, want %q", mode, got, events)
+		}
+	}
+}
+
+func TestNextWithContext(t *testing.T) {
+	events := []string{"SD", "SE r"}
+	for range 100 {
+		events = append(events, "SE e", "CH text", "EE")
+	}
+	events = append(events, "EE", "ED")
+	factory := NewDefaultEXIFactory()
+	exi := encodeBody(t, factory, events)
+
+	decoder, err := factory.CreateEXIBodyDecoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := decoder.SetInputStream(bufio.NewReader(bytes.NewReader(exi))); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for n := 0; ; n++ {
+		if n == 10 {
+			cancel()
+		}
+		eventType, exists, err := decoder.NextWithContext(ctx)
+		if err != nil {
+			if !errors.Is(err, context.Canceled) || n != 10 {
+				t.Fatalf("event %d: got error %v, want context.Canceled at event 10", n, err)
+			}
+			return
+		}
+		if !exists {
+			t.Fatal("decoded the whole document despite cancellation")
+		}
+		if _, err := decodeNext(decoder, eventType); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDecodeFragment(t *testing.T) {
+	events := []string{"SD", "SE a", "CH 1", "EE", "CM between", "SE b", "AT x=2", "SE c", "EE", "EE", "SE a", "EE", "ED"}
+	want := [][]string{{"SE a", "CH 1", "EE"}, {"CM between"}, {"SE b", "AT x=2", "SE c", "EE", "EE"}, {"SE a", "EE"}}
+	factory := NewDefaultEXIFactory()
+	factory.SetFragment(true)
+	if err := factory.GetFidelityOptions().SetFidelity(FeatureComment, true); err != nil {
+		t.Fatal(err)
+	}
+	exi := encodeBody(t, factory, events)
+
+	decode := func(handle func(events []DecodedEvent) error) error {
+		decoder, err := factory.CreateEXIBodyDecoder()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := decoder.SetInput(bytes.NewReader(exi)); err != nil {
+			t.Fatal(err)
+		}
+		return DecodeFragment(decoder, handle)
+	}
+
+	var got [][]string
+	err := decode(func(events []DecodedEvent) error {
+		var item []string
+		for _, ev := range events {
+			switch ev.EventType {
+			case EventTypeStartElement, EventTypeStartElementGeneric, EventTypeStartElementGenericUndeclared:
+				item = append(item, "SE "+ev.QNameContext.GetLocalName())
+			case EventTypeAttribute, EventTypeAttributeGeneric, EventTypeAttributeGenericUndeclared:
+				value, _ := ev.Value.ToString()
+				item = append(item, "AT "+ev.QNameContext.GetLocalName()+"="+value)
+			case EventTypeCharacters, EventTypeCharactersGeneric, EventTypeCharactersGenericUndeclared:
+				value, _ := ev.Value.ToString()
+				item = append(item, "CH "+value)
+			case EventTypeEndElement, EventTypeEndElementUndeclared:
+				item = append(item, "EE")
+			case EventTypeComment:
+				item = append(item, "CM "+string(ev.Comment.Text))
+			default:
+				item = append(item, fmt.Sprintf("event type %d", ev.EventType))
+			}
+		}
+		got = append(got, item)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// the first error of handle stops decoding
+	errStop := errors.New("stop")
+	calls := 0
+	if err := decode(func([]DecodedEvent) error { calls++; return errStop }); err != errStop || calls != 1 {
+		t.Errorf("got error %v after %d calls, want %v after 1", err, calls, errStop)
+	}
+
+	// the NS events of each root element determine its prefix
+	factory = NewDefaultEXIFactory()
+	factory.SetFragment(true)
+	if err := factory.GetFidelityOptions().SetFidelity(FeaturePrefix, true); err != nil {
+		t.Fatal(err)
+	}
+	encoder, err := factory.CreateEXIBodyEncoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := encoder.SetOutput(&buf); err != nil {
+		t.Fatal(err)
+	}
+	p, q := "p", "q"
+	err = encodeAll(
+		encoder.EncodeStartDocument,
+		func() error { return encoder.EncodeStartElement("urn:p", "a", &p) },
+		func() error { return encoder.EncodeNamespaceDeclaration("urn:p", &p) },
+		encoder.EncodeEndElement,
+		func() error { return encoder.EncodeStartElement("urn:q", "b", &q) },
+		func() error { return encoder.EncodeNamespaceDeclaration("urn:q", &q) },
+		encoder.EncodeEndElement,
+		encoder.EncodeEndDocument,
+		encoder.Flush,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exi = buf.Bytes()
+	var prefixes []string
+	if err := decode(func(events []DecodedEvent) error {
+		if events[0].Prefix == nil {
+			prefixes = append(prefixes, "<nil>")
+		} else {
+			prefixes = append(prefixes, *events[0].Prefix)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"p", "q"}; !slices.Equal(prefixes, want) {
+		t.Errorf("prefixes %q, want %q", prefixes, want)
+	}
+}
+
+func TestEventLogReplay(t *testing.T) {
+	events := []string{
+		"SD", "CM head", "SE r", "AT a=1", "SE e", "CH text", "EE",
+		"PI target some data", "SE e", "AT b=2", "EE", "CH tail", "EE", "ED",
+	}
+	tests := []struct {
+		features []string
+		encode   func(encoder EXIBodyEncoder) error
+	}{
+		{
+			[]string{FeatureComment, FeaturePI},
+			func(encoder EXIBodyEncoder) error { return encodeEvents(encoder, events) },
+		},
+		{
+			// the NS events determine the prefix of the start element
+			[]string{FeaturePrefix},
+			func(encoder EXIBodyEncoder) error {
+				p, q := "p", "q"
+				return encodeAll(
+					encoder.EncodeStartDocument,
+					func() error { return encoder.EncodeStartElement("urn:p", "r", &p) },
+					func() error { return encoder.EncodeNamespaceDeclaration("urn:q", &q) },
+					func() error { return encoder.EncodeNamespaceDeclaration("urn:p", &p) },
+					func() error { return encoder.EncodeAttribute("urn:q", "a", &q, NewStringValueFromString("1")) },
+					func() error { return encoder.EncodeStartElement("urn:q", "e", &q) },
+					encoder.EncodeEndElement,
+					encoder.EncodeEndElement,
+					encoder.EncodeEndDocument,
+				)
+			},
+		},
+	}
+	for _, mode := range []CodingMode{CodingModeBitPacked, CodingModeBytePacked, CodingModeCompression} {
+		for _, test := range tests {
+			factory := NewDefaultEXIFactory()
+			factory.SetCodingMode(mode)
+			for _, feature := range test.features {
+				if err := factory.GetFidelityOptions().SetFidelity(feature, true); err != nil {
+					t.Fatal(err)
+				}
+			}
+			encode := func(encode func(encoder EXIBodyEncoder) error) []byte {
+				encoder, err := factory.CreateEXIBodyEncoder()
+				if err != nil {
+					t.Fatal(err)
+				}
+				var buf bytes.Buffer
+				if err := encoder.SetOutput(&buf); err != nil {
+					t.Fatal(err)
+				}
+				if err := encode(encoder); err != nil {
+					t.Fatalf("mode %d, %v: %v", mode, test.features, err)
+				}
+				if err := encoder.Flush(); err != nil {
+					t.Fatal(err)
+				}
+				return buf.Bytes()
+			}
+			exi := encode(test.encode)
+
+			decoder, err := factory.CreateEXIBodyDecoder()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := decoder.SetInput(bytes.NewReader(exi)); err != nil {
+				t.Fatal(err)
+			}
+			log, err := DecodeToEventLog(decoder)
+			if err != nil {
+				t.Fatalf("mode %d, %v: %v", mode, test.features, err)
+			}
+			replayed := encode(func(encoder EXIBodyEncoder) error { return ReplayEventLog(log, encoder) })
+			if !bytes.Equal(replayed, exi) {
+				t.Errorf("mode %d, %v: replayed % x, want % x", mode, test.features, replayed, exi)
+			}
+		}
+	}
+}
+
+// decodeMalformed decodes exi until the end or the first error, which is
+// all that is expected of malformed streams.
+func decodeMalformed(factory EXIFactory, exi []byte) error {
+	decoder, err := factory.CreateEXIBodyDecoder()
+	if err != nil {
+		return err
+	}
+	if err := decoder.SetInputStream(bufio.NewReader(bytes.NewReader(exi))); err != nil {
+		return err
+	}
+	for {
+		eventType, exists, err := decoder.Next()
+		if err != nil || !exists {
+			return err
+		}
+		if _, err := decodeNext(decoder, eventType); err != nil {
+			return err
+		}
+	}
+}
+
+// malformedFactory returns the factory used to decode malformed streams.
+func malformedFactory(mode CodingMode) EXIFactory {
+	factory := NewDefaultEXIFactory()
+	factory.SetCodingMode(mode)
+	factory.GetFidelityOptions().SetFidelity(FeatureComment, true)
+	factory.GetFidelityOptions().SetFidelity(FeaturePI, true)
+	return factory
+}
+
+var malformedSeed = []string{
+	"SD", "CM head", "SE r", "AT a=1", "SE e", "CH text", "EE",
+	"PI target data", "SE e", "AT a=2", "CH text", "EE", "SE f", "EE", "EE", "ED",
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	for _, mode := range []CodingMode{CodingModeBitPacked, CodingModeBytePacked} {
+		factory := malformedFactory(mode)
+		exi := encodeBody(t, factory, malformedSeed)
+
+		// every truncation and every single bit flip of a valid stream
+		for n := range len(exi) {
+			if err := decodeMalformed(factory, exi[:n]); err == nil {
+				t.Errorf("mode %d: no error for stream truncated to %d bytes", mode, n)
+			}
+		}
+		for i := range 8 * len(exi) {
+			flipped := bytes.Clone(exi)
+			flipped[i/8] ^= 0x80 >> (i % 8)
+			_ = decodeMalformed(factory, flipped)
+		}
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	for _, mode := range []CodingMode{CodingModeBitPacked, CodingModeBytePacked} {
+		f.Add(byte(mode), encodeBody(f, malformedFactory(mode), malformedSeed))
+		f.Add(byte(mode), encodeBody(f, malformedFactory(mode), []string{"SD", "SE r", "EE", "ED"}))
+	}
+	f.Fuzz(func(t *testing.T, mode byte, exi []byte) {
+		_ = decodeMalformed(malformedFactory(CodingMode(mode%2)), exi)
+	})
+}
+
+func TestEncoderReset(t *testing.T) {
+	docs := [][]string{
+		{"SD", "SE r", "AT a=1", "SE e", "CH text", "EE", "EE", "ED"},
+		{"SD", "SE other", "CH text", "EE", "ED"},
+		// abandoned half-way
+		{"SD", "SE r", "SE e", "SE e", "CH deep"},
+		{"SD", "SE r", "AT a=1", "SE e", "CH text", "EE", "EE", "ED"},
+	}
+	for _, mode := range []CodingMode{CodingModeBitPacked, CodingModeBytePacked, CodingModeCompression} {
+		factory := NewDefaultEXIFactory()
+		factory.SetCodingMode(mode)
+		encoder, err := factory.CreateEXIBodyEncoder()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, events := range docs {
+			if err := encoder.Reset(); err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			if err := encoder.SetOutput(&buf); err != nil {
+				t.Fatal(err)
+			}
+			err := encodeEvents(encoder, events)
+			if events[len(events)-1] != "ED" {
+				continue
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// a reset encoder encodes like a new one
+			if want := encodeBody(t, factory, events); !bytes.Equal(buf.Bytes(), want) {
+				t.Errorf("mode %d, document %d: got % x, want % x", mode, i, buf.Bytes(), want)
+			}
+		}
+	}
+}
+
+// benchmarkEncodeDocuments encodes 1000 small documents per iteration with
+// encoders returned by next.
+func benchmarkEncodeDocuments(b *testing.B, next func(factory EXIFactory) EXIBodyEncoder) {
+	events := []string{"SD", "SE r", "AT id=1", "SE name", "CH some name", "EE", "SE value", "CH 42", "EE", "EE", "ED"}
+	factory := NewDefaultEXIFactory()
+	var buf bytes.Buffer
+	b.ReportAllocs()
+	for b.Loop() {
+		for range 1000 {
+			encoder := next(factory)
+			buf.Reset()
+			if err := encoder.SetOutput(&buf); err != nil {
+				b.Fatal(err)
+			}
+			if err := encodeEvents(encoder, events); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkEncodeNewEncoder(b *testing.B) {
+	benchmarkEncodeDocuments(b, func(factory EXIFactory) EXIBodyEncoder {
+		encoder, err := factory.CreateEXIBodyEncoder()
+		if err != nil {
+			b.Fatal(err)
+		}
+		return encoder
+	})
+}
+
+func BenchmarkEncodeResetEncoder(b *testing.B) {
+	var encoder EXIBodyEncoder
+	benchmarkEncodeDocuments(b, func(factory EXIFactory) EXIBodyEncoder {
+		if encoder == nil {
+			var err error
+			if encoder, err = factory.CreateEXIBodyEncoder(); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := encoder.Reset(); err != nil {
+			b.Fatal(err)
+		}
+		return encoder
+	})
+}
+
+// nestedEvents returns the events of a document nesting depth elements,
+// each starting with its depth as characters.
+func nestedEvents(depth int) []string {
+	events := []string{"SD"}
+	for i := range depth {
+		events = append(events, "SE e", fmt.Sprintf("CH %d", i))
+	}
+	for range depth {
+		events = append(events, "EE")
+	}
+	return append(events, "ED")
+}
+
+func TestDeeplyNestedRoundTrip(t *testing.T) {
+	events := nestedEvents(5000)
+	for _, mode := range []CodingMode{CodingModeBitPacked, CodingModeCompression} {
+		factory := NewDefaultEXIFactory()
+		factory.SetCodingMode(mode)
+		encoder, err := factory.CreateEXIBodyEncoder()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := encoder.SetOutput(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if err := encodeEvents(encoder, events); err != nil {
+			t.Fatal(err)
+		}
+		if got := decodeBody(t, factory, buf.Bytes()); !slices.Equal(got, events) {
+			t.Errorf("mode %d: decoded events differ", mode)
+		}
+
+		// the stack doubles from 16 to the next power of two
+		if mode == CodingModeBitPacked {
+			if n := len(encoder.(*EXIBodyEncoderInOrder).elementContextStack); n != 8192 {
+				t.Errorf("element context stack size %d, want 8192", n)
+			}
+		}
+	}
+}
+
+func BenchmarkEncodeDeeplyNested(b *testing.B) {
+	events := nestedEvents(5000)
+	factory := NewDefaultEXIFactory()
+	var buf bytes.Buffer
+	b.ReportAllocs()
+	for b.Loop() {
+		encoder, err := factory.CreateEXIBodyEncoder()
+		if err != nil {
+			b.Fatal(err)
+		}
+		buf.Reset()
+		if err := encoder.SetOutput(&buf); err != nil {
+			b.Fatal(err)
+		}
+		if err := encodeEvents(encoder, events); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchmarkDecodeNested decodes a document nesting 200 elements with new
+// decoders using the given initial element context stack size.
+func benchmarkDecodeNested(b *testing.B, stackSize int) {
+	events := []string{"SD"}
+	for range 200 {
+		events = append(events, "SE e")
+	}
+	events = append(events, "CH x")
+	for range 200 {
+		events = append(events, "EE")
+	}
+	events = append(events, "ED")
+
+	factory := NewDefaultEXIFactory()
+	factory.SetInitialElementStackSize(stackSize)
+	exi := encodeBody(b, factory, events)
+	b.ReportAllocs()
+	for b.Loop() {
+		decoder, err := factory.CreateEXIBodyDecoder()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := decoder.SetInputStream(bufio.NewReader(bytes.NewReader(exi))); err != nil {
+			b.Fatal(err)
+		}
+		decodeEvents(b, decoder)
+	}
+}
+
+func BenchmarkDecodeNestedDefaultStack(b *testing.B) {
+	benchmarkDecodeNested(b, ElementContextsInitialStackSize)
+}
+
+func BenchmarkDecodeNestedSizedStack(b *testing.B) {
+	benchmarkDecodeNested(b, 256)
+}
+
+// distinctNames returns the events of a document with n distinct element
+// names starting with prefix.
+func distinctNames(prefix string, n int) []string {
+	events := []string{"SD", "SE r"}
+	for i := range n {
+		events = append(events, fmt.Sprintf("SE %s%d", prefix, i), "AT a=1", "EE")
+	}
+	return append(events, "EE", "ED")
+}
+
+func TestObjectArena(t *testing.T) {
+	factory := NewDefaultEXIFactory()
+	factory.SetObjectArena(16)
+	encoder, err := factory.CreateEXIBodyEncoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder, err := factory.CreateEXIBodyDecoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// recycled blocks must not leak names of previous streams, more names
+	// than the arena holds fall back to regular allocation
+	for i, events := range [][]string{distinctNames("a", 40), distinctNames("b", 5), distinctNames("a", 20)} {
+		var buf bytes.Buffer
+		writer := bufio.NewWriter(&buf)
+		if err := encoder.SetOutputStream(writer); err != nil {
+			t.Fatal(err)
+		}
+		if err := encodeEvents(encoder, events); err != nil {
+			t.Fatalf("stream %d: encode: %v", i, err)
+		}
+		if err := writer.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if err := decoder.SetInputStream(bufio.NewReader(bytes.NewReader(buf.Bytes()))); err != nil {
+			t.Fatal(err)
+		}
+		if got := decodeEvents(t, decoder); !reflect.DeepEqual(got, events) {
+			t.Errorf("stream %d: got %q, want %q", i, got, events)
+		}
+	}
+}
+
+// benchmarkObjectArena reuses one encoder and one decoder for a document
+// with 200 distinct element names.
+func benchmarkObjectArena(b *testing.B, size int) {
+	events := distinctNames("e", 200)
+	factory := NewDefaultEXIFactory()
+	factory.SetObjectArena(size)
+	encoder, err := factory.CreateEXIBodyEncoder()
+	if err != nil {
+		b.Fatal(err)
+	}
+	decoder, err := factory.CreateEXIBodyDecoder()
+	if err != nil {
+		b.Fatal(err)
+	}
+	var buf bytes.Buffer
+	writer := bufio.NewWriter(&buf)
+	b.ReportAllocs()
+	for b.Loop() {
+		buf.Reset()
+		writer.Reset(&buf)
+		if err := encoder.SetOutputStream(writer); err != nil {
+			b.Fatal(err)
+		}
+		if err := encodeEvents(encoder, events); err != nil {
+			b.Fatal(err)
+		}
+		if err := writer.Flush(); err != nil {
+			b.Fatal(err)
+		}
+		if err := decoder.SetInputStream(bufio.NewReader(bytes.NewReader(buf.Bytes()))); err != nil {
+			b.Fatal(err)
+		}
+		decodeEvents(b, decoder)
+	}
+}
+
+func BenchmarkNoObjectArena(b *testing.B) {
+	benchmarkObjectArena(b, 0)
+}
+
+func BenchmarkObjectArena(b *testing.B) {
+	benchmarkObjectArena(b, 256)
+}
+
+// scOffsets records the byte offsets of self-contained fragments.
+type scOffsets []int
+
+func (o *scOffsets) ScElement(uri, localName *string, channel EncoderChannel) error {
+	*o = append(*o, channel.GetLength())
+	return nil
+}
+
+func TestSelfContainedHeaderOption(t *testing.T) {
+	events := []string{"SD", "SE r", "SE s", "CH a", "EE", "SE s", "CH b", "EE", "EE", "ED"}
+	want := []string{"SD", "SE r", "SE s", "SC", "CH a", "EE", "SE s", "SC", "CH b", "EE", "EE", "ED"}
+	for _, mode := range []CodingMode{CodingModeBitPacked, CodingModeBytePacked} {
+		factory := NewDefaultEXIFactory()
+		factory.SetCodingMode(mode)
+		if err := factory.GetFidelityOptions().SetFidelity(FeatureSC, true); err != nil {
+			t.Fatal(err)
+		}
+		factory.SetSelfContainedElements([]utils.QName{{Local: "s"}})
+		if err := factory.GetEncodingOptions().SetOption(OptionIncludeOptions); err != nil {
+			t.Fatal(err)
+		}
+		streamEncoder, err := factory.CreateEXIStreamEncoder()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		writer := bufio.NewWriter(&buf)
+		encoder, err := streamEncoder.EncodeHeader(writer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := encodeEvents(encoder, events); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		// the plain decoding factory gets selfContained from the header
+		streamDecoder, err := NewDefaultEXIFactory().CreateEXIStreamDecoder()
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoder, err := streamDecoder.DecodeHeader(bufio.NewReader(&buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := decoder.(*EXIBodyDecoderInOrderSC); !ok {
+			t.Errorf("mode %d: got decoder %T, want *EXIBodyDecoderInOrderSC", mode, decoder)
+		}
+		if got := decodeEvents(t, decoder); !reflect.DeepEqual(got, want) {
+			t.Errorf("mode %d: got %q, want %q", mode, got, want)
+		}
+	}
+}
+
+func TestSelfContainedSiblings(t *testing.T) {
+	var events []string
+	for i := range 3 {
+		events = append(events, "SE s", fmt.Sprintf("AT id=%d", i), "SE v", fmt.Sprintf("CH record %d", i), "EE", "EE")
+	}
+	events = slices.Concat([]string{"SD", "SE r"}, events, []string{"EE", "ED"})
+
+	for _, mode := range []CodingMode{CodingModeBitPacked, CodingModeBytePacked} {
+		t.Run(fmt.Sprint(mode), func(t *testing.T) {
+			var offsets scOffsets
+			factory := NewDefaultEXIFactory()
+			factory.SetCodingMode(mode)
+			if err := factory.GetFidelityOptions().SetFidelity(FeatureSC, true); err != nil {
+				t.Fatal(err)
+			}
+			factory.SetSelfContainedElementsWithHandler([]utils.QName{{Local: "s"}}, &offsets)
+			exi := encodeBody(t, factory, events)
+
+			var want []string
+			for _, event := range events {
+				if event == "SE s" {
+					want = append(want, event, "SC")
+				} else {
+					want = append(want, event)
+				}
+			}
+			if got := decodeBody(t, factory, exi); !reflect.DeepEqual(got, want) {
+				t.Errorf("got %q, want %q", got, want)
+			}
+
+			// every record is a fragment of its own at an aligned offset
+			if len(offsets) != 3 {
+				t.Fatalf("got %d self-contained fragments, want 3", len(offsets))
+			}
+			fragmentFactory := factory.Clone()
+			fragmentFactory.SetFragment(true)
+			for i, offset := range offsets {
+				got := decodeBody(t, fragmentFactory, exi[offset:])
+				want := slices.Concat([]string{"SD"}, events[2+6*i:2+6*(i+1)], []string{"ED"})
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("record %d: got %q, want %q", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+// Self-contained elements within self-contained fragments are coded by a
+// coder of the enclosing fragment, each level aligned and decodable on its
+// own.
+func TestSelfContainedNested(t *testing.T) {
+	names := []string{"a", "b", "a", "b", "a"}
+	// nestedEvents returns the events of the levels from on, with "SC" after
+	// the start of nested fragments if sc is set.
+	nestedEvents := func(from int, sc bool) []string {
+		var events []string
+		for level := from; level < len(names); level++ {
+			events = append(events, "SE "+names[level])
+			if sc {
+				events = append(events, "SC")
+			}
+			events = append(events, fmt.Sprintf("AT level=%d", level), "CH x")
+		}
+		for range len(names) - from {
+			events = append(events, "EE")
+		}
+		return events
+	}
+	events := slices.Concat([]string{"SD", "SE r"}, nestedEvents(0, false), []string{"EE", "ED"})
+	want := slices.Concat([]string{"SD", "SE r"}, nestedEvents(0, true), []string{"EE", "ED"})
+
+	for _, mode := range []CodingMode{CodingModeBitPacked, CodingModeBytePacked} {
+		var offsets scOffsets
+		factory := NewDefaultEXIFactory()
+		factory.SetCodingMode(mode)
+		if err := factory.GetFidelityOptions().SetFidelity(FeatureSC, true); err != nil {
+			t.Fatal(err)
+		}
+		factory.SetSelfContainedElementsWithHandler([]utils.QName{{Local: "a"}, {Local: "b"}}, &offsets)
+		exi := encodeBody(t, factory, events)
+		if got := decodeBody(t, factory, exi); !reflect.DeepEqual(got, want) {
+			t.Errorf("mode %d: got %q, want %q", mode, got, want)
+		}
+
+		// each level starts a fragment with fresh grammars and string tables
+		if len(offsets) != len(names) {
+			t.Fatalf("mode %d: got %d self-contained fragments, want %d", mode, len(offsets), len(names))
+		}
+		fragmentFactory := factory.Clone()
+		fragmentFactory.SetFragment(true)
+		for level, offset := range offsets {
+			got := decodeBody(t, fragmentFactory, exi[offset:])
+			// Note: the levels within the fragment are fragments as well
+			nested := nestedEvents(level, true)
+			want := slices.Concat([]string{"SD", nested[0]}, nested[2:], []string{"ED"})
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("mode %d, level %d: got %q, want %q", mode, level, got, want)
+			}
+		}
+	}
+}
+
+// decodeSkippingSC decodes exi and calls skip at the SC event of the
+// self-contained element at the given nesting level (1 is the outermost),
+// which is logged as "SKIP".
+func decodeSkippingSC(t *testing.T, factory EXIFactory, exi []byte, level int, skip func(d *EXIBodyDecoderInOrderSC) error) []string {
+	t.Helper()
+	decoder, err := factory.CreateEXIBodyDecoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := decoder.SetInputStream(bufio.NewReader(bytes.NewReader(exi))); err != nil {
+		t.Fatal(err)
+	}
+	var events []string
+	scLevel := 0
+	for {
+		eventType, exists, err := decoder.Next()
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if !exists {
+			return events
+		}
+		if eventType == EventTypeSelfContained {
+			if scLevel++; scLevel == level {
+				if err := skip(decoder.(*EXIBodyDecoderInOrderSC)); err != nil {
+					t.Fatalf("skip: %v", err)
+				}
+				events = append(events, "SKIP")
+				continue
+			}
+		}
+		event, err := decodeNext(decoder, eventType)
+		if err != nil {
+			t.Fatalf("decode %s: %v", eventType, err)
+		}
+		events = append(events, event)
+	}
+}
+
+func TestSkipCurrentSCElement(t *testing.T) {
+	// both s elements are self-contained
+	events := []string{
+		"SD", "SE r",
+		"SE s", "SE a", "CH 1", "EE", "SE s", "SE b", "CH 2", "EE", "EE", "EE",
+		"SE n", "CH 3", "EE",
+		"EE", "ED",
+	}
+	tests := []struct {
+		level int
+		want  []string
+	}{
+		{1, []string{"SD", "SE r", "SE s", "SKIP", "SE n", "CH 3", "EE", "EE", "ED"}},
+		{2, []string{"SD", "SE r", "SE s", "SC", "SE a", "CH 1", "EE", "SE s", "SKIP", "EE", "SE n", "CH 3", "EE", "EE", "ED"}},
+	}
+	for _, mode := range []CodingMode{CodingModeBitPacked, CodingModeBytePacked} {
+		factory := NewDefaultEXIFactory()
+		factory.SetCodingMode(mode)
+		if err := factory.GetFidelityOptions().SetFidelity(FeatureSC, true); err != nil {
+			t.Fatal(err)
+		}
+		factory.SetSelfContainedElements([]utils.QName{{Local: "s"}})
+		exi := encodeBody(t, factory, events)
+
+		for _, test := range tests {
+			var skipped int64
+			got := decodeSkippingSC(t, factory, exi, test.level, func(d *EXIBodyDecoderInOrderSC) error {
+				var err error
+				skipped, err = d.SkipCurrentSCElement()
+				return err
+			})
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("mode %d, level %d: got %q, want %q", mode, test.level, got, test.want)
+			}
+			if skipped <= 0 {
+				t.Errorf("mode %d, level %d: %d bytes skipped", mode, test.level, skipped)
+				continue
+			}
+
+			// the same stream again with the known length
+			got = decodeSkippingSC(t, factory, exi, test.level, func(d *EXIBodyDecoderInOrderSC) error {
+				return d.SkipSCElement(skipped)
+			})
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("mode %d, level %d: SkipSCElement(%d): got %q, want %q", mode, test.level, skipped, got, test.want)
+			}
+		}
+	}
+}
+
+// encodeEvents encodes events written as "SD", "ED", "SE name", "EE",
+// "AT name=value", "NS prefix=uri", "CH text", "CM text" or
+// "PI target data". "FREEZE" calls FreezeGrammars and "PRESERVE true" or
+// "PRESERVE false" calls SetPreserveWhitespace.
+func encodeEvents(encoder EXIBodyEncoder, events []string) error {
+	for _, event := range events {
+		code, arg, _ := strings.Cut(event, " ")
+		var err error
+		switch code {
+		case "SD":
+			err = encoder.EncodeStartDocument()
+		case "ED":
+			err = encoder.EncodeEndDocument()
+		case "SE":
+			err = encoder.EncodeStartElement("", arg, nil)
+		case "EE":
+			err = encoder.EncodeEndElement()
+		case "AT":
+			name, value, _ := strings.Cut(arg, "=")
+			err = encoder.EncodeAttribute("", name, nil, NewStringValueFromString(value))
+		case "NS":
+			prefix, uri, _ := strings.Cut(arg, "=")
+			err = encoder.EncodeNamespaceDeclaration(uri, &prefix)
+		case "CH":
+			err = encoder.EncodeCharacters(NewStringValueFromString(arg))
+		case "CM":
+			text := []rune(arg)
+			err = encoder.EncodeComment(text, 0, len(text))
+		case "PI":
+			target, data, _ := strings.Cut(arg, " ")
+			err = encoder.EncodeProcessingInstruction(target, data)
+		case "FREEZE":
+			encoder.FreezeGrammars()
+		case "PRESERVE":
+			encoder.SetPreserveWhitespace(arg == "true")
+		default:
+			return fmt.Errorf("unknown event %q", event)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", event, err)
+		}
+	}
+	return encoder.Flush()
+}
+
+// encodeBody encodes events with a body encoder of factory and returns the
+// EXI body.
+func encodeBody(t testing.TB, factory EXIFactory, events []string) []byte {
+	t.Helper()
+	encoder, err := factory.CreateEXIBodyEncoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	writer := bufio.NewWriter(&buf)
+	if err := encoder.SetOutputStream(writer); err != nil {
+		t.Fatal(err)
+	}
+	if err := encodeEvents(encoder, events); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// decodeBody decodes the EXI body exi with a body decoder of factory and
+// returns its events in the notation of encodeEvents.
+func decodeBody(t testing.TB, factory EXIFactory, exi []byte) []string {
+	t.Helper()
+	decoder, err := factory.CreateEXIBodyDecoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := decoder.SetInputStream(bufio.NewReader(bytes.NewReader(exi))); err != nil {
+		t.Fatal(err)
+	}
+	return decodeEvents(t, decoder)
+}
+
+// decodeEvents decodes the remaining events of decoder.
+func decodeEvents(t testing.TB, decoder EXIBodyDecoder) []string {
+	t.Helper()
+	var events []string
+	for {
+		eventType, exists, err := decoder.Next()
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if !exists {
+			return events
+		}
+		event, err := decodeNext(decoder, eventType)
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		events = append(events, event)
+	}
+}
+
+// decodeNext decodes the event of eventType returned by Next.
+func decodeNext(decoder EXIBodyDecoder, eventType EventType) (event string, err error) {
+	switch eventType {
+	case EventTypeStartDocument:
+		event, err = "SD", decoder.DecodeStartDocument()
+	case EventTypeEndDocument:
+		event, err = "ED", decoder.DecodeEndDocument()
+	case EventTypeStartElement, EventTypeStartElementNS, EventTypeStartElementGeneric, EventTypeStartElementGenericUndeclared:
+		var qnc *QNameContext
+		if qnc, err = decoder.DecodeStartElement(); err == nil {
+			event = "SE " + qnc.GetLocalName()
+		}
+	case EventTypeEndElement, EventTypeEndElementUndeclared:
+		event = "EE"
+		_, err = decoder.DecodeEndElement()
+	case EventTypeAttribute, EventTypeAttributeNS, EventTypeAttributeGeneric, EventTypeAttributeGenericUndeclared,
+		EventTypeAttributeInvalidValue, EventTypeAttributeAnyInvalidValue:
+		var qnc *QNameContext
+		if qnc, err = decoder.DecodeAttribute(); err == nil {
+			var s string
+			s, err = decoder.GetAttributeValue().ToString()
+			event = "AT " + qnc.GetLocalName() + "=" + s
+		}
+	case EventTypeNamespaceDeclaration:
+		var ns *NamespaceDeclarationContainer
+		if ns, err = decoder.DecodeNamespaceDeclaration(); err == nil {
+			event = "NS " + *ns.Prefix + "=" + ns.NamespaceURI
+		}
+	case EventTypeCharacters, EventTypeCharactersGeneric, EventTypeCharactersGenericUndeclared:
+		var value Value
+		if value, err = decoder.DecodeCharacters(); err == nil {
+			var s string
+			s, err = value.ToString()
+			event = "CH " + s
+		}
+	case EventTypeSelfContained:
+		event, err = "SC", decoder.DecodeStartSelfContainedFragment()
+	case EventTypeComment:
+		var cm CommentContainer
+		if cm, err = decoder.DecodeCommentContainer(); err == nil {
+			event = "CM " + cm.Text
+		}
+	case EventTypeProcessingInstruction:
+		var pi ProcessingInstructionContainer
+		if pi, err = decoder.DecodeProcessingInstruction(); err == nil {
+			event = "PI " + pi.Target + " " + pi.Data
+		}
+	default:
+		return "", fmt.Errorf("unexpected event %s", eventType)
+	}
+	return event, err
+}
+
+// encodeAll runs steps until the first one fails.
+func encodeAll(steps ...func() error) error {
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestFidelityMismatchDetection(t *testing.T) {
+	events := []string{"SD", "CM note", "SE r", "CH text", "EE", "ED"}
+	factory := NewDefaultEXIFactory()
+	factory.GetFidelityOptions().SetFidelity(FeatureComment, true)
+	factory.SetFidelityMismatchDetection(true)
+	exi := encodeBody(t, factory, events)
+	if got := decodeBody(t, factory, exi); !reflect.DeepEqual(got, events) {
+		t.Errorf("got %q, want %q", got, events)
+	}
+
+	mismatched := NewDefaultEXIFactory()
+	mismatched.SetFidelityMismatchDetection(true)
+	err := decodeMalformed(mismatched, exi)
+	if err == nil || !strings.Contains(err.Error(), "fidelity mismatch") {
+		t.Errorf("mismatched fidelity: got %v", err)
+	}
+
+	unmarked := factory.Clone()
+	unmarked.SetFidelityMismatchDetection(false)
+	exi = encodeBody(t, unmarked, events)
+	if err := decodeMalformed(factory, exi); err == nil || !strings.Contains(err.Error(), "marker missing") {
+		t.Errorf("unmarked stream: got %v", err)
+	}
+}
+
+func TestRawValueObserver(t *testing.T) {
+	factory := NewDefaultEXIFactory()
+	factory.SetCodingMode(CodingModeBytePacked)
+	exi := encodeBody(t, factory, []string{"SD", "SE r", "AT a=hello", "SE e", "CH wörld", "EE", "SE e", "CH wörld", "EE", "EE", "ED"})
+	decoder, err := factory.CreateEXIBodyDecoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	decoder.SetRawValueObserver(func(qnc *QNameContext, datatype Datatype, raw []byte) {
+		got = append(got, fmt.Sprintf("%s % x", qnc.GetLocalName(), raw))
+	})
+	if err := decoder.SetInputStream(bufio.NewReader(bytes.NewReader(exi))); err != nil {
+		t.Fatal(err)
+	}
+	decodeEvents(t, decoder)
+	// literals are the length + 2 and the code points as unsigned integers,
+	// the local hit of the repeated value is 0 and an index of 0 bits
+	want := []string{"a 07 68 65 6c 6c 6f", "e 07 77 f6 01 72 6c 64", "e 00"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// nextEventName decodes the next event and returns its type followed by the
+// local-name of start elements.
+func nextEventName(t *testing.T, decoder EXIBodyDecoder) string {
+	t.Helper()
+	ev, exists, err := decoder.DecodeEvent()
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !exists {
+		return ""
+	}
+	switch ev.EventType {
+	case EventTypeStartElement, EventTypeStartElementGeneric, EventTypeStartElementGenericUndeclared:
+		return ev.EventType.String() + " " + ev.QNameContext.GetLocalName()
+	}
+	return ev.EventType.String()
+}
+
+func TestCoderSnapshot(t *testing.T) {
+	factory := NewDefaultEXIFactory()
+	factory.SetCodingMode(CodingModeBytePacked)
+	encoder, err := factory.CreateEXIBodyEncoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	writer := bufio.NewWriter(&buf)
+	if err := encoder.SetOutputStream(writer); err != nil {
+		t.Fatal(err)
+	}
+	steps := []func() error{encoder.EncodeStartDocument}
+	// the second b uses the SE(b) learned by the content of r
+	for _, name := range []string{"r", "a", "b", "b"} {
+		steps = append(steps, func() error { return encoder.EncodeStartElement("", name, nil) })
+		if name != "r" {
+			steps = append(steps, encoder.EncodeEndElement)
+		}
+	}
+	steps = append(steps, encoder.EncodeEndElement, encoder.EncodeEndDocument, encoder.Flush, writer.Flush)
+	for _, step := range steps {
+		if err := step(); err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+	}
+	exi := buf.Bytes()
+
+	d, err := factory.CreateEXIBodyDecoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder := d.(*EXIBodyDecoderInOrder)
+	input := bytes.NewReader(exi)
+	reader := bufio.NewReader(input)
+	if err := decoder.SetInputStream(reader); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"StartDocument", "StartElementGeneric r"} {
+		if got := nextEventName(t, decoder); got != want {
+			t.Fatalf("got %s, want %s", got, want)
+		}
+	}
+
+	uri := decoder.runtimeURIs[0]
+	clone := uri.Clone()
+	snapshot := decoder.Snapshot()
+	position := len(exi) - input.Len() - reader.Buffered()
+
+	var rest []string
+	for name := nextEventName(t, decoder); name != ""; name = nextEventName(t, decoder) {
+		rest = append(rest, name)
+	}
+	want := []string{
+		"StartElementGenericUndeclared a", "EndElementUndeclared",
+		"StartElementGenericUndeclared b", "EndElementUndeclared",
+		"StartElement b", "EndElement",
+		"EndElement", "EndDocument",
+	}
+	if !slices.Equal(rest, want) {
+		t.Fatalf("got %v, want %v", rest, want)
+	}
+
+	// r, a and b
+	if n := uri.GetNumberOfQNames(); n != 3 {
+		t.Errorf("runtime uri: %d local names, want 3", n)
+	}
+	if n := clone.GetNumberOfQNames(); n != 1 {
+		t.Errorf("clone: %d local names, want 1", n)
+	}
+	if qnc := clone.GetQNameContextByLocalName("a"); qnc != nil {
+		t.Errorf("clone knows local name a")
+	}
+
+	// decode the rest again from the snapshot
+	for range 2 {
+		decoder.Restore(snapshot)
+		if n := decoder.runtimeURIs[0].GetNumberOfQNames(); n != 1 {
+			t.Errorf("restored: %d local names, want 1", n)
+		}
+		if err := decoder.UpdateInputStream(bufio.NewReader(bytes.NewReader(exi[position:]))); err != nil {
+			t.Fatal(err)
+		}
+		var again []string
+		for name := nextEventName(t, decoder); name != ""; name = nextEventName(t, decoder) {
+			again = append(again, name)
+		}
+		if !slices.Equal(again, want) {
+			t.Errorf("restored: got %v, want %v", again, want)
+		}
+	}
+}
@@ -19,6 +19,9 @@ const (
 	W3C_EXI_LN_String       string = "string"
 	W3C_EXI_FeatureBodyOnly string = "http://www.w3.org/exi/features/exi-body-only"
 
+	// Namespace of the datatype representations specific to this library
+	GoEXI_NS_URI string = "https://github.com/sderkacs/go-exi"
+
 	EmptyString string = ""
 
 	XSISchemaLocation            string = "schemaLocation"
@@ -63,6 +66,21 @@ const (
 	DefaultValueMaxLength         int = -1
 	DefaultValuePartitionCapacity int = -1
 
+	/*
+	 * Integer settings
+	 */
+	DefaultMaxIntegerDigits int = -1
+
+	/*
+	 * Element settings
+	 */
+	DefaultMaxElementDepth int = -1
+
+	/*
+	 * String table settings
+	 */
+	DefaultMaxStringTableEntries int = -1
+
 	/*
 	 * Float & Double Values
 	 */
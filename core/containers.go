@@ -1,5 +1,7 @@
 package core
 
+import "fmt"
+
 /*
 	NamespaceDeclarationContainer implementation
 */
@@ -38,6 +40,14 @@ type DocTypeContainer struct {
 	Text     []rune
 }
 
+/*
+	CommentContainer implementation
+*/
+
+type CommentContainer struct {
+	Text string
+}
+
 /*
 	ProcessingInstructionContainer implementation
 */
@@ -46,3 +56,86 @@ type ProcessingInstructionContainer struct {
 	Target string
 	Data   string
 }
+
+/*
+	DecodedEvent implementation
+*/
+
+// DecodedEvent is a fully decoded EXI event as returned by
+// EXIBodyDecoder.DecodeEvent. Only the fields relevant to EventType are set.
+type DecodedEvent struct {
+	EventType             EventType
+	QNameContext          *QNameContext // SE, EE, AT, xsi:type and xsi:nil
+	Prefix                *string       // SE and AT prefix, see GetElementPrefix
+	Value                 Value         // AT, xsi:type, xsi:nil and CH value
+	NamespaceDeclaration  *NamespaceDeclarationContainer
+	DocType               *DocTypeContainer
+	EntityReference       []rune
+	Comment               *CommentContainer
+	ProcessingInstruction *ProcessingInstructionContainer
+}
+
+/*
+	ConformanceReport implementation
+*/
+
+// ConformanceReport tells whether a decoded EXI stream respected the EXI
+// profile parameters maxBuiltInElementGrammars and maxBuiltInProductions.
+// Limits of -1 are unbounded. BuiltInElementGrammars is only determined for
+// streams with grammar learning limits.
+type ConformanceReport struct {
+	MaxBuiltInElementGrammars int
+	MaxBuiltInProductions     int
+	BuiltInElementGrammars    int // number of evolved built-in element grammars, counted if MaxBuiltInElementGrammars is set
+	LearnedProductions        int // number of productions learned by built-in grammars
+}
+
+func (r *ConformanceReport) IsElementGrammarsConformant() bool {
+	return r.MaxBuiltInElementGrammars == -1 || r.BuiltInElementGrammars <= r.MaxBuiltInElementGrammars
+}
+
+func (r *ConformanceReport) IsProductionsConformant() bool {
+	return r.MaxBuiltInProductions == -1 || r.LearnedProductions <= r.MaxBuiltInProductions
+}
+
+func (r *ConformanceReport) IsConformant() bool {
+	return r.IsElementGrammarsConformant() && r.IsProductionsConformant()
+}
+
+// Diagnostics returns a message for each violated profile parameter.
+func (r *ConformanceReport) Diagnostics() []string {
+	diagnostics := []string{}
+	if !r.IsElementGrammarsConformant() {
+		diagnostics = append(diagnostics, fmt.Sprintf("maxBuiltInElementGrammars exceeded. Expected %d but was %d", r.MaxBuiltInElementGrammars, r.BuiltInElementGrammars))
+	}
+	if !r.IsProductionsConformant() {
+		diagnostics = append(diagnostics, fmt.Sprintf("maxBuiltInProductions exceeded. Expected %d but was %d", r.MaxBuiltInProductions, r.LearnedProductions))
+	}
+	return diagnostics
+}
+
+/*
+	ValueStats implementation
+*/
+
+// ValueStats summarizes the encoded size of the typed values of one qname,
+// see EXIBodyEncoder.SetCollectingStats. Sizes are measured before any
+// compression.
+type ValueStats struct {
+	Count     int // number of values
+	TotalBits int // sum of the encoded sizes of all values
+	MaxBits   int // encoded size of the largest value
+}
+
+func (s *ValueStats) AverageBits() float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	return float64(s.TotalBits) / float64(s.Count)
+}
+
+func (s *ValueStats) add(bits int) {
+	s.Count++
+	s.TotalBits += bits
+	s.MaxBits = max(s.MaxBits, bits)
+}
@@ -40,6 +40,11 @@ type QNameContext struct {
 }
 
 func NewQNameContext(namespaceUriId int, localNameId int, qName utils.QName) *QNameContext {
+	return new(QNameContext).init(namespaceUriId, localNameId, qName)
+}
+
+// init (re-)initializes c in place, e.g. when allocated by an objectArena.
+func (c *QNameContext) init(namespaceUriId int, localNameId int, qName utils.QName) *QNameContext {
 	var defaultPrefix string
 	var defaultQNameAsString string
 
@@ -58,7 +63,7 @@ func NewQNameContext(namespaceUriId int, localNameId int, qName utils.QName) *QN
 		defaultQNameAsString = defaultPrefix + ":" + qName.Local
 	}
 
-	return &QNameContext{
+	*c = QNameContext{
 		namespaceUriId:       namespaceUriId,
 		localNameId:          localNameId,
 		qName:                qName,
@@ -69,6 +74,7 @@ func NewQNameContext(namespaceUriId int, localNameId int, qName utils.QName) *QN
 			LocalNameID:    localNameId,
 		},
 	}
+	return c
 }
 
 func (q *QNameContext) GetMapKey() QNameContextMapKey {
@@ -2,6 +2,8 @@ package core
 
 import (
 	"fmt"
+	"net/url"
+	"strings"
 
 	"github.com/sderkacs/go-exi/utils"
 )
@@ -174,6 +176,8 @@ func (dt *BinaryHexDatatype) GetDatatypeID() DatatypeID {
 	BooleanDatatype implementation
 */
 
+// BooleanDatatype represents xsd:boolean in its canonical form. Values are
+// encoded as a single bit and "0"/"1" are decoded as "false"/"true".
 type BooleanDatatype struct {
 	*AbstractDatatype
 }
@@ -192,6 +196,12 @@ func (dt *BooleanDatatype) GetDatatypeID() DatatypeID {
 	BooleanFacetDatatype implementation
 */
 
+// BooleanFacetDatatype represents xsd:boolean restricted by a pattern facet.
+// Values are encoded as a 2-bit boolean ID so that all four lexical forms
+// "false", "0", "true" and "1" survive a round-trip.
+//
+// Note: with the PreserveLexicalValues fidelity option both datatypes are
+// encoded as restricted character set strings instead.
 type BooleanFacetDatatype struct {
 	*AbstractDatatype
 }
@@ -292,6 +302,28 @@ func (dt *DecimalDatatype) GetDatatypeID() DatatypeID {
 	return DataTypeID_EXI_Decimal
 }
 
+/*
+	DurationDatatype implementation
+*/
+
+// DurationDatatype codes xsd:duration values by their components, see
+// DurationRepresentation.
+type DurationDatatype struct {
+	*AbstractDatatype
+}
+
+func NewDurationDatatype(schemaType *QNameContext) *DurationDatatype {
+	return &DurationDatatype{
+		AbstractDatatype: NewAbstractDatatype(BuiltInTypeDuration, schemaType),
+	}
+}
+
+// Note: there is no EXI datatype ID for durations, lexical values are
+// strings.
+func (dt *DurationDatatype) GetDatatypeID() DatatypeID {
+	return DataTypeID_EXI_String
+}
+
 /*
 	EnumerationDatatype implementation
 */
@@ -346,7 +378,7 @@ func (dt *EnumerationDatatype) GetCodingLength() int {
 }
 
 func (dt *EnumerationDatatype) GetEnumValue(idx int) Value {
-	if idx < len(dt.enumValues)-1 {
+	if idx >= 0 && idx < len(dt.enumValues) {
 		return dt.enumValues[idx]
 	}
 	return nil
@@ -474,6 +506,12 @@ func (dt *ListDatatype) GetListDatatype() Datatype {
 	NBitUnsignedIntegerDatatype implementation
 */
 
+// NBitUnsignedIntegerDatatype represents integers with a bounded range of
+// at most 4096 values. Values are encoded as offset from the lower bound
+// using the minimum number of bits for the range, e.g. 1005 for [1000, 1010]
+// as 5 in 4 bits. Types with a lower bound only are not offset, see EXI 1.0
+// section 7.1.5; unsigned integers are used if the lower bound is
+// non-negative.
 type NBitUnsignedIntegerDatatype struct {
 	*AbstractDatatype
 	lowerBound         *IntegerValue
@@ -546,6 +584,7 @@ func (dt *RestrictedCharacterSetDatatype) GetRestrictedCharacterSet() Restricted
 type StringDatatype struct {
 	*AbstractDatatype
 	isDerivedByUnion bool
+	isAnyURI         bool
 }
 
 func NewStringDatatypeWithDerive(schemaType *QNameContext, isDerivedByUnion bool) *StringDatatype {
@@ -565,6 +604,15 @@ func NewStringDatatype(schemaType *QNameContext) *StringDatatype {
 	return NewStringDatatypeWithWhiteSpace(schemaType, WhiteSpacePreserve)
 }
 
+// NewAnyURIDatatype returns a string datatype for xsd:anyURI and types
+// derived from it. Values are coded like strings, decoders report them as
+// AnyURIValue.
+func NewAnyURIDatatype(schemaType *QNameContext) *StringDatatype {
+	dt := NewStringDatatypeWithWhiteSpace(schemaType, WhiteSpaceCollapse)
+	dt.isAnyURI = true
+	return dt
+}
+
 func (d *StringDatatype) GetDatatypeID() DatatypeID {
 	return DataTypeID_EXI_String
 }
@@ -573,6 +621,39 @@ func (d *StringDatatype) IsDerivedByUnion() bool {
 	return d.isDerivedByUnion
 }
 
+func (d *StringDatatype) IsAnyURI() bool {
+	return d.isAnyURI
+}
+
+// IsValidURIReference reports whether s, with leading and trailing
+// whitespace removed, is a URI reference as defined by RFC 3986: it consists
+// of unreserved and reserved characters and percent-encodings only and is
+// structured as URI or relative reference.
+func IsValidURIReference(s string) bool {
+	s = strings.TrimSpace(s)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.IndexByte("-._~:/?#[]@!$&'()*+,;=", c) >= 0:
+		case c == '%':
+			if i+2 >= len(s) || !isHexDigit(s[i+1]) || !isHexDigit(s[i+2]) {
+				return false
+			}
+			i += 2
+		default:
+			return false
+		}
+	}
+
+	_, err := url.Parse(s)
+	return err == nil
+}
+
+func isHexDigit(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
 /*
 	UnsignedIntegerDatatype implementation
 */
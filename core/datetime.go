@@ -57,6 +57,18 @@ func DateTimeParse(cal string, kind DateTimeType) (*DateTimeValue, error) {
 		if err != nil {
 			return nil, err
 		}
+	case DateTimeDateTime:
+		sYear, err = dateTimeParseYear(&sb)
+		if err != nil {
+			return nil, err
+		}
+		if err := dateTimeCheckCharacter(&sb, '-'); err != nil {
+			return nil, err
+		}
+		sMonthDay, err = dateTimeParseMonthDay(&sb)
+		if err != nil {
+			return nil, err
+		}
 		if err := dateTimeCheckCharacter(&sb, 'T'); err != nil {
 			return nil, err
 		}
@@ -115,7 +127,7 @@ func DateTimeParse(cal string, kind DateTimeType) (*DateTimeValue, error) {
 		if err := dateTimeCheckCharacter(&sb, '-'); err != nil {
 			return nil, err
 		}
-		sMonthDay, err = dateTimeParseMonth(&sb)
+		sMonthDay, err = dateTimeParseMonthDay(&sb)
 		if err != nil {
 			return nil, err
 		}
@@ -462,7 +474,9 @@ func dateTimeAppendYear(ca []rune, index *int, year int) {
 		*index += 2
 	}
 
-	utils.Itos32(year, index, ca)
+	// digits are written backwards from the end of the year
+	i := *index
+	utils.Itos32(year, &i, ca)
 }
 
 func dateTimeAppendTwoDigits(ca []rune, index *int, i int) {
@@ -472,14 +486,15 @@ func dateTimeAppendTwoDigits(ca []rune, index *int, i int) {
 		ca[*index] = '0'
 		*index += 2
 	}
-	utils.Itos32(i, index, ca)
+	end := *index
+	utils.Itos32(i, &end, ca)
 }
 
 func dateTimeAppendMonth(ca []rune, index *int, monthDay int) {
 	month := monthDay / DateTimeValue_MonthMultiplicator
 
-	*index--
 	ca[*index] = '-'
+	*index++
 
 	dateTimeAppendTwoDigits(ca, index, month)
 }
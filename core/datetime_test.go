@@ -0,0 +1,54 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+func TestDateTimeRoundTrip(t *testing.T) {
+	for _, test := range []struct {
+		kind DateTimeType
+		s    string
+	}{
+		{DateTimeGYear, "2024"},
+		{DateTimeGYear, "-0044"},
+		{DateTimeGYearMonth, "2024-03"},
+		{DateTimeDate, "2024-03-15"},
+		{DateTimeDate, "0001-01-01"},
+		{DateTimeDateTime, "2024-03-15T10:20:30"},
+		{DateTimeDateTime, "2024-03-15T10:20:30.25"},
+		{DateTimeGMonthDay, "--03-15"},
+		{DateTimeTime, "10:20:30"},
+	} {
+		dt, err := DateTimeParse(test.s, test.kind)
+		if err != nil {
+			t.Errorf("%s: %v", test.s, err)
+			continue
+		}
+		if s, err := dt.ToString(); err != nil || s != test.s {
+			t.Errorf("%s: ToString() = %q, %v", test.s, s, err)
+		}
+
+		var buf bytes.Buffer
+		writer := bufio.NewWriter(&buf)
+		encoder := NewBitEncoderChannel(writer)
+		if err := encoder.EncodeDateTime(dt); err != nil {
+			t.Fatal(err)
+		}
+		if err := encoder.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := NewBitDecoderChannel(bufio.NewReader(&buf)).DecodeDateTimeValue(test.kind)
+		if err != nil {
+			t.Errorf("%s: decode: %v", test.s, err)
+			continue
+		}
+		if s, err := decoded.ToString(); err != nil || s != test.s {
+			t.Errorf("%s: decoded %q, %v", test.s, s, err)
+		}
+	}
+}
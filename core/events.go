@@ -1,6 +1,10 @@
 package core
 
-import "github.com/sderkacs/go-exi/utils"
+import (
+	"strconv"
+
+	"github.com/sderkacs/go-exi/utils"
+)
 
 type EventType int
 
@@ -40,6 +44,43 @@ const (
 	EventTypeProcessingInstruction
 )
 
+var eventTypeNames = [...]string{
+	EventTypeStartDocument:                 "StartDocument",
+	EventTypeAttributeXsiType:              "AttributeXsiType",
+	EventTypeAttributeXsiNil:               "AttributeXsiNil",
+	EventTypeAttribute:                     "Attribute",
+	EventTypeAttributeNS:                   "AttributeNS",
+	EventTypeAttributeGeneric:              "AttributeGeneric",
+	EventTypeAttributeInvalidValue:         "AttributeInvalidValue",
+	EventTypeAttributeAnyInvalidValue:      "AttributeAnyInvalidValue",
+	EventTypeAttributeGenericUndeclared:    "AttributeGenericUndeclared",
+	EventTypeStartElement:                  "StartElement",
+	EventTypeStartElementNS:                "StartElementNS",
+	EventTypeStartElementGeneric:           "StartElementGeneric",
+	EventTypeStartElementGenericUndeclared: "StartElementGenericUndeclared",
+	EventTypeEndElement:                    "EndElement",
+	EventTypeEndElementUndeclared:          "EndElementUndeclared",
+	EventTypeCharacters:                    "Characters",
+	EventTypeCharactersGeneric:             "CharactersGeneric",
+	EventTypeCharactersGenericUndeclared:   "CharactersGenericUndeclared",
+	EventTypeEndDocument:                   "EndDocument",
+	EventTypeDocType:                       "DocType",
+	EventTypeNamespaceDeclaration:          "NamespaceDeclaration",
+	EventTypeSelfContained:                 "SelfContained",
+	EventTypeEntityReference:               "EntityReference",
+	EventTypeComment:                       "Comment",
+	EventTypeProcessingInstruction:         "ProcessingInstruction",
+}
+
+// String returns the name of the event type, e.g. "StartElementGeneric",
+// or "EventType(n)" for unknown values.
+func (t EventType) String() string {
+	if t >= 0 && int(t) < len(eventTypeNames) {
+		return eventTypeNames[t]
+	}
+	return "EventType(" + strconv.Itoa(int(t)) + ")"
+}
+
 type Event interface {
 	GetEventType() EventType
 	IsEventType(eventType EventType) bool
@@ -352,16 +393,28 @@ type StartElement struct {
 }
 
 func NewStartElement(qnc *QNameContext) *StartElement {
-	as := &AbstractEvent{
+	return new(startElementBlock).init(qnc)
+}
+
+// startElementBlock holds a StartElement and its AbstractEvent, allocating
+// both at once.
+type startElementBlock struct {
+	se    StartElement
+	event AbstractEvent
+}
+
+// init (re-)initializes the StartElement of b in place.
+func (b *startElementBlock) init(qnc *QNameContext) *StartElement {
+	b.event = AbstractEvent{
 		eventType: EventTypeStartElement,
 	}
-	a := &StartElement{
-		AbstractEvent: as,
+	b.se = StartElement{
+		AbstractEvent: &b.event,
 		qnameContext:  qnc,
 		qname:         qnc.qName,
 	}
-	as.Event = a
-	return a
+	b.event.Event = &b.se
+	return &b.se
 }
 
 func NewStartElementWithGrammar(qnc *QNameContext, grammar Grammar) *StartElement {
@@ -0,0 +1,31 @@
+package core
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestEventTypeString(t *testing.T) {
+	tests := map[EventType]string{
+		EventTypeStartDocument:                 "StartDocument",
+		EventTypeAttributeXsiNil:               "AttributeXsiNil",
+		EventTypeStartElementGenericUndeclared: "StartElementGenericUndeclared",
+		EventTypeEndElement:                    "EndElement",
+		EventTypeCharactersGeneric:             "CharactersGeneric",
+		EventTypeProcessingInstruction:         "ProcessingInstruction",
+		EventType(-1):                          "EventType(-1)",
+		EventTypeProcessingInstruction + 1:     "EventType(25)",
+	}
+	for eventType, want := range tests {
+		if got := fmt.Sprint(eventType); got != want {
+			t.Errorf("EventType %d = %q, want %q", int(eventType), got, want)
+		}
+	}
+
+	// every event type has a name
+	for eventType := EventTypeStartDocument; eventType <= EventTypeProcessingInstruction; eventType++ {
+		if eventTypeNames[eventType] == "" {
+			t.Errorf("EventType %d has no name", int(eventType))
+		}
+	}
+}
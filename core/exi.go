@@ -24,6 +24,19 @@ type ErrorHandler interface {
 	Error(err error)
 }
 
+// GrammarLearningObserver is called whenever a grammar learns a production
+// while decoding. qname is the learned element or attribute, or the current
+// element for learned characters and end elements. what is the kind of the
+// learned production, i.e. "SE", "AT", "CH" or "EE".
+type GrammarLearningObserver func(qname utils.QName, what string)
+
+// RawValueObserver is called whenever a typed value has been read while
+// decoding. qnc is the attribute or element the value belongs to and raw
+// holds the bytes consumed from the channel while reading the value. In
+// bit-packed mode the first and last byte may hold bits of neighboring events,
+// in compression mode raw holds inflated bytes.
+type RawValueObserver func(qnc *QNameContext, datatype Datatype, raw []byte)
+
 type EXIFactory interface {
 	// Sets the fidelity options used by the EXI factory (e.g. preserving XML
 	// comments or DTDs).
@@ -113,6 +126,10 @@ type EXIFactory interface {
 	// Representation Map.
 	SetDatatypeRepresentationMap(dtpMapTypes *[]utils.QName, dtrMapRepresentations *[]utils.QName)
 
+	// Sets the Datatype Representation Map built by a DTRMapBuilder, nil
+	// un-sets it.
+	SetDTRMap(dtrMap *DTRMap)
+
 	// The DTR map representation may use built-in String datatypes (e.g.,
 	// <code>exi:string</code>) or use user-defined type representations. This
 	// method allows to register the datatype that should be used.
@@ -133,6 +150,10 @@ type EXIFactory interface {
 	// "selfContained" element MUST NOT appear in an EXI options document when
 	// one of "compression", "pre-compression" or "strict" elements are present
 	// in the same options document.
+	//
+	// The elements require the selfContained fidelity option (FeatureSC).
+	// Without it, Validate rejects them. Earlier versions silently ignored
+	// them instead.
 	SetSelfContainedElements(elements []utils.QName)
 
 	// Self-contained elements may be read independently from the rest of the
@@ -209,6 +230,142 @@ type EXIFactory interface {
 	// (Experimental) Returns whether non-evolving grammars are used.
 	IsUsingNonEvolvingGrammars() bool
 
+	// Limits the number of decimal digits an arbitrary precision integer may
+	// have while decoding. Streams claiming larger integers are rejected
+	// instead of growing a big.Int without bounds.
+	//
+	// The value "unbounded" (-1) indicates that no restriction is used.
+	SetMaxIntegerDigits(digits int)
+
+	// Returns the maximum number of decimal digits of decoded integers OR
+	// negative for unbounded.
+	GetMaxIntegerDigits() int
+
+	// Limits the nesting depth of elements, the document element having
+	// depth 1. Coders fail on deeper elements instead of growing the element
+	// context stack without bounds, e.g. for streams from untrusted sources.
+	//
+	// The value "unbounded" (-1) indicates that no restriction is used.
+	SetMaxElementDepth(depth int)
+
+	// Returns the maximum nesting depth of elements OR negative for
+	// unbounded.
+	GetMaxElementDepth() int
+
+	// Limits the number of local names and prefixes a stream may add to the
+	// string table partition of each namespace URI, names and prefixes known
+	// from the schema not counted. Coders fail once a stream adds more
+	// instead of growing the string table without bounds.
+	//
+	// The value "unbounded" (-1) indicates that no restriction is used.
+	SetMaxLocalNamesPerURI(max int)
+
+	// Returns the maximum number of local names added per namespace URI OR
+	// negative for unbounded.
+	GetMaxLocalNamesPerURI() int
+
+	// See SetMaxLocalNamesPerURI.
+	SetMaxPrefixesPerURI(max int)
+
+	// Returns the maximum number of prefixes added per namespace URI OR
+	// negative for unbounded.
+	GetMaxPrefixesPerURI() int
+
+	// Limits the number of entries of the global value partition while
+	// decoding, shared strings included. Unlike valuePartitionCapacity this is
+	// no EXI option: streams adding more values are rejected.
+	//
+	// The value "unbounded" (-1) indicates that no restriction is used.
+	SetMaxValueEntries(max int)
+
+	// Returns the maximum number of global value entries OR negative for
+	// unbounded.
+	GetMaxValueEntries() int
+
+	// Sets the number of element contexts coders allocate up front. The
+	// element context stack grows beyond that as needed, a size matching the
+	// usual nesting depth of documents avoids reallocations. Default is
+	// ElementContextsInitialStackSize.
+	SetInitialElementStackSize(size int)
+
+	// Returns the initial size of the element context stack.
+	GetInitialElementStackSize() int
+
+	// Lets coders allocate the QNameContexts, start elements and built-in
+	// grammars of names learned at runtime from blocks of the given size that
+	// are recycled for each run. This reduces allocations when a coder is
+	// reused for many streams. Runtime names and grammars of a stream must
+	// not be retained once the coder is set up for the next stream. Default
+	// is 0, i.e. no arena.
+	SetObjectArena(size int)
+
+	// Returns the block size of the object arena OR 0 for none.
+	GetObjectArenaSize() int
+
+	// Diagnostic aid for body-only setups: encoders write a marker of their
+	// fidelity options at the start of the body and decoders check it against
+	// their own fidelity options, failing early instead of decoding garbage.
+	// Marked streams are no valid EXI 1.0 streams, encoder and decoder must
+	// both enable detection. Disabled by default.
+	SetFidelityMismatchDetection(detect bool)
+
+	// Returns whether fidelity mismatch detection is enabled.
+	IsFidelityMismatchDetection() bool
+
+	// Schema-informed decoders report xsd:anyURI values as AnyURIValue. If
+	// validation is enabled, values that are no URI references according to
+	// RFC 3986 are an error, otherwise any string is accepted. Disabled by
+	// default.
+	SetAnyURIValidation(validate bool)
+
+	// Returns whether xsd:anyURI values are validated when decoding.
+	IsAnyURIValidation() bool
+
+	// Restricts prefix preservation to the given namespace URIs when prefixes
+	// are preserved. Encoders replace the prefixes of other namespaces by
+	// default prefixes ("ns" followed by the namespace URI ID), which keeps
+	// the prefix partitions small. Default prefixes must not clash with the
+	// preserved ones. nil (the default) preserves all prefixes.
+	SetPrefixPreservationNamespaces(namespaces []string)
+
+	// Returns the namespaces that preserve prefixes OR nil for all.
+	GetPrefixPreservationNamespaces() []string
+
+	// Sets prefixes (namespace URI to prefix) the decoder uses instead of the
+	// generated default prefixes (e.g. "ns4") when prefixes are not
+	// preserved. Prefixes must be unique, the caller is responsible for not
+	// mapping two namespaces to the same prefix.
+	SetPreferredPrefixes(prefixes map[string]string)
+
+	// Returns the preferred prefixes per namespace URI.
+	GetPreferredPrefixes() map[string]string
+
+	// Registers a codec for the characters of the given element. The codec
+	// is used in place of the datatype of the element's grammar, regardless
+	// of the declared type. Encoder and decoder must register the same
+	// codecs. A nil codec removes the registration.
+	RegisterElementCodec(element utils.QName, codec ValueCodec)
+
+	// Returns the codec registered for the given element OR nil.
+	GetElementCodec(element utils.QName) ValueCodec
+
+	// Registers a codec for values of the given schema type and of types
+	// derived from it, for elements and attributes alike. The codec is used
+	// in place of the built-in datatype representation and of DTR map
+	// entries. Element codecs take precedence. Encoder and decoder must
+	// register the same codecs. A nil codec removes the registration.
+	RegisterTypeCodec(schemaType utils.QName, codec ValueCodec)
+
+	// Returns the codec registered for the given schema type OR nil.
+	GetTypeCodec(schemaType utils.QName) ValueCodec
+
+	// Checks the settings for combinations that cannot be encoded, e.g.
+	// strict together with preserved prefixes or a datatype representation
+	// map together with preserved lexical values, and returns an error
+	// describing the first one found. The encoders and decoders created by
+	// the factory validate it first.
+	Validate() error
+
 	// Returns an <code>EXIBodyEncoder</code>.
 	CreateEXIBodyEncoder() (EXIBodyEncoder, error)
 
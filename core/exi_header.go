@@ -1,6 +1,8 @@
 package core
 
 import (
+	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 
@@ -663,6 +665,52 @@ func (g *EXIOptionsHeaderGrammars) GetSchemaInformedGrammars() (*SchemaInformedG
 	return gs, nil
 }
 
+/*
+	Format sniffing
+*/
+
+// Format of a stream as recognized by SniffFormat
+type Format int
+
+const (
+	FormatUnknown   Format = iota
+	FormatEXI              // EXI stream starting with the distinguishing bits
+	FormatEXICookie        // EXI stream starting with the $EXI cookie
+	FormatGzip             // gzip compressed stream
+	FormatXML              // plain XML, optionally preceded by a BOM and whitespace
+)
+
+// Number of bytes SniffFormat looks at, less than the minimal bufio.Reader size
+const sniffLength int = 16
+
+// SniffFormat determines the format of the stream read by reader from its
+// first bytes without consuming them. The stream can then be decoded from
+// reader as usual. An empty stream returns FormatUnknown with io.EOF.
+func SniffFormat(reader *bufio.Reader) (Format, error) {
+	b, err := NewByteDecoderChannel(reader).Peek(sniffLength)
+	if len(b) == 0 {
+		return FormatUnknown, err
+	}
+
+	switch {
+	case bytes.HasPrefix(b, []byte("$EXI")):
+		return FormatEXICookie, nil
+	case bytes.HasPrefix(b, []byte{0x1f, 0x8b}):
+		return FormatGzip, nil
+	case int(b[0])>>(8-EXIHeader_NumberOfDistinguishingBits) == EXIHeader_DistinguishingBitsValue:
+		return FormatEXI, nil
+	}
+
+	// UTF-8 byte order mark, then whitespace up to the first markup
+	b = bytes.TrimPrefix(b, []byte{0xef, 0xbb, 0xbf})
+	b = bytes.TrimLeft(b, " \t\r\n")
+	if len(b) > 0 && b[0] == '<' {
+		return FormatXML, nil
+	}
+
+	return FormatUnknown, nil
+}
+
 /*
 	EXIHeaderDecoder implementation
 */
@@ -673,6 +721,8 @@ type EXIHeaderDecoder struct {
 	dtrSection            bool
 	dtrMapTypes           []utils.QName
 	dtrMapRepresentations []utils.QName
+	profileApplied        bool
+	bitLength             int
 }
 
 func NewEXIHeaderDecoder() *EXIHeaderDecoder {
@@ -683,6 +733,7 @@ func NewEXIHeaderDecoder() *EXIHeaderDecoder {
 		dtrSection:            false,
 		dtrMapTypes:           []utils.QName{},
 		dtrMapRepresentations: []utils.QName{},
+		profileApplied:        false,
 	}
 }
 
@@ -691,6 +742,13 @@ func (d *EXIHeaderDecoder) clear() {
 	d.dtrSection = false
 	d.dtrMapTypes = []utils.QName{}
 	d.dtrMapRepresentations = []utils.QName{}
+	d.profileApplied = false
+}
+
+// HeaderBitLength returns the number of bits of the header read by the last
+// Parse, including the cookie and padding bits.
+func (d *EXIHeaderDecoder) HeaderBitLength() int {
+	return d.bitLength
 }
 
 func (d *EXIHeaderDecoder) Parse(headerChannel *BitDecoderChannel, noOptionsFactory EXIFactory) (EXIFactory, error) {
@@ -796,6 +854,7 @@ func (d *EXIHeaderDecoder) Parse(headerChannel *BitDecoderChannel, noOptionsFact
 			return nil, err
 		}
 	}
+	d.bitLength = headerChannel.reader.GetBitLength()
 
 	return exiFactory, nil
 }
@@ -810,6 +869,9 @@ func (d *EXIHeaderDecoder) ReadEXIOptions(headerChannel *BitDecoderChannel, noOp
 		return nil, err
 	}
 	decoder := ebd.(*EXIBodyDecoderInOrder)
+	if err := decoder.SetInputChannel(headerChannel); err != nil {
+		return nil, err
+	}
 
 	// schemaId = null;
 	// schemaIdSet = false;
@@ -820,6 +882,21 @@ func (d *EXIHeaderDecoder) ReadEXIOptions(headerChannel *BitDecoderChannel, noOp
 	// re-use important settings
 	exiOptionsFactory.SetSchemaIDResolver(noOptionsFactory.GetSchemaIDResolver())
 	exiOptionsFactory.SetDecodingOptions(noOptionsFactory.GetDecodingOptions())
+	exiOptionsFactory.SetInitialElementStackSize(noOptionsFactory.GetInitialElementStackSize())
+	exiOptionsFactory.SetObjectArena(noOptionsFactory.GetObjectArenaSize())
+	exiOptionsFactory.SetMaxIntegerDigits(noOptionsFactory.GetMaxIntegerDigits())
+	exiOptionsFactory.SetMaxElementDepth(noOptionsFactory.GetMaxElementDepth())
+	exiOptionsFactory.SetMaxLocalNamesPerURI(noOptionsFactory.GetMaxLocalNamesPerURI())
+	exiOptionsFactory.SetMaxPrefixesPerURI(noOptionsFactory.GetMaxPrefixesPerURI())
+	exiOptionsFactory.SetMaxValueEntries(noOptionsFactory.GetMaxValueEntries())
+	exiOptionsFactory.SetPreferredPrefixes(noOptionsFactory.GetPreferredPrefixes())
+	exiOptionsFactory.SetFidelityMismatchDetection(noOptionsFactory.IsFidelityMismatchDetection())
+	exiOptionsFactory.SetAnyURIValidation(noOptionsFactory.IsAnyURIValidation())
+	if f, ok := noOptionsFactory.(*DefaultEXIFactory); ok {
+		// registrations are copied on write, see RegisterElementCodec
+		exiOptionsFactory.elementCodecs = f.elementCodecs
+		exiOptionsFactory.typeCodecs = f.typeCodecs
+	}
 	// re-use schema knowledge
 	exiOptionsFactory.SetGrammars(noOptionsFactory.GetGrammars())
 
@@ -892,7 +969,7 @@ func (d *EXIHeaderDecoder) ReadEXIOptions(headerChannel *BitDecoderChannel, noOp
 				return nil, err
 			}
 		default:
-			return nil, fmt.Errorf("unexpected EXI event in header: %d", eventType)
+			return nil, fmt.Errorf("unexpected EXI event in header: %s", eventType)
 		}
 
 		eventType, exists, err = decoder.Next()
@@ -964,7 +1041,8 @@ func (d *EXIHeaderDecoder) handleStartElement(se *QNameContext, f EXIFactory) er
 				return err
 			}
 		case EXIHeader_Profile:
-			// profile parameters are not used yet
+			// parameters are applied with the decimal value, see handleCharacters
+			d.profileApplied = false
 		}
 	}
 
@@ -972,12 +1050,16 @@ func (d *EXIHeaderDecoder) handleStartElement(se *QNameContext, f EXIFactory) er
 	return nil
 }
 
-func (d *EXIHeaderDecoder) handleEndElement(ee *QNameContext, _ EXIFactory) error {
+func (d *EXIHeaderDecoder) handleEndElement(ee *QNameContext, f EXIFactory) error {
 	if ee.GetNamespaceUri() == W3C_EXI_NS_URI {
 		localName := ee.GetLocalName()
 
 		if localName == EXIHeader_DatatypeRepresentationMap {
 			d.dtrSection = false
+		} else if localName == EXIHeader_Profile {
+			if !d.profileApplied && f.GetDecodingOptions().IsOptionEnabled(OptionStrictProfileHandling) {
+				return fmt.Errorf("exi header provides profile without parameter values")
+			}
 		}
 	}
 
@@ -1049,6 +1131,13 @@ func (d *EXIHeaderDecoder) handleCharacters(value Value, f EXIFactory) error {
 				return fmt.Errorf("decimal's reverse fractional part is not int")
 			}
 			f.SetMaximumNumberOfBuiltInProductions(val.GetRevFractional().Value32() - 1)
+			d.profileApplied = true
+		} else if f.GetDecodingOptions().IsOptionEnabled(OptionStrictProfileHandling) {
+			s, err := value.ToString()
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("exi header provides profile parameters not typed as decimal: '%s'", s)
 		}
 	}
 
@@ -1079,6 +1168,7 @@ func (d *EXIHeaderDecoder) handleXsiNil(value Value, f EXIFactory) error {
 
 type EXIHeaderEncoder struct {
 	*AbstractEXIHeader
+	bitLength int
 }
 
 func NewEXIHeaderEncoder() *EXIHeaderEncoder {
@@ -1090,10 +1180,12 @@ func NewEXIHeaderEncoder() *EXIHeaderEncoder {
 }
 
 func (e *EXIHeaderEncoder) Write(headerChannel *BitEncoderChannel, f EXIFactory) error {
+	bitLength := headerChannel.writer.GetBitLength()
 	headerOptions := f.GetEncodingOptions()
 	codingMode := f.GetCodingMode()
 
-	if headerOptions.IsOptionEnabled(OptionIncludeCookie) {
+	// A Canonical EXI Header MUST NOT begin with the optional EXI Cookie
+	if headerOptions.IsOptionEnabled(OptionIncludeCookie) && !headerOptions.IsOptionEnabled(OptionCanonicalExi) {
 		// four byte field consists of four characters " $ " , " E ",
 		// " X " and " I " in that order.
 		if err := headerChannel.Encode('$'); err != nil {
@@ -1145,10 +1237,17 @@ func (e *EXIHeaderEncoder) Write(headerChannel *BitEncoderChannel, f EXIFactory)
 			return err
 		}
 	}
+	e.bitLength = headerChannel.writer.GetBitLength() - bitLength
 
 	return nil
 }
 
+// HeaderBitLength returns the number of bits of the header written by the
+// last Write, including the cookie and padding bits.
+func (e *EXIHeaderEncoder) HeaderBitLength() int {
+	return e.bitLength
+}
+
 func (e *EXIHeaderEncoder) WriteEXIOptions(f EXIFactory, encoderChannel EncoderChannel) error {
 	factory, err := e.GetHeaderFactory()
 	if err != nil {
@@ -1256,6 +1355,11 @@ func (e *EXIHeaderEncoder) WriteEXIOptions(f EXIFactory, encoderChannel EncoderC
 						return err
 					}
 				}
+
+				// alignment
+				if err := encoder.EncodeEndElement(); err != nil {
+					return err
+				}
 			}
 
 			if e.isSelfContained(f) {
@@ -1443,7 +1547,7 @@ func (e *EXIHeaderEncoder) WriteEXIOptions(f EXIFactory, encoderChannel EncoderC
 			// body; however, the built-in XML schema types are available
 			// for use in the EXI body.
 			if g.IsBuiltInXMLSchemaTypesOnly() {
-				if g.GetSchemaID() != nil || *g.GetSchemaID() != "" {
+				if g.GetSchemaID() != nil && *g.GetSchemaID() != "" {
 					return fmt.Errorf("schemaID is not empty")
 				}
 				if err := encoder.EncodeCharacters(EmptyStringValue); err != nil {
@@ -1586,7 +1690,7 @@ func (e *EXIHeaderEncoder) isFragment(f EXIFactory) bool {
 }
 
 func (e *EXIHeaderEncoder) isSchemaID(f EXIFactory) bool {
-	return f.GetDecodingOptions().IsOptionEnabled(OptionIncludeSchemaID)
+	return f.GetEncodingOptions().IsOptionEnabled(OptionIncludeSchemaID)
 }
 
 func (e *EXIHeaderEncoder) isStrict(f EXIFactory) bool {
@@ -0,0 +1,298 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"testing"
+)
+
+// encodeUncommonOptions encodes an EXI options document whose uncommon
+// element holds the content encoded by steps.
+func encodeUncommonOptions(t *testing.T, steps func(encoder *EXIBodyEncoderInOrder) []func() error) []byte {
+	t.Helper()
+	headerFactory, err := NewEXIHeaderEncoder().GetHeaderFactory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := headerFactory.CreateEXIBodyEncoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	writer := bufio.NewWriter(&buf)
+	channel := NewBitEncoderChannel(writer)
+	encoder := enc.(*EXIBodyEncoderInOrder)
+	if err := encoder.SetOutputChannel(channel); err != nil {
+		t.Fatal(err)
+	}
+	err = encodeAll(
+		encoder.EncodeStartDocument,
+		func() error { return encoder.EncodeStartElement(W3C_EXI_NS_URI, EXIHeader_Header, nil) },
+		func() error { return encoder.EncodeStartElement(W3C_EXI_NS_URI, EXIHeader_LessCommon, nil) },
+		func() error { return encoder.EncodeStartElement(W3C_EXI_NS_URI, EXIHeader_Uncommon, nil) },
+	)
+	if err == nil {
+		err = encodeAll(steps(encoder)...)
+	}
+	if err == nil {
+		err = encodeAll(encoder.EncodeEndElement, encoder.EncodeEndElement, encoder.EncodeEndElement,
+			encoder.EncodeEndDocument, channel.Flush)
+	}
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// readEXIOptions decodes the EXI options document exi.
+func readEXIOptions(exi []byte, noOptionsFactory EXIFactory) (EXIFactory, error) {
+	headerChannel := NewBitDecoderChannel(bufio.NewReader(bytes.NewReader(exi)))
+	return NewEXIHeaderDecoder().ReadEXIOptions(headerChannel, noOptionsFactory)
+}
+
+func TestStrictProfileHandling(t *testing.T) {
+	decimalType := NewQNameValue(XMLSchemaNS_URI, "decimal", nil)
+	tests := []struct {
+		name    string
+		applied bool
+		content func(encoder *EXIBodyEncoderInOrder) []func() error
+	}{
+		{"decimal", true, func(encoder *EXIBodyEncoderInOrder) []func() error {
+			return []func() error{
+				func() error { return encoder.EncodeStartElement(W3C_EXI_NS_URI, EXIHeader_Profile, nil) },
+				func() error { return encoder.EncodeAttributeXsiType(decimalType, nil) },
+				// local value partitions off, 9 element grammars, 4 productions
+				func() error {
+					return encoder.EncodeCharacters(NewDecimalValue(false, IntegerValueOf32(10), IntegerValueOf32(5)))
+				},
+				encoder.EncodeEndElement,
+			}
+		}},
+		{"empty", false, func(encoder *EXIBodyEncoderInOrder) []func() error {
+			return []func() error{
+				func() error { return encoder.EncodeStartElement(W3C_EXI_NS_URI, EXIHeader_Profile, nil) },
+				encoder.EncodeEndElement,
+			}
+		}},
+		{"string", false, func(encoder *EXIBodyEncoderInOrder) []func() error {
+			return []func() error{
+				func() error { return encoder.EncodeStartElement(W3C_EXI_NS_URI, EXIHeader_Profile, nil) },
+				func() error { return encoder.EncodeCharacters(NewStringValueFromString("1.1")) },
+				encoder.EncodeEndElement,
+			}
+		}},
+	}
+	for _, test := range tests {
+		exi := encodeUncommonOptions(t, test.content)
+		for _, strict := range []bool{false, true} {
+			noOptionsFactory := NewDefaultEXIFactory()
+			if strict {
+				if err := noOptionsFactory.GetDecodingOptions().SetOption(OptionStrictProfileHandling); err != nil {
+					t.Fatal(err)
+				}
+			}
+			f, err := readEXIOptions(exi, noOptionsFactory)
+			if !test.applied && strict {
+				if err == nil {
+					t.Errorf("%s: strict profile handling accepted the profile", test.name)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%s, strict %t: %v", test.name, strict, err)
+				continue
+			}
+			if test.applied && (f.IsLocalValuePartitions() || f.GetMaximumNumberOfBuiltInElementGrammars() != 9 ||
+				f.GetMaximumNumberOfBuiltInProductions() != 4) {
+				t.Errorf("%s, strict %t: profile values not applied", test.name, strict)
+			}
+		}
+	}
+}
+
+func TestProfileValuesHeader(t *testing.T) {
+	factory := NewDefaultEXIFactory()
+	factory.SetMaximumNumberOfBuiltInElementGrammars(9)
+	factory.SetMaximumNumberOfBuiltInProductions(4)
+	for _, option := range []string{OptionIncludeOptions, OptionIncludeProfileValues} {
+		if err := factory.GetEncodingOptions().SetOption(option); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	writer := bufio.NewWriter(&buf)
+	channel := NewBitEncoderChannel(writer)
+	if err := NewEXIHeaderEncoder().Write(channel, factory); err != nil {
+		t.Fatal(err)
+	}
+	if err := channel.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	noOptionsFactory := NewDefaultEXIFactory()
+	if err := noOptionsFactory.GetDecodingOptions().SetOption(OptionStrictProfileHandling); err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewEXIHeaderDecoder().Parse(NewBitDecoderChannel(bufio.NewReader(&buf)), noOptionsFactory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.GetMaximumNumberOfBuiltInElementGrammars() != 9 || f.GetMaximumNumberOfBuiltInProductions() != 4 {
+		t.Errorf("got %d element grammars, %d productions, want 9, 4",
+			f.GetMaximumNumberOfBuiltInElementGrammars(), f.GetMaximumNumberOfBuiltInProductions())
+	}
+}
+
+// TestHeaderXsiTypeAnyURI codes an options header with an element of the
+// datatypeRepresentationMap typed as xsd:anyURI by xsi:type.
+func TestHeaderXsiTypeAnyURI(t *testing.T) {
+	anyURIType := NewQNameValue(XMLSchemaNS_URI, "anyURI", nil)
+	exi := encodeUncommonOptions(t, func(encoder *EXIBodyEncoderInOrder) []func() error {
+		return []func() error{
+			func() error {
+				return encoder.EncodeStartElement(W3C_EXI_NS_URI, EXIHeader_DatatypeRepresentationMap, nil)
+			},
+			func() error { return encoder.EncodeStartElement("urn:t", "t", nil) },
+			func() error { return encoder.EncodeAttributeXsiType(anyURIType, nil) },
+			func() error { return encoder.EncodeCharacters(NewStringValueFromString("urn:schema")) },
+			encoder.EncodeEndElement,
+			func() error { return encoder.EncodeStartElement("urn:r", "r", nil) },
+			encoder.EncodeEndElement,
+			encoder.EncodeEndElement,
+		}
+	})
+
+	noOptionsFactory := NewDefaultEXIFactory()
+	if err := noOptionsFactory.GetDecodingOptions().SetOption(OptionIgnoreSchemaID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readEXIOptions(exi, noOptionsFactory); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+}
+
+func TestHeaderBitLength(t *testing.T) {
+	tests := []struct {
+		name       string
+		codingMode CodingMode
+		options    []string
+		// 0 for whole bytes beyond cookie and distinguishing bits
+		want int
+	}{
+		// distinguishing bits, presence bit and version
+		{"minimal", CodingModeBitPacked, nil, 8},
+		{"cookie", CodingModeBitPacked, []string{OptionIncludeCookie}, 40},
+		// the empty options document SE(header) EE adds 3 bits
+		{"options", CodingModeBitPacked, []string{OptionIncludeOptions}, 11},
+		// padded to the byte-aligned body
+		{"minimal byte-packed", CodingModeBytePacked, nil, 8},
+		{"options byte-packed", CodingModeBytePacked, []string{OptionIncludeCookie, OptionIncludeOptions}, 0},
+	}
+	for _, test := range tests {
+		factory := NewDefaultEXIFactory()
+		factory.SetCodingMode(test.codingMode)
+		for _, option := range test.options {
+			if err := factory.GetEncodingOptions().SetOption(option); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		streamEncoder, err := factory.CreateEXIStreamEncoder()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		writer := bufio.NewWriter(&buf)
+		encoder, err := streamEncoder.EncodeHeader(writer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		steps := []func() error{
+			encoder.EncodeStartDocument,
+			func() error { return encoder.EncodeStartElement("", "a", nil) },
+			encoder.EncodeEndElement,
+			encoder.EncodeEndDocument,
+			encoder.Flush,
+			writer.Flush,
+		}
+		for _, step := range steps {
+			if err := step(); err != nil {
+				t.Fatalf("%s: encode: %v", test.name, err)
+			}
+		}
+
+		encoded := streamEncoder.HeaderBitLength()
+		switch {
+		case test.want != 0 && encoded != test.want:
+			t.Errorf("%s: encoder: %d bits, want %d", test.name, encoded, test.want)
+		case test.want == 0 && (encoded <= 40 || encoded%8 != 0):
+			t.Errorf("%s: encoder: %d bits, want whole bytes", test.name, encoded)
+		}
+
+		decoderFactory := NewDefaultEXIFactory()
+		decoderFactory.SetCodingMode(test.codingMode)
+		streamDecoder, err := decoderFactory.CreateEXIStreamDecoder()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := streamDecoder.DecodeHeader(bufio.NewReader(&buf)); err != nil {
+			t.Fatalf("%s: decode: %v", test.name, err)
+		}
+		if decoded := streamDecoder.HeaderBitLength(); decoded != encoded {
+			t.Errorf("%s: decoder: %d bits, want %d", test.name, decoded, encoded)
+		}
+	}
+}
+
+func TestSniffFormat(t *testing.T) {
+	var gz bytes.Buffer
+	gzipWriter := gzip.NewWriter(&gz)
+	if _, err := gzipWriter.Write([]byte("<r/>")); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		stream []byte
+		want   Format
+	}{
+		{"cookie", []byte("$EXI\xa0\x68\x13\x08"), FormatEXICookie},
+		{"EXI", []byte{0x80, 0x40}, FormatEXI},
+		{"EXI options", []byte{0xa0, 0x68, 0x13, 0x08}, FormatEXI},
+		{"gzip", gz.Bytes(), FormatGzip},
+		{"XML", []byte(`<?xml version="1.0"?><r/>`), FormatXML},
+		{"XML BOM", []byte("\xef\xbb\xbf\r\n  <r/>"), FormatXML},
+		{"text", []byte("hello"), FormatUnknown},
+		{"text after whitespace", []byte("               x  <r/>"), FormatUnknown},
+	}
+	for _, test := range tests {
+		reader := bufio.NewReader(bytes.NewReader(test.stream))
+		got, err := SniffFormat(reader)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if got != test.want {
+			t.Errorf("%s: got format %d, want %d", test.name, got, test.want)
+		}
+		// nothing is consumed
+		if rest, _ := io.ReadAll(reader); !bytes.Equal(rest, test.stream) {
+			t.Errorf("%s: stream consumed", test.name)
+		}
+	}
+
+	if got, err := SniffFormat(bufio.NewReader(bytes.NewReader(nil))); got != FormatUnknown || !errors.Is(err, io.EOF) {
+		t.Errorf("empty: got %d, %v", got, err)
+	}
+}
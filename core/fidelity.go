@@ -1,6 +1,7 @@
 package core
 
 import (
+	"errors"
 	"fmt"
 	"maps"
 	"slices"
@@ -751,3 +752,50 @@ func (fo *FidelityOptions) Equals(other utils.ComparableType) bool {
 
 	return false
 }
+
+/*
+	Fidelity marker implementation
+*/
+
+// Fidelity markers are written at the start of the body when fidelity
+// mismatch detection is enabled, see EXIFactory.SetFidelityMismatchDetection.
+// A marker is a 4 bit magic number followed by one bit per fidelity feature.
+const (
+	fidelityMarkerMagic int = 0b1011
+	fidelityMarkerBits  int = 12
+)
+
+var fidelityMarkerFeatures = []string{
+	FeatureComment, FeaturePI, FeatureDTD, FeaturePrefix, FeatureLexicalValue, FeatureSC, FeatureStrict,
+}
+
+func (fo *FidelityOptions) getMarker() int {
+	marker := fidelityMarkerMagic << (fidelityMarkerBits - 4)
+	for i, feature := range fidelityMarkerFeatures {
+		if fo.IsFidelityEnabled(feature) {
+			marker |= 1 << i
+		}
+	}
+	return marker
+}
+
+// checkMarker compares a marker read from a stream with the options.
+func (fo *FidelityOptions) checkMarker(marker int) error {
+	if marker>>(fidelityMarkerBits-4) != fidelityMarkerMagic {
+		return errors.New("fidelity marker missing, stream was not encoded with fidelity mismatch detection")
+	}
+	if expected := fo.getMarker(); marker != expected {
+		return fmt.Errorf("fidelity mismatch, stream was encoded with %v but decoder uses %v", fidelityMarkerFeatureNames(marker), fidelityMarkerFeatureNames(expected))
+	}
+	return nil
+}
+
+func fidelityMarkerFeatureNames(marker int) []string {
+	features := []string{}
+	for i, feature := range fidelityMarkerFeatures {
+		if marker&(1<<i) != 0 {
+			features = append(features, feature)
+		}
+	}
+	return features
+}
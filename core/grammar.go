@@ -158,6 +158,11 @@ func (g *AbstractGrammar) GetEventCode(eventType EventType, events []EventType)
 }
 
 func (g *AbstractGrammar) GetElementContentGrammar() Grammar {
+	// Note: return the concrete grammar if known, *AbstractGrammar does not
+	// implement the whole Grammar interface on its own
+	if g.Grammar != nil {
+		return g.Grammar
+	}
 	return g
 }
 
@@ -227,7 +232,7 @@ func (g *AbstractSchemaInformedGrammar) AddProduction(event Event, grammar Gramm
 	if (event.IsEventType(EventTypeEndElement) ||
 		event.IsEventType(EventTypeAttributeGeneric) ||
 		event.IsEventType(EventTypeStartElementGeneric)) && g.GetProduction(event.GetEventType()) != nil {
-		log.Printf("Event %d is already present", event.GetEventType())
+		log.Printf("Event %s is already present", event.GetEventType())
 	} else {
 		if event.IsEventType(EventTypeEndElement) {
 			g.hasEndElement = true
@@ -236,7 +241,7 @@ func (g *AbstractSchemaInformedGrammar) AddProduction(event Event, grammar Gramm
 		for _, prod := range g.containers {
 			if prod.GetEvent().Equals(event) {
 				if prod.GetNextGrammar() != grammar {
-					return fmt.Errorf("same event %d with indistinguishable 'next' grammar", event.GetEventType())
+					return fmt.Errorf("same event %s with indistinguishable 'next' grammar", event.GetEventType())
 				}
 			}
 		}
@@ -385,7 +390,7 @@ func (g *AbstractSchemaInformedGrammar) GetStartElementProduction(namespaceUri,
 func (g *AbstractSchemaInformedGrammar) GetStartElementNSProduction(namespaceUri string) Production {
 	for _, ei := range g.containers {
 		if ei.GetEvent().IsEventType(EventTypeStartElementNS) {
-			seEI := ei.GetEvent().(StartElementNS)
+			seEI := ei.GetEvent().(*StartElementNS)
 			if seEI.GetNamespaceUri() == namespaceUri {
 				return ei
 			}
@@ -411,7 +416,7 @@ func (g *AbstractSchemaInformedGrammar) GetAttributeProduction(namespaceUri, loc
 func (g *AbstractSchemaInformedGrammar) GetAttributeNSProduction(namespaceUri string) Production {
 	for _, ei := range g.containers {
 		if ei.GetEvent().IsEventType(EventTypeAttributeNS) {
-			atEI := ei.GetEvent().(AttributeNS)
+			atEI := ei.GetEvent().(*AttributeNS)
 			if atEI.GetNamespaceUri() == namespaceUri {
 				return ei
 			}
@@ -636,7 +641,7 @@ func NewAbstractBuiltInContent() *AbstractBuiltInContent {
 
 func (c *AbstractBuiltInContent) LearnCharacters() {
 	if !c.learnedCH {
-		c.AddProduction(NewCharacters(BuiltInGetDefaultDatatype()), c.GetElementContentGrammar())
+		c.AddProduction(NewCharacters(BuiltInGetDefaultDatatype()), c.Grammar.GetElementContentGrammar())
 		c.learnedCH = true
 	}
 }
@@ -651,17 +656,19 @@ type BuiltInDocContent struct {
 }
 
 func NewBuiltInDocContent(docEnd Grammar) *BuiltInDocContent {
-	return &BuiltInDocContent{
+	c := &BuiltInDocContent{
 		AbstractBuiltInGrammar: NewBuiltInGrammar(),
 		docEnd:                 docEnd,
 	}
+	c.Grammar = c
+	// DocContent --> SE(*) DocEnd
+	c.AddProduction(startElementGeneric, docEnd)
+
+	return c
 }
 
 func NewBuiltInDocContentWithLabel(docEnd Grammar, label string) *BuiltInDocContent {
-	c := &BuiltInDocContent{
-		AbstractBuiltInGrammar: NewBuiltInGrammar(),
-		docEnd:                 docEnd,
-	}
+	c := NewBuiltInDocContent(docEnd)
 	c.SetLabel(label)
 
 	return c
@@ -692,6 +699,7 @@ func NewBuiltInElement() *BuiltInElement {
 	e := &BuiltInElement{
 		AbstractBuiltInContent: NewAbstractBuiltInContent(),
 	}
+	e.Grammar = e
 	e.AddProduction(endElement, endRule)
 
 	return e
@@ -725,6 +733,7 @@ func NewBuiltInFragmentContent() *BuiltInFragmentContent {
 	c := &BuiltInFragmentContent{
 		AbstractBuiltInGrammar: NewBuiltInGrammar(),
 	}
+	c.Grammar = c
 	c.AddTerminalProduction(NewEndDocument())
 	c.AddProduction(startElementGeneric, c)
 
@@ -753,9 +762,56 @@ type BuiltInStartTag struct {
 }
 
 func NewBuiltInStartTag() *BuiltInStartTag {
-	return &BuiltInStartTag{
-		AbstractBuiltInContent: NewAbstractBuiltInContent(),
-		elementContent:         NewBuiltInElement(),
+	return new(builtInStartTagBlock).init()
+}
+
+// builtInStartTagBlock holds a BuiltInStartTag, its element content grammar
+// and the structs both are composed of, allocating them at once.
+type builtInStartTagBlock struct {
+	tag             BuiltInStartTag
+	tagContent      AbstractBuiltInContent
+	tagGrammar      AbstractBuiltInGrammar
+	tagAbstract     AbstractGrammar
+	element         BuiltInElement
+	elementContent  AbstractBuiltInContent
+	elementGrammar  AbstractBuiltInGrammar
+	elementAbstract AbstractGrammar
+}
+
+// init (re-)initializes the BuiltInStartTag of b in place. The production
+// lists of a previous use are recycled.
+func (b *builtInStartTagBlock) init() *BuiltInStartTag {
+	initBuiltInContent(&b.tagContent, &b.tagGrammar, &b.tagAbstract)
+	initBuiltInContent(&b.elementContent, &b.elementGrammar, &b.elementAbstract)
+
+	b.element = BuiltInElement{
+		AbstractBuiltInContent: &b.elementContent,
+	}
+	b.element.Grammar = &b.element
+	b.element.AddProduction(endElement, endRule)
+
+	b.tag = BuiltInStartTag{
+		AbstractBuiltInContent: &b.tagContent,
+		elementContent:         &b.element,
+	}
+	b.tag.Grammar = &b.tag
+	return &b.tag
+}
+
+func initBuiltInContent(c *AbstractBuiltInContent, g *AbstractBuiltInGrammar, a *AbstractGrammar) {
+	*a = AbstractGrammar{
+		label:                     nil,
+		stopLearningContainerSize: NotFound,
+	}
+	*g = AbstractBuiltInGrammar{
+		AbstractGrammar: a,
+		containers:      g.containers[:0],
+		ec1Length:       0,
+	}
+	g.Grammar = g
+	*c = AbstractBuiltInContent{
+		AbstractBuiltInGrammar: g,
+		learnedCH:              false,
 	}
 }
 
@@ -969,7 +1025,7 @@ func (t *SchemaInformedStartTag) Clone() *SchemaInformedStartTag {
 
 func (t *SchemaInformedStartTag) GetTypeEmptyInterval() (SchemaInformedStartTagGrammar, error) {
 	if t.sifst == nil {
-		switch t.GetGrammarType() {
+		switch t.Grammar.GetGrammarType() {
 		case GrammarTypeSchemaInformedFirstStartTagContent:
 			t.sifst = NewSchemaInformedFirstStartTag()
 		case GrammarTypeSchemaInformedStartTagContent:
@@ -980,13 +1036,13 @@ func (t *SchemaInformedStartTag) GetTypeEmptyInterval() (SchemaInformedStartTagG
 		t.sifst.SetElementContentGrammar(sistElementContent2Empty)
 
 		for i := 0; i < t.GetNumberOfEvents(); i++ {
-			prod := t.GetProduction(EventType(i))
+			prod := t.GetProductionByEventCode(i)
 			ev := prod.GetEvent()
 			ng := prod.GetNextGrammar()
 
 			switch ev.GetEventType() {
 			case EventTypeAttribute, EventTypeAttributeNS, EventTypeAttributeGeneric:
-				if ng == t {
+				if ng == t || ng == t.Grammar {
 					t.sifst.AddProduction(ev, t.sifst)
 				} else if ng.GetGrammarType() == GrammarTypeSchemaInformedFirstStartTagContent {
 					ng2 := ng.(*SchemaInformedFirstStartTag)
@@ -1033,23 +1089,27 @@ type SchemaInformedFirstStartTag struct {
 }
 
 func NewSchemaInformedFirstStartTag() *SchemaInformedFirstStartTag {
-	return &SchemaInformedFirstStartTag{
+	t := &SchemaInformedFirstStartTag{
 		SchemaInformedStartTag: NewSchemaInformedStartTag(),
 		isTypeCastable:         false,
 		isNillable:             false,
 		typeEmpty:              nil,
 		typeName:               nil,
 	}
+	t.Grammar = t
+	return t
 }
 
 func NewSchemaInformedFirstStartTagWithEC2(elementContent2 SchemaInformedGrammar) *SchemaInformedFirstStartTag {
-	return &SchemaInformedFirstStartTag{
+	t := &SchemaInformedFirstStartTag{
 		SchemaInformedStartTag: NewSchemaInformedStartTagWithEC2(elementContent2),
 		isTypeCastable:         false,
 		isNillable:             false,
 		typeEmpty:              nil,
 		typeName:               nil,
 	}
+	t.Grammar = t
+	return t
 }
 
 func NewSchemaInformedFirstStartTagWithStartTag(startTag SchemaInformedFirstStartTagGrammar) *SchemaInformedFirstStartTag {
@@ -1058,7 +1118,7 @@ func NewSchemaInformedFirstStartTagWithStartTag(startTag SchemaInformedFirstStar
 
 	// clone top level
 	for i := 0; i < startTag.GetNumberOfEvents(); i++ {
-		ei := startTag.GetProduction(EventType(i))
+		ei := startTag.GetProductionByEventCode(i)
 		// remove self-reference
 		next := ei.GetNextGrammar()
 		if next == startTag {
@@ -0,0 +1,71 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/sderkacs/go-exi/utils"
+)
+
+func TestNamespaceProductions(t *testing.T) {
+	content := NewSchemaInformedElement()
+	startTag := NewSchemaInformedStartTagWithEC2(content)
+	if err := startTag.AddProduction(NewAttributeNS(1, "urn:a"), startTag); err != nil {
+		t.Fatal(err)
+	}
+	if err := startTag.AddProduction(NewStartElementNS(1, "urn:a"), content); err != nil {
+		t.Fatal(err)
+	}
+
+	if prod := startTag.GetAttributeNSProduction("urn:a"); prod == nil || !prod.GetEvent().IsEventType(EventTypeAttributeNS) {
+		t.Errorf("AT(urn:a:*): got %v", prod)
+	}
+	if prod := startTag.GetStartElementNSProduction("urn:a"); prod == nil || !prod.GetEvent().IsEventType(EventTypeStartElementNS) {
+		t.Errorf("SE(urn:a:*): got %v", prod)
+	}
+	if prod := startTag.GetStartElementNSProduction("urn:b"); prod != nil {
+		t.Errorf("SE(urn:b:*): got %v, want nil", prod)
+	}
+}
+
+func TestTypeEmptyStartTag(t *testing.T) {
+	content := NewSchemaInformedElement()
+	startTag := NewSchemaInformedFirstStartTagWithEC2(content)
+	for i, name := range []string{"a", "b"} {
+		at := NewAttribute(NewQNameContext(0, i, utils.QName{Local: name}))
+		if err := startTag.AddProduction(at, startTag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := startTag.AddProduction(NewStartElementNS(1, "urn:a"), content); err != nil {
+		t.Fatal(err)
+	}
+
+	// the attributes loop back to the empty type, elements are dropped
+	typeEmpty, err := startTag.GetTypeEmpty()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typeEmpty.GetNumberOfEvents() != 3 {
+		t.Fatalf("typeEmpty: %d events, want 3", typeEmpty.GetNumberOfEvents())
+	}
+	for i := range 2 {
+		if next := typeEmpty.GetProductionByEventCode(i).GetNextGrammar(); next != typeEmpty {
+			t.Errorf("typeEmpty: AT event code %d: next grammar is not typeEmpty", i)
+		}
+	}
+	if !typeEmpty.GetProductionByEventCode(2).GetEvent().IsEventType(EventTypeEndElement) {
+		t.Error("typeEmpty: event code 2 is not EE")
+	}
+
+	// the clone of a start tag refers to itself where the original did
+	clone := NewSchemaInformedFirstStartTagWithStartTag(startTag)
+	if clone.GetNumberOfEvents() != 3 {
+		t.Fatalf("clone: %d events, want 3", clone.GetNumberOfEvents())
+	}
+	if next := clone.GetProductionByEventCode(0).GetNextGrammar(); next != clone {
+		t.Error("clone: AT event code 0: next grammar is not the clone")
+	}
+	if next := clone.GetProductionByEventCode(2).GetNextGrammar(); next != content {
+		t.Error("clone: SE event code 2: next grammar is not the element content")
+	}
+}
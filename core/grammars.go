@@ -143,10 +143,10 @@ func initSchemaLessGrammarContext() {
 
 	qncs = make([]*QNameContext, len(LocalNamesXSI))
 	for i := 0; i < len(qncs); i++ {
-		qncs[i] = NewQNameContext(1, i, utils.QName{Space: XMLSchemaInstanceNS_URI, Local: LocalNamesXSI[i]})
+		qncs[i] = NewQNameContext(2, i, utils.QName{Space: XMLSchemaInstanceNS_URI, Local: LocalNamesXSI[i]})
 		qNameID++
 	}
-	contexts[2] = NewGrammarUriContext(1, XMLSchemaInstanceNS_URI, qncs, PrefixesXSI)
+	contexts[2] = NewGrammarUriContext(2, XMLSchemaInstanceNS_URI, qncs, PrefixesXSI)
 
 	schemaLessGrammarContext = NewGrammarContext(contexts[:], qNameID)
 }
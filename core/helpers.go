@@ -2,6 +2,10 @@ package core
 
 import (
 	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
 
 	"github.com/sderkacs/go-exi/utils"
 )
@@ -22,6 +26,88 @@ func (h *DefaultErrorHandler) Warning(err error) {}
 
 func (h *DefaultErrorHandler) Error(err error) {}
 
+/*
+	MapSchemaIDResolver implementation
+*/
+
+// MapSchemaIDResolver resolves the schema ID of EXI headers to grammars
+// registered beforehand. Registering is not safe while decoders resolve.
+type MapSchemaIDResolver struct {
+	grammars map[string]Grammars
+}
+
+func NewMapSchemaIDResolver() *MapSchemaIDResolver {
+	return &MapSchemaIDResolver{
+		grammars: map[string]Grammars{},
+	}
+}
+
+func (r *MapSchemaIDResolver) Register(schemaID string, grammars Grammars) {
+	r.grammars[schemaID] = grammars
+}
+
+func (r *MapSchemaIDResolver) ResolveSchemaID(schemaID string) (Grammars, error) {
+	grammars, ok := r.grammars[schemaID]
+	if !ok {
+		return nil, fmt.Errorf("unknown schema ID '%s'", schemaID)
+	}
+	return grammars, nil
+}
+
+/*
+	DTRMapBuilder implementation
+*/
+
+// DTRMap is a datatype representation map, see
+// EXIFactory.SetDatatypeRepresentationMap.
+type DTRMap struct {
+	Types           []utils.QName
+	Representations []utils.QName
+}
+
+// DTRMapBuilder collects the pairs of a datatype representation map instead of
+// maintaining parallel slices.
+type DTRMapBuilder struct {
+	types           []utils.QName
+	representations []utils.QName
+	err             error
+}
+
+func NewDTRMapBuilder() *DTRMapBuilder {
+	return &DTRMapBuilder{
+		types:           []utils.QName{},
+		representations: []utils.QName{},
+	}
+}
+
+// Add maps the schema datatype schemaType to representation, e.g. a built-in
+// EXI datatype representation such as {http://www.w3.org/2009/exi}string.
+func (b *DTRMapBuilder) Add(schemaType, representation utils.QName) *DTRMapBuilder {
+	if b.err != nil {
+		return b
+	}
+	for _, t := range b.types {
+		if t.Space == schemaType.Space && t.Local == schemaType.Local {
+			b.err = fmt.Errorf("duplicate DTR map schema type {%s}%s", schemaType.Space, schemaType.Local)
+			return b
+		}
+	}
+	b.types = append(b.types, schemaType)
+	b.representations = append(b.representations, representation)
+	return b
+}
+
+// Build returns the map, or the first error of Add.
+func (b *DTRMapBuilder) Build() (*DTRMap, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	return &DTRMap{
+		Types:           slices.Clone(b.types),
+		Representations: slices.Clone(b.representations),
+	}, nil
+}
+
 /*
 	DefaultEXIFactory implementation
 */
@@ -50,6 +136,19 @@ type DefaultEXIFactory struct {
 	sharedStrings                         []string
 	isUsingNonEvolvingGrammrs             bool
 	qnameSort                             func(q1, q2 utils.QName) int
+	maxIntegerDigits                      int
+	maxElementDepth                       int
+	maxLocalNamesPerURI                   int
+	maxPrefixesPerURI                     int
+	maxValueEntries                       int
+	preferredPrefixes                     map[string]string
+	elementCodecs                         map[utils.QName]ValueCodec
+	typeCodecs                            map[utils.QName]ValueCodec
+	initialElementStackSize               int
+	objectArenaSize                       int
+	fidelityMismatchDetection             bool
+	prefixPreservationNamespaces          []string
+	anyURIValidation                      bool
 }
 
 func NewDefaultEXIFactory() *DefaultEXIFactory {
@@ -76,6 +175,19 @@ func NewDefaultEXIFactory() *DefaultEXIFactory {
 		sharedStrings:                         []string{},
 		isUsingNonEvolvingGrammrs:             false,
 		qnameSort:                             QNameCompareFunc,
+		maxIntegerDigits:                      DefaultMaxIntegerDigits,
+		maxElementDepth:                       DefaultMaxElementDepth,
+		maxLocalNamesPerURI:                   DefaultMaxStringTableEntries,
+		maxPrefixesPerURI:                     DefaultMaxStringTableEntries,
+		maxValueEntries:                       DefaultMaxStringTableEntries,
+		preferredPrefixes:                     map[string]string{},
+		elementCodecs:                         map[utils.QName]ValueCodec{},
+		typeCodecs:                            map[utils.QName]ValueCodec{},
+		initialElementStackSize:               ElementContextsInitialStackSize,
+		objectArenaSize:                       0,
+		fidelityMismatchDetection:             false,
+		prefixPreservationNamespaces:          nil,
+		anyURIValidation:                      false,
 	}
 }
 
@@ -139,8 +251,8 @@ func (f *DefaultEXIFactory) GetCodingMode() CodingMode {
 }
 
 func (f *DefaultEXIFactory) SetBlockSize(size int) {
-	if size < 0 {
-		panic("negative block size")
+	if size <= 0 {
+		panic("block size has to be larger than 0")
 	}
 	f.blockSize = size
 }
@@ -176,6 +288,14 @@ func (f *DefaultEXIFactory) SetDatatypeRepresentationMap(dtpMapTypes *[]utils.QN
 	}
 }
 
+func (f *DefaultEXIFactory) SetDTRMap(dtrMap *DTRMap) {
+	if dtrMap == nil {
+		f.SetDatatypeRepresentationMap(nil, nil)
+	} else {
+		f.SetDatatypeRepresentationMap(&dtrMap.Types, &dtrMap.Representations)
+	}
+}
+
 func (f *DefaultEXIFactory) RegisterDatatypeRepresentationMapDatatype(dtrMapRepresentation utils.QName, datatype Datatype) Datatype {
 	f.dtrMapRepresentationsDatatype = map[utils.QName]Datatype{}
 	prev := f.dtrMapRepresentationsDatatype[dtrMapRepresentation]
@@ -225,6 +345,7 @@ func (f *DefaultEXIFactory) IsLocalValuePartitions() bool {
 func (f *DefaultEXIFactory) SetMaximumNumberOfBuiltInElementGrammars(num int) {
 	if num >= 0 {
 		f.maximumNumberOfBuiltInElementGrammars = num
+		f.grammarLearningDisabled = true
 	} else {
 		f.maximumNumberOfBuiltInElementGrammars = -1
 	}
@@ -237,6 +358,7 @@ func (f *DefaultEXIFactory) GetMaximumNumberOfBuiltInElementGrammars() int {
 func (f *DefaultEXIFactory) SetMaximumNumberOfBuiltInProductions(num int) {
 	if num >= 0 {
 		f.maximumNumberOfBuiltInProductions = num
+		f.grammarLearningDisabled = true
 	} else {
 		f.maximumNumberOfBuiltInProductions = -1
 	}
@@ -266,9 +388,133 @@ func (f *DefaultEXIFactory) IsUsingNonEvolvingGrammars() bool {
 	return f.isUsingNonEvolvingGrammrs
 }
 
+func (f *DefaultEXIFactory) SetMaxIntegerDigits(digits int) {
+	f.maxIntegerDigits = digits
+}
+
+func (f *DefaultEXIFactory) GetMaxIntegerDigits() int {
+	return f.maxIntegerDigits
+}
+
+func (f *DefaultEXIFactory) SetMaxElementDepth(depth int) {
+	f.maxElementDepth = depth
+}
+
+func (f *DefaultEXIFactory) GetMaxElementDepth() int {
+	return f.maxElementDepth
+}
+
+func (f *DefaultEXIFactory) SetMaxLocalNamesPerURI(max int) {
+	f.maxLocalNamesPerURI = max
+}
+
+func (f *DefaultEXIFactory) GetMaxLocalNamesPerURI() int {
+	return f.maxLocalNamesPerURI
+}
+
+func (f *DefaultEXIFactory) SetMaxPrefixesPerURI(max int) {
+	f.maxPrefixesPerURI = max
+}
+
+func (f *DefaultEXIFactory) GetMaxPrefixesPerURI() int {
+	return f.maxPrefixesPerURI
+}
+
+func (f *DefaultEXIFactory) SetMaxValueEntries(max int) {
+	f.maxValueEntries = max
+}
+
+func (f *DefaultEXIFactory) GetMaxValueEntries() int {
+	return f.maxValueEntries
+}
+
+func (f *DefaultEXIFactory) SetInitialElementStackSize(size int) {
+	if size <= 0 {
+		panic("initial element stack size has to be larger than 0")
+	}
+	f.initialElementStackSize = size
+}
+
+func (f *DefaultEXIFactory) GetInitialElementStackSize() int {
+	return f.initialElementStackSize
+}
+
+func (f *DefaultEXIFactory) SetObjectArena(size int) {
+	if size < 0 {
+		panic("object arena size must not be negative")
+	}
+	f.objectArenaSize = size
+}
+
+func (f *DefaultEXIFactory) GetObjectArenaSize() int {
+	return f.objectArenaSize
+}
+
+func (f *DefaultEXIFactory) SetFidelityMismatchDetection(detect bool) {
+	f.fidelityMismatchDetection = detect
+}
+
+func (f *DefaultEXIFactory) IsFidelityMismatchDetection() bool {
+	return f.fidelityMismatchDetection
+}
+
+func (f *DefaultEXIFactory) SetAnyURIValidation(validate bool) {
+	f.anyURIValidation = validate
+}
+
+func (f *DefaultEXIFactory) IsAnyURIValidation() bool {
+	return f.anyURIValidation
+}
+
+func (f *DefaultEXIFactory) SetPrefixPreservationNamespaces(namespaces []string) {
+	f.prefixPreservationNamespaces = namespaces
+}
+
+func (f *DefaultEXIFactory) GetPrefixPreservationNamespaces() []string {
+	return f.prefixPreservationNamespaces
+}
+
+func (f *DefaultEXIFactory) SetPreferredPrefixes(prefixes map[string]string) {
+	f.preferredPrefixes = prefixes
+}
+
+func (f *DefaultEXIFactory) GetPreferredPrefixes() map[string]string {
+	return f.preferredPrefixes
+}
+
+func (f *DefaultEXIFactory) RegisterElementCodec(element utils.QName, codec ValueCodec) {
+	f.elementCodecs = registerCodec(f.elementCodecs, element, codec)
+}
+
+func (f *DefaultEXIFactory) GetElementCodec(element utils.QName) ValueCodec {
+	return f.elementCodecs[element]
+}
+
+func (f *DefaultEXIFactory) RegisterTypeCodec(schemaType utils.QName, codec ValueCodec) {
+	f.typeCodecs = registerCodec(f.typeCodecs, schemaType, codec)
+}
+
+func (f *DefaultEXIFactory) GetTypeCodec(schemaType utils.QName) ValueCodec {
+	return f.typeCodecs[schemaType]
+}
+
+func registerCodec(codecs map[utils.QName]ValueCodec, qname utils.QName, codec ValueCodec) map[utils.QName]ValueCodec {
+	// copy on write, clones must not share registrations
+	codecs = maps.Clone(codecs)
+	if codecs == nil {
+		codecs = map[utils.QName]ValueCodec{}
+	}
+	if codec == nil {
+		delete(codecs, qname)
+	} else {
+		codecs[qname] = codec
+	}
+	return codecs
+}
+
 func (f *DefaultEXIFactory) doSanityCheck() error {
-	if f.fidelityOptions.IsFidelityEnabled(FeatureSC) && (f.codingMode == CodingModeCompression || f.codingMode == CodingModePreCompression) {
-		return errors.New("(pre-)compression and selfContained elements cannot work together")
+	if err := f.Validate(); err != nil {
+		return err
 	}
 
 	if !f.grammars.IsSchemaInformed() {
@@ -286,15 +532,63 @@ func (f *DefaultEXIFactory) doSanityCheck() error {
 	return nil
 }
 
+func (f *DefaultEXIFactory) Validate() error {
+	fo := f.fidelityOptions
+	if fo.IsStrict() {
+		// strict excludes all options that need productions beyond the schema
+		for _, feature := range []string{FeatureComment, FeaturePI, FeatureDTD, FeaturePrefix, FeatureSC} {
+			if fo.IsFidelityEnabled(feature) {
+				return fmt.Errorf("strict cannot be combined with %s", feature)
+			}
+		}
+	}
+
+	switch f.codingMode {
+	case CodingModeBitPacked, CodingModeBytePacked:
+	case CodingModePreCompression, CodingModeCompression:
+		if fo.IsFidelityEnabled(FeatureSC) {
+			return errors.New("(pre-)compression and selfContained elements cannot work together")
+		}
+	default:
+		return fmt.Errorf("unknown coding mode %d", f.codingMode)
+	}
+
+	if len(f.scElements) > 0 && !fo.IsFidelityEnabled(FeatureSC) {
+		return fmt.Errorf("self-contained elements require %s", FeatureSC)
+	}
+
+	if f.dtrMapTypes != nil && len(*f.dtrMapTypes) > 0 {
+		if fo.IsFidelityEnabled(FeatureLexicalValue) {
+			return fmt.Errorf("datatype representation map cannot be combined with %s", FeatureLexicalValue)
+		}
+		if f.dtrMapRepresentations == nil || len(*f.dtrMapTypes) != len(*f.dtrMapRepresentations) {
+			return errors.New("number of arguments for DTR map must match")
+		}
+	}
+
+	if f.valueMaxLength < DefaultValueMaxLength {
+		return fmt.Errorf("invalid value max length %d", f.valueMaxLength)
+	}
+	if f.valuePartitionCapacity < DefaultValuePartitionCapacity {
+		return fmt.Errorf("invalid value partition capacity %d", f.valuePartitionCapacity)
+	}
+
+	return nil
+}
+
 func (f *DefaultEXIFactory) CreateEXIBodyEncoder() (EXIBodyEncoder, error) {
 	if err := f.doSanityCheck(); err != nil {
 		return nil, err
 	}
 
 	if f.codingMode == CodingModeCompression || f.codingMode == CodingModePreCompression {
-		return NewEXIBodyEncoderInOrderSC(f)
+		return NewEXIBodyEncoderReordered(f)
 	} else {
-		return NewEXIBodyEncoderInOrder(f)
+		if f.fidelityOptions.IsFidelityEnabled(FeatureSC) {
+			return NewEXIBodyEncoderInOrderSC(f)
+		} else {
+			return NewEXIBodyEncoderInOrder(f)
+		}
 	}
 }
 
@@ -356,8 +650,7 @@ func (f *DefaultEXIFactory) CreateEXIBodyDecoder() (EXIBodyDecoder, error) {
 	}
 
 	if f.codingMode == CodingModeCompression || f.codingMode == CodingModePreCompression {
-		//return NewEXIBodyDecoderReordered(f), nil
-		return nil, errors.New("stream compression is not supported yet")
+		return NewEXIBodyDecoderReordered(f)
 	} else {
 		if f.fidelityOptions.IsFidelityEnabled(FeatureSC) {
 			return NewEXIBodyDecoderInOrderSC(f)
@@ -402,6 +695,14 @@ func (f *DefaultEXIFactory) checkDtrMap() error {
 }
 
 func (f *DefaultEXIFactory) CreateTypeEncoder() (TypeEncoder, error) {
+	encoder, err := f.createTypeEncoder()
+	if err != nil || len(f.elementCodecs) == 0 && len(f.typeCodecs) == 0 {
+		return encoder, err
+	}
+	return newValueCodecTypeEncoder(encoder, f.typeCodecs), nil
+}
+
+func (f *DefaultEXIFactory) createTypeEncoder() (TypeEncoder, error) {
 	if f.isSchemaInformed() {
 		if err := f.checkDtrMap(); err != nil {
 			return nil, err
@@ -421,25 +722,47 @@ func (f *DefaultEXIFactory) CreateTypeEncoder() (TypeEncoder, error) {
 
 func (f *DefaultEXIFactory) CreateStringDecoder() StringDecoder {
 	var decoder StringDecoder
+	var sd *StringDecoderImpl
 	if f.GetValueMaxLength() != DefaultValueMaxLength || f.GetValuePartitionCapacity() != DefaultValuePartitionCapacity {
-		decoder = NewBoundedStringDecoderImpl(f.IsLocalValuePartitions(), f.GetValueMaxLength(), f.GetValuePartitionCapacity())
+		bsd := NewBoundedStringDecoderImpl(f.IsLocalValuePartitions(), f.GetValueMaxLength(), f.GetValuePartitionCapacity())
+		decoder, sd = bsd, bsd.StringDecoderImpl
 	} else {
-		decoder = NewStringDecoderImpl(f.IsLocalValuePartitions())
+		sd = NewStringDecoderImpl(f.IsLocalValuePartitions())
+		decoder = sd
 	}
+	sd.maxValues = f.GetMaxValueEntries()
 
 	return decoder
 }
 
 func (f *DefaultEXIFactory) CreateTypeDecoder() (TypeDecoder, error) {
+	decoder, err := f.createTypeDecoder()
+	if err != nil || len(f.elementCodecs) == 0 && len(f.typeCodecs) == 0 {
+		return decoder, err
+	}
+	return newValueCodecTypeDecoder(decoder, f.typeCodecs), nil
+}
+
+func (f *DefaultEXIFactory) createTypeDecoder() (TypeDecoder, error) {
 	if f.isSchemaInformed() {
 		if err := f.checkDtrMap(); err != nil {
 			return nil, err
 		}
 
 		if f.fidelityOptions.IsFidelityEnabled(FeatureLexicalValue) {
-			return NewLexicalTypeDecoder(f.dtrMapTypes, f.dtrMapRepresentations, &f.dtrMapRepresentationsDatatype)
+			decoder, err := NewLexicalTypeDecoder(f.dtrMapTypes, f.dtrMapRepresentations, &f.dtrMapRepresentationsDatatype)
+			if err != nil {
+				return nil, err
+			}
+			decoder.SetAnyURIValidation(f.anyURIValidation)
+			return decoder, nil
 		} else {
-			return NewTypedTypeDecoder(f.dtrMapTypes, f.dtrMapRepresentations, &f.dtrMapRepresentationsDatatype)
+			decoder, err := NewTypedTypeDecoder(f.dtrMapTypes, f.dtrMapRepresentations, &f.dtrMapRepresentationsDatatype)
+			if err != nil {
+				return nil, err
+			}
+			decoder.SetAnyURIValidation(f.anyURIValidation)
+			return decoder, nil
 		}
 	} else {
 		// use strings only
@@ -452,3 +775,45 @@ func (f *DefaultEXIFactory) Clone() EXIFactory {
 	z := *f
 	return &z
 }
+
+/*
+	EncoderPool implementation
+*/
+
+// EncoderPool hands out body encoders created by a shared factory, e.g. for
+// encoding from many goroutines. Grammars are read-only once built and are
+// shared by all encoders, only the per-document state of encoders is pooled.
+//
+// The factory must not be modified while the pool is in use.
+type EncoderPool struct {
+	factory EXIFactory
+	mu      sync.Mutex // creating coders may update the factory
+	pool    sync.Pool
+}
+
+func NewEncoderPool(factory EXIFactory) *EncoderPool {
+	return &EncoderPool{
+		factory: factory,
+	}
+}
+
+// Get returns a pooled encoder or a new one if the pool is empty. The output
+// has to be set before encoding.
+func (p *EncoderPool) Get() (EXIBodyEncoder, error) {
+	if encoder, ok := p.pool.Get().(EXIBodyEncoder); ok {
+		return encoder, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.factory.CreateEXIBodyEncoder()
+}
+
+// Put resets encoder and returns it to the pool. Encoders failing to reset
+// are dropped.
+func (p *EncoderPool) Put(encoder EXIBodyEncoder) {
+	if err := encoder.Reset(); err != nil {
+		return
+	}
+	p.pool.Put(encoder)
+}
@@ -0,0 +1,175 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/sderkacs/go-exi/utils"
+)
+
+func TestEncoderPool(t *testing.T) {
+	events := []string{"SD", "SE r"}
+	for i := range 50 {
+		events = append(events, "SE item", fmt.Sprintf("AT id=%d", i%7), fmt.Sprintf("CH value %d", i%5), "EE")
+	}
+	events = append(events, "EE", "ED")
+
+	for _, mode := range []CodingMode{CodingModeBitPacked, CodingModeCompression} {
+		factory := NewDefaultEXIFactory()
+		factory.SetCodingMode(mode)
+		want := encodeBody(t, factory, events)
+
+		pool := NewEncoderPool(factory)
+		results := make([][]byte, 16)
+		errs := make([]error, len(results))
+		var wg sync.WaitGroup
+		for i := range results {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				// several documents per goroutine to re-use pooled encoders
+				for range 3 {
+					encoder, err := pool.Get()
+					if err != nil {
+						errs[i] = err
+						return
+					}
+					var buf bytes.Buffer
+					if err := encoder.SetOutput(&buf); err != nil {
+						errs[i] = err
+						return
+					}
+					if err := encodeEvents(encoder, events); err != nil {
+						errs[i] = err
+						return
+					}
+					pool.Put(encoder)
+					results[i] = buf.Bytes()
+				}
+			}()
+		}
+		wg.Wait()
+
+		for i, result := range results {
+			if errs[i] != nil {
+				t.Errorf("mode %d: goroutine %d: %v", mode, i, errs[i])
+			} else if !bytes.Equal(result, want) {
+				t.Errorf("mode %d: goroutine %d: output differs", mode, i)
+			}
+		}
+	}
+}
+
+func TestDTRMapBuilder(t *testing.T) {
+	integer := utils.QName{Space: XMLSchemaNS_URI, Local: "integer"}
+	decimal := utils.QName{Space: XMLSchemaNS_URI, Local: "decimal"}
+	exiString := utils.QName{Space: W3C_EXI_NS_URI, Local: W3C_EXI_LN_String}
+
+	dtrMap, err := NewDTRMapBuilder().Add(integer, exiString).Add(decimal, exiString).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(dtrMap.Types, []utils.QName{integer, decimal}) {
+		t.Errorf("types: %v", dtrMap.Types)
+	}
+	if !slices.Equal(dtrMap.Representations, []utils.QName{exiString, exiString}) {
+		t.Errorf("representations: %v", dtrMap.Representations)
+	}
+
+	factory := NewDefaultEXIFactory()
+	factory.SetDTRMap(dtrMap)
+	if types := factory.GetDatatypeRepresentationMapTypes(); types == nil || !slices.Equal(*types, dtrMap.Types) {
+		t.Errorf("factory types: %v", types)
+	}
+	factory.SetDTRMap(nil)
+	if types := factory.GetDatatypeRepresentationMapTypes(); types != nil {
+		t.Errorf("factory types: %v, want nil", *types)
+	}
+
+	_, err = NewDTRMapBuilder().Add(integer, exiString).Add(decimal, exiString).Add(integer, exiString).Build()
+	if err == nil {
+		t.Error("duplicate schema type: want error")
+	}
+}
+
+func TestFactoryValidate(t *testing.T) {
+	integer := []utils.QName{{Space: XMLSchemaNS_URI, Local: "integer"}}
+	exiString := []utils.QName{{Space: W3C_EXI_NS_URI, Local: W3C_EXI_LN_String}}
+
+	tests := []struct {
+		name      string
+		configure func(f *DefaultEXIFactory) error
+	}{
+		{"strict and prefixes", func(f *DefaultEXIFactory) error {
+			// SetFidelity keeps strict exclusive, header options may not
+			f.SetFidelityOptions(NewStrictFidelityOptions())
+			f.fidelityOptions.options[FeaturePrefix] = struct{}{}
+			return nil
+		}},
+		{"compression and self-contained", func(f *DefaultEXIFactory) error {
+			f.SetCodingMode(CodingModeCompression)
+			return f.GetFidelityOptions().SetFidelity(FeatureSC, true)
+		}},
+		{"self-contained elements without feature", func(f *DefaultEXIFactory) error {
+			f.SetSelfContainedElements([]utils.QName{{Local: "s"}})
+			return nil
+		}},
+		{"lexical values and DTR map", func(f *DefaultEXIFactory) error {
+			f.SetDatatypeRepresentationMap(&integer, &exiString)
+			return f.GetFidelityOptions().SetFidelity(FeatureLexicalValue, true)
+		}},
+		{"DTR map length mismatch", func(f *DefaultEXIFactory) error {
+			// the setter drops mismatched maps, the slices stay shared
+			representations := slices.Clone(exiString)
+			f.SetDatatypeRepresentationMap(&integer, &representations)
+			representations = representations[:0]
+			return nil
+		}},
+		{"value max length", func(f *DefaultEXIFactory) error {
+			f.SetValueMaxLength(-2)
+			return nil
+		}},
+		{"value partition capacity", func(f *DefaultEXIFactory) error {
+			f.SetValuePartitionCapacity(-2)
+			return nil
+		}},
+		{"coding mode", func(f *DefaultEXIFactory) error {
+			f.codingMode = CodingMode(42)
+			return nil
+		}},
+	}
+	for _, test := range tests {
+		factory := NewDefaultEXIFactory()
+		if err := test.configure(factory); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if err := factory.Validate(); err == nil {
+			t.Errorf("%s: want error", test.name)
+		}
+		if _, err := factory.CreateEXIBodyEncoder(); err == nil {
+			t.Errorf("%s: encoder: want error", test.name)
+		}
+		if _, err := factory.CreateEXIBodyDecoder(); err == nil {
+			t.Errorf("%s: decoder: want error", test.name)
+		}
+	}
+
+	factory := NewDefaultEXIFactory()
+	factory.SetCodingMode(CodingModeBytePacked)
+	if err := factory.GetFidelityOptions().SetFidelity(FeatureSC, true); err != nil {
+		t.Fatal(err)
+	}
+	factory.SetSelfContainedElements([]utils.QName{{Local: "s"}})
+	factory.SetDatatypeRepresentationMap(&integer, &exiString)
+	factory.SetValueMaxLength(16)
+	factory.SetValuePartitionCapacity(0)
+	if err := factory.Validate(); err != nil {
+		t.Errorf("valid factory: %v", err)
+	}
+	if err := NewDefaultEXIFactory().Validate(); err != nil {
+		t.Errorf("default factory: %v", err)
+	}
+}
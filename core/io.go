@@ -25,6 +25,12 @@ type BitReader struct {
 
 	// Underlying input stream.
 	reader *bufio.Reader
+
+	// Bytes consumed while recording.
+	raw rawRecorder
+
+	// Number of bytes read from the underlying stream.
+	length int
 }
 
 func NewBitReader(reader *bufio.Reader) *BitReader {
@@ -32,6 +38,7 @@ func NewBitReader(reader *bufio.Reader) *BitReader {
 		capacity: 0,
 		buffer:   0,
 		reader:   reader,
+		raw:      rawRecorder{},
 	}
 }
 
@@ -44,6 +51,14 @@ func (r *BitReader) SetReader(reader *bufio.Reader) {
 	r.reader = reader
 	r.buffer = 0
 	r.capacity = 0
+	r.length = 0
+}
+
+/**
+ * Returns the number of bits consumed since the underlying stream was set.
+ */
+func (r *BitReader) GetBitLength() int {
+	return r.length*BufferCapacity - r.capacity
 }
 
 func (r *BitReader) readDirectByte() (int, error) {
@@ -51,9 +66,23 @@ func (r *BitReader) readDirectByte() (int, error) {
 	if err != nil {
 		return -1, err
 	}
+	r.raw.record(b)
+	r.length++
 	return int(b), nil
 }
 
+/**
+ * Starts recording consumed bytes, beginning with the current byte if it is
+ * partially consumed.
+ */
+func (r *BitReader) startRawRecording() {
+	if r.capacity > 0 {
+		r.raw.start(byte(r.buffer))
+	} else {
+		r.raw.start()
+	}
+}
+
 /**
  * If buffer is empty, read byte from underlying stream.
  */
@@ -71,12 +100,27 @@ func (r *BitReader) readBuffer() error {
  * Discard any bits currently in the buffer to byte-align stream
  */
 func (r *BitReader) Align() error {
-	if r.capacity != 0 {
+	// Note: a byte only looked ahead at has not been read from yet
+	if r.capacity != BufferCapacity {
 		r.capacity = 0
 	}
 	return nil
 }
 
+/**
+ * Returns whether no bits of the current byte have been read but not all
+ */
+func (r *BitReader) IsByteAligned() bool {
+	return r.capacity == 0 || r.capacity == BufferCapacity
+}
+
+/**
+ * Returns the number of unread bits of a partially read byte
+ */
+func (r *BitReader) PendingBits() int {
+	return r.capacity % BufferCapacity
+}
+
 /**
  * Returns current byte buffer without actually reading data
  */
@@ -89,6 +133,25 @@ func (r *BitReader) LookAhead() (int, error) {
 	return r.buffer, nil
 }
 
+/**
+ * Returns the next n bytes without reading them, including a byte only looked
+ * ahead at. Fails if the reader is not byte-aligned.
+ */
+func (r *BitReader) Peek(n int) ([]byte, error) {
+	switch r.capacity {
+	case 0:
+		return r.reader.Peek(n)
+	case BufferCapacity:
+		if n <= 0 {
+			return r.reader.Peek(n)
+		}
+		b, err := r.reader.Peek(n - 1)
+		return append([]byte{byte(r.buffer)}, b...), err
+	default:
+		return nil, fmt.Errorf("cannot peek with %d pending bits", r.capacity)
+	}
+}
+
 /**
  * Skip n bytes
  */
@@ -97,6 +160,7 @@ func (r *BitReader) Skip(n int64) error {
 		// algined
 		for n != 0 {
 			skipped, err := r.reader.Discard(int(n))
+			r.length += skipped
 			if err != nil {
 				return err
 			}
@@ -210,13 +274,15 @@ func (r *BitReader) ReadToBuffer(buffer []byte, offset, length int) error {
 		// byte-aligned --> read all bytes at byte-border (at once?)
 		readBytes := 0
 		for readBytes < length {
-			br, err := r.reader.Read(buffer[readBytes : length+readBytes])
+			br, err := r.reader.Read(buffer[offset+readBytes : offset+length])
 			if err == io.EOF {
 				return errors.New("premature EOS found while reading data")
 			}
 			if err != nil {
 				return err
 			}
+			r.raw.record(buffer[offset+readBytes : offset+readBytes+br]...)
+			r.length += br
 			readBytes += br
 		}
 	} else {
@@ -227,7 +293,7 @@ func (r *BitReader) ReadToBuffer(buffer []byte, offset, length int) error {
 			if err != nil {
 				return err
 			}
-			buffer[i] = byte((r.buffer << shift) | (nextByte >> r.capacity))
+			buffer[offset+i] = byte((r.buffer << shift) | (nextByte >> r.capacity))
 			r.buffer = nextByte
 		}
 	}
@@ -270,6 +336,13 @@ func (w *BitWriter) GetLength() int {
 	return w.len
 }
 
+/**
+ * Returns the number of bits written, including those not yet flushed.
+ */
+func (w *BitWriter) GetBitLength() int {
+	return w.len*BitsInByte + w.GetBitsInByffer()
+}
+
 func (w *BitWriter) flushBuffer() error {
 	if w.capacity == 0 {
 		if err := w.writer.WriteByte(byte(w.buffer & 0xFF)); err != nil {
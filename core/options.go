@@ -40,13 +40,46 @@ const (
 	OptionUtcTime string = "UTC_TIME"
 
 	// To indicate that the EXI stream should respect the Canonical EXI rules
-	// (see http://www.w3.org/TR/exi-c14n)
+	// (see http://www.w3.org/TR/exi-c14n). The EXI options document is
+	// included while the cookie is omitted, compression is replaced by
+	// pre-compression and the datatypeRepresentationMap is sorted. Namespace
+	// declarations and attributes passed to the body encoder must be sorted,
+	// see AttributeList.
 	OptionCanonicalExi string = "http://www.w3.org/TR/exi-c14n"
 
 	// To set the deflate stream with a specified compression level.
 	OptionDeflateCompressionValue string = "DEFLATE_COMPRESSION_VALUE"
+
+	// To choose between bit-packed and byte-packed alignment automatically.
+	// The document is encoded in both modes and the smaller stream is kept,
+	// except that byte-packed is preferred as long as its size does not
+	// exceed the optional int value (DefaultAutoAlignmentThreshold bytes
+	// otherwise). The choice is recorded in the EXI options header. Only
+	// whole-document helpers such as sax.EncodeXML honour this option.
+	OptionAutoAlignment string = "AUTO_ALIGNMENT"
+
+	// To reject attribute lists whose namespace declarations or namespaced
+	// attributes lack a prefix while prefixes are preserved, instead of
+	// warning and encoding default prefixes, see EncodeAttributeList.
+	OptionRequirePrefixes string = "REQUIRE_PREFIXES"
+
+	// To sort namespace declarations by prefix and attributes by local-name
+	// and then URI, i.e. in the order of Canonical EXI, regardless of the
+	// order they are passed in. The same logical document then always yields
+	// the same bytes, e.g. for signing EXI streams, while the attribute order
+	// of the source document is lost.
+	OptionSortAttributes string = "SORT_ATTRIBUTES"
+
+	// To encode the attributes of an attribute list in the order of the
+	// attribute productions declared by the current schema-informed grammar,
+	// regardless of the order of the list, see EncodeAttributeList.
+	// Attributes without declared production follow in list order.
+	OptionSchemaOrderAttributes string = "SCHEMA_ORDER_ATTRIBUTES"
 )
 
+// Size in bytes up to which auto alignment prefers byte-packed streams
+const DefaultAutoAlignmentThreshold int = 64
+
 type EncodingOptions struct {
 	options map[string]any
 }
@@ -63,9 +96,10 @@ func (o *EncodingOptions) SetOption(key string) error {
 
 func (o *EncodingOptions) SetOptionKeyValue(key string, value any) error {
 	switch key {
-	case OptionIncludeCookie, OptionIncludeSchemaID, OptionRetainEntityReference,
+	case OptionIncludeCookie, OptionIncludeOptions, OptionIncludeSchemaID, OptionRetainEntityReference,
 		OptionIncludeXsiSchemaLocation, OptionIncludeInsignificanXsiNil,
-		OptionIncludeProfileValues, OptionUtcTime:
+		OptionIncludeProfileValues, OptionUtcTime, OptionRequirePrefixes, OptionSortAttributes,
+		OptionSchemaOrderAttributes:
 		o.options[key] = nil
 	case OptionCanonicalExi:
 		o.options[key] = nil
@@ -83,6 +117,17 @@ func (o *EncodingOptions) SetOptionKeyValue(key string, value any) error {
 		}
 
 		return fmt.Errorf("EncodingOption '%s' requires value of type int", key)
+	case OptionAutoAlignment:
+		if value == nil {
+			o.options[key] = DefaultAutoAlignmentThreshold
+			break
+		}
+		if threshold, ok := value.(int); ok && threshold >= 0 {
+			o.options[key] = threshold
+			break
+		}
+
+		return fmt.Errorf("EncodingOption '%s' requires non-negative value of type int", key)
 	default:
 		return fmt.Errorf("EncodingOption '%s' is unknown", key)
 	}
@@ -104,6 +149,12 @@ func (o *EncodingOptions) GetOptionValue(key string) any {
 	return o.options[key]
 }
 
+func (o *EncodingOptions) Clone() *EncodingOptions {
+	return &EncodingOptions{
+		options: maps.Clone(o.options),
+	}
+}
+
 func (o *EncodingOptions) Equals(other *EncodingOptions) bool {
 	if other == nil {
 		return false
@@ -120,6 +171,16 @@ const (
 	// SchemaId in EXI header is not used
 	OptionIgnoreSchemaID string = "IGNORE_SCHEMA_ID"
 
+	// EXI profile parameters (exi:p element) in the EXI header that cannot be
+	// applied, e.g. because they are not typed as decimal, raise an error
+	// instead of being ignored
+	OptionStrictProfileHandling string = "STRICT_PROFILE_HANDLING"
+
+	// Attribute and character values are reported as StringValue holding
+	// their lexical form regardless of the datatype they were decoded with.
+	// The stream itself is decoded as usual.
+	OptionCoerceValuesToStrings string = "COERCE_VALUES_TO_STRINGS"
+
 	// Pushback size for multiple streams in one file
 	OptionPushbackBufferSize int = 512
 )
@@ -140,7 +201,7 @@ func (o *DecodingOptions) SetOption(key string) error {
 
 func (o *DecodingOptions) SetOptionKeyValue(key string, value any) error {
 	switch key {
-	case OptionIgnoreSchemaID:
+	case OptionIgnoreSchemaID, OptionStrictProfileHandling, OptionCoerceValuesToStrings:
 		o.options[key] = nil
 	default:
 		return fmt.Errorf("DecodingOption '%s' is unknown", key)
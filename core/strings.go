@@ -1,10 +1,13 @@
 package core
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
+	"io"
 	"maps"
 	"slices"
+	"unicode/utf8"
 
 	"github.com/sderkacs/go-exi/utils"
 )
@@ -22,6 +25,10 @@ type StringCoder interface {
 	Clear()
 	SetSharedStrings(sharedStrings []string) error
 	IsLocalValuePartitions() bool
+
+	// Returns the fill state of the string table and how it was used since
+	// it has been cleared.
+	Stats() StringTableStats
 }
 
 type StringDecoder interface {
@@ -77,6 +84,29 @@ func NewLocalIDMap(localID int, qnc *QNameContext) LocalIDMap {
 	}
 }
 
+/*
+	StringTableStats implementation
+*/
+
+// StringTableStats tells how the value partitions of a string table filled
+// up, e.g. to choose valuePartitionCapacity and valueMaxLength empirically.
+type StringTableStats struct {
+	GlobalValues int // values in the global value partition, shared strings included
+	LocalValues  int // compact identifiers assigned in local value partitions
+	Hits         int // values represented by a compact identifier
+	LocalHits    int // hits in the local value partition of the qname, part of Hits
+	Misses       int // non-empty values represented as string literal
+	Evictions    int // values replaced because valuePartitionCapacity was reached
+}
+
+// HitRate returns the ratio of hits to non-empty string values.
+func (s StringTableStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
 /*
 	AbstractStringCoder implementation
 */
@@ -85,6 +115,12 @@ type AbstractStringCoder struct {
 	StringCoder
 	localValuePartitions bool
 	localValues          map[QNameContextMapKey][]*StringValue
+
+	// stats
+	hits      int
+	localHits int
+	misses    int
+	evictions int
 }
 
 func NewAbstractStringCoder(localValuePartitions bool, initialQNameLists int) *AbstractStringCoder {
@@ -95,6 +131,11 @@ func NewAbstractStringCoder(localValuePartitions bool, initialQNameLists int) *A
 }
 
 func (c *AbstractStringCoder) GetNumberOfStringValues(qnc *QNameContext) int {
+	if qnc == nil {
+		// e.g., shared strings
+		return 0
+	}
+
 	n := 0
 	lvs, exists := c.localValues[qnc.GetMapKey()]
 	if exists {
@@ -104,6 +145,11 @@ func (c *AbstractStringCoder) GetNumberOfStringValues(qnc *QNameContext) int {
 }
 
 func (c *AbstractStringCoder) Clear() {
+	c.hits = 0
+	c.localHits = 0
+	c.misses = 0
+	c.evictions = 0
+
 	// local context
 	if c.localValuePartitions {
 		// free strings only, not destroy lists itself
@@ -117,8 +163,40 @@ func (c *AbstractStringCoder) IsLocalValuePartitions() bool {
 	return c.localValuePartitions
 }
 
+// Counts a value represented by a compact identifier.
+func (c *AbstractStringCoder) countHit(local bool) {
+	c.hits++
+	if local {
+		c.localHits++
+	}
+}
+
+// Counts a value about to be added after being represented as string
+// literal. Shared strings (nil qnc) are no misses.
+func (c *AbstractStringCoder) countMiss(qnc *QNameContext) {
+	if qnc != nil {
+		c.misses++
+	}
+}
+
+func (c *AbstractStringCoder) stats(globalValues int) StringTableStats {
+	localValues := 0
+	for _, lvs := range c.localValues {
+		localValues += len(lvs)
+	}
+	return StringTableStats{
+		GlobalValues: globalValues,
+		LocalValues:  localValues,
+		Hits:         c.hits,
+		LocalHits:    c.localHits,
+		Misses:       c.misses,
+		Evictions:    c.evictions,
+	}
+}
+
 func (c *AbstractStringCoder) addLocalValue(qnc *QNameContext, value *StringValue) {
-	if c.localValuePartitions {
+	// Note: shared strings are global values only
+	if c.localValuePartitions && qnc != nil {
 		lvs, exists := c.localValues[qnc.GetMapKey()]
 		if !exists {
 			lvs = []*StringValue{}
@@ -133,8 +211,10 @@ func (c *AbstractStringCoder) addLocalValue(qnc *QNameContext, value *StringValu
 */
 
 type StringDecoderImpl struct {
+	StringDecoder
 	*AbstractStringCoder
 	globalValues []*StringValue
+	maxValues    int // global values, negative for unbounded
 }
 
 func NewStringDecoderImpl(localValuePartitions bool) *StringDecoderImpl {
@@ -142,13 +222,45 @@ func NewStringDecoderImpl(localValuePartitions bool) *StringDecoderImpl {
 }
 
 func NewStringDecoderImplWithInitialQNameLists(localValuePartitions bool, initialQNameLists int) *StringDecoderImpl {
-	return &StringDecoderImpl{
+	sd := &StringDecoderImpl{
 		AbstractStringCoder: NewAbstractStringCoder(localValuePartitions, initialQNameLists),
 		globalValues:        []*StringValue{},
+		maxValues:           DefaultMaxStringTableEntries,
 	}
+	sd.StringDecoder = sd
+
+	return sd
+}
+
+func (sd *StringDecoderImpl) GetNumberOfStringValues(qnc *QNameContext) int {
+	return sd.AbstractStringCoder.GetNumberOfStringValues(qnc)
+}
+
+func (sd *StringDecoderImpl) IsLocalValuePartitions() bool {
+	return sd.AbstractStringCoder.IsLocalValuePartitions()
 }
 
 func (sd *StringDecoderImpl) AddValue(qnc *QNameContext, value *StringValue) error {
+	sd.countMiss(qnc)
+	return sd.addValue(qnc, value)
+}
+
+func (sd *StringDecoderImpl) addValue(qnc *QNameContext, value *StringValue) error {
+	if err := sd.checkMaxValues(); err != nil {
+		return err
+	}
+	// global context
+	sd.globalValues = append(sd.globalValues, value)
+	// local context
+	sd.addLocalValue(qnc, value)
+
+	return nil
+}
+
+func (sd *StringDecoderImpl) checkMaxValues() error {
+	if sd.maxValues >= 0 && len(sd.globalValues) >= sd.maxValues {
+		return fmt.Errorf("string table exceeds maximum number of values %d", sd.maxValues)
+	}
 	return nil
 }
 
@@ -196,7 +308,7 @@ func (sd *StringDecoderImpl) ReadValue(qnc *QNameContext, channel DecoderChannel
 			// After encoding the string value, it is added to both the
 			// associated "local" value string table partition and the
 			// global value string table partition.
-			if err := sd.AddValue(qnc, value); err != nil {
+			if err := sd.StringDecoder.AddValue(qnc, value); err != nil {
 				return nil, err
 			}
 		} else {
@@ -227,6 +339,7 @@ func (sd *StringDecoderImpl) ReadValueLocalHit(qnc *QNameContext, channel Decode
 	if localID >= len(lvs) {
 		return nil, errors.New("out of bounds")
 	}
+	sd.countHit(true)
 
 	return lvs[localID], nil
 }
@@ -237,6 +350,10 @@ func (sd *StringDecoderImpl) ReadValueGlobalHit(channel DecoderChannel) (*String
 	if err != nil {
 		return nil, err
 	}
+	if globalID >= len(sd.globalValues) {
+		return nil, errors.New("out of bounds")
+	}
+	sd.countHit(false)
 	return sd.globalValues[globalID], nil
 }
 
@@ -247,13 +364,17 @@ func (sd *StringDecoderImpl) Clear() {
 
 func (sd *StringDecoderImpl) SetSharedStrings(sharedStrings []string) error {
 	for _, s := range sharedStrings {
-		if err := sd.AddValue(nil, NewStringValueFromString(s)); err != nil {
+		if err := sd.StringDecoder.AddValue(nil, NewStringValueFromString(s)); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+func (sd *StringDecoderImpl) Stats() StringTableStats {
+	return sd.stats(len(sd.globalValues))
+}
+
 /*
 	StringEncoderImpl implementation
 */
@@ -294,6 +415,7 @@ func (se *StringEncoderImpl) WriteValue(qnc *QNameContext, channel EncoderChanne
 			 * Unsigned Integer followed by the compact identifier of the
 			 * string value in the "local" value partition
 			 */
+			se.countHit(true)
 			if err := channel.EncodeUnsignedInteger(0); err != nil {
 				return err
 			}
@@ -305,6 +427,7 @@ func (se *StringEncoderImpl) WriteValue(qnc *QNameContext, channel EncoderChanne
 			 * as an Unsigned Integer followed by the compact identifier of
 			 * the String value in the global value partition.
 			 */
+			se.countHit(false)
 			if err := channel.EncodeUnsignedInteger(1); err != nil {
 				return err
 			}
@@ -364,6 +487,24 @@ func (se *StringEncoderImpl) Clear() {
 	se.stringValues = map[string]ValueContainer{}
 }
 
+func (se *StringEncoderImpl) Stats() StringTableStats {
+	return se.stats(len(se.stringValues))
+}
+
+// Adds value to the global and local value partitions without any bounds.
+func (se *StringEncoderImpl) addValue(qnc *QNameContext, value string) error {
+	if utils.ContainsKey(se.stringValues, value) {
+		panic("attempt to add dupplicate global string value")
+	}
+
+	// global context
+	se.stringValues[value] = NewValueContainer(value, qnc, se.GetNumberOfStringValues(qnc), len(se.stringValues))
+	// local context
+	se.addLocalValue(qnc, NewStringValueFromString(value))
+
+	return nil
+}
+
 func (se *StringEncoderImpl) SetSharedStrings(sharedStrings []string) error {
 	for _, s := range sharedStrings {
 		if err := se.AddValue(nil, s); err != nil {
@@ -402,11 +543,14 @@ func NewBoundedStringDecoderImpl(localValuePartitions bool, valueMaxLength, valu
 		localIDMapping:         make([]LocalIDMap, lmapSize),
 	}
 	sd.StringCoder = bsd
+	sd.StringDecoder = bsd
 
 	return bsd
 }
 
 func (sd *BoundedStringDecoderImpl) AddValue(qnc *QNameContext, value *StringValue) error {
+	sd.countMiss(qnc)
+
 	clen, err := value.GetCharactersLength()
 	if err != nil {
 		return err
@@ -417,7 +561,7 @@ func (sd *BoundedStringDecoderImpl) AddValue(qnc *QNameContext, value *StringVal
 		// next: check "valuePartitionCapacity"
 		if sd.valuePartitionCapacity < 0 {
 			// no "valuePartitionCapacity" restriction
-			return sd.StringDecoderImpl.AddValue(qnc, value)
+			return sd.addValue(qnc, value)
 		} else {
 			// If valuePartitionCapacity is not zero the string S is added
 			if sd.valuePartitionCapacity == 0 {
@@ -448,12 +592,16 @@ func (sd *BoundedStringDecoderImpl) AddValue(qnc *QNameContext, value *StringVal
 
 				if len(sd.globalValues) > sd.globalID {
 					sd.globalValues[sd.globalID] = value
+					sd.evictions++
 					// Java source have a quite weird code here!
 				} else {
 					// Need to check twice?
 					if slices.Contains(sd.globalValues, value) {
 						return errors.New("duplicate global string values")
 					}
+					if err := sd.checkMaxValues(); err != nil {
+						return err
+					}
 					sd.globalValues = append(sd.globalValues, value)
 				}
 
@@ -495,16 +643,8 @@ func NewUnboundedStringEncoderImpl(localValuePartitions bool) *UnboundedStringEn
 }
 
 func (se *UnboundedStringEncoderImpl) AddValue(qnc *QNameContext, value string) error {
-	if utils.ContainsKey(se.stringValues, value) {
-		panic("attempt to add dupplicate global string value")
-	}
-
-	// global context
-	se.stringValues[value] = NewValueContainer(value, qnc, se.GetNumberOfStringValues(qnc), len(se.stringValues))
-	// local context
-	se.addLocalValue(qnc, NewStringValueFromString(value))
-
-	return nil
+	se.countMiss(qnc)
+	return se.addValue(qnc, value)
 }
 
 /*
@@ -535,12 +675,14 @@ func NewBoundedStringEncoderImpl(localValuePartitions bool, valueMaxLength, valu
 }
 
 func (se *BoundedStringEncoderImpl) AddValue(qnc *QNameContext, value string) error {
-	// first: check "valueMaxLength"
-	if se.valueMaxLength < 0 || len(value) <= se.valueMaxLength {
+	se.countMiss(qnc)
+
+	// first: check "valueMaxLength" (in characters, not bytes)
+	if se.valueMaxLength < 0 || utf8.RuneCountInString(value) <= se.valueMaxLength {
 		// next: check "valuePartitionCapacity"
 		if se.valuePartitionCapacity < 0 {
 			// no "valuePartitionCapacity" restriction
-			if err := se.StringEncoderImpl.AddValue(qnc, value); err != nil {
+			if err := se.addValue(qnc, value); err != nil {
 				return err
 			}
 		} else {
@@ -578,6 +720,7 @@ func (se *BoundedStringEncoderImpl) AddValue(qnc *QNameContext, value string) er
 
 					// remove global
 					delete(se.stringValues, vcFree.Value)
+					se.evictions++
 				}
 
 				// add global
@@ -599,7 +742,7 @@ func (se *BoundedStringEncoderImpl) freeStringValue(qnc *QNameContext, localValu
 		if !ok {
 			return fmt.Errorf("local value missing: %+v", qnc.GetMapKey())
 		}
-		if localValueID >= len(se.localValues) {
+		if localValueID >= len(lvs) {
 			return errors.New("local value ID is larger that local values map size")
 		}
 		sv := lvs[localValueID]
@@ -616,3 +759,49 @@ func (se *BoundedStringEncoderImpl) Clear() {
 	se.StringEncoderImpl.Clear()
 	se.globalID = -1
 }
+
+/*
+	Shared strings files
+*/
+
+// SaveSharedStrings writes shared strings (see EXIFactory.SetSharedStrings)
+// so that encoder and decoder can be primed with the same dictionary. The
+// number of strings is followed by the strings, each as length-prefixed
+// sequence of code points using the byte-aligned EXI representations of
+// unsigned integers and strings.
+func SaveSharedStrings(writer io.Writer, sharedStrings []string) error {
+	bw := bufio.NewWriter(writer)
+	channel := NewByteEncoderChannel(bw)
+
+	if err := channel.EncodeUnsignedInteger(len(sharedStrings)); err != nil {
+		return err
+	}
+	for _, s := range sharedStrings {
+		if err := channel.EncodeString(s); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+// LoadSharedStrings reads shared strings written by SaveSharedStrings. The
+// order of the strings is preserved, it determines the string table IDs.
+func LoadSharedStrings(reader io.Reader) ([]string, error) {
+	channel := NewByteDecoderChannel(bufio.NewReader(reader))
+
+	n, err := channel.DecodeUnsignedInteger()
+	if err != nil {
+		return nil, fmt.Errorf("invalid shared strings: %w", err)
+	}
+	sharedStrings := []string{}
+	for i := 0; i < n; i++ {
+		s, err := channel.DecodeString()
+		if err != nil {
+			return nil, fmt.Errorf("invalid shared string %d: %w", i, err)
+		}
+		sharedStrings = append(sharedStrings, string(s))
+	}
+
+	return sharedStrings, nil
+}
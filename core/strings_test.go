@@ -0,0 +1,206 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/sderkacs/go-exi/utils"
+)
+
+func TestSharedStringsFile(t *testing.T) {
+	sharedStrings := []string{"alpha", "", "grüße", "alpha beta gamma", "😀"}
+	var file bytes.Buffer
+	if err := SaveSharedStrings(&file, sharedStrings); err != nil {
+		t.Fatal(err)
+	}
+	saved := slices.Clone(file.Bytes())
+	loaded, err := LoadSharedStrings(&file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(loaded, sharedStrings) {
+		t.Fatalf("loaded %q, want %q", loaded, sharedStrings)
+	}
+
+	// encoder and decoder primed with the loaded file
+	events := []string{"SD", "SE r", "AT a=alpha beta gamma", "SE e", "CH grüße", "EE", "SE e", "CH alpha", "EE", "EE", "ED"}
+	plain := encodeBody(t, NewDefaultEXIFactory(), events)
+	encoderFactory, decoderFactory := NewDefaultEXIFactory(), NewDefaultEXIFactory()
+	encoderFactory.SetSharedStrings(sharedStrings)
+	decoderFactory.SetSharedStrings(loaded)
+	exi := encodeBody(t, encoderFactory, events)
+	if got := decodeBody(t, decoderFactory, exi); !slices.Equal(got, events) {
+		t.Errorf("decoded %q, want %q", got, events)
+	}
+	if len(exi) >= len(plain) {
+		t.Errorf("%d bytes with shared strings, %d bytes without", len(exi), len(plain))
+	}
+
+	// truncated files
+	for _, n := range []int{0, 1, len(saved) - 1} {
+		if _, err := LoadSharedStrings(bytes.NewReader(saved[:n])); err == nil {
+			t.Errorf("%d of %d bytes: want error", n, len(saved))
+		}
+	}
+}
+
+func TestValueMaxLengthCharacters(t *testing.T) {
+	// "äöü" has 3 characters in 6 bytes and fits valueMaxLength 3, x in c
+	// is a global hit with the same ID in encoder and decoder
+	events := []string{"SD", "SE r", "SE a", "CH äöü", "EE", "SE b", "CH x", "EE", "SE c", "CH x", "EE", "SE c", "CH äöü", "EE", "EE", "ED"}
+	for _, mode := range []CodingMode{CodingModeBitPacked, CodingModeCompression} {
+		factory := NewDefaultEXIFactory()
+		factory.SetCodingMode(mode)
+		factory.SetValueMaxLength(3)
+		exi := encodeBody(t, factory, events)
+		if got := decodeBody(t, factory, exi); !slices.Equal(got, events) {
+			t.Errorf("mode %d: decoded %q, want %q", mode, got, events)
+		}
+	}
+}
+
+func TestBoundedStringEncoderFreeStringValue(t *testing.T) {
+	se := NewBoundedStringEncoderImpl(true, -1, 3)
+	var qncs []*QNameContext
+	for i, name := range []string{"a", "b", "c"} {
+		qnc := NewQNameContext(0, i, utils.QName{Local: name})
+		if err := se.AddValue(qnc, name); err != nil {
+			t.Fatal(err)
+		}
+		qncs = append(qncs, qnc)
+	}
+
+	// the partition of a holds one value, there are three partitions
+	if err := se.freeStringValue(qncs[0], 1); err == nil {
+		t.Error("local value ID 1 of a: want error")
+	}
+	if err := se.freeStringValue(qncs[0], 0); err != nil {
+		t.Errorf("local value ID 0 of a: %v", err)
+	}
+	if err := se.freeStringValue(qncs[0], 0); err == nil {
+		t.Error("freed local value ID 0 of a: want error")
+	}
+}
+
+func TestStringTableStats(t *testing.T) {
+	// five repeated values in v, interleaved with five unique ones in u
+	events := []string{"SD", "SE r"}
+	for i := range 5 {
+		events = append(events, "SE v", "CH same", "EE", "SE u", fmt.Sprintf("CH unique %d", i), "EE")
+	}
+	events = append(events, "EE", "ED")
+
+	tests := []struct {
+		name     string
+		capacity int
+		want     StringTableStats
+		hitRate  float64
+	}{
+		{"unbounded", -1, StringTableStats{GlobalValues: 6, LocalValues: 6, Hits: 4, LocalHits: 4, Misses: 6}, 0.4},
+		// the unique values push same out of the table after its second hit
+		{"capacity 3", 3, StringTableStats{GlobalValues: 3, LocalValues: 7, Hits: 3, LocalHits: 3, Misses: 7, Evictions: 4}, 0.3},
+	}
+	for _, tt := range tests {
+		factory := NewDefaultEXIFactory()
+		factory.SetValuePartitionCapacity(tt.capacity)
+
+		encoder, err := factory.CreateEXIBodyEncoder()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		writer := bufio.NewWriter(&buf)
+		if err := encoder.SetOutputStream(writer); err != nil {
+			t.Fatal(err)
+		}
+		if err := encodeEvents(encoder, events); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if got := encoder.GetStringTableStats(); got != tt.want {
+			t.Errorf("%s: encoder stats %+v, want %+v", tt.name, got, tt.want)
+		}
+
+		decoder, err := factory.CreateEXIBodyDecoder()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := decoder.SetInputStream(bufio.NewReader(&buf)); err != nil {
+			t.Fatal(err)
+		}
+		if got := decodeEvents(t, decoder); !slices.Equal(got, events) {
+			t.Errorf("%s: decoded %q, want %q", tt.name, got, events)
+		}
+		if got := decoder.GetStringTableStats(); got != tt.want {
+			t.Errorf("%s: decoder stats %+v, want %+v", tt.name, got, tt.want)
+		}
+		if got, want := tt.want.HitRate(), tt.hitRate; got != want {
+			t.Errorf("%s: hit rate %v, want %v", tt.name, got, want)
+		}
+	}
+}
+
+func TestStringDecoderMaxValues(t *testing.T) {
+	qnc := NewQNameContext(0, 0, utils.QName{Local: "a"})
+	tests := []struct {
+		name    string
+		decoder func() (StringDecoder, *StringDecoderImpl)
+		// values added without error, negative for all
+		added int
+	}{
+		{"unbounded", func() (StringDecoder, *StringDecoderImpl) {
+			sd := NewStringDecoderImpl(true)
+			return sd, sd
+		}, 3},
+		{"capacity 5", func() (StringDecoder, *StringDecoderImpl) {
+			bsd := NewBoundedStringDecoderImpl(true, -1, 5)
+			return bsd, bsd.StringDecoderImpl
+		}, 3},
+		// replacing values does not grow the global partition
+		{"capacity 3", func() (StringDecoder, *StringDecoderImpl) {
+			bsd := NewBoundedStringDecoderImpl(true, -1, 3)
+			return bsd, bsd.StringDecoderImpl
+		}, -1},
+	}
+	for _, test := range tests {
+		decoder, sd := test.decoder()
+		sd.maxValues = 3
+		for i := range 4 {
+			err := decoder.AddValue(qnc, NewStringValueFromString(fmt.Sprint(i)))
+			if (test.added < 0 || i < test.added) && err != nil {
+				t.Errorf("%s: value %d: %v", test.name, i, err)
+			}
+			if test.added >= 0 && i >= test.added && err == nil {
+				t.Errorf("%s: value %d: want error", test.name, i)
+			}
+		}
+	}
+
+	// shared strings count against the limit, also if the stream adds no
+	// values
+	for _, events := range [][]string{
+		{"SD", "SE r", "EE", "ED"},
+		{"SD", "SE r", "CH x", "EE", "ED"},
+	} {
+		exi := encodeBody(t, NewDefaultEXIFactory(), events)
+		// a, b and the values of the stream
+		added := 2 + len(events) - 4
+		for _, maxValues := range []int{added, added - 1} {
+			factory := NewDefaultEXIFactory()
+			factory.SetSharedStrings([]string{"a", "b"})
+			factory.SetMaxValueEntries(maxValues)
+			err := decodeMalformed(factory, exi)
+			if maxValues == added && err != nil {
+				t.Errorf("%q: max %d: %v", events, maxValues, err)
+			}
+			if maxValues < added && err == nil {
+				t.Errorf("%q: max %d: want error", events, maxValues)
+			}
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package core
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	"github.com/sderkacs/go-exi/utils"
+)
+
+/*
+	Subtree deduplication
+
+	Non-standard extension: DeduplicateSubtrees replaces a repeated element
+	subtree of an event log by a processing instruction referencing its first
+	occurrence, ExpandSubtreeReferences restores the original events. The
+	reference PI has the target SubtreeReferenceTarget and the zero-based
+	number of the referenced SE event in the deduplicated log, i.e. counting
+	the SE events actually encoded, as decimal data. References only point
+	back to elements that ended before. Processing instructions of the log
+	that have the same target keep it, their data is prefixed by
+	subtreeEscapePrefix.
+*/
+
+// SubtreeReferenceTarget is the target of processing instructions that
+// reference repeated subtrees, see DeduplicateSubtrees.
+const SubtreeReferenceTarget = "exi-subtree-ref"
+
+// prefix of the data of escaped processing instructions, no reference data
+const subtreeEscapePrefix = "!"
+
+// multiplier of the polynomial subtree hash
+const subtreeHashBase uint64 = 1099511628211
+
+// DeduplicateSubtrees returns log, as recorded by DecodeToEventLog, with
+// every element subtree of at least minEvents events (SE to EE) that
+// repeats an earlier one replaced by a reference processing instruction.
+// Encode the result with ReplayEventLog and restore the original events after
+// decoding with ExpandSubtreeReferences. A reference costs about as much as
+// a few events whose strings are found in the string table, so minEvents
+// should not be too small.
+//
+// This is not part of EXI: other decoders report the references as plain
+// processing instructions. The encoder has to preserve processing
+// instructions (FeaturePI), otherwise references are dropped silently, and
+// must not be strict.
+func DeduplicateSubtrees(log []DecodedEvent, minEvents int) []DecodedEvent {
+	ends := subtreeEnds(log)
+
+	// prefix hashes, the hash of events i..j is prefix[j+1] - prefix[i]*powers[j+1-i]
+	prefix := make([]uint64, len(log)+1)
+	powers := make([]uint64, len(log)+1)
+	powers[0] = 1
+	for i := range log {
+		prefix[i+1] = prefix[i]*subtreeHashBase + eventHash(&log[i])
+		powers[i+1] = powers[i] * subtreeHashBase
+	}
+
+	type occurrence struct {
+		start   int // index in log
+		ordinal int // number of SE event in deduplicated log
+	}
+	occurrences := map[uint64][]occurrence{}
+
+	deduplicated := make([]DecodedEvent, 0, len(log))
+	numberOfStartElements := 0
+
+	for i := 0; i < len(log); i++ {
+		end, isStartElement := ends[i]
+		if !isStartElement {
+			deduplicated = append(deduplicated, escapeSubtreeReference(log[i]))
+			continue
+		}
+
+		length := end + 1 - i
+		if length >= minEvents {
+			hash := prefix[end+1] - prefix[i]*powers[length]
+			referenced := false
+			for _, o := range occurrences[hash] {
+				if ends[o.start]+1-o.start == length && eventsEqual(log[o.start:ends[o.start]+1], log[i:end+1]) {
+					deduplicated = append(deduplicated, DecodedEvent{
+						EventType: EventTypeProcessingInstruction,
+						ProcessingInstruction: &ProcessingInstructionContainer{
+							Target: SubtreeReferenceTarget,
+							Data:   strconv.Itoa(o.ordinal),
+						},
+					})
+					referenced = true
+					break
+				}
+			}
+			if referenced {
+				i = end
+				continue
+			}
+			occurrences[hash] = append(occurrences[hash], occurrence{start: i, ordinal: numberOfStartElements})
+		}
+
+		deduplicated = append(deduplicated, log[i])
+		numberOfStartElements++
+	}
+
+	return deduplicated
+}
+
+// escapeSubtreeReference returns ev with the data of a processing instruction
+// with target SubtreeReferenceTarget prefixed, so that it is not taken for a
+// reference.
+func escapeSubtreeReference(ev DecodedEvent) DecodedEvent {
+	if ev.EventType == EventTypeProcessingInstruction && ev.ProcessingInstruction.Target == SubtreeReferenceTarget {
+		ev.ProcessingInstruction = &ProcessingInstructionContainer{
+			Target: SubtreeReferenceTarget,
+			Data:   subtreeEscapePrefix + ev.ProcessingInstruction.Data,
+		}
+	}
+	return ev
+}
+
+// ExpandSubtreeReferences returns log with the subtree references inserted by
+// DeduplicateSubtrees replaced by the events of the referenced subtrees.
+//
+// References may point to subtrees containing references themselves, so a
+// small log can expand to a huge one. The expansion fails once it exceeds
+// maxEvents events, negative for unbounded; logs decoded from untrusted
+// sources should always be limited.
+func ExpandSubtreeReferences(log []DecodedEvent, maxEvents int) ([]DecodedEvent, error) {
+	ends := subtreeEnds(log)
+	startElements := []int{} // indices of SE events by number
+	for i := range log {
+		if _, ok := ends[i]; ok {
+			startElements = append(startElements, i)
+		}
+	}
+
+	expanded := make([]DecodedEvent, 0, len(log))
+	var expand func(start, end int) error
+	expand = func(start, end int) error {
+		for i := start; i < end; i++ {
+			if maxEvents >= 0 && len(expanded) >= maxEvents {
+				return fmt.Errorf("expanded subtrees exceed maximum number of events %d", maxEvents)
+			}
+			ev := &log[i]
+			if ev.EventType != EventTypeProcessingInstruction || ev.ProcessingInstruction.Target != SubtreeReferenceTarget {
+				expanded = append(expanded, *ev)
+				continue
+			}
+			if data, escaped := strings.CutPrefix(ev.ProcessingInstruction.Data, subtreeEscapePrefix); escaped {
+				// processing instruction of the original log
+				pi := *ev
+				pi.ProcessingInstruction = &ProcessingInstructionContainer{
+					Target: SubtreeReferenceTarget,
+					Data:   data,
+				}
+				expanded = append(expanded, pi)
+				continue
+			}
+
+			ordinal, err := strconv.Atoi(ev.ProcessingInstruction.Data)
+			if err != nil || ordinal < 0 || ordinal >= len(startElements) {
+				return fmt.Errorf("invalid subtree reference: %q", ev.ProcessingInstruction.Data)
+			}
+			refStart := startElements[ordinal]
+			refEnd, closed := ends[refStart]
+			// Note: references to elements ending later could be circular
+			if !closed || refEnd >= i {
+				return fmt.Errorf("subtree reference to unfinished element: %d", ordinal)
+			}
+			if err := expand(refStart, refEnd+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := expand(0, len(log)); err != nil {
+		return nil, err
+	}
+	return expanded, nil
+}
+
+// subtreeEnds maps the indices of the SE events of log to the indices of
+// their EE events, or to len(log) for elements not closed.
+func subtreeEnds(log []DecodedEvent) map[int]int {
+	ends := map[int]int{}
+	open := []int{}
+
+	for i := range log {
+		switch log[i].EventType {
+		case EventTypeStartElement, EventTypeStartElementNS, EventTypeStartElementGeneric, EventTypeStartElementGenericUndeclared:
+			open = append(open, i)
+			ends[i] = len(log)
+		case EventTypeEndElement, EventTypeEndElementUndeclared:
+			if len(open) > 0 {
+				ends[open[len(open)-1]] = i
+				open = open[:len(open)-1]
+			}
+		}
+	}
+
+	return ends
+}
+
+// eventKind maps the event types that ReplayEventLog encodes alike, e.g.
+// SE(qname) and SE(*), to one of them.
+func eventKind(eventType EventType) EventType {
+	switch eventType {
+	case EventTypeStartElementNS, EventTypeStartElementGeneric, EventTypeStartElementGenericUndeclared:
+		return EventTypeStartElement
+	case EventTypeEndElementUndeclared:
+		return EventTypeEndElement
+	case EventTypeAttributeNS, EventTypeAttributeGeneric, EventTypeAttributeGenericUndeclared,
+		EventTypeAttributeInvalidValue, EventTypeAttributeAnyInvalidValue:
+		return EventTypeAttribute
+	case EventTypeCharactersGeneric, EventTypeCharactersGenericUndeclared:
+		return EventTypeCharacters
+	default:
+		return eventType
+	}
+}
+
+// eventKey lists the fields that make up the identity of ev. Values are
+// compared by their characters.
+func eventKey(ev *DecodedEvent) []string {
+	key := []string{strconv.Itoa(int(eventKind(ev.EventType)))}
+	if ev.QNameContext != nil {
+		key = append(key, ev.QNameContext.GetNamespaceUri(), ev.QNameContext.GetLocalName())
+	}
+	if ev.Prefix != nil {
+		key = append(key, "p", *ev.Prefix)
+	}
+	if ev.Value != nil {
+		s, err := ev.Value.ToString()
+		if err != nil {
+			// Note: values without characters never match
+			s = fmt.Sprintf("%p", ev.Value)
+		}
+		key = append(key, "v", s)
+	}
+	if ev.NamespaceDeclaration != nil {
+		key = append(key, ev.NamespaceDeclaration.NamespaceURI, utils.AsValue(ev.NamespaceDeclaration.Prefix))
+	}
+	if ev.DocType != nil {
+		key = append(key, string(ev.DocType.Name), string(ev.DocType.PublicID), string(ev.DocType.SystemID), string(ev.DocType.Text))
+	}
+	if ev.EntityReference != nil {
+		key = append(key, string(ev.EntityReference))
+	}
+	if ev.Comment != nil {
+		key = append(key, ev.Comment.Text)
+	}
+	if ev.ProcessingInstruction != nil {
+		key = append(key, ev.ProcessingInstruction.Target, ev.ProcessingInstruction.Data)
+	}
+	return key
+}
+
+func eventHash(ev *DecodedEvent) uint64 {
+	h := fnv.New64a()
+	for _, s := range eventKey(ev) {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	return h.Sum64()
+}
+
+func eventsEqual(events1, events2 []DecodedEvent) bool {
+	if len(events1) != len(events2) {
+		return false
+	}
+	for i := range events1 {
+		key1, key2 := eventKey(&events1[i]), eventKey(&events2[i])
+		if len(key1) != len(key2) {
+			return false
+		}
+		for j := range key1 {
+			if key1[j] != key2[j] {
+				return false
+			}
+		}
+	}
+	return true
+}
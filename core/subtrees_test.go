@@ -0,0 +1,158 @@
+package core
+
+import (
+	"bytes"
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/sderkacs/go-exi/utils"
+)
+
+// subtreeLog builds event logs for the subtree tests.
+type subtreeLog []DecodedEvent
+
+func (l subtreeLog) se(name string) subtreeLog {
+	return append(l, DecodedEvent{
+		EventType:    EventTypeStartElement,
+		QNameContext: NewQNameContext(0, 0, utils.QName{Local: name}),
+	})
+}
+
+func (l subtreeLog) ee() subtreeLog {
+	return append(l, DecodedEvent{EventType: EventTypeEndElement})
+}
+
+func (l subtreeLog) ch(value string) subtreeLog {
+	return append(l, DecodedEvent{EventType: EventTypeCharacters, Value: NewStringValueFromString(value)})
+}
+
+func (l subtreeLog) pi(target, data string) subtreeLog {
+	return append(l, DecodedEvent{
+		EventType:             EventTypeProcessingInstruction,
+		ProcessingInstruction: &ProcessingInstructionContainer{Target: target, Data: data},
+	})
+}
+
+func (l subtreeLog) leaf(name, value string) subtreeLog {
+	return l.se(name).ch(value).ee()
+}
+
+func TestDeduplicateSubtrees(t *testing.T) {
+	var log subtreeLog
+	log = log.se("r")
+	for range 3 {
+		log = log.se("item").leaf("a", "1").leaf("b", "2").pi(SubtreeReferenceTarget, "0").ee()
+	}
+	log = log.pi(SubtreeReferenceTarget, "7").pi(SubtreeReferenceTarget, "!x").ee()
+
+	deduplicated := DeduplicateSubtrees(log, 4)
+	if len(deduplicated) >= len(log) {
+		t.Fatalf("no subtree deduplicated: %d events", len(deduplicated))
+	}
+	references := 0
+	for _, ev := range deduplicated {
+		if ev.EventType == EventTypeProcessingInstruction {
+			if _, err := strconv.Atoi(ev.ProcessingInstruction.Data); err == nil {
+				references++
+			}
+		}
+	}
+	if references != 2 {
+		t.Errorf("got %d references, want 2", references)
+	}
+
+	expanded, err := ExpandSubtreeReferences(deduplicated, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !eventsEqual(expanded, log) {
+		t.Errorf("expanded log differs from original:\n got %v\nwant %v", expanded, log)
+	}
+	// Note: the log itself must not be modified
+	if log[len(log)-3].ProcessingInstruction.Data != "7" {
+		t.Errorf("original log modified")
+	}
+
+	// the references survive encoding and decoding
+	factory := NewDefaultEXIFactory()
+	if err := factory.GetFidelityOptions().SetFidelity(FeaturePI, true); err != nil {
+		t.Fatal(err)
+	}
+	replay := func(events []DecodedEvent) []DecodedEvent {
+		encoder, err := factory.CreateEXIBodyEncoder()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var exi bytes.Buffer
+		if err := encoder.SetOutput(&exi); err != nil {
+			t.Fatal(err)
+		}
+		document := slices.Concat([]DecodedEvent{{EventType: EventTypeStartDocument}}, events, []DecodedEvent{{EventType: EventTypeEndDocument}})
+		if err := ReplayEventLog(document, encoder); err != nil {
+			t.Fatal(err)
+		}
+		if err := encoder.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		decoder, err := factory.CreateEXIBodyDecoder()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := decoder.SetInput(&exi); err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := DecodeToEventLog(decoder)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return decoded
+	}
+	want := replay(log)
+	if expanded, err = ExpandSubtreeReferences(replay(deduplicated), -1); err != nil {
+		t.Fatal(err)
+	}
+	if !eventsEqual(expanded, want) {
+		t.Errorf("expanded decoded log differs:\n got %v\nwant %v", expanded, want)
+	}
+}
+
+func TestExpandSubtreeReferencesLimit(t *testing.T) {
+	// every level references the previous one twice, i.e. level n expands
+	// to about 2^n events
+	const levels = 40
+	var log subtreeLog
+	log = log.se("r").leaf("l", "x")
+	for level := 1; level <= levels; level++ {
+		ref := strconv.Itoa(level)
+		log = log.se("l").pi(SubtreeReferenceTarget, ref).pi(SubtreeReferenceTarget, ref).ee()
+	}
+	log = log.ee()
+
+	if _, err := ExpandSubtreeReferences(log, 100000); err == nil {
+		t.Error("want error")
+	}
+
+	// r, l(x) and a second l with two copies of l(x)
+	small := slices.Clone(log[:8]).ee()
+	expanded, err := ExpandSubtreeReferences(small, 13)
+	if err != nil {
+		t.Fatalf("limit 13: %v", err)
+	}
+	if len(expanded) != 13 {
+		t.Errorf("got %d events, want 13", len(expanded))
+	}
+	if _, err := ExpandSubtreeReferences(small, 12); err == nil {
+		t.Error("limit 12: want error")
+	}
+}
+
+func TestExpandSubtreeReferencesInvalid(t *testing.T) {
+	for _, data := range []string{"", "x", "-1", "5", "0"} {
+		// Note: 0 references the unfinished root element
+		log := subtreeLog{}.se("r").pi(SubtreeReferenceTarget, data).ee()
+		if _, err := ExpandSubtreeReferences(log, -1); err == nil {
+			t.Errorf("reference %q: want error", data)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package core
 
 import (
 	"fmt"
+	"io"
 	"strings"
 
 	"github.com/sderkacs/go-exi/utils"
@@ -27,6 +28,7 @@ const (
 	BuiltInTypeEnumeration
 	BuiltInTypeList
 	BuiltInTypeQName
+	BuiltInTypeDuration
 
 	DateTimeGYear DateTimeType = iota
 	DateTimeGYearMonth
@@ -58,10 +60,19 @@ var (
 	XsdString             utils.QName = utils.QName{Space: XMLSchemaNS_URI, Local: "string"}
 	XsdExtendedString     utils.QName = utils.QName{Space: XMLSchemaNS_URI, Local: "estring"}
 	XsdAnySimpleType      utils.QName = utils.QName{Space: XMLSchemaNS_URI, Local: "anySimpleType"}
+	XsdDuration           utils.QName = utils.QName{Space: XMLSchemaNS_URI, Local: "duration"}
 	XsdQName              utils.QName = utils.QName{Space: XMLSchemaNS_URI, Local: "QName"}
 	XsdNotation           utils.QName = utils.QName{Space: XMLSchemaNS_URI, Local: "Notation"}
 	DefaultValueName      utils.QName = XsdString
 
+	// DurationRepresentation is the datatype representation of DurationDatatype
+	// for datatype representation maps. EXI 1.0 represents xsd:duration as
+	// String, mapping it to DurationRepresentation codes its components
+	// instead, e.g.
+	//
+	//	factory.SetDatatypeRepresentationMap(&[]utils.QName{XsdDuration}, &[]utils.QName{DurationRepresentation})
+	DurationRepresentation utils.QName = utils.QName{Space: GoEXI_NS_URI, Local: "duration"}
+
 	defaultDatatype Datatype = NewStringDatatype(NewQNameContext(-1, -1, utils.QName{}))
 )
 
@@ -81,6 +92,22 @@ type TypeDecoder interface {
 	ReadValue(datatype Datatype, qnc *QNameContext, channel DecoderChannel, decoder StringDecoder) (Value, error)
 }
 
+// binaryTypeDecoder is implemented by type decoders that can copy the octets
+// of base64Binary and hexBinary values to a writer instead of holding them.
+type binaryTypeDecoder interface {
+	// Copies the octets of a value of datatype to w and returns 'true', or
+	// returns 'false' without reading if the value is not read as octets.
+	ReadBinaryValueTo(datatype Datatype, channel DecoderChannel, w io.Writer) (bool, error)
+}
+
+// setTypeDecoderErrorHandler passes handler on to type decoders reporting
+// warnings, see AbstractTypeDecoder.
+func setTypeDecoderErrorHandler(decoder TypeDecoder, handler ErrorHandler) {
+	if d, ok := decoder.(interface{ SetErrorHandler(handler ErrorHandler) }); ok {
+		d.SetErrorHandler(handler)
+	}
+}
+
 /*
 	AbstractTypeCoder implementation
 */
@@ -92,12 +119,24 @@ type AbstractTypeCoder struct {
 	dtrMapRepresentationDatatype *map[utils.QName]Datatype
 	dtrMap                       map[utils.QName]Datatype
 	dtrMapInUse                  bool
+	// string datatypes standing in for unsupported representations, nil if
+	// unsupported representations are an error
+	unsupportedRepresentations map[Datatype]utils.QName
 }
 
 func NewAbstractTypeCoder(
 	dtrMapTypes *[]utils.QName,
 	dtrMapRepresentations *[]utils.QName,
 	dtrMapRepresentationDatatype *map[utils.QName]Datatype,
+) (*AbstractTypeCoder, error) {
+	return newAbstractTypeCoder(dtrMapTypes, dtrMapRepresentations, dtrMapRepresentationDatatype, false)
+}
+
+func newAbstractTypeCoder(
+	dtrMapTypes *[]utils.QName,
+	dtrMapRepresentations *[]utils.QName,
+	dtrMapRepresentationDatatype *map[utils.QName]Datatype,
+	stringFallback bool,
 ) (*AbstractTypeCoder, error) {
 	c := &AbstractTypeCoder{
 		dtrMapTypes:                  dtrMapTypes,
@@ -106,6 +145,9 @@ func NewAbstractTypeCoder(
 		dtrMap:                       map[utils.QName]Datatype{},
 		dtrMapInUse:                  (dtrMapTypes != nil),
 	}
+	if stringFallback {
+		c.unsupportedRepresentations = map[Datatype]utils.QName{}
+	}
 	if dtrMapTypes != nil {
 		if err := c.initDtrMaps(); err != nil {
 			return nil, err
@@ -194,7 +236,12 @@ func (c *AbstractTypeCoder) initDtrMaps() error {
 		dtrMapRepr := (*c.dtrMapRepresentations)[i]
 		representation, err := c.getDatatypeRepresentation(dtrMapRepr.Space, dtrMapRepr.Local)
 		if err != nil {
-			return err
+			if c.unsupportedRepresentations == nil {
+				return err
+			}
+			// e.g., a representation added by a future EXI version
+			representation = NewStringDatatype(nil)
+			c.unsupportedRepresentations[representation] = dtrMapRepr
 		}
 		kind := (*c.dtrMapTypes)[i]
 		c.dtrMap[kind] = representation
@@ -255,8 +302,11 @@ func (c *AbstractTypeCoder) getDatatypeRepresentation(uri string, localPart stri
 		if c.dtrMapRepresentationDatatype != nil {
 			datatype = (*c.dtrMapRepresentationDatatype)[qn]
 		}
+		if datatype == nil && qn == DurationRepresentation {
+			datatype = NewDurationDatatype(nil)
+		}
 		if datatype == nil {
-			return nil, fmt.Errorf("[exi] no datatype instance")
+			return nil, fmt.Errorf("[exi] unsupported datatype representation: {%s}%s", uri, localPart)
 		}
 	}
 
@@ -358,6 +408,11 @@ func (c *AbstractTypeCoder) getDtrDatatype(datatype Datatype) (Datatype, error)
 
 func (c *AbstractTypeCoder) updateDtrDatatype(datatype Datatype) (Datatype, error) {
 	baseDatatype := datatype.GetBaseDatatype()
+	if baseDatatype == nil {
+		// no representation is mapped for the type hierarchy
+		c.dtrMap[datatype.GetSchemaType().GetQName()] = datatype
+		return datatype, nil
+	}
 	simpleBaseType := baseDatatype.GetSchemaType()
 	var err error
 
@@ -454,12 +509,12 @@ func (e *AbstractTypeEncoder) writeRCSValue(rcsDT *RestrictedCharacterSetDatatyp
 						return err
 					}
 				}
-
-				// After encoding the string value, it is added to both the
-				// associated "local" value string table partition and the
-				// global value string table partition.
-				encoder.AddValue(qnc, lastValidValue)
 			}
+
+			// After encoding the string value, it is added to both the
+			// associated "local" value string table partition and the
+			// global value string table partition.
+			encoder.AddValue(qnc, lastValidValue)
 		}
 	}
 
@@ -470,24 +525,75 @@ func (e *AbstractTypeEncoder) writeRCSValue(rcsDT *RestrictedCharacterSetDatatyp
 	AbstractTypeDecoder implementation
 */
 
+// AbstractTypeDecoder decodes values of datatype representations it does
+// not support, e.g., ones announced by the datatypeRepresentationMap of an
+// EXI header, as strings. A warning is reported to the error handler the
+// first time such a representation is decoded.
 type AbstractTypeDecoder struct {
 	*AbstractTypeCoder
+	errorHandler    ErrorHandler
+	validateAnyURIs bool
 }
 
 func NewAbstractTypeDecoder(dtrMapTypes *[]utils.QName,
 	dtrMapRepresentations *[]utils.QName,
 	dtrMapRepresentationDatatype *map[utils.QName]Datatype,
 ) (*AbstractTypeDecoder, error) {
-	super, err := NewAbstractTypeCoder(dtrMapTypes, dtrMapRepresentations, dtrMapRepresentationDatatype)
+	super, err := newAbstractTypeCoder(dtrMapTypes, dtrMapRepresentations, dtrMapRepresentationDatatype, true)
 	if err != nil {
 		return nil, err
 	}
 
 	return &AbstractTypeDecoder{
 		AbstractTypeCoder: super,
+		errorHandler:      NewDefaultErrorHandler(),
 	}, nil
 }
 
+func (d *AbstractTypeDecoder) SetErrorHandler(handler ErrorHandler) {
+	d.errorHandler = handler
+}
+
+// SetAnyURIValidation sets whether xsd:anyURI values that are no URI
+// references according to RFC 3986 are an error, see
+// EXIFactory.SetAnyURIValidation.
+func (d *AbstractTypeDecoder) SetAnyURIValidation(validate bool) {
+	d.validateAnyURIs = validate
+}
+
+// anyURIValue returns value as AnyURIValue if datatype is xsd:anyURI.
+func (d *AbstractTypeDecoder) anyURIValue(datatype Datatype, value *StringValue) (Value, error) {
+	if sDT, ok := datatype.(*StringDatatype); !ok || !sDT.IsAnyURI() {
+		return value, nil
+	}
+	if d.validateAnyURIs {
+		s, err := value.ToString()
+		if err != nil {
+			return nil, err
+		}
+		if !IsValidURIReference(s) {
+			return nil, fmt.Errorf("invalid anyURI value '%s'", s)
+		}
+	}
+	return NewAnyURIValue(value), nil
+}
+
+func (d *AbstractTypeDecoder) getDtrDatatype(datatype Datatype) (Datatype, error) {
+	dtrDatatype, err := d.AbstractTypeCoder.getDtrDatatype(datatype)
+	if err != nil {
+		return nil, err
+	}
+
+	if representation, ok := d.unsupportedRepresentations[dtrDatatype]; ok {
+		// report once
+		delete(d.unsupportedRepresentations, dtrDatatype)
+		d.errorHandler.Warning(fmt.Errorf("unsupported datatype representation {%s}%s, values are decoded as strings",
+			representation.Space, representation.Local))
+	}
+
+	return dtrDatatype, nil
+}
+
 func (d *AbstractTypeDecoder) readRCSValue(rcsDT *RestrictedCharacterSetDatatype, qnc *QNameContext, channel DecoderChannel, decoder StringDecoder) (Value, error) {
 	rcs := rcsDT.GetRestrictedCharacterSet()
 
@@ -523,8 +629,7 @@ func (d *AbstractTypeDecoder) readRCSValue(rcsDT *RestrictedCharacterSetDatatype
 			numberOfBits := rcs.GetCodingLength()
 			size := rcs.GetSize()
 
-			cValue := make([]rune, l)
-			value = NewStringValueFromSlice(cValue)
+			cValue := make([]rune, 0, min(l, maxPreallocatedLength))
 
 			for k := 0; k < l; k++ {
 				code, err := channel.DecodeNBitUnsignedInteger(numberOfBits)
@@ -545,8 +650,9 @@ func (d *AbstractTypeDecoder) readRCSValue(rcsDT *RestrictedCharacterSetDatatype
 					}
 				}
 
-				cValue[k] = rune(codePoint)
+				cValue = append(cValue, rune(codePoint))
 			}
+			value = NewStringValueFromSlice(cValue)
 
 			// After encoding the string value, it is added to both the
 			// associated "local" value string table partition and the
@@ -578,9 +684,11 @@ type TypedTypeEncoder struct {
 	lastUnsignedIntger *IntegerValue
 	lastInteger        *IntegerValue
 	lastDateTime       *DateTimeValue
+	lastDuration       *DurationValue
 	lastString         *string
 	lastEnumIndex      int
 	lastListValues     *ListValue
+	listItemEncoder    *TypedTypeEncoder // validates list items, see isValidString
 }
 
 func NewTypedTypeEncoder(dtrMapTypes *[]utils.QName,
@@ -613,6 +721,7 @@ func NewTypedTypeEncoderWithNormalize(dtrMapTypes *[]utils.QName,
 		lastUnsignedIntger:  nil,
 		lastInteger:         nil,
 		lastDateTime:        nil,
+		lastDuration:        nil,
 		lastString:          nil,
 		lastEnumIndex:       -1,
 		lastListValues:      nil,
@@ -657,13 +766,10 @@ func (e *TypedTypeEncoder) IsValid(datatype Datatype, value Value) (bool, error)
 	case BuiltInTypeBooleanFacet:
 		b, ok := value.(*BooleanValue)
 		if ok {
+			// Note: the lexical form of the boolean value decides about the
+			// boolean ID, e.g., BooleanValue1 ("0") must not become "false"
 			e.lastBool = b
-			e.lastBooleanID = 0
-			// TODO not fully correct
-			if e.lastBoolean {
-				e.lastBooleanID = 2
-			}
-			return true, nil
+			return e.isValidString(b.sValue)
 		} else {
 			s, err := value.ToString()
 			if err != nil {
@@ -744,6 +850,18 @@ func (e *TypedTypeEncoder) IsValid(datatype Datatype, value Value) (bool, error)
 			}
 			return e.isValidString(s)
 		}
+	case BuiltInTypeDuration:
+		d, ok := value.(*DurationValue)
+		if ok {
+			e.lastDuration = d
+			return true, nil
+		} else {
+			s, err := value.ToString()
+			if err != nil {
+				return false, err
+			}
+			return e.isValidString(s)
+		}
 	case BuiltInTypeString, BuiltInTypeRcsString, BuiltInTypeExtendedString:
 		// Note: no validity check needed for RCS strings since any char-sequence
 		// can be encoded due to fallback mechanism.
@@ -765,6 +883,25 @@ func (e *TypedTypeEncoder) IsValid(datatype Datatype, value Value) (bool, error)
 			index++
 		}
 
+		// Note: typed enumeration values do not equal string values, compare
+		// the lexical forms instead
+		if _, ok := value.(*StringValue); ok {
+			s, err := value.ToString()
+			if err != nil {
+				return false, err
+			}
+			for index = 0; index < enumDT.GetEnumerationSize(); index++ {
+				es, err := enumDT.GetEnumValue(index).ToString()
+				if err != nil {
+					return false, err
+				}
+				if es == strings.TrimSpace(s) {
+					e.lastEnumIndex = index
+					return true, nil
+				}
+			}
+		}
+
 		return false, nil
 	case BuiltInTypeList:
 		lv, ok := value.(*ListValue)
@@ -789,6 +926,9 @@ func (e *TypedTypeEncoder) IsValid(datatype Datatype, value Value) (bool, error)
 	return false, nil
 }
 
+// isValidString parses value according to the last datatype. Values that
+// cannot be parsed are not valid, non-strict coders represent them as untyped
+// strings.
 func (e *TypedTypeEncoder) isValidString(value string) (bool, error) {
 	var err error
 
@@ -839,19 +979,19 @@ func (e *TypedTypeEncoder) isValidString(value string) (bool, error) {
 	case BuiltInTypeDecimal:
 		e.lastDecimal, err = DecimalValueParseString(value)
 		if err != nil {
-			return false, err
+			return false, nil
 		}
 		return (e.lastDecimal != nil), nil
 	case BuiltInTypeFloat:
 		e.lastFloat, err = FloatValueParseString(value)
 		if err != nil {
-			return false, err
+			return false, nil
 		}
 		return (e.lastFloat != nil), nil
 	case BuiltInTypeNBitUnsignedInteger:
 		e.lastNBitInteger, err = IntegerValueParse(value)
 		if err != nil {
-			return false, err
+			return false, nil
 		}
 		if e.lastNBitInteger == nil {
 			return false, nil
@@ -862,7 +1002,7 @@ func (e *TypedTypeEncoder) isValidString(value string) (bool, error) {
 	case BuiltInTypeUnsignedInteger:
 		e.lastUnsignedIntger, err = IntegerValueParse(value)
 		if err != nil {
-			return false, err
+			return false, nil
 		}
 		if e.lastUnsignedIntger != nil {
 			return e.lastUnsignedIntger.IsPositive(), nil
@@ -872,19 +1012,30 @@ func (e *TypedTypeEncoder) isValidString(value string) (bool, error) {
 	case BuiltInTypeInteger:
 		e.lastInteger, err = IntegerValueParse(value)
 		if err != nil {
-			return false, err
+			return false, nil
 		}
 		return (e.lastInteger != nil), nil
 	case BuiltInTypeDateTime:
 		datetimeDT := e.lastDataType.(*DatetimeDatatype)
 		e.lastDateTime, err = DateTimeParse(value, datetimeDT.GetDatetimeType())
 		if err != nil {
-			return false, err
+			return false, nil
 		}
 		return (e.lastDateTime != nil), nil
+	case BuiltInTypeDuration:
+		// Note: invalid durations are no error, they are encoded as strings
+		e.lastDuration, err = DurationValueParse(value)
+		return (err == nil), nil
 	case BuiltInTypeList:
 		listDT := e.lastDataType.(*ListDatatype)
-		e.lastListValues, err = ListValueParse(value, listDT.GetListDatatype())
+		if e.listItemEncoder == nil {
+			// Note: items can't be validated by e, it would lose the list state
+			e.listItemEncoder, err = NewTypedTypeEncoder(nil, nil, nil)
+			if err != nil {
+				return false, err
+			}
+		}
+		e.lastListValues, err = listValueParse(value, listDT.GetListDatatype(), e.listItemEncoder)
 		if err != nil {
 			return false, err
 		}
@@ -966,6 +1117,10 @@ func (e *TypedTypeEncoder) WriteValue(qnc *QNameContext, channel EncoderChannel,
 		if err := channel.EncodeDateTime(e.lastDateTime); err != nil {
 			return err
 		}
+	case BuiltInTypeDuration:
+		if err := channel.EncodeDuration(e.lastDuration); err != nil {
+			return err
+		}
 	case BuiltInTypeString:
 		if err := encoder.WriteValue(qnc, channel, *e.lastString); err != nil {
 			return err
@@ -1034,35 +1189,10 @@ func (e *TypedTypeEncoder) writeExtendedValue(esDT *ExtendedStringDatatype, qnc
 
 	vc := encoder.GetValueContainer(value)
 	if vc != nil {
-		// hit
-		if encoder.IsLocalValuePartitions() && qnc.Equals(vc.Context) {
-			/*
-			 * local value hit ==> is represented as zero (0) encoded as an
-			 * Unsigned Integer followed by the compact identifier of the
-			 * string value in the "local" value partition
-			 */
-			if err := channel.EncodeUnsignedInteger(0); err != nil {
-				return err
-			}
-			numberBitsLocal := utils.GetCodingLength(encoder.GetNumberOfStringValues(qnc))
-			if err := channel.EncodeNBitUnsignedInteger(vc.LocalValueID, numberBitsLocal); err != nil {
-				return err
-			}
-		} else {
-			/*
-			 * global value hit ==> value is represented as one (1) encoded
-			 * as an Unsigned Integer followed by the compact identifier of
-			 * the String value in the global value partition.
-			 */
-			if err := channel.EncodeUnsignedInteger(1); err != nil {
-				return err
-			}
-
-			// global value size
-			numberBitsGlobal := utils.GetCodingLength(encoder.GetValueContainerSize())
-			if err := channel.EncodeNBitUnsignedInteger(vc.GlobalValueID, numberBitsGlobal); err != nil {
-				return err
-			}
+		// hit, local or global value hits are represented as for plain
+		// strings
+		if err := encoder.WriteValue(qnc, channel, value); err != nil {
+			return err
 		}
 	} else {
 		/*
@@ -1140,6 +1270,24 @@ func NewTypedTypeDecoder(
 	}, nil
 }
 
+func (d *TypedTypeDecoder) ReadBinaryValueTo(datatype Datatype, channel DecoderChannel, w io.Writer) (bool, error) {
+	var err error
+	if d.dtrMapInUse {
+		datatype, err = d.getDtrDatatype(datatype)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	switch datatype.GetBuiltInType() {
+	case BuiltInTypeBinaryBase64, BuiltInTypeBinaryHex:
+		_, err := channel.DecodeBinaryTo(w)
+		return true, err
+	default:
+		return false, nil
+	}
+}
+
 func (d *TypedTypeDecoder) ReadValue(datatype Datatype, qnc *QNameContext, channel DecoderChannel, decoder StringDecoder) (Value, error) {
 	var err error
 	if d.dtrMapInUse {
@@ -1216,12 +1364,18 @@ func (d *TypedTypeDecoder) ReadValue(datatype Datatype, qnc *QNameContext, chann
 			return nil, err
 		}
 		return value, nil
+	case BuiltInTypeDuration:
+		value, err := channel.DecodeDurationValue()
+		if err != nil {
+			return nil, err
+		}
+		return value, nil
 	case BuiltInTypeString:
 		value, err := decoder.ReadValue(qnc, channel)
 		if err != nil {
 			return nil, err
 		}
-		return value, nil
+		return d.anyURIValue(datatype, value)
 	case BuiltInTypeRcsString:
 		rcsDT := datatype.(*RestrictedCharacterSetDatatype)
 		return d.readRCSValue(rcsDT, qnc, channel, decoder)
@@ -1475,7 +1629,11 @@ func (d *LexicalTypeDecoder) ReadValue(datatype Datatype, qnc *QNameContext, cha
 		return d.readRCSValue(d.rcsInteger, qnc, channel, decoder)
 	case DataTypeID_EXI_String:
 		// exi:string no restricted character set
-		return decoder.ReadValue(qnc, channel)
+		value, err := decoder.ReadValue(qnc, channel)
+		if err != nil {
+			return nil, err
+		}
+		return d.anyURIValue(datatype, value)
 	default:
 		return nil, fmt.Errorf("unsupported datatype ID: %d", datatype.GetDatatypeID())
 	}
@@ -1583,3 +1741,125 @@ func (e *LexicalTypeEncoder) WriteValue(qnc *QNameContext, channel EncoderChanne
 
 	return nil
 }
+
+/*
+	ValueCodec implementation
+*/
+
+// ValueCodec encodes and decodes the characters of a specific element in
+// place of the datatype given by the grammar, e.g. a timestamp element as
+// epoch milliseconds. Codecs are registered per element with
+// EXIFactory.RegisterElementCodec or per schema type with
+// EXIFactory.RegisterTypeCodec, encoder and decoder must agree on them.
+type ValueCodec interface {
+	Encode(channel EncoderChannel, value Value) error
+	Decode(channel DecoderChannel) (Value, error)
+}
+
+// valueCodecDatatype replaces the datatype of characters of elements with a
+// registered ValueCodec. Threading the codec through the datatype keeps
+// (pre-)compression working, which codes values after their structure.
+type valueCodecDatatype struct {
+	*AbstractDatatype
+	codec ValueCodec
+}
+
+func newValueCodecDatatype(codec ValueCodec) *valueCodecDatatype {
+	return &valueCodecDatatype{
+		AbstractDatatype: NewAbstractDatatypeWithWhiteSpace(BuiltInTypeString, nil, WhiteSpacePreserve),
+		codec:            codec,
+	}
+}
+
+func (dt *valueCodecDatatype) GetDatatypeID() DatatypeID {
+	return DataTypeID_EXI_String
+}
+
+// valueCodec returns the codec of datatype, i.e. the codec of a
+// valueCodecDatatype or the codec registered for the schema type of datatype
+// or the closest of its base types, OR nil.
+func valueCodec(datatype Datatype, typeCodecs map[utils.QName]ValueCodec) ValueCodec {
+	if dt, ok := datatype.(*valueCodecDatatype); ok {
+		return dt.codec
+	}
+	if len(typeCodecs) == 0 {
+		return nil
+	}
+	for dt := datatype; dt != nil; dt = dt.GetBaseDatatype() {
+		if schemaType := dt.GetSchemaType(); schemaType != nil {
+			if codec, ok := typeCodecs[schemaType.GetQName()]; ok {
+				return codec
+			}
+		}
+	}
+	return nil
+}
+
+// valueCodecTypeEncoder passes values of valueCodecDatatype and of schema
+// types with a registered codec to their codec and all others to the wrapped
+// TypeEncoder.
+type valueCodecTypeEncoder struct {
+	TypeEncoder
+	typeCodecs map[utils.QName]ValueCodec
+	codec      ValueCodec
+	value      Value
+}
+
+func newValueCodecTypeEncoder(encoder TypeEncoder, typeCodecs map[utils.QName]ValueCodec) *valueCodecTypeEncoder {
+	return &valueCodecTypeEncoder{
+		TypeEncoder: encoder,
+		typeCodecs:  typeCodecs,
+	}
+}
+
+func (e *valueCodecTypeEncoder) IsValid(datatype Datatype, value Value) (bool, error) {
+	if codec := valueCodec(datatype, e.typeCodecs); codec != nil {
+		e.codec = codec
+		e.value = value
+		return true, nil
+	}
+	e.codec = nil
+	e.value = nil
+	return e.TypeEncoder.IsValid(datatype, value)
+}
+
+func (e *valueCodecTypeEncoder) WriteValue(qnc *QNameContext, channel EncoderChannel, encoder StringEncoder) error {
+	if e.codec != nil {
+		return e.codec.Encode(channel, e.value)
+	}
+	return e.TypeEncoder.WriteValue(qnc, channel, encoder)
+}
+
+// valueCodecTypeDecoder is the decoding counterpart of valueCodecTypeEncoder.
+type valueCodecTypeDecoder struct {
+	TypeDecoder
+	typeCodecs map[utils.QName]ValueCodec
+}
+
+func newValueCodecTypeDecoder(decoder TypeDecoder, typeCodecs map[utils.QName]ValueCodec) *valueCodecTypeDecoder {
+	return &valueCodecTypeDecoder{
+		TypeDecoder: decoder,
+		typeCodecs:  typeCodecs,
+	}
+}
+
+func (d *valueCodecTypeDecoder) SetErrorHandler(handler ErrorHandler) {
+	setTypeDecoderErrorHandler(d.TypeDecoder, handler)
+}
+
+func (d *valueCodecTypeDecoder) ReadValue(datatype Datatype, qnc *QNameContext, channel DecoderChannel, decoder StringDecoder) (Value, error) {
+	if codec := valueCodec(datatype, d.typeCodecs); codec != nil {
+		return codec.Decode(channel)
+	}
+	return d.TypeDecoder.ReadValue(datatype, qnc, channel, decoder)
+}
+
+func (d *valueCodecTypeDecoder) ReadBinaryValueTo(datatype Datatype, channel DecoderChannel, w io.Writer) (bool, error) {
+	if valueCodec(datatype, d.typeCodecs) != nil {
+		return false, nil
+	}
+	if bd, ok := d.TypeDecoder.(binaryTypeDecoder); ok {
+		return bd.ReadBinaryValueTo(datatype, channel, w)
+	}
+	return false, nil
+}
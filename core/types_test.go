@@ -0,0 +1,160 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+// codeValues encodes values with datatype and decodes them again, returning
+// the decoded values and the number of bytes used.
+func codeValues(t *testing.T, datatype Datatype, values []Value) ([]Value, int) {
+	t.Helper()
+	encoder, err := NewTypedTypeEncoder(nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	writer := bufio.NewWriter(&buf)
+	channel := NewBitEncoderChannel(writer)
+	for _, value := range values {
+		if ok, err := encoder.IsValid(datatype, value); !ok || err != nil {
+			t.Fatalf("%T %v: IsValid() = %v, %v", datatype, value, ok, err)
+		}
+		if err := encoder.WriteValue(nil, channel, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := channel.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	size := buf.Len()
+
+	decoder, err := NewTypedTypeDecoder(nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := NewBitDecoderChannel(bufio.NewReader(&buf))
+	decoded := make([]Value, len(values))
+	for i := range values {
+		if decoded[i], err = decoder.ReadValue(datatype, nil, input, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return decoded, size
+}
+
+func TestBooleanDatatypes(t *testing.T) {
+	lexical := []string{"false", "0", "true", "1", "false", "0", "true", "1"}
+	var values []Value
+	for _, s := range lexical {
+		values = append(values, NewStringValueFromString(s))
+	}
+
+	tests := []struct {
+		datatype Datatype
+		want     []string
+		size     int // in bytes, for 8 values
+	}{
+		// one bit per value, canonical form
+		{NewBooleanDatatype(nil), []string{"false", "false", "true", "true", "false", "false", "true", "true"}, 1},
+		// two bits per value, lexical form kept
+		{NewBooleanFacetDatatype(nil), lexical, 2},
+	}
+	for _, test := range tests {
+		decoded, size := codeValues(t, test.datatype, values)
+		if size != test.size {
+			t.Errorf("%T: %d bytes, want %d", test.datatype, size, test.size)
+		}
+		// decoded boolean values encode the same again
+		again, _ := codeValues(t, test.datatype, decoded)
+		for i, want := range test.want {
+			if s, _ := decoded[i].ToString(); s != want {
+				t.Errorf("%T %s: got %s, want %s", test.datatype, lexical[i], s, want)
+			}
+			if s, _ := again[i].ToString(); s != want {
+				t.Errorf("%T %s: re-encoded: got %s, want %s", test.datatype, lexical[i], s, want)
+			}
+		}
+	}
+}
+
+func TestEnumerationDatatype(t *testing.T) {
+	var enumValues, values []Value
+	for _, s := range []string{"a", "b", "c"} {
+		enumValues = append(enumValues, NewStringValueFromString(s))
+		values = append(values, NewStringValueFromString(s))
+	}
+	datatype := NewEnumerationDatatype(enumValues, NewStringDatatype(nil), nil)
+
+	// the last value is as reachable as the others
+	decoded, _ := codeValues(t, datatype, values)
+	for i, want := range []string{"a", "b", "c"} {
+		if decoded[i] == nil {
+			t.Errorf("%s: decoded nil", want)
+		} else if s, _ := decoded[i].ToString(); s != want {
+			t.Errorf("got %s, want %s", s, want)
+		}
+	}
+
+	// typed enumeration values match the lexical form of string values
+	intEnum := NewEnumerationDatatype([]Value{NewIntegerValue32(1), NewIntegerValue32(20)}, NewIntegerDatatype(nil), nil)
+	decoded, _ = codeValues(t, intEnum, []Value{NewStringValueFromString("20"), NewStringValueFromString(" 1 ")})
+	for i, want := range []string{"20", "1"} {
+		if s, _ := decoded[i].ToString(); s != want {
+			t.Errorf("integer enumeration: got %s, want %s", s, want)
+		}
+	}
+}
+
+func TestNBitUnsignedIntegerOffset(t *testing.T) {
+	datatype := NewNBitUnsignedIntegerDatatype(NewIntegerValue32(1000), NewIntegerValue32(1010), nil)
+	if datatype.GetNumberOfBits() != 4 {
+		t.Fatalf("%d bits for [1000, 1010], want 4", datatype.GetNumberOfBits())
+	}
+
+	// 1005 is written as offset 5 in 4 bits, padded to 0101 0000
+	encoder, err := NewTypedTypeEncoder(nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	writer := bufio.NewWriter(&buf)
+	channel := NewBitEncoderChannel(writer)
+	if ok, err := encoder.IsValid(datatype, NewStringValueFromString("1005")); !ok || err != nil {
+		t.Fatalf("IsValid() = %v, %v", ok, err)
+	}
+	if err := encoder.WriteValue(nil, channel, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := channel.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), []byte{0x50}) {
+		t.Errorf("1005: encoded % x, want 50", buf.Bytes())
+	}
+
+	lexical := []string{"1000", "1005", "1010", "1007"}
+	var values []Value
+	for _, s := range lexical {
+		values = append(values, NewStringValueFromString(s))
+	}
+	decoded, size := codeValues(t, datatype, values)
+	if size != 2 {
+		t.Errorf("%d bytes, want 2", size)
+	}
+	for i, want := range lexical {
+		if s, _ := decoded[i].ToString(); s != want {
+			t.Errorf("got %s, want %s", s, want)
+		}
+	}
+	if ok, _ := encoder.IsValid(datatype, NewStringValueFromString("1011")); ok {
+		t.Error("1011 is valid, want out of range")
+	}
+}
@@ -0,0 +1,100 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/sderkacs/go-exi/utils"
+)
+
+/*
+	ValidateStream implementation
+*/
+
+// ValidateStream decodes the EXI stream read from r according to factory and
+// reports every grammar or type validity issue recorded in the stream, i.e.
+// the undeclared productions non-strict encoders use for content deviating
+// from the schema. path holds the open elements with the element of the
+// issue last.
+//
+// Content of elements that are not described by schema-informed grammars,
+// i.e. of wildcard or undeclared elements without global declaration, is not
+// validated. The returned error tells that the stream could not be decoded,
+// validity issues are not errors.
+func ValidateStream(r io.Reader, factory EXIFactory, report func(path []utils.QName, issue string)) error {
+	exiStream, err := factory.CreateEXIStreamDecoder()
+	if err != nil {
+		return err
+	}
+	decoder, err := exiStream.DecodeHeader(bufio.NewReader(r))
+	if err != nil {
+		return err
+	}
+
+	path := []utils.QName{}
+	// per open element whether its content is validated
+	validated := []bool{true}
+	// EE follows CH [untyped value] as the grammar did not advance
+	lastCharactersInvalid := false
+
+	issue := func(format string, args ...any) {
+		if validated[len(validated)-1] {
+			report(slices.Clone(path), fmt.Sprintf(format, args...))
+		}
+	}
+
+	for {
+		ev, exists, err := decoder.DecodeEvent()
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return nil
+		}
+
+		charactersInvalid := false
+		switch ev.EventType {
+		case EventTypeStartElement, EventTypeStartElementNS, EventTypeStartElementGeneric, EventTypeStartElementGenericUndeclared:
+			path = append(path, ev.QNameContext.GetQName())
+			if ev.EventType == EventTypeStartElementGenericUndeclared {
+				issue("undeclared element")
+			}
+			// Note: wildcards without global declaration use built-in grammars
+			schemaInformed := ev.EventType == EventTypeStartElement || ev.QNameContext.GetGlobalStartElement() != nil
+			validated = append(validated, validated[len(validated)-1] && schemaInformed)
+		case EventTypeEndElement, EventTypeEndElementUndeclared:
+			if ev.EventType == EventTypeEndElementUndeclared && !lastCharactersInvalid {
+				issue("missing content")
+			}
+			if len(path) > 0 {
+				path = path[:len(path)-1]
+				validated = validated[:len(validated)-1]
+			}
+		case EventTypeAttributeGenericUndeclared:
+			issue("undeclared attribute %s", validationQNameString(ev.QNameContext.GetQName()))
+		case EventTypeAttributeInvalidValue, EventTypeAttributeAnyInvalidValue:
+			s, err := ev.Value.ToString()
+			if err != nil {
+				return err
+			}
+			issue("invalid value '%s' of attribute %s", s, validationQNameString(ev.QNameContext.GetQName()))
+		case EventTypeCharactersGenericUndeclared:
+			s, err := ev.Value.ToString()
+			if err != nil {
+				return err
+			}
+			issue("invalid or unexpected characters '%s'", s)
+			charactersInvalid = true
+		}
+		lastCharactersInvalid = charactersInvalid
+	}
+}
+
+func validationQNameString(qname utils.QName) string {
+	if qname.Space == "" {
+		return qname.Local
+	}
+	return "{" + qname.Space + "}" + qname.Local
+}
@@ -5,11 +5,15 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"math"
 	"math/big"
+	"net/url"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/cockroachdb/apd/v3"
 	Text "github.com/linkdotnet/golang-stringbuilder"
@@ -29,6 +33,7 @@ const (
 	ValueTypeString
 	ValueTypeList
 	ValueTypeQName
+	ValueTypeDuration
 )
 
 type Value interface {
@@ -145,9 +150,11 @@ type BinaryBase64Value struct {
 }
 
 func NewBinaryBase64Value(bytes []byte) *BinaryBase64Value {
-	return &BinaryBase64Value{
+	v := &BinaryBase64Value{
 		AbstractBinaryValue: NewAbstractBinaryValue(ValueTypeBinaryBase64, bytes),
 	}
+	v.Value = v
+	return v
 }
 
 func BinaryBase64ValueParse(val string) *BinaryBase64Value {
@@ -180,10 +187,31 @@ func (v *BinaryBase64Value) GetCharactersLength() (int, error) {
 }
 
 func (v *BinaryBase64Value) FillCharactersBuffer(buffer []rune, offset int) error {
-	v.GetCharactersLength()
-	b := base64.StdEncoding.EncodeToString(v.bytes)
-	copy(buffer[offset:], []rune(b))
-	return nil
+	return v.WriteBase64(&runeBufferWriter{buffer: buffer, offset: offset})
+}
+
+// WriteBase64 writes the base64 characters of the value to w in chunks, i.e.
+// without creating the whole string at once as ToString does.
+func (v *BinaryBase64Value) WriteBase64(w io.Writer) error {
+	encoder := base64.NewEncoder(base64.StdEncoding, w)
+	if _, err := encoder.Write(v.bytes); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// runeBufferWriter writes ASCII characters to a rune buffer.
+type runeBufferWriter struct {
+	buffer []rune
+	offset int
+}
+
+func (w *runeBufferWriter) Write(p []byte) (int, error) {
+	for i, b := range p {
+		w.buffer[w.offset+i] = rune(b)
+	}
+	w.offset += len(p)
+	return len(p), nil
 }
 
 func (v *BinaryBase64Value) Equals(o Value) bool {
@@ -217,10 +245,12 @@ type BinaryHexValue struct {
 }
 
 func NewBinaryHexValue(bytes []byte) *BinaryHexValue {
-	return &BinaryHexValue{
+	v := &BinaryHexValue{
 		AbstractBinaryValue: NewAbstractBinaryValue(ValueTypeBinaryHex, bytes),
 		lengthData:          -1,
 	}
+	v.Value = v
+	return v
 }
 
 func BinaryHexValueParse(val string) *BinaryHexValue {
@@ -489,7 +519,7 @@ func NewDateTimeValueWithNormalized(kind DateTimeType, year, monthDay, time, fra
 		presence = true
 	}
 
-	return &DateTimeValue{
+	v := &DateTimeValue{
 		AbstractValue:           NewAbstractValue(ValueTypeDateTime),
 		kind:                    kind,
 		time:                    time,
@@ -503,6 +533,8 @@ func NewDateTimeValueWithNormalized(kind DateTimeType, year, monthDay, time, fra
 		normalizedDateTimeValue: nil,
 		sizeFractionalSecs:      -1,
 	}
+	v.Value = v
+	return v
 }
 
 func (v *DateTimeValue) ToTime() (*time.Time, error) {
@@ -593,7 +625,7 @@ func (v *DateTimeValue) GetCharactersLength() (int, error) {
 			if v.timezone == 0 {
 				v.sLen += 1
 			} else {
-				v.timezone += 6
+				v.sLen += 6
 			}
 		}
 	}
@@ -610,11 +642,11 @@ func (v *DateTimeValue) FillCharactersBuffer(buffer []rune, offset int) error {
 		dateTimeAppendMonth(buffer, &offset, v.monthDay)
 	case DateTimeDate: // Year, MonthDay, [TimeZone]
 		dateTimeAppendYear(buffer, &offset, v.year)
-		dateTimeAppendMonth(buffer, &offset, v.monthDay)
+		dateTimeAppendMonthDay(buffer, &offset, v.monthDay)
 	case DateTimeDateTime: // Year, MonthDay, Time, [FractionalSecs], [TimeZone]
 		// e.g. "0001-01-01T00:00:00.111+00:33";
 		dateTimeAppendYear(buffer, &offset, v.year)
-		dateTimeAppendMonth(buffer, &offset, v.monthDay)
+		dateTimeAppendMonthDay(buffer, &offset, v.monthDay)
 		buffer[offset] = 'T'
 		offset++
 		dateTimeAppendTime(buffer, &offset, v.time)
@@ -832,16 +864,18 @@ type DecimalValue struct {
 }
 
 func NewDecimalValue(negative bool, integral, revFractional *IntegerValue) *DecimalValue {
-	if negative && ZeroIntegerValue.Equals(integral) && ZeroIntegerValue.Equals(revFractional) {
+	if negative && integral.IsZero() && revFractional.IsZero() {
 		negative = false
 	}
 	// normalize "-0.0" to "0.0"
-	return &DecimalValue{
+	v := &DecimalValue{
 		AbstractValue: NewAbstractValue(ValueTypeDecimal),
 		negative:      negative,
 		integral:      integral,
 		revFractional: revFractional,
 	}
+	v.Value = v
+	return v
 }
 
 func DecimalValueParseBig(decimal *apd.Decimal) (*DecimalValue, error) {
@@ -982,10 +1016,10 @@ func (v *DecimalValue) GetCharactersLength() (int, error) {
 			return -1, err
 		}
 
+		v.sLen = iLen + 1 + revLen
 		if v.negative {
-			v.sLen = 1
+			v.sLen++
 		}
-		v.sLen = iLen + 1 + revLen
 	}
 
 	return v.sLen, nil
@@ -1051,6 +1085,305 @@ func (v *DecimalValue) Equals(o Value) bool {
 	return v.equals(dv)
 }
 
+// Cmp returns -1, 0 or +1 as v is less than, equal to, or greater than o.
+func (v *DecimalValue) Cmp(o *DecimalValue) int {
+	if v.negative != o.negative {
+		// Note: "-0.0" is normalized to "0.0"
+		if v.negative {
+			return -1
+		}
+		return 1
+	}
+
+	c := v.integral.ValueBig().Cmp(o.integral.ValueBig())
+	if c == 0 {
+		c = decimalCmpRevFractional(v.revFractional, o.revFractional)
+	}
+	if v.negative {
+		return -c
+	}
+	return c
+}
+
+// decimalCmpRevFractional compares the fractional digits stored reversed in
+// r1 and r2, e.g. 0.05 is stored as 50 and 0.5 as 5.
+func decimalCmpRevFractional(r1, r2 *IntegerValue) int {
+	f1 := utils.ReverseString(r1.String())
+	f2 := utils.ReverseString(r2.String())
+	if len(f1) < len(f2) {
+		f1 += strings.Repeat("0", len(f2)-len(f1))
+	} else {
+		f2 += strings.Repeat("0", len(f1)-len(f2))
+	}
+	return strings.Compare(f1, f2)
+}
+
+// Add returns v+o, computed with arbitrary precision.
+func (v *DecimalValue) Add(o *DecimalValue) (*DecimalValue, error) {
+	return v.apply(o, apd.BaseContext.Add)
+}
+
+// Sub returns v-o, computed with arbitrary precision.
+func (v *DecimalValue) Sub(o *DecimalValue) (*DecimalValue, error) {
+	return v.apply(o, apd.BaseContext.Sub)
+}
+
+func (v *DecimalValue) apply(o *DecimalValue, op func(d, x, y *apd.Decimal) (apd.Condition, error)) (*DecimalValue, error) {
+	x, err := v.ToBigDecimal()
+	if err != nil {
+		return nil, err
+	}
+	y, err := o.ToBigDecimal()
+	if err != nil {
+		return nil, err
+	}
+	result := &apd.Decimal{}
+	if _, err := op(result, x, y); err != nil {
+		return nil, err
+	}
+	return DecimalValueParseString(result.Text('f'))
+}
+
+/*
+	DurationValue implementation
+*/
+
+// DurationValue is an xsd:duration, kept as the components of its lexical
+// form, e.g. "-P1Y2M3DT4H5M6.7S". Components are not limited in size.
+type DurationValue struct {
+	*AbstractValue
+	negative bool
+	years    *IntegerValue
+	months   *IntegerValue
+	days     *IntegerValue
+	hours    *IntegerValue
+	minutes  *IntegerValue
+	seconds  *DecimalValue
+	sValue   string
+}
+
+// NewDurationValue returns the duration of the given (non-negative)
+// components. seconds must not be negative either, nil stands for zero.
+func NewDurationValue(negative bool, years, months, days, hours, minutes *IntegerValue, seconds *DecimalValue) *DurationValue {
+	if seconds == nil {
+		seconds = NewDecimalValue(false, ZeroIntegerValue, ZeroIntegerValue)
+	}
+	v := &DurationValue{
+		AbstractValue: NewAbstractValue(ValueTypeDuration),
+		years:         durationComponent(years),
+		months:        durationComponent(months),
+		days:          durationComponent(days),
+		hours:         durationComponent(hours),
+		minutes:       durationComponent(minutes),
+		seconds:       seconds,
+	}
+	// normalize "-PT0S" to "PT0S"
+	v.negative = negative && !v.isZero()
+	v.sValue = v.format()
+	v.Value = v
+	return v
+}
+
+func durationComponent(n *IntegerValue) *IntegerValue {
+	if n == nil {
+		return ZeroIntegerValue
+	}
+	return n
+}
+
+// DurationValueParse parses the lexical form of xsd:duration, i.e.
+// "-?PnYnMnDTnHnMnS" with optional components.
+func DurationValueParse(value string) (*DurationValue, error) {
+	s := strings.TrimSpace(value)
+	negative := strings.HasPrefix(s, "-")
+	if negative {
+		s = s[1:]
+	}
+	if !strings.HasPrefix(s, "P") {
+		return nil, fmt.Errorf("invalid duration: %q", value)
+	}
+	datePart, timePart, hasTime := strings.Cut(s[1:], "T")
+	if (datePart == "" && !hasTime) || (hasTime && timePart == "") {
+		return nil, fmt.Errorf("invalid duration: %q", value)
+	}
+
+	// years, months, days
+	dateComponents, _, err := parseDurationComponents(datePart, "YMD")
+	if err != nil {
+		return nil, fmt.Errorf("invalid duration: %q", value)
+	}
+	// hours, minutes, seconds
+	timeComponents, seconds, err := parseDurationComponents(timePart, "HMS")
+	if err != nil {
+		return nil, fmt.Errorf("invalid duration: %q", value)
+	}
+
+	return NewDurationValue(negative, dateComponents[0], dateComponents[1], dateComponents[2],
+		timeComponents[0], timeComponents[1], seconds), nil
+}
+
+// parseDurationComponents parses numbers followed by one of the designators
+// each, in the order of designators. Only an "S" component may be decimal.
+func parseDurationComponents(s string, designators string) ([3]*IntegerValue, *DecimalValue, error) {
+	var components [3]*IntegerValue
+	var seconds *DecimalValue
+	next := 0
+
+	for len(s) > 0 {
+		end := strings.IndexAny(s, designators)
+		if end < 1 {
+			return components, nil, errors.New("number and designator expected")
+		}
+		index := strings.IndexByte(designators, s[end])
+		if index < next {
+			return components, nil, errors.New("designators out of order")
+		}
+		number := s[:end]
+
+		if designators[index] == 'S' {
+			if strings.Trim(number, "0123456789.") != "" {
+				return components, nil, errors.New("invalid seconds")
+			}
+			d, err := DecimalValueParseString(number)
+			if err != nil || d == nil {
+				return components, nil, errors.New("invalid seconds")
+			}
+			seconds = d
+		} else {
+			if strings.Trim(number, "0123456789") != "" {
+				return components, nil, errors.New("invalid number")
+			}
+			n, err := IntegerValueParse(number)
+			if err != nil {
+				return components, nil, err
+			}
+			components[index] = n
+		}
+		next = index + 1
+		s = s[end+1:]
+	}
+
+	return components, seconds, nil
+}
+
+func (v *DurationValue) IsNegative() bool {
+	return v.negative
+}
+
+func (v *DurationValue) GetYears() *IntegerValue {
+	return v.years
+}
+
+func (v *DurationValue) GetMonths() *IntegerValue {
+	return v.months
+}
+
+func (v *DurationValue) GetDays() *IntegerValue {
+	return v.days
+}
+
+func (v *DurationValue) GetHours() *IntegerValue {
+	return v.hours
+}
+
+func (v *DurationValue) GetMinutes() *IntegerValue {
+	return v.minutes
+}
+
+func (v *DurationValue) GetSeconds() *DecimalValue {
+	return v.seconds
+}
+
+func (v *DurationValue) isZero() bool {
+	return v.years.IsZero() && v.months.IsZero() && v.days.IsZero() && v.hours.IsZero() && v.minutes.IsZero() &&
+		v.seconds.integral.IsZero() && v.seconds.revFractional.IsZero()
+}
+
+// format returns the lexical form, omitting zero components.
+func (v *DurationValue) format() string {
+	var sb strings.Builder
+	if v.negative {
+		sb.WriteByte('-')
+	}
+	sb.WriteByte('P')
+	for _, c := range []struct {
+		n          *IntegerValue
+		designator byte
+	}{{v.years, 'Y'}, {v.months, 'M'}, {v.days, 'D'}} {
+		if !c.n.IsZero() {
+			sb.WriteString(c.n.String())
+			sb.WriteByte(c.designator)
+		}
+	}
+
+	secondsZero := v.seconds.integral.IsZero() && v.seconds.revFractional.IsZero()
+	if !v.hours.IsZero() || !v.minutes.IsZero() || !secondsZero || v.isZero() {
+		sb.WriteByte('T')
+		if !v.hours.IsZero() {
+			sb.WriteString(v.hours.String())
+			sb.WriteByte('H')
+		}
+		if !v.minutes.IsZero() {
+			sb.WriteString(v.minutes.String())
+			sb.WriteByte('M')
+		}
+		if !secondsZero || v.isZero() {
+			integral, _ := v.seconds.integral.ToString()
+			sb.WriteString(integral)
+			if !v.seconds.revFractional.IsZero() {
+				revFractional, _ := v.seconds.revFractional.ToString()
+				sb.WriteByte('.')
+				sb.WriteString(utils.ReverseString(revFractional))
+			}
+			sb.WriteByte('S')
+		}
+	}
+
+	return sb.String()
+}
+
+func (v *DurationValue) GetCharactersLength() (int, error) {
+	return len(v.sValue), nil
+}
+
+func (v *DurationValue) FillCharactersBuffer(buffer []rune, offset int) error {
+	// Note: the lexical form is ASCII only
+	for i := 0; i < len(v.sValue); i++ {
+		buffer[offset+i] = rune(v.sValue[i])
+	}
+	return nil
+}
+
+func (v *DurationValue) ToString() (string, error) {
+	return v.sValue, nil
+}
+
+// totals returns the duration in months and seconds, the two components of
+// the xsd:duration value space.
+func (v *DurationValue) totals() (*IntegerValue, *DecimalValue) {
+	months := v.years.Mul(IntegerValueOf32(12)).Add(v.months)
+	seconds := v.days.Mul(IntegerValueOf32(24)).Add(v.hours).Mul(IntegerValueOf32(60)).Add(v.minutes).Mul(IntegerValueOf32(60))
+	return months, NewDecimalValue(false, seconds.Add(v.seconds.integral), v.seconds.revFractional)
+}
+
+// Equals compares durations by value, e.g. "P1Y" equals "P12M" and "PT1H"
+// equals "PT60M". Note that "P1M" and "P30D" are not equal.
+func (v *DurationValue) Equals(o Value) bool {
+	if o == nil {
+		return false
+	}
+	dv, ok := o.(*DurationValue)
+	if !ok {
+		return false
+	}
+	if v.negative != dv.negative {
+		return false
+	}
+	vMonths, vSeconds := v.totals()
+	oMonths, oSeconds := dv.totals()
+	return vMonths.ValueBig().Cmp(oMonths.ValueBig()) == 0 && vSeconds.Cmp(oSeconds) == 0
+}
+
 /*
 	FloatValue implementation
 */
@@ -1072,12 +1405,18 @@ type FloatValue struct {
 
 func NewFloatValue(mantissa, exponent *IntegerValue) *FloatValue {
 	// http://www.w3.org/TR/exi-c14n/#dt-float
-	if ZeroIntegerValue.Equals(mantissa) {
+	if FloatValueSpecialValues.Equals(exponent) {
+		// If the exponent value is -(2^14) and the mantissa value is neither 1
+		// nor -1, to indicate the special value not-a-number (NaN), the
+		// mantissa MUST be 0.
+		// Note: before removing trailing zeros, e.g. 10E-16384 is NaN
+		if !FloatNegativeInfinity.Equals(mantissa) && !FloatPositiveInfinity.Equals(mantissa) {
+			mantissa = FloatNaN // 0
+		}
+	} else if mantissa.IsZero() {
 		// If the mantissa is 0 and the exponent value is not -(2^14)
 		// to indicate one of the special values then the exponent MUST be 0.
-		if !FloatValueSpecialValues.Equals(exponent) {
-			exponent = ZeroIntegerValue
-		}
+		exponent = ZeroIntegerValue
 	} else {
 		// If the mantissa is not 0, mantissas MUST have no trailing zeros
 		// e.g., 12300E0 --> 123E2
@@ -1099,22 +1438,14 @@ func NewFloatValue(mantissa, exponent *IntegerValue) *FloatValue {
 		}
 	}
 
-	// If the exponent value is -(2^14) and the mantissa value is neither 1
-	// nor -1, to indicate the special value not-a-number (NaN), the
-	// mantissa MUST be 0.
-	if FloatValueSpecialValues.Equals(exponent) &&
-		!FloatNegativeInfinity.Equals(mantissa) &&
-		!FloatPositiveInfinity.Equals(mantissa) {
-		mantissa = FloatNaN // 0
-	}
-
-	return &FloatValue{
+	v := &FloatValue{
 		AbstractValue: NewAbstractValue(ValueTypeFloat),
 		mantissa:      mantissa,
 		exponent:      exponent,
 		slenMantissa:  -1,
 	}
-
+	v.Value = v
+	return v
 }
 
 func NewFloatValueFrom64(mantissa, exponent int64) *FloatValue {
@@ -1160,6 +1491,7 @@ func FloatValueParseString(value string) (*FloatValue, error) {
 
 		decPoint := false
 		decimalDigits := 0
+		mantissaDigits := 0
 		sMantissa = 0
 		sExponent = 0
 
@@ -1167,9 +1499,6 @@ func FloatValueParseString(value string) (*FloatValue, error) {
 		if lenMantissa == 0 {
 			return nil, fmt.Errorf("mantissa length is zero")
 		}
-		if lenMantissa >= len(chars) {
-			return nil, fmt.Errorf("out of bounds")
-		}
 
 		// parsing mantissa
 		for i := startMantissa; i < lenMantissa; i++ {
@@ -1178,6 +1507,7 @@ func FloatValueParseString(value string) (*FloatValue, error) {
 			switch c {
 			case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
 				sMantissa = 10*sMantissa + int64(c-'0')
+				mantissaDigits++
 				if decPoint {
 					decimalDigits++
 				}
@@ -1191,6 +1521,10 @@ func FloatValueParseString(value string) (*FloatValue, error) {
 				return nil, fmt.Errorf("unexpected character in mantissa: %c", c)
 			}
 		}
+		// "-", "+", "." etc.
+		if mantissaDigits == 0 {
+			return nil, fmt.Errorf("mantissa has no digits")
+		}
 
 		// check for mantissa overflow
 		if sMantissa < 0 {
@@ -1210,14 +1544,14 @@ func FloatValueParseString(value string) (*FloatValue, error) {
 		// parsing exponent
 		negativeExp := false
 		if indexE != -1 {
+			exponentDigits := 0
 			for i := indexE + 1; i < len(chars); i++ {
 				c = chars[i]
 
 				switch c {
-				case '0':
-					sExponent = 10 * sExponent
-				case '1', '2', '3', '4', '5', '6', '7', '8', '9':
+				case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
 					sExponent = 10*sExponent + int64(c-'0')
+					exponentDigits++
 				case '-':
 					if negativeExp {
 						return nil, fmt.Errorf("multiple exponent sign")
@@ -1229,6 +1563,10 @@ func FloatValueParseString(value string) (*FloatValue, error) {
 					return nil, fmt.Errorf("unexpected character in exponent: %c", c)
 				}
 			}
+			// "1E", "1E-" etc.
+			if exponentDigits == 0 {
+				return nil, fmt.Errorf("exponent has no digits")
+			}
 		}
 
 		if negativeExp {
@@ -1247,38 +1585,14 @@ func FloatValueParseString(value string) (*FloatValue, error) {
 }
 
 func FloatValueParseFloat32(value float32) *FloatValue {
-	var sMantissa, sExponent int
-
-	if math.IsInf(float64(value), 0) || math.IsNaN(float64(value)) {
-		// exponent value is -(2^14),
-		// . the mantissa value 1 represents INF,
-		// . the mantissa value -1 represents -INF
-		// . any other mantissa value represents NaN
-		if math.IsNaN(float64(value)) {
-			sMantissa = FloatMantissaNotANumber
-		} else if value < 0 {
-			sMantissa = FloatMantissaMinusInfinity
-		} else {
-			sMantissa = FloatMantissaInfinity
-		}
-		// exponent (special value)
-		sExponent = FloatSpecialValues // e == -(2^14)
-	} else {
-		// floating-point according to the IEEE 754 floating-point
-		// "single format" bit layout.
-		sExponent = 0
-
-		for value-float32(math.Trunc(float64(value))) != 0.0 {
-			value *= 10
-			sExponent--
-		}
-		sMantissa = int(math.Trunc(float64(value)))
-	}
-
-	return NewFloatValueFrom64(int64(sMantissa), int64(sExponent))
+	return floatValueParseFloat(float64(value), 32)
 }
 
 func FloatValueParseFloat64(value float64) *FloatValue {
+	return floatValueParseFloat(value, 64)
+}
+
+func floatValueParseFloat(value float64, bitSize int) *FloatValue {
 	var sMantissa, sExponent int64
 
 	if math.IsInf(value, 0) || math.IsNaN(value) {
@@ -1296,15 +1610,19 @@ func FloatValueParseFloat64(value float64) *FloatValue {
 		// exponent (special value)
 		sExponent = int64(FloatSpecialValues) // e == -(2^14)
 	} else {
-		// floating-point according to the IEEE 754 floating-point
-		// "single format" bit layout.
-		sExponent = 0
+		// Use the shortest decimal representation that uniquely identifies
+		// the value in the given precision, e.g., float32(0.1) --> 1E-1
+		// instead of the exact binary expansion 100000001490116119384765625E-27.
+		s := strconv.FormatFloat(value, 'E', -1, bitSize)
+		indexE := strings.IndexByte(s, 'E')
+		digits := strings.Replace(s[:indexE], ".", "", 1)
 
-		for value-math.Trunc(value) != 0.0 {
-			value *= 10
-			sExponent--
+		// at most 17 significant digits, fits into int64
+		sMantissa, _ = strconv.ParseInt(digits, 10, 64)
+		sExponent, _ = strconv.ParseInt(s[indexE+1:], 10, 64)
+		if dot := strings.IndexByte(s[:indexE], '.'); dot != -1 {
+			sExponent -= int64(indexE - dot - 1)
 		}
-		sMantissa = int64(math.Trunc(value))
 	}
 
 	return NewFloatValueFrom64(sMantissa, sExponent)
@@ -1319,33 +1637,34 @@ func (v *FloatValue) GetExponent() *IntegerValue {
 }
 
 func (v *FloatValue) ToFloat32() float32 {
+	// Note: parse directly in single precision, narrowing ToFloat64 may
+	// round twice and end up one ULP off
+	return float32(v.toFloat(32))
+}
+
+func (v *FloatValue) ToFloat64() float64 {
 	if v.f == nil {
-		v.ToFloat64()
+		v.f = utils.AsPtr(v.toFloat(64))
 	}
 
-	return float32(*v.f)
+	return *v.f
 }
 
-func (v *FloatValue) ToFloat64() float64 {
-	if v.f == nil {
-		if v.exponent.Equals(FloatValueSpecialValues) {
-			if v.mantissa.Equals(FloatNegativeInfinity) {
-				v.f = utils.AsPtr(math.Inf(-1))
-			} else if v.mantissa.Equals(FloatPositiveInfinity) {
-				v.f = utils.AsPtr(math.Inf(+1))
-			} else {
-				v.f = utils.AsPtr(math.NaN())
-			}
+func (v *FloatValue) toFloat(bitSize int) float64 {
+	if v.exponent.Equals(FloatValueSpecialValues) {
+		if v.mantissa.Equals(FloatNegativeInfinity) {
+			return math.Inf(-1)
+		} else if v.mantissa.Equals(FloatPositiveInfinity) {
+			return math.Inf(+1)
 		} else {
-			// f = mantissa * (double) (Math.pow(10, exponent));
-			lMantissa := v.mantissa.Value64()
-			lExponent := v.exponent.Value64()
-
-			v.f = utils.AsPtr(float64(lMantissa) * math.Pow(10, float64(lExponent)))
+			return math.NaN()
 		}
 	}
 
-	return *v.f
+	// f = mantissa * 10^exponent, correctly rounded
+	// Note: out of range values yield +-Inf or 0 which is the expected result
+	f, _ := strconv.ParseFloat(fmt.Sprintf("%dE%d", v.mantissa.Value64(), v.exponent.Value64()), bitSize)
+	return f
 }
 
 func (v *FloatValue) GetCharactersLength() (int, error) {
@@ -1356,9 +1675,7 @@ func (v *FloatValue) GetCharactersLength() (int, error) {
 			} else if v.mantissa.Equals(FloatPositiveInfinity) {
 				v.sLen = len(FloatInfinityCharArray)
 			} else {
-				if v.mantissa.Equals(FloatNaN) {
-					return -1, fmt.Errorf("NaN")
-				}
+				// any other mantissa represents NaN
 				v.sLen = len(FloatNotANumberCharArray)
 			}
 		} else {
@@ -1392,9 +1709,7 @@ func (v *FloatValue) FillCharactersBuffer(buffer []rune, offset int) error {
 		} else if v.mantissa.Equals(FloatPositiveInfinity) {
 			a2copy = FloatInfinityCharArray
 		} else {
-			if v.mantissa.Equals(FloatNaN) {
-				return fmt.Errorf("NaN")
-			}
+			// any other mantissa represents NaN
 			a2copy = FloatNotANumberCharArray
 		}
 		copy(buffer[offset:], a2copy)
@@ -1420,9 +1735,7 @@ func (v *FloatValue) ToString() (string, error) {
 		} else if v.mantissa.Equals(FloatPositiveInfinity) {
 			return FloatInfinity, nil
 		} else {
-			if v.mantissa.Equals(FloatNaN) {
-				return "", fmt.Errorf("NaN")
-			}
+			// any other mantissa represents NaN
 			return FloatNotANumber, nil
 		}
 	} else {
@@ -1446,9 +1759,7 @@ func (v *FloatValue) BufferToString(buffer []rune, offset int) (string, error) {
 		} else if v.mantissa.Equals(FloatPositiveInfinity) {
 			return FloatInfinity, nil
 		} else {
-			if v.mantissa.Equals(FloatNaN) {
-				return "", fmt.Errorf("NaN")
-			}
+			// any other mantissa represents NaN
 			return FloatNotANumber, nil
 		}
 	} else {
@@ -1475,7 +1786,7 @@ func (v *FloatValue) equals(o *FloatValue) bool {
 			tExponent := v.exponent.Value64()
 			oExponent := o.exponent.Value64()
 			tMantissa := v.mantissa.Value64()
-			oMantissa := o.exponent.Value64()
+			oMantissa := o.mantissa.Value64()
 
 			if tExponent > oExponent {
 				// e.g. 234E2 vs. 2340E1
@@ -1567,17 +1878,21 @@ func NewIntegerValue64(lval int64) *IntegerValue {
 		lval:          lval,
 		bval:          nil,
 	}
+	av.Value = iv
 	return iv
 }
 
 func NewIntegerValueBig(bval big.Int) *IntegerValue {
-	return &IntegerValue{
-		AbstractValue: NewAbstractValue(ValueTypeInteger),
+	av := NewAbstractValue(ValueTypeInteger)
+	iv := &IntegerValue{
+		AbstractValue: av,
 		ival:          0,
 		iValType:      IntegerValueBig,
 		lval:          0,
 		bval:          &bval,
 	}
+	av.Value = iv
+	return iv
 }
 
 func integerValueGetAdjustedValue(value string) string {
@@ -1675,7 +1990,7 @@ func (v *IntegerValue) GetCharactersLength() (int, error) {
 	if v.sLen == -1 {
 		switch v.iValType {
 		case IntegerValue32:
-			if v.ival == math.MinInt {
+			if v.ival == math.MinInt32 {
 				v.sLen = len(utils.IntegerMinValueCharArray)
 			} else {
 				v.sLen = utils.GetStringSize32(v.ival)
@@ -1699,7 +2014,7 @@ func (v *IntegerValue) GetCharactersLength() (int, error) {
 func (v *IntegerValue) FillCharactersBuffer(buffer []rune, offset int) error {
 	switch v.iValType {
 	case IntegerValue32:
-		if v.ival == math.MinInt {
+		if v.ival == math.MinInt32 {
 			copy(buffer[offset:], utils.IntegerMinValueCharArray)
 		} else {
 			length, err := v.GetCharactersLength()
@@ -1728,7 +2043,7 @@ func (v *IntegerValue) FillCharactersBuffer(buffer []rune, offset int) error {
 		}
 	case IntegerValueBig:
 		sval := v.bval.String()
-		copy(buffer, []rune(sval))
+		copy(buffer[offset:], []rune(sval))
 	default:
 		// return nil
 	}
@@ -1784,8 +2099,40 @@ func (v *IntegerValue) IsPositive() bool {
 	panic(fmt.Errorf("unexpected integer value: %d", v.iValType))
 }
 
+func (v *IntegerValue) IsNegative() bool {
+	return v.Sign() < 0
+}
+
+func (v *IntegerValue) IsZero() bool {
+	return v.Sign() == 0
+}
+
+// Sign returns -1, 0 or +1 depending on whether the value is negative,
+// zero or positive, regardless of its internal representation.
+func (v *IntegerValue) Sign() int {
+	switch v.iValType {
+	case IntegerValue32:
+		return cmpSign(int64(v.ival))
+	case IntegerValue64:
+		return cmpSign(v.lval)
+	case IntegerValueBig:
+		return v.bval.Sign()
+	}
+	panic(fmt.Errorf("unexpected integer value: %d", v.iValType))
+}
+
+func cmpSign(n int64) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
 func (v *IntegerValue) Add(o *IntegerValue) *IntegerValue {
-	if o.equals(ZeroIntegerValue) {
+	if o.IsZero() {
 		return v
 	}
 
@@ -1839,7 +2186,7 @@ func (v *IntegerValue) Add(o *IntegerValue) *IntegerValue {
 }
 
 func (v *IntegerValue) Sub(o *IntegerValue) *IntegerValue {
-	if o.equals(ZeroIntegerValue) {
+	if o.IsZero() {
 		return v
 	}
 
@@ -1892,6 +2239,54 @@ func (v *IntegerValue) Sub(o *IntegerValue) *IntegerValue {
 	}
 }
 
+// Mul returns v*o. Results that overflow 64 bits are promoted to big.Int,
+// results are demoted to the smallest fitting representation.
+func (v *IntegerValue) Mul(o *IntegerValue) *IntegerValue {
+	switch {
+	case v.iValType == IntegerValue32 && o.iValType == IntegerValue32:
+		// Note: the product of two 32 bit values always fits into 64 bits
+		return IntegerValueOf64(int64(v.ival) * int64(o.ival))
+	case v.iValType != IntegerValueBig && o.iValType != IntegerValueBig:
+		a, b := v.Value64(), o.Value64()
+		p := a * b
+		if a == 0 || (p/a == b && !(a == -1 && b == math.MinInt64)) {
+			return IntegerValueOf64(p)
+		}
+	}
+
+	val := new(big.Int).Mul(v.ValueBig(), o.ValueBig())
+	return IntegerValueOfBig(*val)
+}
+
+// Div returns v/o truncated towards zero. Division by zero is an error.
+func (v *IntegerValue) Div(o *IntegerValue) (*IntegerValue, error) {
+	switch o.iValType {
+	case IntegerValue32:
+		if o.ival == 0 {
+			return nil, errors.New("integer division by zero")
+		}
+	case IntegerValue64:
+		if o.lval == 0 {
+			return nil, errors.New("integer division by zero")
+		}
+	case IntegerValueBig:
+		if o.bval.Sign() == 0 {
+			return nil, errors.New("integer division by zero")
+		}
+	}
+
+	if v.iValType != IntegerValueBig && o.iValType != IntegerValueBig {
+		a, b := v.Value64(), o.Value64()
+		// Note: MinInt64 / -1 is the only quotient overflowing 64 bits
+		if !(a == math.MinInt64 && b == -1) {
+			return IntegerValueOf64(a / b), nil
+		}
+	}
+
+	val := new(big.Int).Quo(v.ValueBig(), o.ValueBig())
+	return IntegerValueOfBig(*val), nil
+}
+
 func (v *IntegerValue) Equals(o Value) bool {
 	if o == nil {
 		return false
@@ -2000,37 +2395,46 @@ type ListValue struct {
 }
 
 func NewListValue(values []Value, listDatatype Datatype) *ListValue {
-	return &ListValue{
+	v := &ListValue{
 		AbstractValue:  NewAbstractValue(ValueTypeList),
 		values:         values,
 		listDatatype:   listDatatype,
 		numberOfValues: len(values),
 	}
+	v.Value = v
+	return v
 }
 
+// ListValueParse splits value at whitespace and returns the tokens as list
+// of listDatatype items, OR nil if a token is no valid item.
 func ListValueParse(value string, listDatatype Datatype) (*ListValue, error) {
-	tokens := strings.Fields(value)
-	values := make([]Value, len(tokens))
-	index := 0
+	return listValueParse(value, listDatatype, nil)
+}
 
-	for _, token := range tokens {
-		next := NewStringValueFromString(token)
-		encoder, err := NewTypedTypeEncoder(nil, nil, nil)
+// listValueParse validates all tokens with itemEncoder, a nil encoder is
+// created once per call.
+func listValueParse(value string, listDatatype Datatype, itemEncoder *TypedTypeEncoder) (*ListValue, error) {
+	if itemEncoder == nil {
+		var err error
+		itemEncoder, err = NewTypedTypeEncoder(nil, nil, nil)
 		if err != nil {
 			return nil, err
 		}
+	}
+
+	tokens := strings.Fields(value)
+	values := make([]Value, len(tokens))
 
-		valid, err := encoder.IsValid(listDatatype, next)
+	for i, token := range tokens {
+		next := NewStringValueFromString(token)
+		valid, err := itemEncoder.IsValid(listDatatype, next)
 		if err != nil {
 			return nil, err
 		}
-
-		if valid {
-			values[index] = next
-			index++
-		} else {
+		if !valid {
 			return nil, nil
 		}
+		values[i] = next
 	}
 
 	return NewListValue(values, listDatatype), nil
@@ -2225,6 +2629,17 @@ func (v *QNameValue) Equals(o Value) bool {
 	}
 }
 
+// EqualsWithPrefix is like Equals but also compares the prefixes, e.g. to
+// check that xsi:type values keep their prefix. A nil prefix equals the
+// empty prefix.
+func (v *QNameValue) EqualsWithPrefix(o Value) bool {
+	if !v.Equals(o) {
+		return false
+	}
+	oi := o.(*QNameValue)
+	return utils.AsValue(v.prefix) == utils.AsValue(oi.prefix)
+}
+
 /*
 	StringValue implementation
 */
@@ -2233,6 +2648,7 @@ type StringValue struct {
 	*AbstractValue
 	characters *[]rune
 	sValue     *string
+	sLen       int // number of characters, -1 until known
 }
 
 func NewStringValueFromSlice(ch []rune) *StringValue {
@@ -2240,6 +2656,7 @@ func NewStringValueFromSlice(ch []rune) *StringValue {
 		AbstractValue: NewAbstractValue(ValueTypeString),
 		characters:    &ch,
 		sValue:        nil,
+		sLen:          len(ch),
 	}
 }
 
@@ -2248,18 +2665,23 @@ func NewStringValueFromString(s string) *StringValue {
 		AbstractValue: NewAbstractValue(ValueTypeString),
 		characters:    nil,
 		sValue:        &s,
+		sLen:          -1,
 	}
 }
 
 func (v *StringValue) checkCharacters() {
 	if v.characters == nil {
 		v.characters = utils.AsPtr([]rune(*v.sValue))
+		v.sLen = len(*v.characters)
 	}
 }
 
 func (v *StringValue) GetCharactersLength() (int, error) {
-	v.checkCharacters()
-	return len(*v.characters), nil
+	if v.sLen == -1 {
+		// Note: counting does not require the characters
+		v.sLen = utf8.RuneCountInString(*v.sValue)
+	}
+	return v.sLen, nil
 }
 
 func (v *StringValue) GetCharacters() ([]rune, error) {
@@ -2268,11 +2690,11 @@ func (v *StringValue) GetCharacters() ([]rune, error) {
 }
 
 func (v *StringValue) FillCharactersBuffer(buffer []rune, offset int) error {
-	if offset+len(*v.characters) > len(buffer) {
+	v.checkCharacters()
+	if offset+v.sLen > len(buffer) {
 		return utils.ErrorIndexOutOfBounds
 	}
 
-	v.checkCharacters()
 	copy(buffer[offset:], *v.characters)
 	return nil
 }
@@ -2295,6 +2717,17 @@ func (v *StringValue) Equals(o Value) bool {
 	if v == o {
 		return true
 	} else {
+		if sv, ok := o.(*StringValue); ok {
+			// compare without materializing strings, already materialized
+			// strings compare fastest
+			if v.sValue != nil && sv.sValue != nil {
+				return *v.sValue == *sv.sValue
+			}
+			if v.characters != nil && sv.characters != nil {
+				return slices.Equal(*v.characters, *sv.characters)
+			}
+		}
+
 		vs, err := v.ToString()
 		if err != nil {
 			return false
@@ -2308,3 +2741,29 @@ func (v *StringValue) Equals(o Value) bool {
 		return vs == os
 	}
 }
+
+/*
+	AnyURIValue implementation
+*/
+
+// AnyURIValue is a string value of type xsd:anyURI, see NewAnyURIDatatype.
+// It is coded and compared like any string.
+type AnyURIValue struct {
+	*StringValue
+}
+
+func NewAnyURIValue(value *StringValue) *AnyURIValue {
+	return &AnyURIValue{
+		StringValue: value,
+	}
+}
+
+// GetURL parses the URI with leading and trailing whitespace removed, see
+// url.Parse.
+func (v *AnyURIValue) GetURL() (*url.URL, error) {
+	s, err := v.ToString()
+	if err != nil {
+		return nil, err
+	}
+	return url.Parse(strings.TrimSpace(s))
+}
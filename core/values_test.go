@@ -0,0 +1,644 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"math/big"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/sderkacs/go-exi/utils"
+)
+
+func TestFloatValueParseString(t *testing.T) {
+	valid := map[string]string{
+		"1.5":    "15E-1",
+		"-1.5E2": "-15E1",
+		"+3":     "3E0",
+		".5":     "5E-1",
+		"5.":     "5E0",
+		"0":      "0E0",
+		"-0E-3":  "0E0",
+		"1e+2":   "1E2",
+		"INF":    "INF",
+		"-INF":   "-INF",
+		"NaN":    "NaN",
+	}
+	for lexical, want := range valid {
+		f, err := FloatValueParseString(lexical)
+		if err != nil {
+			t.Errorf("FloatValueParseString(%q): unexpected error: %v", lexical, err)
+			continue
+		}
+		got, err := f.ToString()
+		if err != nil {
+			t.Errorf("FloatValueParseString(%q).ToString(): %v", lexical, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("FloatValueParseString(%q) = %s, want %s", lexical, got, want)
+		}
+	}
+
+	for _, lexical := range []string{"", "-", "+", ".", "-.", "+.", "E5", "-E5", ".E1", "1E", "1E-", "1E+", "1..2", "1x"} {
+		if f, err := FloatValueParseString(lexical); err == nil {
+			s, _ := f.ToString()
+			t.Errorf("FloatValueParseString(%q) = %s, want error", lexical, s)
+		}
+	}
+}
+
+// codeFloat encodes fv with a bit-packed channel and decodes it again.
+func codeFloat(t *testing.T, fv *FloatValue) *FloatValue {
+	t.Helper()
+	var buf bytes.Buffer
+	writer := bufio.NewWriter(&buf)
+	encoder := NewBitEncoderChannel(writer)
+	if err := encoder.EncodeFloat(fv); err != nil {
+		t.Fatal(err)
+	}
+	if err := encoder.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := NewBitDecoderChannel(bufio.NewReader(&buf)).DecodeFloatValue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
+func TestFloatValueRoundTrip32(t *testing.T) {
+	for _, f := range []float32{
+		0, 0.1, 1.5, -2.75, 1.0 / 3, 123456.79, 1e-10, 3.4e38,
+		math.MaxFloat32, -math.MaxFloat32, math.SmallestNonzeroFloat32, 1e-40,
+		float32(math.Inf(1)), float32(math.Inf(-1)),
+	} {
+		if got := codeFloat(t, FloatValueParseFloat32(f)).ToFloat32(); got != f {
+			t.Errorf("%g: got %g", f, got)
+		}
+	}
+}
+
+func TestFloatValueRoundTrip64(t *testing.T) {
+	for _, f := range []float64{
+		0, 0.1, 1.5, -2.75, 1.0 / 3, 1e-300, 1.7976931348623157e308, 2.2250738585072014e-308,
+		math.MaxFloat64, -math.MaxFloat64, math.SmallestNonzeroFloat64, 5e-320,
+		math.Inf(1), math.Inf(-1),
+	} {
+		if got := codeFloat(t, FloatValueParseFloat64(f)).ToFloat64(); got != f {
+			t.Errorf("%g: got %g", f, got)
+		}
+	}
+}
+
+func TestFloatValueSpecial(t *testing.T) {
+	if got := codeFloat(t, FloatValueParseFloat32(float32(math.NaN()))).ToFloat32(); !math.IsNaN(float64(got)) {
+		t.Errorf("float32 NaN: got %g", got)
+	}
+	nan := codeFloat(t, FloatValueParseFloat64(math.NaN()))
+	if got := nan.ToFloat64(); !math.IsNaN(got) {
+		t.Errorf("NaN: got %g", got)
+	}
+	if s, err := nan.ToString(); err != nil || s != "NaN" {
+		t.Errorf("NaN: ToString() = %q, %v", s, err)
+	}
+
+	// EXI floats have no negative zero, -0 decodes as 0
+	negativeZero := math.Copysign(0, -1)
+	if got := codeFloat(t, FloatValueParseFloat64(negativeZero)).ToFloat64(); got != 0 || math.Signbit(got) {
+		t.Errorf("-0: got %g", got)
+	}
+	if got := codeFloat(t, FloatValueParseFloat32(float32(negativeZero))).ToFloat32(); got != 0 {
+		t.Errorf("float32 -0: got %g", got)
+	}
+
+	// shortest representation in the precision of the value
+	for _, test := range []struct {
+		fv   *FloatValue
+		want string
+	}{
+		{FloatValueParseFloat32(0.1), "1E-1"},
+		{FloatValueParseFloat64(0.1), "1E-1"},
+		{FloatValueParseFloat32(100), "1E2"},
+		{FloatValueParseFloat32(float32(math.Inf(-1))), "-INF"},
+	} {
+		if s, err := test.fv.ToString(); err != nil || s != test.want {
+			t.Errorf("ToString() = %q, %v, want %q", s, err, test.want)
+		}
+	}
+}
+
+func TestFloatValueEqualsRepresentations(t *testing.T) {
+	// unnormalized values, NewFloatValue removes trailing zeros of mantissas
+	float := func(mantissa, exponent int64) *FloatValue {
+		return &FloatValue{mantissa: IntegerValueOf64(mantissa), exponent: IntegerValueOf64(exponent)}
+	}
+	tests := []struct {
+		a, b *FloatValue
+		want bool
+	}{
+		{float(10, -1), float(1000, -3), true},
+		{float(234, 2), float(2340, 1), true},
+		{float(30, 0), float(3, 1), true},
+		{float(-50, -2), float(-5, -1), true},
+		{float(10, -1), float(1001, -3), false},
+		{float(2340, 1), float(235, 2), false},
+		{float(10, -1), float(-1000, -3), false},
+	}
+	for _, test := range tests {
+		if got := test.a.equals(test.b); got != test.want {
+			t.Errorf("%dE%d.equals(%dE%d) = %v, want %v", test.a.mantissa.Value64(), test.a.exponent.Value64(),
+				test.b.mantissa.Value64(), test.b.exponent.Value64(), got, test.want)
+		}
+		if got := test.b.equals(test.a); got != test.want {
+			t.Errorf("%dE%d.equals(%dE%d) = %v, want %v", test.b.mantissa.Value64(), test.b.exponent.Value64(),
+				test.a.mantissa.Value64(), test.a.exponent.Value64(), got, test.want)
+		}
+	}
+}
+
+// TestFloatValueNaN checks that any mantissa other than 1 and -1 with the
+// special exponent -(2^14) is NaN.
+func TestFloatValueNaN(t *testing.T) {
+	special := IntegerValueOf32(FloatSpecialValues)
+	huge, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+	for _, mantissa := range []*IntegerValue{
+		IntegerValueOf32(0),
+		IntegerValueOf32(2),
+		IntegerValueOf32(-5),
+		IntegerValueOf32(10),
+		IntegerValueOf32(-100),
+		IntegerValueOf64(math.MaxInt64),
+		IntegerValueOfBig(*huge),
+	} {
+		// as decoded from a stream
+		f := codeFloat(t, &FloatValue{mantissa: mantissa, exponent: special})
+		if s, err := f.ToString(); err != nil || s != FloatNotANumber {
+			t.Errorf("mantissa %s: ToString() = %q, %v, want NaN", mantissa, s, err)
+		}
+		if n, err := f.GetCharactersLength(); err != nil || n != len(FloatNotANumber) {
+			t.Errorf("mantissa %s: GetCharactersLength() = %d, %v", mantissa, n, err)
+		}
+		buffer := make([]rune, len(FloatNotANumber))
+		if err := f.FillCharactersBuffer(buffer, 0); err != nil || string(buffer) != FloatNotANumber {
+			t.Errorf("mantissa %s: FillCharactersBuffer() = %q, %v", mantissa, string(buffer), err)
+		}
+		if !math.IsNaN(f.ToFloat64()) {
+			t.Errorf("mantissa %s: ToFloat64() = %v, want NaN", mantissa, f.ToFloat64())
+		}
+
+		// trailing zeros must not turn the special exponent into a number
+		if s, _ := NewFloatValue(mantissa, special).ToString(); s != FloatNotANumber {
+			t.Errorf("mantissa %s: NewFloatValue().ToString() = %q, want NaN", mantissa, s)
+		}
+	}
+
+	for mantissa, want := range map[int]string{1: FloatInfinity, -1: FloatMinusInfinity} {
+		f := NewFloatValue(IntegerValueOf32(mantissa), special)
+		if s, _ := f.ToString(); s != want {
+			t.Errorf("mantissa %d: ToString() = %q, want %q", mantissa, s, want)
+		}
+	}
+}
+
+func TestValueToString(t *testing.T) {
+	mustDecimal := func(t *testing.T, s string) Value {
+		dv, err := DecimalValueParseString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dv
+	}
+	// ToString and GetCharacters of AbstractValue dispatch to the concrete value
+	list := NewListValue([]Value{NewIntegerValue32(1), NewIntegerValue32(-2)}, NewListDatatype(NewIntegerDatatype(nil), nil))
+	for _, test := range []struct {
+		value Value
+		want  string
+	}{
+		{NewBinaryBase64Value([]byte("exi")), "ZXhp"},
+		{NewBinaryHexValue([]byte{0x0f, 0xa0}), "0fa0"},
+		{mustDecimal(t, "1.5"), "1.5"},
+		{NewFloatValueFrom64(15, -1), "15E-1"},
+		{list, "1 -2"},
+	} {
+		if s, err := test.value.ToString(); err != nil || s != test.want {
+			t.Errorf("%T: ToString() = %q, %v, want %q", test.value, s, err, test.want)
+		}
+	}
+}
+
+func TestStringValueEquals(t *testing.T) {
+	runes := func(s string) Value { return NewStringValueFromSlice([]rune(s)) }
+	str := func(s string) Value { return NewStringValueFromString(s) }
+	tests := []struct {
+		a, b Value
+		want bool
+	}{
+		{runes("abc"), runes("abc"), true},
+		{runes("abc"), runes("abd"), false},
+		{runes("abc"), runes("ab"), false},
+		{runes(""), runes(""), true},
+		{str("abc"), str("abc"), true},
+		{str("abc"), str("abd"), false},
+		{runes("äbc"), str("äbc"), true},
+		{str("äbc"), runes("äb"), false},
+		{runes("1"), NewIntegerValue32(1), true},
+	}
+	for _, test := range tests {
+		if got := test.a.Equals(test.b); got != test.want {
+			t.Errorf("%v.Equals(%v) = %v, want %v", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func BenchmarkStringValueEquals(b *testing.B) {
+	// string values of a document that repeats a few values many times
+	events := []string{"SD", "SE r"}
+	for i := range 1000 {
+		events = append(events, "SE v", fmt.Sprintf("CH repeated value %d", i%10), "EE")
+	}
+	events = append(events, "EE", "ED")
+	factory := NewDefaultEXIFactory()
+	exi := encodeBody(b, factory, events)
+
+	decoder, err := factory.CreateEXIBodyDecoder()
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := decoder.SetInputStream(bufio.NewReader(bytes.NewReader(exi))); err != nil {
+		b.Fatal(err)
+	}
+	var characters [][]rune
+	for {
+		ev, exists, err := decoder.DecodeEvent()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if !exists {
+			break
+		}
+		if ev.Value != nil {
+			ch, err := ev.Value.GetCharacters()
+			if err != nil {
+				b.Fatal(err)
+			}
+			characters = append(characters, ch)
+		}
+	}
+
+	// compare fresh rune-backed values, as the string table hands them out
+	values := make([]Value, len(characters))
+	b.ReportAllocs()
+	for b.Loop() {
+		for i, ch := range characters {
+			values[i] = NewStringValueFromSlice(ch)
+		}
+		for i := 1; i < len(values); i++ {
+			values[i].Equals(values[i-1])
+		}
+	}
+}
+
+func TestQNameValueEqualsWithPrefix(t *testing.T) {
+	qname := func(uri, local string, prefix *string) *QNameValue { return NewQNameValue(uri, local, prefix) }
+	p, q, empty := utils.AsPtr("p"), utils.AsPtr("q"), utils.AsPtr("")
+	tests := []struct {
+		a      *QNameValue
+		b      Value
+		equals bool
+		want   bool
+	}{
+		{qname("urn:a", "e", p), qname("urn:a", "e", p), true, true},
+		{qname("urn:a", "e", p), qname("urn:a", "e", q), true, false},
+		{qname("urn:a", "e", p), qname("urn:a", "e", nil), true, false},
+		{qname("urn:a", "e", nil), qname("urn:a", "e", empty), true, true},
+		{qname("urn:a", "e", p), qname("urn:b", "e", p), false, false},
+		{qname("urn:a", "e", p), qname("urn:a", "f", p), false, false},
+		{qname("urn:a", "e", p), NewStringValueFromString("p:e"), false, false},
+		{qname("urn:a", "e", p), nil, false, false},
+	}
+	for _, test := range tests {
+		if got := test.a.Equals(test.b); got != test.equals {
+			t.Errorf("%v.Equals(%v) = %v, want %v", test.a, test.b, got, test.equals)
+		}
+		if got := test.a.EqualsWithPrefix(test.b); got != test.want {
+			t.Errorf("%v.EqualsWithPrefix(%v) = %v, want %v", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestListValueParse(t *testing.T) {
+	integers := NewIntegerDatatype(nil)
+	lv, err := ListValueParse(" 1 -2\t300\n", integers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, v := range lv.ToValues() {
+		s, err := v.ToString()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, s)
+	}
+	if want := []string{"1", "-2", "300"}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if lv, _ := ListValueParse("1 x 3", integers); lv != nil {
+		t.Errorf("invalid item: got %v, want no list", lv)
+	}
+}
+
+func BenchmarkListValueParse(b *testing.B) {
+	items := make([]string, 5000)
+	for i := range items {
+		items[i] = fmt.Sprint(i * 7)
+	}
+	value := strings.Join(items, " ")
+	integers := NewIntegerDatatype(nil)
+	b.ReportAllocs()
+	for b.Loop() {
+		lv, err := ListValueParse(value, integers)
+		if err != nil || lv.GetNumberOfValues() != len(items) {
+			b.Fatal(lv, err)
+		}
+	}
+}
+
+func TestIntegerValueMulDiv(t *testing.T) {
+	bigValue := func(s string) *IntegerValue {
+		b, _ := new(big.Int).SetString(s, 10)
+		return NewIntegerValueBig(*b)
+	}
+	tests := []struct {
+		a, b     *IntegerValue
+		product  string
+		kind     IntegerValueType
+		quotient string
+	}{
+		{NewIntegerValue32(6), NewIntegerValue32(-4), "-24", IntegerValue32, "-1"},
+		{NewIntegerValue32(math.MaxInt32), NewIntegerValue32(math.MaxInt32), "4611686014132420609", IntegerValue64, "1"},
+		{NewIntegerValue32(3), NewIntegerValue64(1 << 40), "3298534883328", IntegerValue64, "0"},
+		{NewIntegerValue64(1 << 40), NewIntegerValue32(-2), "-2199023255552", IntegerValue64, "-549755813888"},
+		{NewIntegerValue64(1 << 40), NewIntegerValue64(1 << 40), "1208925819614629174706176", IntegerValueBig, "1"},
+		{NewIntegerValue64(math.MinInt64), NewIntegerValue32(-1), "9223372036854775808", IntegerValueBig, "9223372036854775808"},
+		{NewIntegerValue64(math.MinInt64), NewIntegerValue32(1), "-9223372036854775808", IntegerValue64, "-9223372036854775808"},
+		{bigValue("100000000000000000000"), NewIntegerValue32(7), "700000000000000000000", IntegerValueBig, "14285714285714285714"},
+		{bigValue("100000000000000000000"), bigValue("-100000000000000000000"), "-10000000000000000000000000000000000000000", IntegerValueBig, "-1"},
+		{bigValue("100000000000000000000"), NewIntegerValue32(0), "0", IntegerValue32, ""},
+	}
+	for _, test := range tests {
+		name := test.a.ValueBig().String() + ", " + test.b.ValueBig().String()
+		p := test.a.Mul(test.b)
+		if got := p.ValueBig().String(); got != test.product || p.GetIntegerValueType() != test.kind {
+			t.Errorf("%s: Mul = %s (type %d), want %s (type %d)", name, got, p.GetIntegerValueType(), test.product, test.kind)
+		}
+		q, err := test.a.Div(test.b)
+		if test.quotient == "" {
+			if err == nil {
+				t.Errorf("%s: Div = %v, want error", name, q.ValueBig())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Div: %v", name, err)
+		} else if got := q.ValueBig().String(); got != test.quotient {
+			t.Errorf("%s: Div = %s, want %s", name, got, test.quotient)
+		}
+	}
+
+	for _, zero := range []*IntegerValue{NewIntegerValue32(0), NewIntegerValue64(0), NewIntegerValueBig(big.Int{})} {
+		if _, err := NewIntegerValue32(1).Div(zero); err == nil {
+			t.Errorf("division by zero of type %d: no error", zero.GetIntegerValueType())
+		}
+	}
+}
+
+func TestIntegerValueAbstractValue(t *testing.T) {
+	big30, _ := new(big.Int).SetString("-123456789012345678901234567890", 10)
+	tests := []struct {
+		value *IntegerValue
+		s     string
+	}{
+		{NewIntegerValue32(-42), "-42"},
+		{NewIntegerValue64(1 << 40), "1099511627776"},
+		{NewIntegerValue64(math.MinInt64), "-9223372036854775808"},
+		{NewIntegerValueBig(*big30), "-123456789012345678901234567890"},
+	}
+	for _, test := range tests {
+		// through the embedded AbstractValue
+		av := test.value.AbstractValue
+		if c, err := av.GetCharacters(); err != nil || string(c) != test.s {
+			t.Errorf("%s: GetCharacters() = %q, %v", test.s, string(c), err)
+		}
+		if s, err := av.ToString(); err != nil || s != test.s {
+			t.Errorf("%s: ToString() = %q, %v", test.s, s, err)
+		}
+		buffer := make([]rune, len(test.s)+2)
+		if s, err := av.BufferToString(buffer, 2); err != nil || s != test.s {
+			t.Errorf("%s: BufferToString() = %q, %v", test.s, s, err)
+		}
+	}
+}
+
+func TestDecimalValueArithmetic(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		cmp      int
+		sum, sub string
+	}{
+		{"1.5", "1.25", 1, "2.75", "0.25"},
+		{"-0.5", "0.5", -1, "0.0", "-1.0"},
+		{"-1.25", "-1.5", 1, "-2.75", "0.25"},
+		{"-0.0", "0.0", 0, "0.0", "0.0"},
+		{"10", "9.99", 1, "19.99", "0.01"},
+		{"0.05", "0.5", -1, "0.55", "-0.45"},
+		{"123456789012345678901234567890.1", "0.9", 1, "123456789012345678901234567891.0", "123456789012345678901234567889.2"},
+		{"-7", "-7.0", 0, "-14.0", "0.0"},
+	}
+	for _, test := range tests {
+		a, err := DecimalValueParseString(test.a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := DecimalValueParseString(test.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := a.Cmp(b); got != test.cmp {
+			t.Errorf("%s Cmp %s = %d, want %d", test.a, test.b, got, test.cmp)
+		}
+		if got := b.Cmp(a); got != -test.cmp {
+			t.Errorf("%s Cmp %s = %d, want %d", test.b, test.a, got, -test.cmp)
+		}
+		for op, want := range map[string]string{"+": test.sum, "-": test.sub} {
+			apply := a.Add
+			if op == "-" {
+				apply = a.Sub
+			}
+			d, err := apply(b)
+			if err != nil {
+				t.Errorf("%s %s %s: %v", test.a, op, test.b, err)
+				continue
+			}
+			if got, err := d.ToString(); err != nil || got != want {
+				t.Errorf("%s %s %s = %q, %v, want %q", test.a, op, test.b, got, err, want)
+			}
+		}
+	}
+}
+
+func TestDurationValueParse(t *testing.T) {
+	tests := map[string]string{
+		"P1Y2M3DT4H5M6.7S":                 "P1Y2M3DT4H5M6.7S",
+		"-P0Y0DT0S":                        "PT0S",
+		"PT36H":                            "PT36H",
+		"-P1Y":                             "-P1Y",
+		"PT0.5S":                           "PT0.5S",
+		"P99999999999Y":                    "P99999999999Y",
+		"P123456789012345678901234567890D": "P123456789012345678901234567890D",
+		"-PT9223372036854775808M":          "-PT9223372036854775808M",
+	}
+	for lexical, want := range tests {
+		d, err := DurationValueParse(lexical)
+		if err != nil {
+			t.Errorf("DurationValueParse(%q): unexpected error: %v", lexical, err)
+			continue
+		}
+		if got, _ := d.ToString(); got != want {
+			t.Errorf("DurationValueParse(%q) = %s, want %s", lexical, got, want)
+		}
+	}
+
+	for _, lexical := range []string{"", "P", "PT", "1Y", "P1", "P-1Y", "P1M1Y", "P1.5Y", "PT1S2M"} {
+		if _, err := DurationValueParse(lexical); err == nil {
+			t.Errorf("DurationValueParse(%q): want error", lexical)
+		}
+	}
+}
+
+func TestDurationValueEquals(t *testing.T) {
+	tests := []struct {
+		a, b  string
+		equal bool
+	}{
+		{"P1Y", "P12M", true},
+		{"PT1H", "PT60M", true},
+		{"P1D", "PT86400S", true},
+		{"P1M", "P30D", false},
+		{"P1Y", "-P1Y", false},
+		{"P768614336404564650Y", "P9223372036854775800M", true},
+		{"P768614336404564651Y", "P9223372036854775812M", true},
+		{"P768614336404564651Y", "P9223372036854775800M", false},
+	}
+	for _, test := range tests {
+		a, err := DurationValueParse(test.a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := DurationValueParse(test.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := a.Equals(b); got != test.equal {
+			t.Errorf("%s equals %s = %v, want %v", test.a, test.b, got, test.equal)
+		}
+	}
+}
+
+func TestStringValueFillCharactersBuffer(t *testing.T) {
+	for _, v := range []*StringValue{NewStringValueFromString("äbc"), NewStringValueFromSlice([]rune("äbc"))} {
+		// fill before any other call converts the characters
+		buffer := []rune("..xxx")
+		if err := v.FillCharactersBuffer(buffer, 2); err != nil {
+			t.Fatal(err)
+		}
+		if string(buffer) != "..äbc" {
+			t.Errorf("got %q, want %q", string(buffer), "..äbc")
+		}
+		if n, err := v.GetCharactersLength(); err != nil || n != 3 {
+			t.Errorf("GetCharactersLength() = %d, %v, want 3", n, err)
+		}
+		if err := v.FillCharactersBuffer(make([]rune, 4), 2); err == nil {
+			t.Error("filled a buffer that is too small")
+		}
+	}
+}
+
+func TestDateTimeValueTimezone(t *testing.T) {
+	tests := []struct {
+		s    string
+		kind DateTimeType
+	}{
+		{"2024-01-02T03:04:05+05:30", DateTimeDateTime},
+		{"2024-01-02T03:04:05.25-08:00", DateTimeDateTime},
+		{"10:00:00+01:00", DateTimeTime},
+		{"2024Z", DateTimeGYear},
+	}
+	for _, test := range tests {
+		value, err := DateTimeParse(test.s, test.kind)
+		if err != nil {
+			t.Fatalf("%s: %v", test.s, err)
+		}
+		// the length must not change the value
+		for range 2 {
+			if n, err := value.GetCharactersLength(); err != nil || n != len(test.s) {
+				t.Errorf("%s: GetCharactersLength() = %d, %v", test.s, n, err)
+			}
+		}
+		for range 2 {
+			if s, err := value.ToString(); err != nil || s != test.s {
+				t.Errorf("%s: ToString() = %q, %v", test.s, s, err)
+			}
+		}
+	}
+}
+
+func TestIntegerValueSign(t *testing.T) {
+	minInt64 := big.NewInt(math.MinInt64)
+	belowMinInt64 := new(big.Int).Sub(minInt64, big.NewInt(1))
+	tests := []struct {
+		value *IntegerValue
+		sign  int
+		s     string
+	}{
+		{NewIntegerValue32(0), 0, "0"},
+		{NewIntegerValue32(7), 1, "7"},
+		{NewIntegerValue32(-7), -1, "-7"},
+		{NewIntegerValue32(math.MaxInt32), 1, "2147483647"},
+		{NewIntegerValue32(math.MinInt32), -1, "-2147483648"},
+		{NewIntegerValue64(0), 0, "0"},
+		{NewIntegerValue64(1 << 40), 1, "1099511627776"},
+		{NewIntegerValue64(-1 << 40), -1, "-1099511627776"},
+		{NewIntegerValue64(math.MaxInt64), 1, "9223372036854775807"},
+		{NewIntegerValue64(math.MinInt64), -1, "-9223372036854775808"},
+		{NewIntegerValueBig(*big.NewInt(0)), 0, "0"},
+		{NewIntegerValueBig(*new(big.Int).Neg(belowMinInt64)), 1, "9223372036854775809"},
+		{NewIntegerValueBig(*minInt64), -1, "-9223372036854775808"},
+		{NewIntegerValueBig(*belowMinInt64), -1, "-9223372036854775809"},
+	}
+	for _, test := range tests {
+		if got := test.value.Sign(); got != test.sign {
+			t.Errorf("%s: Sign() = %d, want %d", test.s, got, test.sign)
+		}
+		if got := test.value.IsZero(); got != (test.sign == 0) {
+			t.Errorf("%s: IsZero() = %v", test.s, got)
+		}
+		if got := test.value.IsNegative(); got != (test.sign < 0) {
+			t.Errorf("%s: IsNegative() = %v", test.s, got)
+		}
+		if got := test.value.IsPositive(); got != (test.sign >= 0) {
+			t.Errorf("%s: IsPositive() = %v", test.s, got)
+		}
+		if s, err := test.value.ToString(); err != nil || s != test.s {
+			t.Errorf("%s: ToString() = %q, %v", test.s, s, err)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package dom
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+
+	"github.com/sderkacs/go-exi/core"
+)
+
+// DOMDecoder decodes EXI streams into an in-memory document tree
+type DOMDecoder struct {
+	noOptionsFactory core.EXIFactory
+	exiStream        core.EXIStreamDecoder
+	exiBodyOnly      bool
+}
+
+// NewDOMDecoder creates a new tree decoder
+func NewDOMDecoder(noOptionsFactory core.EXIFactory) (*DOMDecoder, error) {
+	exiStream, err := noOptionsFactory.CreateEXIStreamDecoder()
+	if err != nil {
+		return nil, err
+	}
+
+	return &DOMDecoder{
+		noOptionsFactory: noOptionsFactory,
+		exiStream:        exiStream,
+		exiBodyOnly:      false,
+	}, nil
+}
+
+// SetFeature sets decoder features like body-only mode
+func (d *DOMDecoder) SetFeature(name string, value bool) error {
+	switch name {
+	case core.W3C_EXI_FeatureBodyOnly:
+		d.exiBodyOnly = value
+	default:
+		return fmt.Errorf("DOM feature not supported: %s", name)
+	}
+	return nil
+}
+
+// DecodeDocument decodes the EXI stream read from source into a document
+// tree. Values keep the type they were decoded with.
+func (d *DOMDecoder) DecodeDocument(source *bufio.Reader) (*Document, error) {
+	var decoder core.EXIBodyDecoder
+	var err error
+	if d.exiBodyOnly {
+		decoder, err = d.exiStream.GetBodyOnlyDecoder(source)
+	} else {
+		decoder, err = d.exiStream.DecodeHeader(source)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	doc := NewDocument()
+	elements := []*Element{}
+
+	appendChild := func(node Node) {
+		if len(elements) == 0 {
+			doc.Children = append(doc.Children, node)
+		} else {
+			parent := elements[len(elements)-1]
+			parent.Children = append(parent.Children, node)
+		}
+	}
+
+	reader := core.NewEventReader(decoder)
+	for {
+		ev, exists, err := reader.Next()
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			break
+		}
+
+		switch ev.EventType {
+		case core.EventTypeStartElement,
+			core.EventTypeStartElementNS,
+			core.EventTypeStartElementGeneric,
+			core.EventTypeStartElementGenericUndeclared:
+			element := NewElement(ev.QNameContext, ev.Prefix)
+			appendChild(element)
+			elements = append(elements, element)
+		case core.EventTypeEndElement, core.EventTypeEndElementUndeclared:
+			if len(elements) == 0 {
+				return nil, errors.New("end element without start element")
+			}
+			elements = elements[:len(elements)-1]
+		case core.EventTypeNamespaceDeclaration:
+			if len(elements) == 0 {
+				return nil, errors.New("namespace declaration outside of element")
+			}
+			element := elements[len(elements)-1]
+			element.NamespaceDeclarations = append(element.NamespaceDeclarations, *ev.NamespaceDeclaration)
+		case core.EventTypeAttributeXsiNil,
+			core.EventTypeAttributeXsiType,
+			core.EventTypeAttribute,
+			core.EventTypeAttributeNS,
+			core.EventTypeAttributeGeneric,
+			core.EventTypeAttributeGenericUndeclared,
+			core.EventTypeAttributeInvalidValue,
+			core.EventTypeAttributeAnyInvalidValue:
+			if len(elements) == 0 {
+				return nil, errors.New("attribute outside of element")
+			}
+			element := elements[len(elements)-1]
+			element.Attributes = append(element.Attributes, NewAttribute(ev.QNameContext, ev.Prefix, ev.Value))
+		case core.EventTypeCharacters, core.EventTypeCharactersGeneric, core.EventTypeCharactersGenericUndeclared:
+			appendChild(NewText(ev.Value))
+		case core.EventTypeComment:
+			appendChild(NewComment(ev.Comment.Text))
+		case core.EventTypeProcessingInstruction:
+			appendChild(NewProcessingInstruction(ev.ProcessingInstruction.Target, ev.ProcessingInstruction.Data))
+		case core.EventTypeDocType:
+			appendChild(NewDocType(*ev.DocType))
+		case core.EventTypeEntityReference:
+			appendChild(NewEntityReference(string(ev.EntityReference)))
+		default:
+			// SD, ED and SC carry no content
+		}
+	}
+
+	return doc, nil
+}
@@ -0,0 +1,248 @@
+package dom_test
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/sderkacs/go-exi/core"
+	"github.com/sderkacs/go-exi/dom"
+	"github.com/sderkacs/go-exi/sax"
+	"github.com/sderkacs/go-exi/xsd"
+)
+
+// newFactory returns a factory preserving comments, PIs and the given
+// features.
+func newFactory(t *testing.T, mode core.CodingMode, features ...string) core.EXIFactory {
+	t.Helper()
+	factory := core.NewDefaultEXIFactory()
+	factory.SetCodingMode(mode)
+	for _, feature := range append(features, core.FeatureComment, core.FeaturePI) {
+		if err := factory.GetFidelityOptions().SetFidelity(feature, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return factory
+}
+
+// encodeXML encodes the XML document doc with factory.
+func encodeXML(t *testing.T, factory core.EXIFactory, doc string) []byte {
+	t.Helper()
+	var exi bytes.Buffer
+	if err := sax.EncodeXML(factory, strings.NewReader(doc), &exi); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	return exi.Bytes()
+}
+
+// decodeDocument decodes exi into a document tree.
+func decodeDocument(t *testing.T, factory core.EXIFactory, exi []byte) *dom.Document {
+	t.Helper()
+	decoder, err := dom.NewDOMDecoder(factory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := decoder.DecodeDocument(bufio.NewReader(bytes.NewReader(exi)))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	return doc
+}
+
+// reencode decodes exi into a document tree and encodes the tree again.
+func reencode(t *testing.T, factory core.EXIFactory, exi []byte) []byte {
+	t.Helper()
+	encoder, err := dom.NewDOMEncoder(factory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	writer := bufio.NewWriter(&out)
+	if err := encoder.EncodeDocument(decodeDocument(t, factory, exi), writer); err != nil {
+		t.Fatalf("encode document: %v", err)
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+// dump writes node and its descendants in a compact form.
+func dump(sb *strings.Builder, node dom.Node) {
+	value := func(v core.Value) string {
+		s, _ := v.ToString()
+		return s
+	}
+	prefixed := func(prefix *string, name string) string {
+		if prefix == nil || *prefix == "" {
+			return name
+		}
+		return *prefix + ":" + name
+	}
+	switch n := node.(type) {
+	case *dom.Document:
+		for _, child := range n.Children {
+			dump(sb, child)
+		}
+	case *dom.Element:
+		fmt.Fprintf(sb, "(%s", prefixed(n.Prefix, n.QNameContext.GetLocalName()))
+		for _, ns := range n.NamespaceDeclarations {
+			fmt.Fprintf(sb, " ns:%s=%s", *ns.Prefix, ns.NamespaceURI)
+		}
+		for _, at := range n.Attributes {
+			fmt.Fprintf(sb, " @%s=%s", prefixed(at.Prefix, at.QNameContext.GetLocalName()), value(at.Value))
+		}
+		for _, child := range n.Children {
+			sb.WriteString(" ")
+			dump(sb, child)
+		}
+		sb.WriteString(")")
+	case *dom.Text:
+		fmt.Fprintf(sb, "%q", value(n.Value))
+	case *dom.Comment:
+		fmt.Fprintf(sb, "<!--%s-->", n.Text)
+	case *dom.ProcessingInstruction:
+		fmt.Fprintf(sb, "<?%s %s?>", n.Target, n.Data)
+	}
+}
+
+func TestDecodeDocument(t *testing.T) {
+	tests := []struct {
+		features []string
+		doc      string
+		want     string
+	}{
+		{
+			nil,
+			`<!--head--><r b="2" a="1"><e>text</e><?pi data?><e/>tail<!--c--></r>`,
+			`<!--head-->(r @b=2 @a=1 (e "text") <?pi data?> (e) "tail" <!--c-->)`,
+		},
+		{
+			[]string{core.FeaturePrefix},
+			`<p:r xmlns:p="urn:p" xmlns:q="urn:q" q:b="2" a="1"><q:e>text</q:e></p:r>`,
+			`(p:r ns:p=urn:p ns:q=urn:q @q:b=2 @a=1 (q:e "text"))`,
+		},
+	}
+	for _, test := range tests {
+		factory := newFactory(t, core.CodingModeBitPacked, test.features...)
+		doc := decodeDocument(t, factory, encodeXML(t, factory, test.doc))
+		var sb strings.Builder
+		dump(&sb, doc)
+		if got := sb.String(); got != test.want {
+			t.Errorf("%s:\n got %s\nwant %s", test.doc, got, test.want)
+		}
+		if root := doc.GetDocumentElement(); root == nil || root.GetAttribute("", "a") == nil {
+			t.Errorf("%s: no document element with attribute a", test.doc)
+		}
+	}
+}
+
+func TestDocumentRoundTrip(t *testing.T) {
+	docs := []string{
+		`<r/>`,
+		`<r>text</r>`,
+		`<!--head--><r b="2" a="1"><e>text</e><?pi data?><e/>tail<!--c--></r>`,
+		`<r>` + strings.Repeat(`<item id="1">value</item>`, 50) + `</r>`,
+		`<r xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xmlns:xs="http://www.w3.org/2001/XMLSchema">` +
+			`<e xsi:type="xs:int">1</e><e xsi:nil="true"/></r>`,
+	}
+	for _, mode := range []core.CodingMode{core.CodingModeBitPacked, core.CodingModeBytePacked, core.CodingModeCompression} {
+		for _, features := range [][]string{nil, {core.FeaturePrefix}} {
+			factory := newFactory(t, mode, features...)
+			for _, doc := range docs {
+				exi := encodeXML(t, factory, doc)
+				if got := reencode(t, factory, exi); !bytes.Equal(got, exi) {
+					t.Errorf("mode %d %v, %.30s:\n got % x\nwant % x", mode, features, doc, got, exi)
+				}
+			}
+		}
+	}
+}
+
+func TestSchemaInformedDocumentRoundTrip(t *testing.T) {
+	grammars, err := xsd.CreateGrammars(strings.NewReader(`<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema">
+		<xs:element name="r">
+			<xs:complexType>
+				<xs:sequence>
+					<xs:element name="e" type="Base" maxOccurs="unbounded"/>
+				</xs:sequence>
+			</xs:complexType>
+		</xs:element>
+		<xs:complexType name="Base">
+			<xs:sequence>
+				<xs:element name="v" type="xs:int"/>
+				<xs:element name="c" type="Base" minOccurs="0"/>
+			</xs:sequence>
+		</xs:complexType>
+		<xs:complexType name="Derived">
+			<xs:complexContent>
+				<xs:extension base="Base">
+					<xs:attribute name="a" type="xs:boolean"/>
+				</xs:extension>
+			</xs:complexContent>
+		</xs:complexType>
+	</xs:schema>`), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// xsi:type on the root's children and on their children; the encoder
+	// gets the decoded int values, each must be encoded once
+	doc := `<r xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">` +
+		`<e><v>1</v></e>` +
+		`<e xsi:type="Derived" a="true"><v>2</v><c xsi:type="Derived" a="false"><v>3</v></c></e>` +
+		`</r>`
+	for _, mode := range []core.CodingMode{core.CodingModeBitPacked, core.CodingModeCompression} {
+		factory := newFactory(t, mode)
+		factory.SetGrammars(grammars)
+		exi := encodeXML(t, factory, doc)
+		if got := reencode(t, factory, exi); !bytes.Equal(got, exi) {
+			t.Errorf("mode %d:\n got % x\nwant % x", mode, got, exi)
+		}
+	}
+}
+
+func TestEncodeDocumentSortAttributes(t *testing.T) {
+	doc := `<r xmlns:p="urn:p" xmlns:q="urn:q" a="1" b="2" p:a="3"><p:e c="5" q:c="4"/></r>`
+	for _, option := range []string{core.OptionSortAttributes, core.OptionCanonicalExi} {
+		factory := newFactory(t, core.CodingModeBitPacked, core.FeaturePrefix)
+		if err := factory.GetEncodingOptions().SetOption(option); err != nil {
+			t.Fatal(err)
+		}
+		exi := encodeXML(t, factory, doc)
+
+		// the tree encoder sorts reversed namespace declarations and
+		// attributes back
+		tree := decodeDocument(t, factory, exi)
+		var reverse func(element *dom.Element)
+		reverse = func(element *dom.Element) {
+			slices.Reverse(element.NamespaceDeclarations)
+			slices.Reverse(element.Attributes)
+			for _, child := range element.Children {
+				if child, ok := child.(*dom.Element); ok {
+					reverse(child)
+				}
+			}
+		}
+		reverse(tree.GetDocumentElement())
+
+		encoder, err := dom.NewDOMEncoder(factory)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		writer := bufio.NewWriter(&out)
+		if err := encoder.EncodeDocument(tree, writer); err != nil {
+			t.Fatalf("%s: encode document: %v", option, err)
+		}
+		if err := writer.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), exi) {
+			t.Errorf("%s:\n got % x\nwant % x", option, out.Bytes(), exi)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package dom
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"slices"
+
+	"github.com/sderkacs/go-exi/core"
+	"github.com/sderkacs/go-exi/utils"
+)
+
+// DOMEncoder encodes an in-memory document tree as EXI stream
+type DOMEncoder struct {
+	factory        core.EXIFactory
+	exiStream      core.EXIStreamEncoder
+	exiBodyOnly    bool
+	sortAttributes bool
+}
+
+// NewDOMEncoder creates a new tree encoder
+func NewDOMEncoder(factory core.EXIFactory) (*DOMEncoder, error) {
+	exiStream, err := factory.CreateEXIStreamEncoder()
+	if err != nil {
+		return nil, err
+	}
+
+	options := factory.GetEncodingOptions()
+
+	return &DOMEncoder{
+		factory:        factory,
+		exiStream:      exiStream,
+		exiBodyOnly:    false,
+		sortAttributes: options.IsOptionEnabled(core.OptionCanonicalExi) || options.IsOptionEnabled(core.OptionSortAttributes),
+	}, nil
+}
+
+// SetFeature sets encoder features like body-only mode
+func (e *DOMEncoder) SetFeature(name string, value bool) error {
+	switch name {
+	case core.W3C_EXI_FeatureBodyOnly:
+		e.exiBodyOnly = value
+	default:
+		return fmt.Errorf("DOM feature not supported: %s", name)
+	}
+	return nil
+}
+
+// EncodeDocument walks doc and writes it as EXI stream to writer.
+//
+// Namespace declarations of an element are encoded first, followed by
+// xsi:type, xsi:nil and the remaining attributes in tree order. For
+// schema-informed streams attributes have to be in schema order, as they are
+// in decoded trees. With core.OptionSortAttributes or core.OptionCanonicalExi
+// namespace declarations and attributes are sorted instead.
+func (e *DOMEncoder) EncodeDocument(doc *Document, writer *bufio.Writer) error {
+	var encoder core.EXIBodyEncoder
+	var err error
+	if e.exiBodyOnly {
+		encoder, err = e.factory.CreateEXIBodyEncoder()
+		if err != nil {
+			return err
+		}
+		err = encoder.SetOutputStream(writer)
+	} else {
+		encoder, err = e.exiStream.EncodeHeader(writer)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := encoder.EncodeStartDocument(); err != nil {
+		return err
+	}
+	for _, child := range doc.Children {
+		if err := e.encodeNode(encoder, child); err != nil {
+			return err
+		}
+	}
+	if err := encoder.EncodeEndDocument(); err != nil {
+		return err
+	}
+
+	return encoder.Flush()
+}
+
+func (e *DOMEncoder) encodeNode(encoder core.EXIBodyEncoder, node Node) error {
+	switch n := node.(type) {
+	case *Element:
+		return e.encodeElement(encoder, n)
+	case *Text:
+		return encoder.EncodeCharacters(n.Value)
+	case *Comment:
+		ch := []rune(n.Text)
+		return encoder.EncodeComment(ch, 0, len(ch))
+	case *ProcessingInstruction:
+		return encoder.EncodeProcessingInstruction(n.Target, n.Data)
+	case *DocType:
+		return encoder.EncodeDocType(string(n.Name), string(n.PublicID), string(n.SystemID), string(n.Text))
+	case *EntityReference:
+		return encoder.EncodeEntityReference(n.Name)
+	default:
+		return fmt.Errorf("unexpected node type: %d", node.GetNodeType())
+	}
+}
+
+func (e *DOMEncoder) encodeElement(encoder core.EXIBodyEncoder, element *Element) error {
+	qnc := element.QNameContext
+	if err := encoder.EncodeStartElement(qnc.GetNamespaceUri(), qnc.GetLocalName(), element.Prefix); err != nil {
+		return err
+	}
+
+	nsDecls := element.NamespaceDeclarations
+	attributes := element.Attributes
+	if e.sortAttributes {
+		nsDecls = slices.SortedStableFunc(slices.Values(nsDecls), func(a, b core.NamespaceDeclarationContainer) int {
+			return cmp.Compare(utils.AsValue(a.Prefix), utils.AsValue(b.Prefix))
+		})
+		attributes = slices.SortedStableFunc(slices.Values(attributes), func(a, b *Attribute) int {
+			return cmp.Or(
+				cmp.Compare(a.QNameContext.GetLocalName(), b.QNameContext.GetLocalName()),
+				cmp.Compare(a.QNameContext.GetNamespaceUri(), b.QNameContext.GetNamespaceUri()),
+			)
+		})
+	}
+
+	// 1. NS
+	for _, ns := range nsDecls {
+		if err := encoder.EncodeNamespaceDeclaration(ns.NamespaceURI, ns.Prefix); err != nil {
+			return err
+		}
+	}
+
+	// 2. XSI-Type
+	for _, at := range attributes {
+		if at.IsXsiType() {
+			if err := encoder.EncodeAttributeXsiType(at.Value, at.Prefix); err != nil {
+				return err
+			}
+		}
+	}
+
+	// 3. XSI-Nil
+	for _, at := range attributes {
+		if at.IsXsiNil() {
+			if err := encoder.EncodeAttributeXsiNil(at.Value, at.Prefix); err != nil {
+				return err
+			}
+		}
+	}
+
+	// 4. Remaining Attributes
+	for _, at := range attributes {
+		if !at.IsXsiType() && !at.IsXsiNil() {
+			if err := encoder.EncodeAttribute(at.QNameContext.GetNamespaceUri(), at.QNameContext.GetLocalName(), at.Prefix, at.Value); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, child := range element.Children {
+		if err := e.encodeNode(encoder, child); err != nil {
+			return err
+		}
+	}
+
+	return encoder.EncodeEndElement()
+}
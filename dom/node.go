@@ -0,0 +1,210 @@
+package dom
+
+import (
+	"github.com/sderkacs/go-exi/core"
+)
+
+type NodeType int
+
+const (
+	NodeTypeDocument NodeType = iota
+	NodeTypeElement
+	NodeTypeText
+	NodeTypeComment
+	NodeTypeProcessingInstruction
+	NodeTypeDocType
+	NodeTypeEntityReference
+)
+
+// Node is an item of the in-memory document tree
+type Node interface {
+	GetNodeType() NodeType
+}
+
+/*
+	Document implementation
+*/
+
+// Document is the root of the tree. Its children are the document element
+// and the comments, processing instructions and DOCTYPE around it.
+type Document struct {
+	Children []Node
+}
+
+func NewDocument() *Document {
+	return &Document{
+		Children: []Node{},
+	}
+}
+
+func (d *Document) GetNodeType() NodeType {
+	return NodeTypeDocument
+}
+
+// GetDocumentElement returns the root element or nil if there is none.
+func (d *Document) GetDocumentElement() *Element {
+	for _, child := range d.Children {
+		if e, ok := child.(*Element); ok {
+			return e
+		}
+	}
+	return nil
+}
+
+/*
+	Element implementation
+*/
+
+type Element struct {
+	QNameContext          *core.QNameContext
+	Prefix                *string // only set if prefixes are preserved
+	NamespaceDeclarations []core.NamespaceDeclarationContainer
+	Attributes            []*Attribute // in stream order
+	Children              []Node
+}
+
+func NewElement(qnc *core.QNameContext, prefix *string) *Element {
+	return &Element{
+		QNameContext:          qnc,
+		Prefix:                prefix,
+		NamespaceDeclarations: []core.NamespaceDeclarationContainer{},
+		Attributes:            []*Attribute{},
+		Children:              []Node{},
+	}
+}
+
+func (e *Element) GetNodeType() NodeType {
+	return NodeTypeElement
+}
+
+// GetAttribute returns the attribute with the given namespace URI and local
+// name or nil if there is none.
+func (e *Element) GetAttribute(uri, localName string) *Attribute {
+	for _, at := range e.Attributes {
+		if at.QNameContext.GetNamespaceUri() == uri && at.QNameContext.GetLocalName() == localName {
+			return at
+		}
+	}
+	return nil
+}
+
+/*
+	Attribute implementation
+*/
+
+// Attribute is an attribute of an element, including xsi:type and xsi:nil.
+// Namespace declarations are kept separately by Element.
+type Attribute struct {
+	QNameContext *core.QNameContext
+	Prefix       *string // only set if prefixes are preserved
+	Value        core.Value
+}
+
+func NewAttribute(qnc *core.QNameContext, prefix *string, value core.Value) *Attribute {
+	return &Attribute{
+		QNameContext: qnc,
+		Prefix:       prefix,
+		Value:        value,
+	}
+}
+
+func (a *Attribute) IsXsiType() bool {
+	return a.QNameContext.GetNamespaceUri() == core.XMLSchemaInstanceNS_URI && a.QNameContext.GetLocalName() == core.XSIType
+}
+
+func (a *Attribute) IsXsiNil() bool {
+	return a.QNameContext.GetNamespaceUri() == core.XMLSchemaInstanceNS_URI && a.QNameContext.GetLocalName() == core.XSINil
+}
+
+/*
+	Text implementation
+*/
+
+// Text is character data, typed according to the schema if one is used.
+type Text struct {
+	Value core.Value
+}
+
+func NewText(value core.Value) *Text {
+	return &Text{
+		Value: value,
+	}
+}
+
+func (t *Text) GetNodeType() NodeType {
+	return NodeTypeText
+}
+
+/*
+	Comment implementation
+*/
+
+type Comment struct {
+	Text string
+}
+
+func NewComment(text string) *Comment {
+	return &Comment{
+		Text: text,
+	}
+}
+
+func (c *Comment) GetNodeType() NodeType {
+	return NodeTypeComment
+}
+
+/*
+	ProcessingInstruction implementation
+*/
+
+type ProcessingInstruction struct {
+	Target string
+	Data   string
+}
+
+func NewProcessingInstruction(target, data string) *ProcessingInstruction {
+	return &ProcessingInstruction{
+		Target: target,
+		Data:   data,
+	}
+}
+
+func (pi *ProcessingInstruction) GetNodeType() NodeType {
+	return NodeTypeProcessingInstruction
+}
+
+/*
+	DocType implementation
+*/
+
+type DocType struct {
+	core.DocTypeContainer
+}
+
+func NewDocType(docType core.DocTypeContainer) *DocType {
+	return &DocType{
+		DocTypeContainer: docType,
+	}
+}
+
+func (dt *DocType) GetNodeType() NodeType {
+	return NodeTypeDocType
+}
+
+/*
+	EntityReference implementation
+*/
+
+type EntityReference struct {
+	Name string
+}
+
+func NewEntityReference(name string) *EntityReference {
+	return &EntityReference{
+		Name: name,
+	}
+}
+
+func (er *EntityReference) GetNodeType() NodeType {
+	return NodeTypeEntityReference
+}
@@ -0,0 +1,496 @@
+package json
+
+import (
+	"bufio"
+	"bytes"
+	encjson "encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/sderkacs/go-exi/core"
+)
+
+// Coalescing controls which sibling elements of the same name are combined
+// into a JSON array.
+type Coalescing int
+
+const (
+	// Adjacent siblings of the same name form an array, others are repeated
+	// keys. Output is streamed, only the last element of each open element is
+	// held back until the next sibling tells whether it starts an array.
+	CoalesceAdjacent Coalescing = iota
+	// All siblings of the same name form an array at the position of the
+	// first one. The content of each element is held back until its end.
+	CoalesceAll
+	// No arrays, repeated elements are repeated keys.
+	CoalesceNone
+)
+
+// Options configure the JSON representation of EXI documents
+type Options struct {
+	// Prefix of attribute keys
+	AttributePrefix string
+	// Key of the characters of elements with attributes or child elements
+	TextKey string
+	// Array coalescing of repeated elements
+	Coalescing Coalescing
+}
+
+// DefaultOptions returns the options used unless set otherwise: attributes
+// prefixed with "@", characters under "#text" and adjacent coalescing.
+func DefaultOptions() Options {
+	return Options{
+		AttributePrefix: "@",
+		TextKey:         "#text",
+		Coalescing:      CoalesceAdjacent,
+	}
+}
+
+/*
+	JSONConverter implementation
+*/
+
+// JSONConverter converts EXI streams into JSON. The document is an object
+// with a key for the root element. Elements with attributes or child
+// elements are objects; others are their characters, null if empty. Values
+// keep the type they were decoded with: numbers and booleans of
+// schema-informed streams become JSON numbers and booleans, lists become
+// arrays. Names are local names; namespace declarations, comments,
+// processing instructions, DOCTYPEs and entity references are dropped. Mixed
+// content is concatenated under the text key.
+type JSONConverter struct {
+	noOptionsFactory core.EXIFactory
+	exiStream        core.EXIStreamDecoder
+	exiBodyOnly      bool
+	options          Options
+}
+
+// NewJSONConverter creates a new converter with DefaultOptions
+func NewJSONConverter(noOptionsFactory core.EXIFactory) (*JSONConverter, error) {
+	exiStream, err := noOptionsFactory.CreateEXIStreamDecoder()
+	if err != nil {
+		return nil, err
+	}
+
+	return &JSONConverter{
+		noOptionsFactory: noOptionsFactory,
+		exiStream:        exiStream,
+		exiBodyOnly:      false,
+		options:          DefaultOptions(),
+	}, nil
+}
+
+// SetFeature sets converter features like body-only mode
+func (c *JSONConverter) SetFeature(name string, value bool) error {
+	switch name {
+	case core.W3C_EXI_FeatureBodyOnly:
+		c.exiBodyOnly = value
+	default:
+		return fmt.Errorf("JSON feature not supported: %s", name)
+	}
+	return nil
+}
+
+func (c *JSONConverter) SetOptions(options Options) {
+	c.options = options
+}
+
+func (c *JSONConverter) GetOptions() Options {
+	return c.options
+}
+
+// Convert decodes the EXI stream read from source and writes it as JSON to w
+func (c *JSONConverter) Convert(source *bufio.Reader, w io.Writer) error {
+	var decoder core.EXIBodyDecoder
+	var err error
+	if c.exiBodyOnly {
+		decoder, err = c.exiStream.GetBodyOnlyDecoder(source)
+	} else {
+		decoder, err = c.exiStream.DecodeHeader(source)
+	}
+	if err != nil {
+		return err
+	}
+
+	return ConvertEvents(decoder, w, c.options)
+}
+
+// ConvertEvents decodes the remaining events of decoder and writes them as
+// JSON to w, see JSONConverter.
+func ConvertEvents(decoder core.EXIBodyDecoder, w io.Writer, options Options) error {
+	out := bufio.NewWriter(w)
+	cv := &converter{
+		options: options,
+		stack:   []*frame{{w: out}}, // document
+	}
+
+	for done := false; !done; {
+		ev, exists, err := decoder.DecodeEvent()
+		if err != nil {
+			return err
+		}
+		if !exists {
+			break
+		}
+
+		switch ev.EventType {
+		case core.EventTypeStartElement,
+			core.EventTypeStartElementNS,
+			core.EventTypeStartElementGeneric,
+			core.EventTypeStartElementGenericUndeclared:
+			if err := cv.startElement(ev.QNameContext.GetLocalName()); err != nil {
+				return err
+			}
+		case core.EventTypeEndElement, core.EventTypeEndElementUndeclared:
+			if len(cv.stack) < 2 {
+				return errors.New("end element without start element")
+			}
+			if err := cv.endElement(); err != nil {
+				return err
+			}
+		case core.EventTypeAttributeXsiNil,
+			core.EventTypeAttributeXsiType,
+			core.EventTypeAttribute,
+			core.EventTypeAttributeNS,
+			core.EventTypeAttributeGeneric,
+			core.EventTypeAttributeGenericUndeclared,
+			core.EventTypeAttributeInvalidValue,
+			core.EventTypeAttributeAnyInvalidValue:
+			if len(cv.stack) < 2 {
+				return errors.New("attribute outside of element")
+			}
+			if err := cv.attribute(ev.QNameContext.GetLocalName(), ev.Value); err != nil {
+				return err
+			}
+		case core.EventTypeCharacters, core.EventTypeCharactersGeneric, core.EventTypeCharactersGenericUndeclared:
+			if err := cv.characters(ev.Value); err != nil {
+				return err
+			}
+		case core.EventTypeEndDocument:
+			done = true
+		default:
+			// SD and SC carry no content, others are dropped
+		}
+	}
+
+	if len(cv.stack) != 1 {
+		return errors.New("unexpected end of EXI stream")
+	}
+	if err := cv.endObject(cv.stack[0]); err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// writer is implemented by *bufio.Writer and *bytes.Buffer, write errors of
+// the former are reported by Flush
+type writer interface {
+	io.Writer
+	io.StringWriter
+	io.ByteWriter
+}
+
+// frame is the JSON value of an open element, or of the document
+type frame struct {
+	w      writer        // where the value is written
+	buffer *bytes.Buffer // w if the value is held back
+	name   string
+
+	object  bool // "{" written
+	members int
+
+	text  strings.Builder
+	texts int
+	value core.Value // value of the only characters
+
+	// CoalesceAdjacent: last child held back and the open array
+	pendingName string
+	pending     []byte
+	hasPending  bool
+	array       string
+	inArray     bool
+
+	// CoalesceAll: children by name in order of appearance
+	groups []group
+}
+
+type group struct {
+	name   string
+	values [][]byte
+}
+
+type converter struct {
+	options Options
+	stack   []*frame
+}
+
+func (cv *converter) top() *frame {
+	return cv.stack[len(cv.stack)-1]
+}
+
+func (cv *converter) openObject(f *frame) {
+	if !f.object {
+		f.w.WriteByte('{')
+		f.object = true
+	}
+}
+
+func (cv *converter) key(f *frame, key string) error {
+	if f.members > 0 {
+		f.w.WriteByte(',')
+	}
+	f.members++
+	if err := writeString(f.w, key); err != nil {
+		return err
+	}
+	f.w.WriteByte(':')
+	return nil
+}
+
+func (cv *converter) startElement(name string) error {
+	parent := cv.top()
+	cv.openObject(parent)
+
+	child := &frame{name: name}
+	switch cv.options.Coalescing {
+	case CoalesceNone:
+		if err := cv.key(parent, name); err != nil {
+			return err
+		}
+		child.w = parent.w
+	case CoalesceAll:
+		child.buffer = &bytes.Buffer{}
+		child.w = child.buffer
+	default:
+		if parent.inArray && parent.array == name {
+			parent.w.WriteByte(',')
+			child.w = parent.w
+			break
+		}
+		cv.closeArray(parent)
+		if parent.hasPending && parent.pendingName == name {
+			// second of adjacent siblings, stream the array
+			if err := cv.key(parent, name); err != nil {
+				return err
+			}
+			parent.w.WriteByte('[')
+			parent.w.Write(parent.pending)
+			parent.w.WriteByte(',')
+			parent.hasPending = false
+			parent.inArray = true
+			parent.array = name
+			child.w = parent.w
+			break
+		}
+		if err := cv.flushPending(parent); err != nil {
+			return err
+		}
+		child.buffer = &bytes.Buffer{}
+		child.w = child.buffer
+	}
+
+	cv.stack = append(cv.stack, child)
+	return nil
+}
+
+func (cv *converter) endElement() error {
+	f := cv.top()
+	cv.stack = cv.stack[:len(cv.stack)-1]
+
+	if f.object {
+		if err := cv.endObject(f); err != nil {
+			return err
+		}
+	} else {
+		switch {
+		case f.texts == 0:
+			f.w.WriteString("null")
+		case f.value != nil:
+			if err := writeValue(f.w, f.value); err != nil {
+				return err
+			}
+		default:
+			if err := writeString(f.w, f.text.String()); err != nil {
+				return err
+			}
+		}
+	}
+
+	if f.buffer == nil {
+		return nil
+	}
+	parent := cv.top()
+	if cv.options.Coalescing == CoalesceAll {
+		for i := range parent.groups {
+			if parent.groups[i].name == f.name {
+				parent.groups[i].values = append(parent.groups[i].values, f.buffer.Bytes())
+				return nil
+			}
+		}
+		parent.groups = append(parent.groups, group{name: f.name, values: [][]byte{f.buffer.Bytes()}})
+	} else {
+		parent.pendingName = f.name
+		parent.pending = f.buffer.Bytes()
+		parent.hasPending = true
+	}
+	return nil
+}
+
+// endObject writes the held back children and characters of f and closes
+// its object
+func (cv *converter) endObject(f *frame) error {
+	cv.openObject(f)
+	cv.closeArray(f)
+	if err := cv.flushPending(f); err != nil {
+		return err
+	}
+
+	for _, g := range f.groups {
+		if err := cv.key(f, g.name); err != nil {
+			return err
+		}
+		if len(g.values) == 1 {
+			f.w.Write(g.values[0])
+			continue
+		}
+		f.w.WriteByte('[')
+		for i, v := range g.values {
+			if i > 0 {
+				f.w.WriteByte(',')
+			}
+			f.w.Write(v)
+		}
+		f.w.WriteByte(']')
+	}
+	f.groups = nil
+
+	// Note: whitespace between child elements is no content
+	if f.texts > 0 && (f.members == 0 || strings.TrimSpace(f.text.String()) != "") {
+		if err := cv.key(f, cv.options.TextKey); err != nil {
+			return err
+		}
+		if f.value != nil {
+			if err := writeValue(f.w, f.value); err != nil {
+				return err
+			}
+		} else if err := writeString(f.w, f.text.String()); err != nil {
+			return err
+		}
+	}
+
+	f.w.WriteByte('}')
+	return nil
+}
+
+func (cv *converter) closeArray(f *frame) {
+	if f.inArray {
+		f.w.WriteByte(']')
+		f.inArray = false
+	}
+}
+
+func (cv *converter) flushPending(f *frame) error {
+	if !f.hasPending {
+		return nil
+	}
+	if err := cv.key(f, f.pendingName); err != nil {
+		return err
+	}
+	f.w.Write(f.pending)
+	f.hasPending = false
+	return nil
+}
+
+func (cv *converter) attribute(name string, value core.Value) error {
+	f := cv.top()
+	cv.openObject(f)
+	if err := cv.key(f, cv.options.AttributePrefix+name); err != nil {
+		return err
+	}
+	return writeValue(f.w, value)
+}
+
+func (cv *converter) characters(value core.Value) error {
+	f := cv.top()
+	s, err := value.ToString()
+	if err != nil {
+		return err
+	}
+	f.text.WriteString(s)
+	f.texts++
+	if f.texts == 1 {
+		f.value = value
+	} else {
+		f.value = nil
+	}
+	return nil
+}
+
+// writeValue writes value as JSON number or boolean if it is one, lists as
+// arrays and other values as strings
+func writeValue(w writer, value core.Value) error {
+	switch value.GetValueType() {
+	case core.ValueTypeBoolean:
+		if bv, ok := value.(*core.BooleanValue); ok {
+			if bv.ToBoolean() {
+				w.WriteString("true")
+			} else {
+				w.WriteString("false")
+			}
+			return nil
+		}
+	case core.ValueTypeInteger, core.ValueTypeDecimal, core.ValueTypeFloat:
+		s, err := value.ToString()
+		if err != nil {
+			return err
+		}
+		// Note: INF, -INF and NaN are no JSON numbers
+		if isNumber(s) {
+			w.WriteString(s)
+			return nil
+		}
+		return writeString(w, s)
+	case core.ValueTypeList:
+		if lv, ok := value.(*core.ListValue); ok {
+			w.WriteByte('[')
+			for i, v := range lv.ToValues() {
+				if i > 0 {
+					w.WriteByte(',')
+				}
+				if err := writeValue(w, v); err != nil {
+					return err
+				}
+			}
+			w.WriteByte(']')
+			return nil
+		}
+	}
+
+	s, err := value.ToString()
+	if err != nil {
+		return err
+	}
+	return writeString(w, s)
+}
+
+func isNumber(s string) bool {
+	if s == "" || (s[0] != '-' && (s[0] < '0' || s[0] > '9')) {
+		return false
+	}
+	var n encjson.Number
+	return encjson.Unmarshal([]byte(s), &n) == nil
+}
+
+func writeString(w writer, s string) error {
+	// Note: the encoder terminates values with a newline
+	var b bytes.Buffer
+	enc := encjson.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(s); err != nil {
+		return err
+	}
+	w.Write(bytes.TrimSuffix(b.Bytes(), []byte{'\n'}))
+	return nil
+}
@@ -0,0 +1,116 @@
+package json_test
+
+import (
+	"bufio"
+	"bytes"
+	encjson "encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/sderkacs/go-exi/core"
+	"github.com/sderkacs/go-exi/json"
+	"github.com/sderkacs/go-exi/sax"
+	"github.com/sderkacs/go-exi/xsd"
+)
+
+const schema = `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema">
+<xs:element name="r">
+  <xs:complexType>
+    <xs:sequence>
+      <xs:element name="n" type="xs:int" maxOccurs="unbounded"/>
+      <xs:element name="b" type="xs:boolean"/>
+      <xs:element name="d" type="xs:decimal"/>
+      <xs:element name="f" type="xs:double"/>
+      <xs:element name="s" type="xs:string" maxOccurs="unbounded"/>
+      <xs:element name="l">
+        <xs:simpleType><xs:list itemType="xs:int"/></xs:simpleType>
+      </xs:element>
+      <xs:element name="e" minOccurs="0"/>
+    </xs:sequence>
+    <xs:attribute name="id" type="xs:int"/>
+    <xs:attribute name="name" type="xs:string"/>
+  </xs:complexType>
+</xs:element>
+</xs:schema>`
+
+const doc = `<r id="7" name="x"><n>1</n><n>-2</n><b>true</b><d>1.50</d><f>INF</f>` +
+	`<s>a "quoted" text</s><s>second</s><l>1 2 3</l><e/></r>`
+
+// convert encodes doc with factory and converts it into JSON.
+func convert(t *testing.T, factory core.EXIFactory, doc string, options json.Options) string {
+	t.Helper()
+	var exi bytes.Buffer
+	if err := sax.EncodeXML(factory, strings.NewReader(doc), &exi); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	converter, err := json.NewJSONConverter(factory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	converter.SetOptions(options)
+	var out bytes.Buffer
+	if err := converter.Convert(bufio.NewReader(&exi), &out); err != nil {
+		t.Fatalf("convert: %v", err)
+	}
+	if !encjson.Valid(out.Bytes()) {
+		t.Errorf("invalid JSON: %s", out.String())
+	}
+	return out.String()
+}
+
+func schemaFactory(t *testing.T) core.EXIFactory {
+	t.Helper()
+	grammars, err := xsd.CreateGrammars(strings.NewReader(schema), "test")
+	if err != nil {
+		t.Fatalf("schema: %v", err)
+	}
+	factory := core.NewDefaultEXIFactory()
+	factory.SetGrammars(grammars)
+	return factory
+}
+
+func TestConvertSchemaInformed(t *testing.T) {
+	got := convert(t, schemaFactory(t), doc, json.DefaultOptions())
+	want := `{"r":{"@id":7,"@name":"x","n":[1,-2],"b":true,"d":1.5,"f":"INF",` +
+		`"s":["a \"quoted\" text","second"],"l":[1,2,3],"e":null}}`
+	if got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+}
+
+func TestConvertSchemaLess(t *testing.T) {
+	// all values are strings without schema
+	got := convert(t, core.NewDefaultEXIFactory(), doc, json.DefaultOptions())
+	want := `{"r":{"@id":"7","@name":"x","n":["1","-2"],"b":"true","d":"1.50","f":"INF",` +
+		`"s":["a \"quoted\" text","second"],"l":"1 2 3","e":null}}`
+	if got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+}
+
+func TestConvertOptions(t *testing.T) {
+	const doc = `<r a="1"><x>1</x><y>2</y><x>3</x><z a="2">text</z></r>`
+	tests := []struct {
+		options json.Options
+		want    string
+	}{
+		{
+			json.DefaultOptions(),
+			`{"r":{"@a":"1","x":"1","y":"2","x":"3","z":{"@a":"2","#text":"text"}}}`,
+		},
+		{
+			json.Options{AttributePrefix: "_", TextKey: "value", Coalescing: json.CoalesceAll},
+			`{"r":{"_a":"1","x":["1","3"],"y":"2","z":{"_a":"2","value":"text"}}}`,
+		},
+		{
+			json.Options{AttributePrefix: "", TextKey: "#text", Coalescing: json.CoalesceNone},
+			`{"r":{"a":"1","x":"1","y":"2","x":"3","z":{"a":"2","#text":"text"}}}`,
+		},
+	}
+	for _, test := range tests {
+		got := convert(t, core.NewDefaultEXIFactory(), doc, test.options)
+		if got != test.want {
+			t.Errorf("%+v:\n got  %s\nwant %s", test.options, got, test.want)
+		}
+	}
+}
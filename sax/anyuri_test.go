@@ -0,0 +1,82 @@
+package sax_test
+
+import (
+	"bytes"
+	"encoding/xml"
+	"testing"
+
+	"github.com/sderkacs/go-exi/core"
+)
+
+func TestAnyURIValue(t *testing.T) {
+	const schema = `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema">
+<xs:element name="u" type="xs:anyURI"/></xs:schema>`
+
+	tests := []struct {
+		uri   string
+		valid bool
+	}{
+		{"http://example.com/a?b=c#d", true},
+		{"../relative/path", true},
+		{"urn:isbn:0451450523", true},
+		{"mailto:someone@example.com", true},
+		{"http://example.com/%41", true},
+		{"http://example.com/a b", false},
+		{"http://example.com/<a>", false},
+		{"http://example.com/%zz", false},
+		{"http://example.com/%4", false},
+		{"http://[::1", false},
+		{"http://example.com/ä", false},
+	}
+	for _, test := range tests {
+		var doc bytes.Buffer
+		doc.WriteString("<u>")
+		if err := xml.EscapeText(&doc, []byte(test.uri)); err != nil {
+			t.Fatal(err)
+		}
+		doc.WriteString("</u>")
+		exi := encode(t, schemaFactory(t, schema), doc.String())
+
+		// lax decoding accepts any string
+		value, err := decodeValue(schemaFactory(t, schema), exi, nil)
+		if err != nil {
+			t.Errorf("%q: lax: %v", test.uri, err)
+			continue
+		}
+		uri, ok := value.(*core.AnyURIValue)
+		if !ok {
+			t.Errorf("%q: lax: got %T, want *core.AnyURIValue", test.uri, value)
+			continue
+		}
+		if s, _ := uri.ToString(); s != test.uri {
+			t.Errorf("%q: lax: got %q", test.uri, s)
+		}
+		if test.valid {
+			if u, err := uri.GetURL(); err != nil || u.String() != test.uri {
+				t.Errorf("%q: GetURL() = %v, %v", test.uri, u, err)
+			}
+		}
+
+		factory := schemaFactory(t, schema)
+		factory.SetAnyURIValidation(true)
+		_, err = decodeValue(factory, exi, nil)
+		if test.valid && err != nil {
+			t.Errorf("%q: strict: %v", test.uri, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%q: strict: want error", test.uri)
+		}
+	}
+
+	// other strings are no URIs
+	factory := schemaFactory(t, `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema">
+<xs:element name="u" type="xs:string"/></xs:schema>`)
+	factory.SetAnyURIValidation(true)
+	value, err := decodeValue(factory, encode(t, factory, "<u>a b</u>"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := value.(*core.AnyURIValue); ok {
+		t.Error("xs:string decoded as *core.AnyURIValue")
+	}
+}
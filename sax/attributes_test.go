@@ -0,0 +1,124 @@
+package sax_test
+
+import (
+	"bufio"
+	"bytes"
+	"slices"
+	"testing"
+
+	"github.com/sderkacs/go-exi/core"
+)
+
+// orderedAttributes is an attribute list that keeps the caller order.
+type orderedAttributes struct {
+	core.AttributeList
+	names []string
+}
+
+func (l *orderedAttributes) GetNumberOfNamespaceDeclarations() int { return 0 }
+func (l *orderedAttributes) HasXsiType() bool                      { return false }
+func (l *orderedAttributes) HasXsiNil() bool                       { return false }
+func (l *orderedAttributes) GetNumberOfAttributes() int            { return len(l.names) }
+func (l *orderedAttributes) GetAttributeURI(index int) *string     { return new(string) }
+func (l *orderedAttributes) GetAttributeLocalName(index int) *string {
+	return &l.names[index]
+}
+func (l *orderedAttributes) GetAttributeValue(index int) *string  { return &l.names[index] }
+func (l *orderedAttributes) GetAttributePrefix(index int) *string { return nil }
+
+func TestSchemaOrderAttributes(t *testing.T) {
+	const schema = `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema">
+<xs:element name="r"><xs:complexType>
+  <xs:attribute name="a" type="xs:string"/>
+  <xs:attribute name="b" type="xs:string"/>
+  <xs:attribute name="c" type="xs:string"/>
+</xs:complexType></xs:element></xs:schema>`
+
+	// encodeAttributes returns the stream of <r> with the attributes c, a
+	// and b in this order.
+	encodeAttributes := func(factory core.EXIFactory) ([]byte, error) {
+		encoder, err := factory.CreateEXIBodyEncoder()
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		writer := bufio.NewWriter(&buf)
+		if err := encoder.SetOutputStream(writer); err != nil {
+			return nil, err
+		}
+		steps := []func() error{
+			encoder.EncodeStartDocument,
+			func() error { return encoder.EncodeStartElement("", "r", nil) },
+			func() error {
+				return encoder.EncodeAttributeList(&orderedAttributes{names: []string{"c", "a", "b"}})
+			},
+			encoder.EncodeEndElement,
+			encoder.EncodeEndDocument,
+			encoder.Flush,
+			writer.Flush,
+		}
+		for _, step := range steps {
+			if err := step(); err != nil {
+				return nil, err
+			}
+		}
+		return buf.Bytes(), nil
+	}
+
+	// decodeAttributes returns the attribute events of exi.
+	decodeAttributes := func(factory core.EXIFactory, exi []byte) []string {
+		decoder, err := factory.CreateEXIBodyDecoder()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := decoder.SetInputStream(bufio.NewReader(bytes.NewReader(exi))); err != nil {
+			t.Fatal(err)
+		}
+		var ats []string
+		for {
+			ev, exists, err := decoder.DecodeEvent()
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if !exists {
+				return ats
+			}
+			if ev.QNameContext != nil && ev.Value != nil {
+				ats = append(ats, ev.EventType.String()+" "+ev.QNameContext.GetLocalName())
+			}
+		}
+	}
+
+	declared := []string{"Attribute a", "Attribute b", "Attribute c"}
+	for _, strict := range []bool{false, true} {
+		for _, schemaOrder := range []bool{false, true} {
+			factory := schemaFactory(t, schema)
+			factory.GetFidelityOptions().SetFidelity(core.FeatureStrict, strict)
+			if schemaOrder {
+				if err := factory.GetEncodingOptions().SetOption(core.OptionSchemaOrderAttributes); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			exi, err := encodeAttributes(factory)
+			switch {
+			case schemaOrder && err != nil:
+				t.Errorf("strict=%v schema order: %v", strict, err)
+			case !schemaOrder && strict && err == nil:
+				t.Errorf("strict=%v caller order: want error", strict)
+			}
+			if err != nil {
+				continue
+			}
+
+			got := decodeAttributes(factory, exi)
+			if schemaOrder && !slices.Equal(got, declared) {
+				t.Errorf("strict=%v schema order: got %q, want %q", strict, got, declared)
+			}
+			// Note: c skips the declared productions of a and b
+			if !schemaOrder && slices.Equal(got, declared) {
+				t.Errorf("strict=%v caller order: got %q, want generic productions", strict, got)
+			}
+		}
+	}
+}
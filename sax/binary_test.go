@@ -0,0 +1,108 @@
+package sax_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"math/rand"
+	"testing"
+
+	"github.com/sderkacs/go-exi/core"
+)
+
+// TestDecodeCharactersTo round-trips a multi-megabyte base64Binary value
+// through the streaming API.
+func TestDecodeCharactersTo(t *testing.T) {
+	const schema = `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema">
+<xs:element name="r"><xs:complexType><xs:sequence>
+  <xs:element name="b" type="xs:base64Binary"/>
+  <xs:element name="s" type="xs:string"/>
+</xs:sequence></xs:complexType></xs:element></xs:schema>`
+
+	binary := make([]byte, 3<<20+1)
+	rand.New(rand.NewSource(1)).Read(binary)
+	doc := "<r><b>" + base64.StdEncoding.EncodeToString(binary) + "</b><s>after</s></r>"
+
+	codingModes := []core.CodingMode{
+		core.CodingModeBitPacked,
+		core.CodingModeBytePacked,
+		core.CodingModePreCompression,
+		core.CodingModeCompression,
+	}
+	for _, codingMode := range codingModes {
+		factory := schemaFactory(t, schema)
+		factory.SetCodingMode(codingMode)
+		exi := encode(t, factory, doc)
+
+		streamDecoder, err := factory.CreateEXIStreamDecoder()
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoder, err := streamDecoder.DecodeHeader(bufio.NewReader(bytes.NewReader(exi)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var binaries [][]byte
+		var values []string
+		for {
+			eventType, exists, err := decoder.Next()
+			if err != nil {
+				t.Fatalf("mode %d: %v", codingMode, err)
+			}
+			if !exists {
+				break
+			}
+			switch eventType {
+			case core.EventTypeStartDocument:
+				err = decoder.DecodeStartDocument()
+			case core.EventTypeEndDocument:
+				err = decoder.DecodeEndDocument()
+			case core.EventTypeStartElement:
+				_, err = decoder.DecodeStartElement()
+			case core.EventTypeEndElement:
+				_, err = decoder.DecodeEndElement()
+			default:
+				var buf bytes.Buffer
+				var value core.Value
+				value, err = decoder.DecodeCharactersTo(&buf)
+				if value == nil {
+					binaries = append(binaries, buf.Bytes())
+				} else {
+					s, _ := value.ToString()
+					values = append(values, s)
+				}
+			}
+			if err != nil {
+				t.Fatalf("mode %d: %s: %v", codingMode, eventType, err)
+			}
+		}
+
+		if len(binaries) != 1 || !bytes.Equal(binaries[0], binary) {
+			t.Errorf("mode %d: binary values differ", codingMode)
+		}
+		// other values are returned, not written
+		if len(values) != 1 || values[0] != "after" {
+			t.Errorf("mode %d: got values %q", codingMode, values)
+		}
+	}
+}
+
+func TestBinaryBase64ValueWriteBase64(t *testing.T) {
+	for _, n := range []int{0, 1, 2, 3, 1000, 1 << 16} {
+		binary := make([]byte, n)
+		rand.New(rand.NewSource(int64(n))).Read(binary)
+		want := base64.StdEncoding.EncodeToString(binary)
+
+		value := core.NewBinaryBase64Value(binary)
+		var buf bytes.Buffer
+		if err := value.WriteBase64(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != want {
+			t.Errorf("%d bytes: WriteBase64 differs", n)
+		}
+		if s, err := value.ToString(); err != nil || s != want {
+			t.Errorf("%d bytes: ToString differs: %v", n, err)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package sax_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/sderkacs/go-exi/core"
+)
+
+func canonicalFactory(t *testing.T) core.EXIFactory {
+	t.Helper()
+	factory := core.NewDefaultEXIFactory()
+	if err := factory.GetEncodingOptions().SetOption(core.OptionCanonicalExi); err != nil {
+		t.Fatal(err)
+	}
+	return factory
+}
+
+// TestCanonicalOutput compares canonical streams with output worked out by
+// hand from the built-in grammars: header bits 10, options present, final
+// version 1 (a0), the empty options document SE(header) EE (011) and the
+// bit-packed body padded to a byte.
+func TestCanonicalOutput(t *testing.T) {
+	tests := []struct {
+		doc  string
+		want []byte
+	}{
+		{
+			// SE(*) "" a, EE via the second level
+			`<a/>`,
+			[]byte{0xa0, 0x68, 0x13, 0x08},
+		},
+		{
+			// attributes in canonical order a, b; the second e uses the
+			// learned SE(e) and CH productions and local value hits
+			`<r b="2" a="1"><e>x</e><e>x</e></r>`,
+			[]byte{
+				0xa0, 0x68, 0x13, 0x92, 0x81, 0x30, 0x81, 0x98, 0xd4, 0x09, 0x88,
+				0x0c, 0xca, 0x90, 0x26, 0x5c, 0x0d, 0xe1, 0x20, 0x18, 0x00, 0x80,
+			},
+		},
+	}
+	for _, test := range tests {
+		got := encode(t, canonicalFactory(t), test.doc)
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("%s:\n got % x\nwant % x", test.doc, got, test.want)
+		}
+		// the same infoset gives the same stream
+		if again := encode(t, canonicalFactory(t), test.doc); !bytes.Equal(again, got) {
+			t.Errorf("%s: output differs between runs", test.doc)
+		}
+		assertRoundTrip(t, canonicalFactory(t), test.doc)
+	}
+}
+
+func TestCanonicalNoCookie(t *testing.T) {
+	factory := canonicalFactory(t)
+	if err := factory.GetEncodingOptions().SetOption(core.OptionIncludeCookie); err != nil {
+		t.Fatal(err)
+	}
+	exi := encode(t, factory, `<a/>`)
+	if bytes.HasPrefix(exi, []byte("$EXI")) {
+		t.Errorf("canonical stream starts with cookie: % x", exi)
+	}
+}
+
+// TestCanonicalUnsorted passes events to the body encoder directly, which
+// must reject them unless sorted.
+func TestCanonicalUnsorted(t *testing.T) {
+	a, b := "a", "b"
+	tests := map[string]func(encoder core.EXIBodyEncoder) error{
+		"attributes": func(encoder core.EXIBodyEncoder) error {
+			if err := encoder.EncodeAttribute("", "b", nil, core.NewStringValueFromString("2")); err != nil {
+				return err
+			}
+			return encoder.EncodeAttribute("", "a", nil, core.NewStringValueFromString("1"))
+		},
+		"attribute uris": func(encoder core.EXIBodyEncoder) error {
+			if err := encoder.EncodeAttribute("urn:b", "a", nil, core.NewStringValueFromString("2")); err != nil {
+				return err
+			}
+			return encoder.EncodeAttribute("urn:a", "a", nil, core.NewStringValueFromString("1"))
+		},
+		"namespaces": func(encoder core.EXIBodyEncoder) error {
+			if err := encoder.EncodeNamespaceDeclaration("urn:b", &b); err != nil {
+				return err
+			}
+			return encoder.EncodeNamespaceDeclaration("urn:a", &a)
+		},
+	}
+	for name, encodeEvents := range tests {
+		factory := canonicalFactory(t)
+		if err := factory.GetFidelityOptions().SetFidelity(core.FeaturePrefix, true); err != nil {
+			t.Fatal(err)
+		}
+		encoder, err := factory.CreateEXIBodyEncoder()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := encoder.SetOutput(io.Discard); err != nil {
+			t.Fatal(err)
+		}
+		if err := encoder.EncodeStartDocument(); err != nil {
+			t.Fatal(err)
+		}
+		if err := encoder.EncodeStartElement("", "r", nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := encodeEvents(encoder); err == nil {
+			t.Errorf("%s: want error", name)
+		}
+	}
+}
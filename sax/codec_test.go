@@ -0,0 +1,159 @@
+package sax_test
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/sderkacs/go-exi/core"
+	"github.com/sderkacs/go-exi/utils"
+)
+
+// pointCodec codes "x,y" integer pairs as two EXI integers.
+type pointCodec struct {
+	encoded, decoded int
+}
+
+func (c *pointCodec) Encode(channel core.EncoderChannel, value core.Value) error {
+	s, err := value.ToString()
+	if err != nil {
+		return err
+	}
+	xs, ys, ok := strings.Cut(strings.TrimSpace(s), ",")
+	if !ok {
+		return fmt.Errorf("invalid point %q", s)
+	}
+	for _, v := range []string{xs, ys} {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		if err := channel.EncodeInteger(n); err != nil {
+			return err
+		}
+	}
+	c.encoded++
+	return nil
+}
+
+func (c *pointCodec) Decode(channel core.DecoderChannel) (core.Value, error) {
+	x, err := channel.DecodeIntegerValue()
+	if err != nil {
+		return nil, err
+	}
+	y, err := channel.DecodeIntegerValue()
+	if err != nil {
+		return nil, err
+	}
+	c.decoded++
+	return core.NewStringValueFromString(x.String() + "," + y.String()), nil
+}
+
+func TestElementCodec(t *testing.T) {
+	const schema = `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema" targetNamespace="urn:geo" xmlns="urn:geo"
+  elementFormDefault="qualified">
+<xs:element name="r"><xs:complexType><xs:sequence>
+  <xs:element name="p" type="xs:string" maxOccurs="unbounded"/>
+  <xs:element name="s" type="xs:string"/>
+</xs:sequence></xs:complexType></xs:element></xs:schema>`
+	const doc = `<r xmlns="urn:geo"><p>10,20</p><p>300000,-400000</p><s>7,8</s></r>`
+
+	codingModes := []core.CodingMode{
+		core.CodingModeBitPacked,
+		core.CodingModeBytePacked,
+		core.CodingModePreCompression,
+		core.CodingModeCompression,
+	}
+	for _, codingMode := range codingModes {
+		for _, schemaInformed := range []bool{true, false} {
+			codec := &pointCodec{}
+			var factory core.EXIFactory
+			if schemaInformed {
+				factory = schemaFactory(t, schema)
+			} else {
+				factory = core.NewDefaultEXIFactory()
+				if err := factory.GetFidelityOptions().SetFidelity(core.FeaturePrefix, true); err != nil {
+					t.Fatal(err)
+				}
+			}
+			factory.SetCodingMode(codingMode)
+			factory.RegisterElementCodec(utils.QName{Space: "urn:geo", Local: "p"}, codec)
+
+			assertRoundTrip(t, factory, doc)
+			if codec.encoded != 2 || codec.decoded != 2 {
+				t.Errorf("mode %d, schema-informed %v: %d values encoded, %d decoded, want 2",
+					codingMode, schemaInformed, codec.encoded, codec.decoded)
+			}
+		}
+	}
+
+	// the decoder keeps the registrations for streams with an options header
+	codec := &pointCodec{}
+	factory := schemaFactory(t, schema)
+	if err := factory.GetEncodingOptions().SetOption(core.OptionIncludeOptions); err != nil {
+		t.Fatal(err)
+	}
+	factory.RegisterElementCodec(utils.QName{Space: "urn:geo", Local: "p"}, codec)
+	assertRoundTrip(t, factory, doc)
+	if codec.decoded != 2 {
+		t.Errorf("options header: %d values decoded, want 2", codec.decoded)
+	}
+
+	// removed registrations use the built-in representation
+	factory = schemaFactory(t, schema)
+	factory.RegisterElementCodec(utils.QName{Space: "urn:geo", Local: "p"}, &pointCodec{})
+	factory.RegisterElementCodec(utils.QName{Space: "urn:geo", Local: "p"}, nil)
+	if factory.GetElementCodec(utils.QName{Space: "urn:geo", Local: "p"}) != nil {
+		t.Error("codec still registered")
+	}
+	assertRoundTrip(t, factory, `<r xmlns="urn:geo"><p>no point</p><s>x</s></r>`)
+}
+
+func TestTypeCodec(t *testing.T) {
+	const schema = `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema" targetNamespace="urn:geo" xmlns="urn:geo"
+  elementFormDefault="qualified">
+<xs:simpleType name="point"><xs:restriction base="xs:string"/></xs:simpleType>
+<xs:simpleType name="position"><xs:restriction base="point"/></xs:simpleType>
+<xs:element name="r"><xs:complexType><xs:sequence>
+  <xs:element name="p" type="point" maxOccurs="unbounded"/>
+  <xs:element name="q" type="position"/>
+  <xs:element name="s" type="xs:string"/>
+</xs:sequence><xs:attribute name="at" type="point"/></xs:complexType></xs:element></xs:schema>`
+	const doc = `<r xmlns="urn:geo" at="-1,2"><p>10,20</p><p>300000,-400000</p><q>5,6</q><s>7,8</s></r>`
+
+	codingModes := []core.CodingMode{
+		core.CodingModeBitPacked,
+		core.CodingModeBytePacked,
+		core.CodingModePreCompression,
+		core.CodingModeCompression,
+	}
+	for _, codingMode := range codingModes {
+		codec := &pointCodec{}
+		factory := schemaFactory(t, schema)
+		factory.SetCodingMode(codingMode)
+		factory.RegisterTypeCodec(utils.QName{Space: "urn:geo", Local: "point"}, codec)
+
+		assertRoundTrip(t, factory, doc)
+		// at, two p and q, which derives from point
+		if codec.encoded != 4 || codec.decoded != 4 {
+			t.Errorf("mode %d: %d values encoded, %d decoded, want 4", codingMode, codec.encoded, codec.decoded)
+		}
+	}
+
+	// element codecs take precedence
+	typeCodec, elementCodec := &pointCodec{}, &pointCodec{}
+	factory := schemaFactory(t, schema)
+	factory.RegisterTypeCodec(utils.QName{Space: "urn:geo", Local: "point"}, typeCodec)
+	factory.RegisterElementCodec(utils.QName{Space: "urn:geo", Local: "p"}, elementCodec)
+	assertRoundTrip(t, factory, doc)
+	if typeCodec.encoded != 2 || elementCodec.encoded != 2 {
+		t.Errorf("type codec: %d values, element codec: %d values, want 2 each", typeCodec.encoded, elementCodec.encoded)
+	}
+
+	// removed registrations use the built-in representation
+	factory.RegisterTypeCodec(utils.QName{Space: "urn:geo", Local: "point"}, nil)
+	if factory.GetTypeCodec(utils.QName{Space: "urn:geo", Local: "point"}) != nil {
+		t.Error("codec still registered")
+	}
+}
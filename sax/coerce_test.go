@@ -0,0 +1,80 @@
+package sax_test
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/sderkacs/go-exi/core"
+)
+
+// decodedValues decodes exi and returns the value type and string of all
+// attribute and character values.
+func decodedValues(t *testing.T, factory core.EXIFactory, exi []byte) []string {
+	t.Helper()
+	streamDecoder, err := factory.CreateEXIStreamDecoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder, err := streamDecoder.DecodeHeader(bufio.NewReader(bytes.NewReader(exi)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values []string
+	for {
+		ev, exists, err := decoder.DecodeEvent()
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if !exists {
+			return values
+		}
+		if ev.Value != nil {
+			s, err := ev.Value.ToString()
+			if err != nil {
+				t.Fatal(err)
+			}
+			values = append(values, fmt.Sprintf("%d %s", ev.Value.GetValueType(), s))
+		}
+	}
+}
+
+func TestCoerceValuesToStrings(t *testing.T) {
+	factory := schemaFactory(t, `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema">
+<xs:element name="r"><xs:complexType><xs:sequence>
+  <xs:element name="n" type="xs:integer"/>
+  <xs:element name="b" type="xs:boolean"/>
+  <xs:element name="d" type="xs:decimal"/>
+</xs:sequence><xs:attribute name="i" type="xs:int"/></xs:complexType></xs:element></xs:schema>`)
+	const doc = `<r i=" 042"><n>+7</n><b>1</b><d>01.50</d></r>`
+
+	str := func(s string) string { return fmt.Sprintf("%d %s", core.ValueTypeString, s) }
+	typed := []string{
+		fmt.Sprintf("%d 42", core.ValueTypeInteger),
+		fmt.Sprintf("%d 7", core.ValueTypeInteger),
+		fmt.Sprintf("%d true", core.ValueTypeBoolean),
+		fmt.Sprintf("%d 1.5", core.ValueTypeDecimal),
+	}
+	// Note: the lexical form of the typed value, not of the document
+	coerced := []string{str("42"), str("7"), str("true"), str("1.5")}
+
+	for _, codingMode := range []core.CodingMode{core.CodingModeBitPacked, core.CodingModeCompression} {
+		factory.SetCodingMode(codingMode)
+		exi := encode(t, factory, doc)
+
+		factory.GetDecodingOptions().UnsetOption(core.OptionCoerceValuesToStrings)
+		if got := decodedValues(t, factory, exi); !slices.Equal(got, typed) {
+			t.Errorf("mode %d: typed: got %q, want %q", codingMode, got, typed)
+		}
+
+		if err := factory.GetDecodingOptions().SetOption(core.OptionCoerceValuesToStrings); err != nil {
+			t.Fatal(err)
+		}
+		if got := decodedValues(t, factory, exi); !slices.Equal(got, coerced) {
+			t.Errorf("mode %d: coerced: got %q, want %q", codingMode, got, coerced)
+		}
+		factory.GetDecodingOptions().UnsetOption(core.OptionCoerceValuesToStrings)
+	}
+}
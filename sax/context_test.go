@@ -0,0 +1,90 @@
+package sax_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/sderkacs/go-exi/core"
+	"github.com/sderkacs/go-exi/sax"
+)
+
+// cancelingWriter cancels its context once more than n bytes were written.
+type cancelingWriter struct {
+	bytes.Buffer
+	n      int
+	cancel context.CancelFunc
+}
+
+func (w *cancelingWriter) Write(p []byte) (int, error) {
+	if w.Len() > w.n {
+		w.cancel()
+	}
+	return w.Buffer.Write(p)
+}
+
+// cancelingReader cancels its context once more than n bytes were read.
+type cancelingReader struct {
+	io.Reader
+	n      int
+	read   int
+	cancel context.CancelFunc
+}
+
+func (r *cancelingReader) Read(p []byte) (int, error) {
+	if r.read > r.n {
+		r.cancel()
+	}
+	n, err := r.Reader.Read(p)
+	r.read += n
+	return n, err
+}
+
+func TestContextCancellation(t *testing.T) {
+	doc := `<r>` + strings.Repeat(`<e a="1">text</e>`, 2000) + `</r>`
+	factory := core.NewDefaultEXIFactory()
+
+	t.Run("encode", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		reader := &cancelingReader{Reader: strings.NewReader(doc), n: 1000, cancel: cancel}
+		encoder, err := sax.NewSAXEncoder(factory)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var exi bytes.Buffer
+		writer := bufio.NewWriter(&exi)
+		if err := encoder.SetWriter(writer); err != nil {
+			t.Fatal(err)
+		}
+		if err := encoder.EncodeWithContext(ctx, bufio.NewReader(reader)); !errors.Is(err, context.Canceled) {
+			t.Errorf("got %v, want context.Canceled", err)
+		}
+	})
+
+	t.Run("decode", func(t *testing.T) {
+		var exi bytes.Buffer
+		if err := sax.EncodeXML(factory, strings.NewReader(doc), &exi); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		decoder, err := sax.NewSAXDecoder(factory)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := &cancelingWriter{n: 1000, cancel: cancel}
+		_, err = decoder.ParseWithContext(ctx, bufio.NewReader(&exi), xml.NewEncoder(out))
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("got %v, want context.Canceled", err)
+		}
+		if out.Len() >= len(doc) {
+			t.Errorf("decoded the whole document despite cancellation")
+		}
+	})
+}
@@ -2,8 +2,11 @@ package sax
 
 import (
 	"bufio"
+	"context"
 	"encoding/xml"
+	"errors"
 	"fmt"
+	"io"
 
 	"github.com/sderkacs/go-exi/core"
 )
@@ -22,6 +25,7 @@ type SAXDecoder struct {
 	debug             bool
 	attributeList     []xml.Attr
 	namespaceList     []core.NamespaceDeclarationContainer
+	elementNames      []string // qualified names of open elements
 	isFirstElement    bool
 }
 
@@ -45,10 +49,67 @@ func NewSAXDecoderWithBuffer(noOptionsFactory core.EXIFactory, cbuffer []rune) (
 		debug:             false,
 		attributeList:     []xml.Attr{},
 		namespaceList:     []core.NamespaceDeclarationContainer{},
+		elementNames:      []string{},
 		isFirstElement:    true,
 	}, nil
 }
 
+// DecodeXML reads an EXI stream from reader, decodes it according to the
+// settings of noOptionsFactory and writes the resulting XML document to writer.
+func DecodeXML(noOptionsFactory core.EXIFactory, reader io.Reader, writer io.Writer) error {
+	decoder, err := NewSAXDecoder(noOptionsFactory)
+	if err != nil {
+		return err
+	}
+	_, err = decoder.Parse(bufio.NewReader(reader), xml.NewEncoder(writer))
+	return err
+}
+
+// ErrOutputLimitExceeded is returned by DecodeXMLWithLimit when the decoded
+// XML document exceeds the given size.
+var ErrOutputLimitExceeded = errors.New("decoded XML exceeds output limit")
+
+// DecodeXMLWithLimit is like DecodeXML but aborts with ErrOutputLimitExceeded
+// once more than maxBytes bytes of XML would be written to writer. It guards
+// against small EXI streams that expand to huge XML documents, e.g. through
+// repeated string table hits on long values. Output up to the limit has been
+// written when decoding aborts. A negative maxBytes is an error.
+func DecodeXMLWithLimit(noOptionsFactory core.EXIFactory, reader io.Reader, writer io.Writer, maxBytes int64) error {
+	if maxBytes < 0 {
+		return fmt.Errorf("negative output limit %d", maxBytes)
+	}
+	decoder, err := NewSAXDecoder(noOptionsFactory)
+	if err != nil {
+		return err
+	}
+	lw := &limitedWriter{
+		writer:    writer,
+		remaining: maxBytes,
+	}
+	_, err = decoder.Parse(bufio.NewReader(reader), xml.NewEncoder(lw))
+	return err
+}
+
+// limitedWriter passes at most remaining bytes to writer.
+type limitedWriter struct {
+	writer    io.Writer
+	remaining int64
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) <= w.remaining {
+		n, err := w.writer.Write(p)
+		w.remaining -= int64(n)
+		return n, err
+	}
+	n, err := w.writer.Write(p[:w.remaining])
+	w.remaining -= int64(n)
+	if err != nil {
+		return n, err
+	}
+	return n, ErrOutputLimitExceeded
+}
+
 func (d *SAXDecoder) GetFeature(name string) (bool, error) {
 	switch name {
 	case "http://xml.org/sax/features/namespaces":
@@ -78,6 +139,7 @@ func (d *SAXDecoder) SetFeature(name string, value bool) error {
 func (d *SAXDecoder) reset() {
 	d.attributeList = []xml.Attr{}
 	d.namespaceList = []core.NamespaceDeclarationContainer{}
+	d.elementNames = []string{}
 	d.isFirstElement = true
 }
 
@@ -86,6 +148,12 @@ func (d *SAXDecoder) reset() {
 // the local name of the document's root element. If an error occurs during decoding
 // or writing, it returns an empty string and the error.
 func (d *SAXDecoder) Parse(source *bufio.Reader, writer *xml.Encoder) (string, error) {
+	return d.ParseWithContext(context.Background(), source, writer)
+}
+
+// ParseWithContext is like Parse but stops with the context error once ctx is
+// done. The context is checked before each EXI event.
+func (d *SAXDecoder) ParseWithContext(ctx context.Context, source *bufio.Reader, writer *xml.Encoder) (string, error) {
 	d.reset()
 
 	var decoder core.EXIBodyDecoder
@@ -102,7 +170,7 @@ func (d *SAXDecoder) Parse(source *bufio.Reader, writer *xml.Encoder) (string, e
 		}
 	}
 
-	rootName, err := d.parseEXIEvents(decoder, writer)
+	rootName, err := d.parseEXIEvents(ctx, decoder, writer)
 	if err != nil {
 		return "", err
 	}
@@ -110,13 +178,13 @@ func (d *SAXDecoder) Parse(source *bufio.Reader, writer *xml.Encoder) (string, e
 	return rootName, nil
 }
 
-func (d *SAXDecoder) parseEXIEvents(decoder core.EXIBodyDecoder, writer *xml.Encoder) (string, error) {
+func (d *SAXDecoder) parseEXIEvents(ctx context.Context, decoder core.EXIBodyDecoder, writer *xml.Encoder) (string, error) {
 	var deferredStartElement *core.QNameContext = nil
 	var err error
 	isStartElementDeferred := false
 	rootName := ""
 
-	eventType, exists, err := decoder.Next()
+	eventType, exists, err := decoder.NextWithContext(ctx)
 	if err != nil {
 		return "", err
 	}
@@ -217,10 +285,17 @@ func (d *SAXDecoder) parseEXIEvents(decoder core.EXIBodyDecoder, writer *xml.Enc
 				return "", err
 			}
 
+			// Note: end element has to match the name of its start element
+			eeQNameAsString := eeQName.GetDefaultQNameAsString()
+			if n := len(d.elementNames); n > 0 {
+				eeQNameAsString = d.elementNames[n-1]
+				d.elementNames = d.elementNames[:n-1]
+			}
+
 			// ENCODE
 			if err := writer.EncodeToken(xml.EndElement{
 				Name: xml.Name{
-					Local: eeQName.GetDefaultQNameAsString(),
+					Local: eeQNameAsString,
 				},
 			}); err != nil {
 				return "", err
@@ -260,67 +335,27 @@ func (d *SAXDecoder) parseEXIEvents(decoder core.EXIBodyDecoder, writer *xml.Enc
 				}
 			case core.ValueTypeList:
 				lv := val.(*core.ListValue)
-				values := lv.ToValues()
-
-				if len(values) > 0 {
-					vt := values[0].GetValueType()
-
-					for _, val2 := range values {
-						switch vt {
-						case core.ValueTypeBoolean, core.ValueTypeString:
-							chars, err := val2.GetCharacters()
-							if err != nil {
-								return "", err
-							}
-
-							// ENCODE
-							if err := writer.EncodeToken(xml.CharData(string(chars))); err != nil {
-								return "", err
-							}
-							if d.debug {
-								fmt.Printf("[ENCODE] CharData: %s\n", string(chars))
-							}
-							// ENCODE
-							if err := writer.EncodeToken(xml.CharData(string(core.XSDListDelimCharArray))); err != nil {
-								return "", err
-							}
-							if d.debug {
-								fmt.Printf("[ENCODE] CharData: %s\n", string(core.XSDListDelimCharArray))
-							}
-						default:
-							offset := 0
-							length, err := val2.GetCharactersLength()
-							if err != nil {
-								return "", err
-							}
-
-							// Weird java code here
-							if len(d.cbuffer) < (offset + length + 1) {
-								// ENCODE
-								if err := writer.EncodeToken(xml.CharData(string(d.cbuffer[:offset]))); err != nil {
-									return "", err
-								}
-								if d.debug {
-									fmt.Printf("[ENCODE] CharData: %s\n", string(d.cbuffer[:offset]))
-								}
-							}
-
-							if err := val2.FillCharactersBuffer(d.cbuffer, offset); err != nil {
-								return "", err
-							}
-							offset += length
-							d.cbuffer[offset] = ' '
-							offset++
-
-							// ENCODE
-							if err := writer.EncodeToken(xml.CharData(string(d.cbuffer[:offset]))); err != nil {
-								return "", err
-							}
-							if d.debug {
-								fmt.Printf("[ENCODE] CharData: %s\n", string(d.cbuffer[:offset]))
-							}
+
+				for i, val2 := range lv.ToValues() {
+					if i > 0 {
+						// ENCODE
+						if err := writer.EncodeToken(xml.CharData(string(core.XSDListDelimCharArray))); err != nil {
+							return "", err
 						}
 					}
+
+					chars, err := val2.GetCharacters()
+					if err != nil {
+						return "", err
+					}
+
+					// ENCODE
+					if err := writer.EncodeToken(xml.CharData(string(chars))); err != nil {
+						return "", err
+					}
+					if d.debug {
+						fmt.Printf("[ENCODE] CharData: %s\n", string(chars))
+					}
 				}
 			default:
 				slen, err := val.GetCharactersLength()
@@ -389,12 +424,12 @@ func (d *SAXDecoder) parseEXIEvents(decoder core.EXIBodyDecoder, writer *xml.Enc
 				isStartElementDeferred = false
 			}
 
-			com, err := decoder.DecodeComment()
+			com, err := decoder.DecodeCommentContainer()
 			if err != nil {
 				return "", err
 			}
 
-			if err := d.handleComment(com); err != nil {
+			if err := d.handleComment(com, writer); err != nil {
 				return "", err
 			}
 		case core.EventTypeProcessingInstruction:
@@ -423,12 +458,12 @@ func (d *SAXDecoder) parseEXIEvents(decoder core.EXIBodyDecoder, writer *xml.Enc
 				fmt.Printf("[ENCODE] ProcInst{Target = %s, Data = %s}\n", pi.Target, pi.Data)
 			}
 		default:
-			return "", fmt.Errorf("unexpected EXI event: %d", eventType)
+			return "", fmt.Errorf("unexpected EXI event: %s", eventType)
 		}
 
-		eventType, exists, err = decoder.Next()
+		eventType, exists, err = decoder.NextWithContext(ctx)
 		if d.debug {
-			fmt.Printf("[NEXT] ET: %d, Exists: %v, Err: %v\n", eventType, exists, err)
+			fmt.Printf("[NEXT] ET: %s, Exists: %v, Err: %v\n", eventType, exists, err)
 		}
 		if err != nil {
 			return "", err
@@ -441,7 +476,7 @@ func (d *SAXDecoder) parseEXIEvents(decoder core.EXIBodyDecoder, writer *xml.Enc
 func (d *SAXDecoder) handleDeferredStartElement(decoder core.EXIBodyDecoder, deferredStartElement *core.QNameContext, writer *xml.Encoder) error {
 	nsAttrs := []xml.Attr{}
 
-	if d.namespaces && d.isFirstElement {
+	if d.namespaces {
 		prefixes := decoder.GetDeclaredPrefixDeclarations()
 		for _, prefix := range prefixes {
 			p := ""
@@ -451,9 +486,13 @@ func (d *SAXDecoder) handleDeferredStartElement(decoder core.EXIBodyDecoder, def
 			if d.debug {
 				fmt.Printf("NSDECL(DEF): %+v, Prefix: %s\n", prefix, p)
 			}
+			name := core.XML_NS_Attribute
+			if p != core.XMLDefaultNSPrefix {
+				name = fmt.Sprintf("%s:%s", core.XML_NS_Attribute, p)
+			}
 			nsAttrs = append(nsAttrs, xml.Attr{
 				Name: xml.Name{
-					Local: fmt.Sprintf("xmlns:%s", p),
+					Local: name,
 				},
 				Value: prefix.NamespaceURI,
 			})
@@ -477,25 +516,24 @@ func (d *SAXDecoder) handleDeferredStartElement(decoder core.EXIBodyDecoder, def
 	 * /5839494
 	 */
 
-	//seQNameAsString := decoder.GetElementQNameAsString()
+	seQNameAsString := decoder.GetElementQNameAsString()
 
 	// start so far deferred start element
 	// ENCODE
 
 	attrs := []xml.Attr{}
-	if d.isFirstElement {
-		attrs = append(attrs, nsAttrs...)
-	}
+	attrs = append(attrs, nsAttrs...)
 	attrs = append(attrs, d.attributeList...)
 
 	if err := writer.EncodeToken(xml.StartElement{
 		Name: xml.Name{
-			Local: deferredStartElement.GetDefaultQNameAsString(),
+			Local: seQNameAsString,
 		},
 		Attr: attrs,
 	}); err != nil {
 		return err
 	}
+	d.elementNames = append(d.elementNames, seQNameAsString)
 	if d.debug {
 		fmt.Printf("[ENCODE] StartElement{Space: %s, Local: %s}\n", deferredStartElement.GetNamespaceUri(), deferredStartElement.GetLocalName())
 	}
@@ -630,9 +668,13 @@ func (d *SAXDecoder) handleEntityReference(erName []rune) error {
 	return nil
 }
 
-func (d *SAXDecoder) handleComment(comment []rune) error {
+func (d *SAXDecoder) handleComment(comment core.CommentContainer, writer *xml.Encoder) error {
+	// ENCODE
+	if err := writer.EncodeToken(xml.Comment(comment.Text)); err != nil {
+		return err
+	}
 	if d.debug {
-		fmt.Printf("COM: %s\n", string(comment))
+		fmt.Printf("[ENCODE] Comment{%s}\n", comment.Text)
 	}
 	return nil
 }
@@ -0,0 +1,47 @@
+package sax_test
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/sderkacs/go-exi/core"
+)
+
+func TestDecoderWarnings(t *testing.T) {
+	tests := []struct {
+		doc  string
+		want string
+	}{
+		{`<r xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:type="unknown">x</r>`, "xsi:type 'unknown' cannot be resolved, type grammar not applied"},
+		{`<r>x</r>`, ""},
+		{`<r xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:nil="true"/>`, ""},
+	}
+	for _, test := range tests {
+		factory := schemaFactory(t, `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema">
+<xs:element name="r" nillable="true"/></xs:schema>`)
+		if err := factory.GetFidelityOptions().SetFidelity(core.FeatureLexicalValue, true); err != nil {
+			t.Fatal(err)
+		}
+		streamDecoder, err := factory.CreateEXIStreamDecoder()
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoder, err := streamDecoder.DecodeHeader(bufio.NewReader(bytes.NewReader(encode(t, factory, test.doc))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var warnings []string
+		decoder.SetErrorHandler(warningRecorder{&warnings})
+		for exists := true; exists; {
+			if _, exists, err = decoder.DecodeEvent(); err != nil {
+				t.Fatalf("%s: decode: %v", test.doc, err)
+			}
+		}
+		// Note: warnings end with the fidelity options
+		if test.want == "" && len(warnings) != 0 || test.want != "" && (len(warnings) != 1 || !strings.HasPrefix(warnings[0], test.want)) {
+			t.Errorf("%s: got warnings %q, want %q", test.doc, warnings, test.want)
+		}
+	}
+}
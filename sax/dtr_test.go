@@ -0,0 +1,144 @@
+package sax_test
+
+import (
+	"bufio"
+	"bytes"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/sderkacs/go-exi/core"
+	"github.com/sderkacs/go-exi/sax"
+	"github.com/sderkacs/go-exi/utils"
+)
+
+// decodeValue returns the characters of the single element of exi. Warnings
+// of the decoder are appended to warnings if not nil.
+func decodeValue(factory core.EXIFactory, exi []byte, warnings *[]string) (core.Value, error) {
+	streamDecoder, err := factory.CreateEXIStreamDecoder()
+	if err != nil {
+		return nil, err
+	}
+	decoder, err := streamDecoder.DecodeHeader(bufio.NewReader(bytes.NewReader(exi)))
+	if err != nil {
+		return nil, err
+	}
+	if warnings != nil {
+		decoder.SetErrorHandler(warningRecorder{warnings})
+	}
+	var value core.Value
+	for {
+		eventType, exists, err := decoder.Next()
+		if err != nil || !exists {
+			return value, err
+		}
+		switch eventType {
+		case core.EventTypeStartDocument:
+			err = decoder.DecodeStartDocument()
+		case core.EventTypeEndDocument:
+			err = decoder.DecodeEndDocument()
+		case core.EventTypeStartElement:
+			_, err = decoder.DecodeStartElement()
+		case core.EventTypeEndElement:
+			_, err = decoder.DecodeEndElement()
+		default:
+			value, err = decoder.DecodeCharacters()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// warningRecorder is an error handler recording warnings.
+type warningRecorder struct {
+	warnings *[]string
+}
+
+func (r warningRecorder) Warning(err error) { *r.warnings = append(*r.warnings, err.Error()) }
+func (r warningRecorder) Error(err error)   {}
+
+func TestUnsupportedRepresentation(t *testing.T) {
+	const schema = `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema">
+<xs:element name="r"><xs:complexType><xs:sequence>
+  <xs:element name="i" type="xs:integer" maxOccurs="unbounded"/>
+</xs:sequence></xs:complexType></xs:element></xs:schema>`
+	const doc = `<r><i>007</i><i>8</i></r>`
+	integer := []utils.QName{{Space: core.XMLSchemaNS_URI, Local: "integer"}}
+
+	// the encoder represents integers as strings, the decoder maps them to
+	// a representation it does not know
+	encoderFactory := schemaFactory(t, schema)
+	encoderFactory.SetDatatypeRepresentationMap(&integer, &[]utils.QName{{Space: core.W3C_EXI_NS_URI, Local: core.W3C_EXI_LN_String}})
+	exi := encode(t, encoderFactory, doc)
+
+	decoderFactory := schemaFactory(t, schema)
+	decoderFactory.SetDatatypeRepresentationMap(&integer, &[]utils.QName{{Space: "urn:future", Local: "bigint"}})
+	var warnings []string
+	value, err := decodeValue(decoderFactory, exi, &warnings)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if s, _ := value.ToString(); s != "8" || value.GetValueType() != core.ValueTypeString {
+		t.Errorf("got %v value %q, want string 8", value.GetValueType(), s)
+	}
+	// reported once
+	if len(warnings) != 1 || warnings[0] != "unsupported datatype representation {urn:future}bigint, values are decoded as strings" {
+		t.Errorf("warnings %q", warnings)
+	}
+
+	// encoders have no fallback
+	encoderFactory.SetDatatypeRepresentationMap(&integer, &[]utils.QName{{Space: "urn:future", Local: "bigint"}})
+	if _, err := encoderFactory.CreateEXIBodyEncoder(); err == nil {
+		t.Error("encoder with unsupported representation: want error")
+	}
+}
+
+func TestDTRMapHeader(t *testing.T) {
+	const schema = `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema">
+<xs:element name="r"><xs:complexType><xs:sequence>
+	<xs:element name="i" type="xs:integer" maxOccurs="unbounded"/>
+	<xs:element name="d" type="xs:decimal" maxOccurs="unbounded"/>
+</xs:sequence></xs:complexType></xs:element></xs:schema>`
+	const doc = `<r><i>007</i><i>-0</i><d>01.50</d><d>-0.0</d></r>`
+	types := []utils.QName{
+		{Space: core.XMLSchemaNS_URI, Local: "integer"},
+		{Space: core.XMLSchemaNS_URI, Local: "decimal"},
+	}
+	str := utils.QName{Space: core.W3C_EXI_NS_URI, Local: core.W3C_EXI_LN_String}
+
+	modes := []core.CodingMode{core.CodingModeBitPacked, core.CodingModeBytePacked, core.CodingModePreCompression, core.CodingModeCompression}
+	for _, mode := range modes {
+		for _, strict := range []bool{false, true} {
+			factory := schemaFactory(t, schema)
+			factory.SetCodingMode(mode)
+			if err := factory.GetFidelityOptions().SetFidelity(core.FeatureStrict, strict); err != nil {
+				t.Fatal(err)
+			}
+			factory.SetDatatypeRepresentationMap(&types, &[]utils.QName{str, str})
+			if err := factory.GetEncodingOptions().SetOption(core.OptionIncludeOptions); err != nil {
+				t.Fatal(err)
+			}
+			exi := encode(t, factory, doc)
+
+			// Note: the decoding factory has no map, it comes from the header
+			var out bytes.Buffer
+			if err := sax.DecodeXML(schemaFactory(t, schema), bytes.NewReader(exi), &out); err != nil {
+				t.Fatalf("mode %d, strict %t: decode: %v", mode, strict, err)
+			}
+			if got, want := events(t, out.String()), events(t, doc); !slices.Equal(got, want) {
+				t.Errorf("mode %d, strict %t:\n got %q\nwant %q", mode, strict, got, want)
+			}
+		}
+	}
+
+	// without the map, the values are typed and lose their lexical form
+	exi := encode(t, schemaFactory(t, schema), doc)
+	var out bytes.Buffer
+	if err := sax.DecodeXML(schemaFactory(t, schema), bytes.NewReader(exi), &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() == doc || strings.Contains(out.String(), "007") {
+		t.Errorf("typed values kept their lexical form: %s", out.String())
+	}
+}
@@ -2,18 +2,84 @@ package sax
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/xml"
+	"fmt"
 	"io"
 	"strings"
 
 	"github.com/sderkacs/go-exi/core"
+	"github.com/sderkacs/go-exi/utils"
 )
 
 type SAXEncoder struct {
-	factory       core.EXIFactory
-	exiStream     core.EXIStreamEncoder
-	encoder       core.EXIBodyEncoder
-	exiAttributes core.AttributeList
+	factory        core.EXIFactory
+	exiStream      core.EXIStreamEncoder
+	encoder        core.EXIBodyEncoder
+	exiAttributes  core.AttributeList
+	preservePrefix bool
+	prefixMappings []core.NamespaceDeclarationContainer // prefix mappings in scope
+	prefixCounts   []int                                // number of prefix mappings per open element
+	started        bool                                 // start document encoded
+}
+
+// EncodeXML reads an XML document from reader and writes it as EXI stream
+// (header and body) according to the settings of factory to writer.
+func EncodeXML(factory core.EXIFactory, reader io.Reader, writer io.Writer) error {
+	mode := factory.GetCodingMode()
+	if factory.GetEncodingOptions().IsOptionEnabled(core.OptionAutoAlignment) &&
+		(mode == core.CodingModeBitPacked || mode == core.CodingModeBytePacked) {
+		return encodeXMLAutoAlignment(factory, reader, writer)
+	}
+
+	encoder, err := NewSAXEncoder(factory)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(writer)
+	if err := encoder.SetWriter(bw); err != nil {
+		return err
+	}
+	if err := encoder.Encode(bufio.NewReader(reader)); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// encodeXMLAutoAlignment encodes the whole document bit-packed and
+// byte-packed and writes the preferred stream, see core.OptionAutoAlignment.
+func encodeXMLAutoAlignment(factory core.EXIFactory, reader io.Reader, writer io.Writer) error {
+	doc, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	// Note: the alignment has to be part of the header to be decodable
+	options := factory.GetEncodingOptions().Clone()
+	options.UnsetOption(core.OptionAutoAlignment)
+	if err := options.SetOption(core.OptionIncludeOptions); err != nil {
+		return err
+	}
+
+	streams := make([]bytes.Buffer, 2)
+	for i, mode := range []core.CodingMode{core.CodingModeBitPacked, core.CodingModeBytePacked} {
+		f := factory.Clone()
+		f.SetCodingMode(mode)
+		f.SetEncodingOptions(options)
+		if err := EncodeXML(f, bytes.NewReader(doc), &streams[i]); err != nil {
+			return err
+		}
+	}
+
+	bitPacked, bytePacked := &streams[0], &streams[1]
+	threshold := factory.GetEncodingOptions().GetOptionValue(core.OptionAutoAlignment).(int)
+	if bytePacked.Len() <= threshold || bytePacked.Len() <= bitPacked.Len() {
+		_, err = bytePacked.WriteTo(writer)
+	} else {
+		_, err = bitPacked.WriteTo(writer)
+	}
+	return err
 }
 
 func NewSAXEncoder(factory core.EXIFactory) (*SAXEncoder, error) {
@@ -23,10 +89,14 @@ func NewSAXEncoder(factory core.EXIFactory) (*SAXEncoder, error) {
 	}
 
 	return &SAXEncoder{
-		factory:       factory,
-		exiStream:     exiStream,
-		encoder:       nil,
-		exiAttributes: core.NewAttributeListImpl(factory),
+		factory:        factory,
+		exiStream:      exiStream,
+		encoder:        nil,
+		exiAttributes:  core.NewAttributeListImpl(factory),
+		preservePrefix: factory.GetFidelityOptions().IsFidelityEnabled(core.FeaturePrefix),
+		prefixMappings: []core.NamespaceDeclarationContainer{},
+		prefixCounts:   []int{},
+		started:        false,
 	}, nil
 }
 
@@ -36,11 +106,31 @@ func (s *SAXEncoder) SetWriter(writer *bufio.Writer) error {
 		return err
 	}
 	s.encoder = enc
+	s.prefixMappings = s.prefixMappings[:0]
+	s.prefixCounts = s.prefixCounts[:0]
+	s.started = false
 	return nil
 }
 
 func (s *SAXEncoder) StartPrefixMapping(prefix *string, uri string) error {
 	s.exiAttributes.AddNamespaceDeclaration(uri, prefix)
+	s.prefixMappings = append(s.prefixMappings, core.NewNamespaceDeclarationContainer(uri, prefix))
+	return nil
+}
+
+// lookupPrefix returns the innermost prefix bound to uri or nil if there is
+// none. The default namespace is only considered for elements.
+func (s *SAXEncoder) lookupPrefix(uri string, isElement bool) *string {
+	for i := len(s.prefixMappings) - 1; i >= 0; i-- {
+		pm := s.prefixMappings[i]
+		if pm.NamespaceURI != uri || pm.Prefix == nil {
+			continue
+		}
+		if *pm.Prefix == core.XMLDefaultNSPrefix && !isElement {
+			continue
+		}
+		return pm.Prefix
+	}
 	return nil
 }
 
@@ -49,18 +139,24 @@ func (s *SAXEncoder) StartElement(uri, local string, raw *string, attributes []x
 }
 
 func (s *SAXEncoder) startElementPfx(uri, local string, prefix *string, attributes []xml.Attr) error {
+	if prefix == nil && s.preservePrefix {
+		prefix = s.lookupPrefix(uri, true)
+		if prefix == nil && uri == core.XMLNullNS_URI {
+			prefix = utils.AsPtr(core.XMLDefaultNSPrefix)
+		}
+	}
 	if err := s.encoder.EncodeStartElement(uri, local, prefix); err != nil {
 		return err
 	}
 
 	for _, attr := range attributes {
-		prefix := s.getPrefixOf(&attr)
-
 		// Skip namespace declarations
-		if attr.Name.Space == core.XML_NS_Attribute {
+		if isNamespaceDeclaration(&attr) {
 			continue
 		}
 
+		prefix := s.getPrefixOf(&attr)
+
 		s.exiAttributes.AddAttribute(&attr.Name.Space, attr.Name.Local, &prefix, attr.Value)
 	}
 
@@ -72,7 +168,16 @@ func (s *SAXEncoder) startElementPfx(uri, local string, prefix *string, attribut
 	return nil
 }
 
+func isNamespaceDeclaration(attr *xml.Attr) bool {
+	return attr.Name.Space == core.XML_NS_Attribute || (attr.Name.Space == core.XMLNullNS_URI && attr.Name.Local == core.XML_NS_Attribute)
+}
+
 func (s *SAXEncoder) getPrefixOf(attr *xml.Attr) string {
+	if attr.Name.Space != core.XMLNullNS_URI {
+		if prefix := s.lookupPrefix(attr.Name.Space, false); prefix != nil {
+			return *prefix
+		}
+	}
 	idx := strings.Index(attr.Name.Local, ":")
 	if idx == -1 {
 		return core.XMLDefaultNSPrefix
@@ -100,12 +205,28 @@ func (s *SAXEncoder) Characters(ch []rune, start, length int) error {
 	return s.encoder.EncodeCharacters(core.NewStringValueFromSlice(ch[start : start+length]))
 }
 
+func (s *SAXEncoder) Comment(ch []rune, start, length int) error {
+	return s.encoder.EncodeComment(ch, start, length)
+}
+
+func (s *SAXEncoder) ProcessingInstruction(target, data string) error {
+	return s.encoder.EncodeProcessingInstruction(target, data)
+}
+
 func (s *SAXEncoder) Encode(reader *bufio.Reader) error {
-	dec := xml.NewDecoder(reader)
+	return s.EncodeWithContext(context.Background(), reader)
+}
 
-	start := true
+// EncodeWithContext is like Encode but stops with the context error once ctx
+// is done. The context is checked before each XML token.
+func (s *SAXEncoder) EncodeWithContext(ctx context.Context, reader *bufio.Reader) error {
+	dec := xml.NewDecoder(reader)
 
 	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		token, err := dec.Token()
 		if err != nil {
 			if err == io.EOF {
@@ -118,30 +239,69 @@ func (s *SAXEncoder) Encode(reader *bufio.Reader) error {
 			return err
 		}
 
-		if start {
-			if err := s.StartDocument(); err != nil {
-				return err
-			}
-			start = false
+		if err := s.EncodeToken(token); err != nil {
+			return err
 		}
+	}
+}
 
-		switch tok := token.(type) {
-		case xml.StartElement:
-			if err := s.StartElement(tok.Name.Space, tok.Name.Local, nil, tok.Attr); err != nil {
-				return err
-			}
-		case xml.EndElement:
-			if err := s.EndElement(tok.Name.Space, tok.Name.Local, nil); err != nil {
-				return err
-			}
-		case xml.CharData:
-			str := string(tok)
+// EncodeToken encodes a token as returned by xml.Decoder.Token, i.e. with
+// namespace URIs in the Space of names, after SetWriter. The start document
+// is encoded before the first token, call EndDocument after the last one.
+// Namespace declarations are taken from the "xmlns" attributes, xsi:type and
+// xsi:nil attributes are encoded as such. Directives are skipped.
+func (s *SAXEncoder) EncodeToken(token xml.Token) error {
+	if !s.started {
+		if err := s.StartDocument(); err != nil {
+			return err
+		}
+		s.started = true
+	}
 
-			if err := s.Characters([]rune(str), 0, len(str)); err != nil {
-				return err
+	switch tok := token.(type) {
+	case xml.StartElement:
+		count := 0
+		for _, attr := range tok.Attr {
+			if isNamespaceDeclaration(&attr) {
+				prefix := core.XMLDefaultNSPrefix
+				if attr.Name.Space == core.XML_NS_Attribute {
+					prefix = attr.Name.Local
+				}
+				if err := s.StartPrefixMapping(&prefix, attr.Value); err != nil {
+					return err
+				}
+				count++
 			}
-		default:
-			// Skip for now
 		}
+		s.prefixCounts = append(s.prefixCounts, count)
+
+		return s.StartElement(tok.Name.Space, tok.Name.Local, nil, tok.Attr)
+	case xml.EndElement:
+		if len(s.prefixCounts) == 0 {
+			return fmt.Errorf("unexpected end element %s", tok.Name.Local)
+		}
+		if err := s.EndElement(tok.Name.Space, tok.Name.Local, nil); err != nil {
+			return err
+		}
+
+		// prefix mappings of element go out of scope
+		count := s.prefixCounts[len(s.prefixCounts)-1]
+		s.prefixCounts = s.prefixCounts[:len(s.prefixCounts)-1]
+		s.prefixMappings = s.prefixMappings[:len(s.prefixMappings)-count]
+	case xml.CharData:
+		ch := []rune(string(tok))
+		return s.Characters(ch, 0, len(ch))
+	case xml.Comment:
+		ch := []rune(string(tok))
+		return s.Comment(ch, 0, len(ch))
+	case xml.ProcInst:
+		// Note: XML declaration is not a processing instruction
+		if tok.Target != "xml" {
+			return s.ProcessingInstruction(tok.Target, string(tok.Inst))
+		}
+	default:
+		// Skip for now
 	}
+
+	return nil
 }
@@ -0,0 +1,340 @@
+package sax_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/sderkacs/go-exi/core"
+	"github.com/sderkacs/go-exi/sax"
+	"github.com/sderkacs/go-exi/utils"
+)
+
+// decodedEvents decodes exi and returns its events in a readable form.
+func decodedEvents(t *testing.T, factory core.EXIFactory, exi []byte) []string {
+	t.Helper()
+	streamDecoder, err := factory.CreateEXIStreamDecoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder, err := streamDecoder.DecodeHeader(bufio.NewReader(bytes.NewReader(exi)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var evs []string
+	for {
+		ev, exists, err := decoder.DecodeEvent()
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if !exists {
+			return evs
+		}
+		var value string
+		if ev.Value != nil {
+			value, _ = ev.Value.ToString()
+		}
+		switch ev.EventType {
+		case core.EventTypeStartElement, core.EventTypeStartElementGeneric, core.EventTypeStartElementGenericUndeclared:
+			evs = append(evs, fmt.Sprintf("SE {%s}%s", ev.QNameContext.GetNamespaceUri(), ev.QNameContext.GetLocalName()))
+		case core.EventTypeAttribute, core.EventTypeAttributeGeneric, core.EventTypeAttributeGenericUndeclared,
+			core.EventTypeAttributeXsiType, core.EventTypeAttributeXsiNil:
+			// Note: schema-less streams code xsi:type and xsi:nil as
+			// generic attributes with typed values
+			if qv, ok := ev.Value.(*core.QNameValue); ok {
+				value = fmt.Sprintf("{%s}%s", qv.GetNamespaceURI(), qv.GetLocalName())
+			}
+			evs = append(evs, fmt.Sprintf("AT {%s}%s=%s", ev.QNameContext.GetNamespaceUri(), ev.QNameContext.GetLocalName(), value))
+		case core.EventTypeCharacters, core.EventTypeCharactersGeneric, core.EventTypeCharactersGenericUndeclared:
+			evs = append(evs, "CH "+value)
+		case core.EventTypeEndElement, core.EventTypeEndElementUndeclared:
+			evs = append(evs, "EE")
+		case core.EventTypeComment:
+			evs = append(evs, "CM "+string(ev.Comment.Text))
+		case core.EventTypeProcessingInstruction:
+			evs = append(evs, "PI "+ev.ProcessingInstruction.Target+" "+ev.ProcessingInstruction.Data)
+		}
+	}
+}
+
+func TestAutoAlignment(t *testing.T) {
+	encode := func(mode core.CodingMode, option string, value any, doc string) []byte {
+		t.Helper()
+		factory := core.NewDefaultEXIFactory()
+		factory.SetCodingMode(mode)
+		if err := factory.GetEncodingOptions().SetOptionKeyValue(option, value); err != nil {
+			t.Fatal(err)
+		}
+		var exi bytes.Buffer
+		if err := sax.EncodeXML(factory, strings.NewReader(doc), &exi); err != nil {
+			t.Fatal(err)
+		}
+		return exi.Bytes()
+	}
+
+	small := `<r a="1"><e>text</e></r>`
+	large := `<r>` + strings.Repeat(`<item id="1">some text</item>`, 200) + `</r>`
+	tests := []struct {
+		doc       string
+		threshold any
+		want      core.CodingMode
+	}{
+		{small, nil, core.CodingModeBytePacked},
+		{large, nil, core.CodingModeBitPacked},
+		{large, 1 << 20, core.CodingModeBytePacked},
+		{small, 0, core.CodingModeBitPacked},
+	}
+	for _, test := range tests {
+		exi := encode(core.CodingModeBitPacked, core.OptionAutoAlignment, test.threshold, test.doc)
+		// the chosen alignment is recorded in the options header
+		if want := encode(test.want, core.OptionIncludeOptions, nil, test.doc); !bytes.Equal(exi, want) {
+			t.Errorf("%.20s, threshold %v: got %d bytes, want the %d bytes of mode %d", test.doc, test.threshold, len(exi), len(want), test.want)
+		}
+
+		var xml bytes.Buffer
+		if err := sax.DecodeXML(core.NewDefaultEXIFactory(), bytes.NewReader(exi), &xml); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if got, want := events(t, xml.String()), events(t, test.doc); !slices.Equal(got, want) {
+			t.Errorf("%.20s, threshold %v: decoded %q", test.doc, test.threshold, got)
+		}
+	}
+}
+
+func TestValueStats(t *testing.T) {
+	factory := schemaFactory(t, `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema">
+<xs:element name="r"><xs:complexType>
+	<xs:sequence><xs:element name="i" type="xs:int" maxOccurs="unbounded"/></xs:sequence>
+	<xs:attribute name="n"><xs:simpleType><xs:restriction base="xs:int">
+		<xs:minInclusive value="1"/><xs:maxInclusive value="100"/>
+	</xs:restriction></xs:simpleType></xs:attribute>
+</xs:complexType></xs:element></xs:schema>`)
+	encoder, err := factory.CreateEXIBodyEncoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder.SetCollectingStats(true)
+	if err := encoder.SetOutputStream(bufio.NewWriter(&bytes.Buffer{})); err != nil {
+		t.Fatal(err)
+	}
+	steps := []func() error{
+		encoder.EncodeStartDocument,
+		func() error { return encoder.EncodeStartElement("", "r", nil) },
+		func() error { return encoder.EncodeAttribute("", "n", nil, core.NewStringValueFromString("42")) },
+	}
+	for _, value := range []string{"1", "-1", "1000000"} {
+		steps = append(steps,
+			func() error { return encoder.EncodeStartElement("", "i", nil) },
+			func() error { return encoder.EncodeCharacters(core.NewStringValueFromString(value)) },
+			encoder.EncodeEndElement)
+	}
+	steps = append(steps, encoder.EncodeEndElement, encoder.EncodeEndDocument)
+	for _, step := range steps {
+		if err := step(); err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+	}
+
+	// integers are a sign bit and 7 bits per octet of the magnitude, the
+	// bounded attribute is a 7 bit offset
+	want := map[string]core.ValueStats{
+		"i": {Count: 3, TotalBits: 9 + 9 + 25, MaxBits: 25},
+		"n": {Count: 1, TotalBits: 7, MaxBits: 7},
+	}
+	stats := encoder.Stats()
+	if len(stats) != len(want) {
+		t.Errorf("got stats of %d qnames, want %d", len(stats), len(want))
+	}
+	for qname, s := range stats {
+		if w, ok := want[qname.Local]; !ok || *s != w {
+			t.Errorf("%s: got %+v, want %+v", qname.Local, *s, w)
+		}
+	}
+	if avg := stats[utils.QName{Local: "i"}].AverageBits(); avg != 43.0/3 {
+		t.Errorf("average of i: got %v, want %v", avg, 43.0/3)
+	}
+
+	// disabled stats
+	encoder.SetCollectingStats(false)
+	if stats := encoder.Stats(); stats != nil {
+		t.Errorf("got %v after disabling stats", stats)
+	}
+}
+
+func TestGrammarBudgetExhaustedHandler(t *testing.T) {
+	schema := `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema">
+<xs:element name="r"><xs:complexType><xs:sequence>
+	<xs:any processContents="lax" minOccurs="0" maxOccurs="unbounded"/>
+</xs:sequence></xs:complexType></xs:element></xs:schema>`
+	// past the budget the encoder stops grammar learning for b and c with
+	// xsi:type anyType
+	tests := []struct {
+		name                string
+		elementGrammars     int
+		productions         int
+		wantExhaustedPerDoc int
+		xsiTypes            []string
+	}{
+		{"unlimited", -1, -1, 0, nil},
+		{"element grammars", 1, -1, 1, []string{"b", "c"}},
+		{"productions", -1, 2, 1, []string{"b", "c"}},
+	}
+	for _, test := range tests {
+		want := []string{"SE {}r"}
+		for _, name := range []string{"a", "b", "c", "a"} {
+			want = append(want, "SE {}"+name)
+			if slices.Contains(test.xsiTypes, name) {
+				want = append(want, "AT {"+core.XMLSchemaInstanceNS_URI+"}type={"+core.XMLSchemaNS_URI+"}anyType")
+			}
+			want = append(want, "AT {}v="+name, "CH "+name, "EE")
+		}
+		want = append(want, "EE")
+
+		factory := schemaFactory(t, schema)
+		factory.SetMaximumNumberOfBuiltInElementGrammars(test.elementGrammars)
+		factory.SetMaximumNumberOfBuiltInProductions(test.productions)
+		streamEncoder, err := factory.CreateEXIStreamEncoder()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the handler fires again for a further document
+		exhausted := 0
+		for doc := 1; doc <= 2; doc++ {
+			var exi bytes.Buffer
+			writer := bufio.NewWriter(&exi)
+			encoder, err := streamEncoder.EncodeHeader(writer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			encoder.SetGrammarBudgetExhaustedHandler(func() { exhausted++ })
+			steps := []func() error{
+				encoder.EncodeStartDocument,
+				func() error { return encoder.EncodeStartElement("", "r", nil) },
+			}
+			for _, name := range []string{"a", "b", "c", "a"} {
+				steps = append(steps,
+					func() error { return encoder.EncodeStartElement("", name, nil) },
+					func() error {
+						return encoder.EncodeAttribute("", "v", nil, core.NewStringValueFromString(name))
+					},
+					func() error { return encoder.EncodeCharacters(core.NewStringValueFromString(name)) },
+					encoder.EncodeEndElement)
+			}
+			steps = append(steps, encoder.EncodeEndElement, encoder.EncodeEndDocument, encoder.Flush)
+			for _, step := range steps {
+				if err := step(); err != nil {
+					t.Fatalf("%s: encode: %v", test.name, err)
+				}
+			}
+			if err := writer.Flush(); err != nil {
+				t.Fatal(err)
+			}
+
+			if exhausted != doc*test.wantExhaustedPerDoc {
+				t.Errorf("%s, document %d: handler called %d times, want %d", test.name, doc, exhausted, doc*test.wantExhaustedPerDoc)
+			}
+			if got := decodedEvents(t, factory, exi.Bytes()); !slices.Equal(got, want) {
+				t.Errorf("%s: decoded %q, want %q", test.name, got, want)
+			}
+		}
+	}
+}
+
+func TestSortAttributes(t *testing.T) {
+	docs := []string{
+		`<r xmlns:q="urn:q" xmlns:p="urn:p" b="2" p:a="3" a="1"><p:e q:c="4" c="5"/></r>`,
+		`<r a="1" xmlns:p="urn:p" p:a="3" b="2" xmlns:q="urn:q"><p:e c="5" q:c="4"/></r>`,
+	}
+	for _, mode := range []core.CodingMode{core.CodingModeBitPacked, core.CodingModeCompression} {
+		for _, preservePrefixes := range []bool{false, true} {
+			factory := core.NewDefaultEXIFactory()
+			factory.SetCodingMode(mode)
+			if err := factory.GetFidelityOptions().SetFidelity(core.FeaturePrefix, preservePrefixes); err != nil {
+				t.Fatal(err)
+			}
+			if exi0, exi1 := encode(t, factory, docs[0]), encode(t, factory, docs[1]); bytes.Equal(exi0, exi1) {
+				t.Errorf("mode %d, prefixes %t: unsorted attributes encode identically", mode, preservePrefixes)
+			}
+
+			if err := factory.GetEncodingOptions().SetOption(core.OptionSortAttributes); err != nil {
+				t.Fatal(err)
+			}
+			if exi0, exi1 := encode(t, factory, docs[0]), encode(t, factory, docs[1]); !bytes.Equal(exi0, exi1) {
+				t.Errorf("mode %d, prefixes %t: sorted attributes differ:\n% x\n% x", mode, preservePrefixes, exi0, exi1)
+			}
+			assertRoundTrip(t, factory, docs[1])
+		}
+	}
+}
+
+func TestSAXEncoderEncodeToken(t *testing.T) {
+	const doc = `<r xmlns="urn:r" xmlns:p="urn:p" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance"` +
+		` xmlns:xs="http://www.w3.org/2001/XMLSchema"><!--c--><?pi data?>` +
+		`<p:e a="1" p:b="2">text</p:e><t xsi:type="xs:string">typed</t><n xsi:nil="true"/></r>`
+
+	factory := core.NewDefaultEXIFactory()
+	factory.GetFidelityOptions().SetFidelity(core.FeatureComment, true)
+	factory.GetFidelityOptions().SetFidelity(core.FeaturePI, true)
+
+	encoder, err := sax.NewSAXEncoder(factory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var exi bytes.Buffer
+	writer := bufio.NewWriter(&exi)
+	if err := encoder.SetWriter(writer); err != nil {
+		t.Fatal(err)
+	}
+	d := xml.NewDecoder(strings.NewReader(doc))
+	for {
+		token, err := d.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := encoder.EncodeToken(token); err != nil {
+			t.Fatalf("EncodeToken(%#v): %v", token, err)
+		}
+	}
+	if err := encoder.EndDocument(); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"SE {urn:r}r",
+		"CM c",
+		"PI pi data",
+		"SE {urn:p}e", "AT {}a=1", "AT {urn:p}b=2", "CH text", "EE",
+		"SE {urn:r}t", "AT {http://www.w3.org/2001/XMLSchema-instance}type={http://www.w3.org/2001/XMLSchema}string", "CH typed", "EE",
+		"SE {urn:r}n", "AT {http://www.w3.org/2001/XMLSchema-instance}nil=true", "EE",
+		"EE",
+	}
+	if got := decodedEvents(t, factory, exi.Bytes()); !slices.Equal(got, want) {
+		t.Errorf("got  %q\nwant %q", got, want)
+	}
+
+	// Encode streams the same tokens, so its output is unchanged
+	if plain := encode(t, factory, doc); !bytes.Equal(plain, exi.Bytes()) {
+		t.Errorf("Encode and EncodeToken differ:\n%x\n%x", plain, exi.Bytes())
+	}
+
+	// a stray end element is an error, SetWriter starts over
+	if err := encoder.SetWriter(bufio.NewWriter(io.Discard)); err != nil {
+		t.Fatal(err)
+	}
+	if err := encoder.EncodeToken(xml.EndElement{Name: xml.Name{Local: "r"}}); err == nil {
+		t.Error("stray end element: want error")
+	}
+}
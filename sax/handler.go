@@ -0,0 +1,301 @@
+package sax
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/sderkacs/go-exi/core"
+	"github.com/sderkacs/go-exi/utils"
+)
+
+// Attribute is an attribute passed to ContentHandler.StartElement. Value keeps
+// the type it was decoded with.
+type Attribute struct {
+	Name  utils.QName
+	Value core.Value
+}
+
+// ContentHandler receives the content of a decoded EXI stream, see Decode.
+//
+// As with SAX, prefix mappings of an element are reported before its start
+// element and ended after its end element. Start elements carry all
+// attributes of the element, including xsi:type and xsi:nil. Characters are
+// passed as typed values so that handlers can avoid re-parsing them.
+type ContentHandler interface {
+	StartDocument() error
+	EndDocument() error
+	StartPrefixMapping(prefix *string, uri string) error
+	EndPrefixMapping(prefix *string) error
+	StartElement(name utils.QName, attributes []Attribute) error
+	EndElement(name utils.QName) error
+	Characters(value core.Value) error
+	Comment(text string) error
+	ProcessingInstruction(target, data string) error
+	DocType(docType core.DocTypeContainer) error
+	EntityReference(name string) error
+}
+
+/*
+	DefaultHandler implementation
+*/
+
+// DefaultHandler ignores all content. It is meant to be embedded by handlers
+// that are interested in a few events only.
+type DefaultHandler struct{}
+
+func (DefaultHandler) StartDocument() error                                        { return nil }
+func (DefaultHandler) EndDocument() error                                          { return nil }
+func (DefaultHandler) StartPrefixMapping(prefix *string, uri string) error         { return nil }
+func (DefaultHandler) EndPrefixMapping(prefix *string) error                       { return nil }
+func (DefaultHandler) StartElement(name utils.QName, attributes []Attribute) error { return nil }
+func (DefaultHandler) EndElement(name utils.QName) error                           { return nil }
+func (DefaultHandler) Characters(value core.Value) error                           { return nil }
+func (DefaultHandler) Comment(text string) error                                   { return nil }
+func (DefaultHandler) ProcessingInstruction(target, data string) error             { return nil }
+func (DefaultHandler) DocType(docType core.DocTypeContainer) error                 { return nil }
+func (DefaultHandler) EntityReference(name string) error                           { return nil }
+
+/*
+	StringHandler implementation
+*/
+
+// StringHandler builds a readable representation of the decoded content,
+// one indented line per event, e.g. for debugging and logging.
+type StringHandler struct {
+	builder strings.Builder
+	depth   int
+}
+
+func NewStringHandler() *StringHandler {
+	return &StringHandler{}
+}
+
+// String returns the representation of the content handled so far.
+func (h *StringHandler) String() string {
+	return h.builder.String()
+}
+
+func (h *StringHandler) line(format string, args ...any) {
+	h.builder.WriteString(strings.Repeat("  ", h.depth))
+	fmt.Fprintf(&h.builder, format, args...)
+	h.builder.WriteByte('\n')
+}
+
+func (h *StringHandler) StartDocument() error {
+	h.line("SD")
+	return nil
+}
+
+func (h *StringHandler) EndDocument() error {
+	h.line("ED")
+	return nil
+}
+
+func (h *StringHandler) StartPrefixMapping(prefix *string, uri string) error {
+	h.line("NS %s=%s", prefixString(prefix), uri)
+	return nil
+}
+
+func (h *StringHandler) EndPrefixMapping(prefix *string) error {
+	return nil
+}
+
+func (h *StringHandler) StartElement(name utils.QName, attributes []Attribute) error {
+	h.line("SE %s", qnameString(name))
+	h.depth++
+	for _, at := range attributes {
+		value, err := at.Value.ToString()
+		if err != nil {
+			return err
+		}
+		h.line("AT %s=%q", qnameString(at.Name), value)
+	}
+	return nil
+}
+
+func (h *StringHandler) EndElement(name utils.QName) error {
+	h.depth--
+	h.line("EE %s", qnameString(name))
+	return nil
+}
+
+func (h *StringHandler) Characters(value core.Value) error {
+	s, err := value.ToString()
+	if err != nil {
+		return err
+	}
+	h.line("CH %q", s)
+	return nil
+}
+
+func (h *StringHandler) Comment(text string) error {
+	h.line("CM %q", text)
+	return nil
+}
+
+func (h *StringHandler) ProcessingInstruction(target, data string) error {
+	h.line("PI %s %q", target, data)
+	return nil
+}
+
+func (h *StringHandler) DocType(docType core.DocTypeContainer) error {
+	h.line("DT %s", string(docType.Name))
+	return nil
+}
+
+func (h *StringHandler) EntityReference(name string) error {
+	h.line("ER %s", name)
+	return nil
+}
+
+func prefixString(prefix *string) string {
+	if prefix == nil {
+		return "<nil>"
+	}
+	return *prefix
+}
+
+func qnameString(name utils.QName) string {
+	if name.Prefix != nil && *name.Prefix != "" {
+		return *name.Prefix + ":" + name.Local
+	}
+	if name.Space != "" {
+		return "{" + name.Space + "}" + name.Local
+	}
+	return name.Local
+}
+
+/*
+	Decode implementation
+*/
+
+// Decode reads an EXI stream from reader, decodes it according to the
+// settings of noOptionsFactory and reports its content to handler.
+func Decode(noOptionsFactory core.EXIFactory, reader io.Reader, handler ContentHandler) error {
+	exiStream, err := noOptionsFactory.CreateEXIStreamDecoder()
+	if err != nil {
+		return err
+	}
+	decoder, err := exiStream.DecodeHeader(bufio.NewReader(reader))
+	if err != nil {
+		return err
+	}
+	return DecodeBody(decoder, handler)
+}
+
+// DecodeBody reports all remaining events of decoder to handler. The start
+// element is deferred until its attributes and namespace declarations have
+// been read.
+func DecodeBody(decoder core.EXIBodyDecoder, handler ContentHandler) error {
+	var pending *utils.QName
+	attributes := []Attribute{}
+	// open elements and the prefixes they declared
+	elements := []utils.QName{}
+	declarations := [][]*string{}
+
+	startElement := func() error {
+		if pending == nil {
+			return nil
+		}
+		name := *pending
+		pending = nil
+		err := handler.StartElement(name, attributes)
+		attributes = []Attribute{}
+		return err
+	}
+
+	reader := core.NewEventReader(decoder)
+	for {
+		ev, exists, err := reader.Next()
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return nil
+		}
+
+		switch ev.EventType {
+		case core.EventTypeAttributeXsiNil,
+			core.EventTypeAttributeXsiType,
+			core.EventTypeAttribute,
+			core.EventTypeAttributeNS,
+			core.EventTypeAttributeGeneric,
+			core.EventTypeAttributeGenericUndeclared,
+			core.EventTypeAttributeInvalidValue,
+			core.EventTypeAttributeAnyInvalidValue:
+			if pending == nil {
+				return errors.New("attribute outside of start tag")
+			}
+			name := ev.QNameContext.GetQName()
+			name.Prefix = ev.Prefix
+			attributes = append(attributes, Attribute{Name: name, Value: ev.Value})
+			continue
+		case core.EventTypeNamespaceDeclaration:
+			if pending == nil {
+				return errors.New("namespace declaration outside of start tag")
+			}
+			last := len(elements) - 1
+			declarations[last] = append(declarations[last], ev.NamespaceDeclaration.Prefix)
+			if err := handler.StartPrefixMapping(ev.NamespaceDeclaration.Prefix, ev.NamespaceDeclaration.NamespaceURI); err != nil {
+				return err
+			}
+			continue
+		case core.EventTypeSelfContained:
+			// Note: SC carries no content and does not end the start tag
+			continue
+		}
+
+		if err := startElement(); err != nil {
+			return err
+		}
+
+		switch ev.EventType {
+		case core.EventTypeStartDocument:
+			err = handler.StartDocument()
+		case core.EventTypeEndDocument:
+			err = handler.EndDocument()
+		case core.EventTypeStartElement,
+			core.EventTypeStartElementNS,
+			core.EventTypeStartElementGeneric,
+			core.EventTypeStartElementGenericUndeclared:
+			name := ev.QNameContext.GetQName()
+			name.Prefix = ev.Prefix
+			pending = &name
+			elements = append(elements, name)
+			declarations = append(declarations, nil)
+		case core.EventTypeEndElement, core.EventTypeEndElementUndeclared:
+			last := len(elements) - 1
+			if last < 0 {
+				return errors.New("end element without start element")
+			}
+			// Note: use the prefix the start tag ended up with
+			err = handler.EndElement(elements[last])
+			for _, prefix := range declarations[last] {
+				if err != nil {
+					break
+				}
+				err = handler.EndPrefixMapping(prefix)
+			}
+			elements = elements[:last]
+			declarations = declarations[:last]
+		case core.EventTypeCharacters, core.EventTypeCharactersGeneric, core.EventTypeCharactersGenericUndeclared:
+			err = handler.Characters(ev.Value)
+		case core.EventTypeComment:
+			err = handler.Comment(ev.Comment.Text)
+		case core.EventTypeProcessingInstruction:
+			err = handler.ProcessingInstruction(ev.ProcessingInstruction.Target, ev.ProcessingInstruction.Data)
+		case core.EventTypeDocType:
+			err = handler.DocType(*ev.DocType)
+		case core.EventTypeEntityReference:
+			err = handler.EntityReference(string(ev.EntityReference))
+		default:
+			err = fmt.Errorf("unexpected EXI event: %s", ev.EventType)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
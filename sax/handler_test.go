@@ -0,0 +1,91 @@
+package sax_test
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/sderkacs/go-exi/core"
+	"github.com/sderkacs/go-exi/sax"
+	"github.com/sderkacs/go-exi/utils"
+)
+
+func TestStringHandler(t *testing.T) {
+	factory := core.NewDefaultEXIFactory()
+	for _, feature := range []string{core.FeaturePrefix, core.FeatureComment, core.FeaturePI} {
+		if err := factory.GetFidelityOptions().SetFidelity(feature, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exi := encode(t, factory, `<!--c--><p:r xmlns:p="urn:p" a="1"><?pi data?><e p:b="2">text</e></p:r>`)
+
+	handler := sax.NewStringHandler()
+	if err := sax.Decode(factory, bytes.NewReader(exi), handler); err != nil {
+		t.Fatal(err)
+	}
+	want := `SD
+CM "c"
+NS p=urn:p
+SE p:r
+  AT a="1"
+  PI pi "data"
+  SE e
+    AT p:b="2"
+    CH "text"
+  EE e
+EE p:r
+ED
+`
+	if got := handler.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+// typeHandler records the value types of characters and attributes and
+// fails on the element named stop.
+type typeHandler struct {
+	sax.DefaultHandler
+	types []core.ValueType
+}
+
+var errStop = errors.New("stop")
+
+func (h *typeHandler) StartElement(name utils.QName, attributes []sax.Attribute) error {
+	if name.Local == "stop" {
+		return errStop
+	}
+	for _, at := range attributes {
+		h.types = append(h.types, at.Value.GetValueType())
+	}
+	return nil
+}
+
+func (h *typeHandler) Characters(value core.Value) error {
+	h.types = append(h.types, value.GetValueType())
+	return nil
+}
+
+func TestDecodeTypedValues(t *testing.T) {
+	factory := schemaFactory(t, `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema">
+<xs:element name="r"><xs:complexType><xs:sequence>
+  <xs:element name="i" type="xs:int"/>
+  <xs:element name="b" type="xs:boolean"/>
+  <xs:element name="stop" minOccurs="0"/>
+</xs:sequence><xs:attribute name="d" type="xs:decimal"/></xs:complexType></xs:element></xs:schema>`)
+
+	handler := &typeHandler{}
+	if err := sax.Decode(factory, bytes.NewReader(encode(t, factory, `<r d="1.5"><i>42</i><b>true</b></r>`)), handler); err != nil {
+		t.Fatal(err)
+	}
+	want := []core.ValueType{core.ValueTypeDecimal, core.ValueTypeInteger, core.ValueTypeBoolean}
+	if !slices.Equal(handler.types, want) {
+		t.Errorf("value types %v, want %v", handler.types, want)
+	}
+
+	// handler errors abort decoding
+	err := sax.Decode(factory, bytes.NewReader(encode(t, factory, `<r><i>1</i><b>0</b><stop/></r>`)), &typeHandler{})
+	if !errors.Is(err, errStop) {
+		t.Errorf("error %v, want %v", err, errStop)
+	}
+}
@@ -0,0 +1,236 @@
+package sax_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/sderkacs/go-exi/core"
+	"github.com/sderkacs/go-exi/sax"
+	"github.com/sderkacs/go-exi/utils"
+)
+
+// nested returns depth elements e nested in each other.
+func nested(depth int) string {
+	return strings.Repeat("<e>", depth) + "x" + strings.Repeat("</e>", depth)
+}
+
+func decode(factory core.EXIFactory, exi []byte) error {
+	return sax.DecodeXML(factory, bytes.NewReader(exi), io.Discard)
+}
+
+// countingReader counts the bytes read from reader.
+type countingReader struct {
+	reader io.Reader
+	n      int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.n += n
+	return n, err
+}
+
+func TestDecodeXMLWithLimit(t *testing.T) {
+	factory := core.NewDefaultEXIFactory()
+	doc := `<r><e>value</e><e>value</e></r>`
+	exi := encode(t, factory, doc)
+
+	var out bytes.Buffer
+	if err := sax.DecodeXMLWithLimit(factory, bytes.NewReader(exi), &out, 1<<20); err != nil {
+		t.Fatalf("unlimited: %v", err)
+	}
+	size := int64(out.Len())
+
+	out.Reset()
+	if err := sax.DecodeXMLWithLimit(factory, bytes.NewReader(exi), &out, size); err != nil {
+		t.Errorf("limit %d: %v", size, err)
+	}
+
+	for _, limit := range []int64{0, size - 1} {
+		out.Reset()
+		err := sax.DecodeXMLWithLimit(factory, bytes.NewReader(exi), &out, limit)
+		if !errors.Is(err, sax.ErrOutputLimitExceeded) {
+			t.Errorf("limit %d: got %v, want ErrOutputLimitExceeded", limit, err)
+		}
+		if int64(out.Len()) > limit {
+			t.Errorf("limit %d: %d bytes written", limit, out.Len())
+		}
+	}
+
+	if err := sax.DecodeXMLWithLimit(factory, bytes.NewReader(exi), io.Discard, -1); err == nil {
+		t.Error("limit -1: want error")
+	}
+}
+
+func TestDecodeXMLWithLimitExpansion(t *testing.T) {
+	factory := core.NewDefaultEXIFactory()
+	value := strings.Repeat("x", 5000)
+
+	// a small stream of string table hits expanding to 1MB of XML
+	exi := encode(t, factory, "<r>"+strings.Repeat("<e>"+value+"</e>", 200)+"</r>")
+	if len(exi) > 6000 {
+		t.Fatalf("%d bytes of EXI", len(exi))
+	}
+	var out bytes.Buffer
+	err := sax.DecodeXMLWithLimit(factory, bytes.NewReader(exi), &out, 64<<10)
+	if !errors.Is(err, sax.ErrOutputLimitExceeded) || out.Len() > 64<<10 {
+		t.Errorf("error %v, %d bytes written", err, out.Len())
+	}
+
+	// decoding stops at the limit instead of consuming the whole stream
+	var doc strings.Builder
+	doc.WriteString("<r>")
+	for i := range 200 {
+		fmt.Fprintf(&doc, "<e>%d%s</e>", i, value)
+	}
+	doc.WriteString("</r>")
+	exi = encode(t, factory, doc.String())
+	reader := &countingReader{reader: bytes.NewReader(exi)}
+	err = sax.DecodeXMLWithLimit(factory, reader, io.Discard, 64<<10)
+	if !errors.Is(err, sax.ErrOutputLimitExceeded) {
+		t.Errorf("distinct values: error %v", err)
+	}
+	if reader.n > len(exi)/4 {
+		t.Errorf("%d of %d bytes read after exceeding the limit", reader.n, len(exi))
+	}
+}
+
+func TestMaxElementDepth(t *testing.T) {
+	const maxDepth = 5
+
+	for _, sc := range []string{"none", "root", "all"} {
+		newFactory := func() core.EXIFactory {
+			factory := core.NewDefaultEXIFactory()
+			factory.SetCodingMode(core.CodingModeBytePacked)
+			switch sc {
+			case "root":
+				// a single self-contained fragment
+				factory.GetFidelityOptions().SetFidelity(core.FeatureSC, true)
+				factory.SetSelfContainedElements([]utils.QName{{Local: "r"}})
+			case "all":
+				// self-contained fragments nested in each other
+				factory.GetFidelityOptions().SetFidelity(core.FeatureSC, true)
+				factory.SetSelfContainedElements([]utils.QName{{Local: "e"}})
+			}
+			return factory
+		}
+
+		for _, depth := range []int{maxDepth - 1, 40} {
+			// Note: <r> adds one level
+			doc := "<r>" + nested(depth) + "</r>"
+			exi := encode(t, newFactory(), doc)
+
+			factory := newFactory()
+			factory.SetMaxElementDepth(maxDepth)
+			err := decode(factory, exi)
+			if depth < maxDepth && err != nil {
+				t.Errorf("sc=%s depth=%d: decode: %v", sc, depth+1, err)
+			}
+			if depth >= maxDepth && err == nil {
+				t.Errorf("sc=%s depth=%d: decode: want error", sc, depth+1)
+			}
+
+			err = sax.EncodeXML(factory, strings.NewReader(doc), io.Discard)
+			if depth < maxDepth && err != nil {
+				t.Errorf("sc=%s depth=%d: encode: %v", sc, depth+1, err)
+			}
+			if depth >= maxDepth && err == nil {
+				t.Errorf("sc=%s depth=%d: encode: want error", sc, depth+1)
+			}
+		}
+	}
+}
+
+func TestMaxElementDepthBoundary(t *testing.T) {
+	for _, sc := range []bool{false, true} {
+		for maxDepth := 1; maxDepth <= 4; maxDepth++ {
+			factory := core.NewDefaultEXIFactory()
+			if sc {
+				factory.GetFidelityOptions().SetFidelity(core.FeatureSC, true)
+				factory.SetSelfContainedElements([]utils.QName{{Local: "e"}})
+			}
+			exi := encode(t, factory, nested(4))
+
+			factory.SetMaxElementDepth(maxDepth)
+			err := decode(factory, exi)
+			if maxDepth < 4 && err == nil {
+				t.Errorf("sc=%v max=%d: want error for depth 4", sc, maxDepth)
+			}
+			if maxDepth == 4 && err != nil {
+				t.Errorf("sc=%v max=%d: %v", sc, maxDepth, err)
+			}
+		}
+	}
+}
+
+// TestMaxElementDepthHeaderOptions checks that a stream cannot escape the
+// limit by enabling self-contained elements in its header.
+func TestMaxElementDepthHeaderOptions(t *testing.T) {
+	factory := core.NewDefaultEXIFactory()
+	factory.GetFidelityOptions().SetFidelity(core.FeatureSC, true)
+	factory.SetSelfContainedElements([]utils.QName{{Local: "e"}})
+	if err := factory.GetEncodingOptions().SetOption(core.OptionIncludeOptions); err != nil {
+		t.Fatal(err)
+	}
+	exi := encode(t, factory, nested(40))
+
+	decoder := core.NewDefaultEXIFactory()
+	decoder.SetMaxElementDepth(5)
+	if err := decode(decoder, exi); err == nil {
+		t.Error("want error")
+	}
+}
+
+func TestStringTableLimits(t *testing.T) {
+	var sb strings.Builder
+	sb.WriteString(`<r xmlns:p="urn:p">`)
+	for i := range 10 {
+		fmt.Fprintf(&sb, `<n%d a="v%d">w%d</n%d>`, i, i, i, i)
+	}
+	sb.WriteString(`</r>`)
+	doc := sb.String()
+
+	exi := encode(t, core.NewDefaultEXIFactory(), doc)
+
+	tests := []struct {
+		name  string
+		limit func(f core.EXIFactory, n int)
+		// entries added by doc
+		entries int
+	}{
+		// r, a and n0..n9
+		{"local names", func(f core.EXIFactory, n int) { f.SetMaxLocalNamesPerURI(n) }, 12},
+		// v0..v9 and w0..w9
+		{"values", func(f core.EXIFactory, n int) { f.SetMaxValueEntries(n) }, 20},
+	}
+	for _, test := range tests {
+		factory := core.NewDefaultEXIFactory()
+		test.limit(factory, test.entries)
+		if err := decode(factory, exi); err != nil {
+			t.Errorf("%s: limit %d: %v", test.name, test.entries, err)
+		}
+
+		factory = core.NewDefaultEXIFactory()
+		test.limit(factory, test.entries-1)
+		if err := decode(factory, exi); err == nil {
+			t.Errorf("%s: limit %d: want error", test.name, test.entries-1)
+		}
+	}
+
+	// prefixes are only part of the stream if preserved
+	factory := core.NewDefaultEXIFactory()
+	factory.GetFidelityOptions().SetFidelity(core.FeaturePrefix, true)
+	exi = encode(t, factory, `<p:r xmlns:p="urn:p" xmlns:q="urn:p"><q:e/></p:r>`)
+	factory.SetMaxPrefixesPerURI(2)
+	if err := decode(factory, exi); err != nil {
+		t.Errorf("prefixes: limit 2: %v", err)
+	}
+	factory.SetMaxPrefixesPerURI(1)
+	if err := decode(factory, exi); err == nil {
+		t.Errorf("prefixes: limit 1: want error")
+	}
+}
@@ -0,0 +1,94 @@
+package sax_test
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/sderkacs/go-exi/core"
+)
+
+// decodeRecovering decodes exi, recovering from errors, and returns the
+// characters of msg elements.
+func decodeRecovering(t *testing.T, factory core.EXIFactory, exi []byte) (messages []string, recoveries int) {
+	t.Helper()
+	streamDecoder, err := factory.CreateEXIStreamDecoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder, err := streamDecoder.DecodeHeader(bufio.NewReader(bytes.NewReader(exi)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var element string
+	for {
+		ev, exists, err := decoder.DecodeEvent()
+		if err != nil {
+			recoveries++
+			if recoveries > 10 {
+				t.Fatalf("too many recoveries")
+			}
+			if err := decoder.RecoverToNextElement(); err != nil {
+				return messages, recoveries
+			}
+			continue
+		}
+		if !exists {
+			return messages, recoveries
+		}
+		switch ev.EventType {
+		case core.EventTypeStartElement, core.EventTypeStartElementGeneric, core.EventTypeStartElementGenericUndeclared:
+			element = ev.QNameContext.GetLocalName()
+		case core.EventTypeCharacters, core.EventTypeCharactersGeneric, core.EventTypeCharactersGenericUndeclared:
+			if element == "msg" {
+				s, _ := ev.Value.ToString()
+				messages = append(messages, s)
+			}
+		}
+	}
+}
+
+func TestRecoverToNextElement(t *testing.T) {
+	const schema = `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema">
+<xs:element name="log"><xs:complexType><xs:sequence>
+  <xs:element name="rec" maxOccurs="unbounded"><xs:complexType><xs:sequence>
+    <xs:element name="id" type="xs:int"/>
+    <xs:element name="msg" type="xs:string"/>
+  </xs:sequence></xs:complexType></xs:element>
+</xs:sequence></xs:complexType></xs:element></xs:schema>`
+
+	var sb strings.Builder
+	sb.WriteString("<log>")
+	var want []string
+	for i := 1; i <= 6; i++ {
+		msg := fmt.Sprintf("message number %d", i)
+		fmt.Fprintf(&sb, "<rec><id>%d</id><msg>%s</msg></rec>", i, msg)
+		want = append(want, msg)
+	}
+	sb.WriteString("</log>")
+
+	factory := schemaFactory(t, schema)
+	factory.SetCodingMode(core.CodingModeBytePacked)
+	exi := encode(t, factory, sb.String())
+
+	// the length of the second message covers part of the third record
+	second := bytes.Index(exi, []byte(want[1])) - 1
+	corrupt := slices.Clone(exi)
+	corrupt[second] = 0x30
+	got, recoveries := decodeRecovering(t, factory, corrupt)
+	if recoveries == 0 {
+		t.Fatal("corrupt stream decoded without errors")
+	}
+	// Note: recovery is a heuristic, records after the corrupt one may be
+	// lost as well
+	if len(got) < 3 || got[0] != want[0] || !slices.Equal(got[len(got)-2:], want[4:]) {
+		t.Errorf("got messages %q, want %q, ..., %q", got, want[0], want[4:])
+	}
+
+	if got, recoveries := decodeRecovering(t, factory, exi); recoveries != 0 || !slices.Equal(got, want) {
+		t.Errorf("intact stream: got messages %q after %d recoveries", got, recoveries)
+	}
+}
@@ -0,0 +1,833 @@
+package sax_test
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/sderkacs/go-exi/core"
+	"github.com/sderkacs/go-exi/sax"
+	"github.com/sderkacs/go-exi/utils"
+	"github.com/sderkacs/go-exi/xsd"
+)
+
+// encode returns the EXI stream of doc, failing the test on errors.
+func encode(t *testing.T, factory core.EXIFactory, doc string) []byte {
+	t.Helper()
+	var exi bytes.Buffer
+	if err := sax.EncodeXML(factory, strings.NewReader(doc), &exi); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	return exi.Bytes()
+}
+
+// roundTrip encodes doc with factory and returns the decoded XML document.
+func roundTrip(t *testing.T, factory core.EXIFactory, doc string) string {
+	t.Helper()
+	exi := encode(t, factory, doc)
+	var out bytes.Buffer
+	if err := sax.DecodeXML(factory, bytes.NewReader(exi), &out); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	return out.String()
+}
+
+// events returns the elements, attributes and characters of doc in a form
+// that does not depend on prefixes, namespace declarations and attribute
+// order.
+func events(t *testing.T, doc string) []string {
+	t.Helper()
+	var evs []string
+	d := xml.NewDecoder(strings.NewReader(doc))
+	for {
+		token, err := d.Token()
+		if errors.Is(err, io.EOF) {
+			return evs
+		}
+		if err != nil {
+			t.Fatalf("parse %s: %v", doc, err)
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			evs = append(evs, fmt.Sprintf("SE {%s}%s", token.Name.Space, token.Name.Local))
+			var ats []string
+			for _, attr := range token.Attr {
+				if attr.Name.Space != "xmlns" && attr.Name.Local != "xmlns" {
+					ats = append(ats, fmt.Sprintf("AT {%s}%s=%s", attr.Name.Space, attr.Name.Local, attr.Value))
+				}
+			}
+			slices.Sort(ats)
+			evs = append(evs, ats...)
+		case xml.EndElement:
+			evs = append(evs, "EE")
+		case xml.CharData:
+			evs = append(evs, "CH "+string(token))
+		}
+	}
+}
+
+// assertRoundTrip checks that doc survives encoding and decoding with
+// factory.
+func assertRoundTrip(t *testing.T, factory core.EXIFactory, doc string) {
+	t.Helper()
+	got := roundTrip(t, factory, doc)
+	if want, have := events(t, doc), events(t, got); !slices.Equal(want, have) {
+		t.Errorf("round trip of %s:\n got %q\nwant %q", doc, have, want)
+	}
+}
+
+func TestSchemaLessRoundTrip(t *testing.T) {
+	docs := []string{
+		`<r/>`,
+		`<r a="1" b="two"><e>text</e><e/><e>more text</e></r>`,
+		`<r>mixed <b>bold</b> content</r>`,
+		`<r><e><e><e>deep</e></e></e><f g="h"/></r>`,
+		`<a:r xmlns:a="urn:a"><b:e xmlns:b="urn:b" b:x="1" y="2"><c xmlns="urn:c" a:z="3"/></b:e><a:e/></a:r>`,
+		`<r><e xmlns="urn:d"><f/></e><g xmlns:h="urn:h" h:i="j"/></r>`,
+	}
+	for _, mode := range []core.CodingMode{core.CodingModeBitPacked, core.CodingModeBytePacked, core.CodingModeCompression} {
+		for _, doc := range docs {
+			factory := core.NewDefaultEXIFactory()
+			factory.SetCodingMode(mode)
+			assertRoundTrip(t, factory, doc)
+		}
+	}
+}
+
+func TestDecodeXMLPreservedPrefixes(t *testing.T) {
+	factory := core.NewDefaultEXIFactory()
+	for _, feature := range []string{core.FeatureComment, core.FeaturePI, core.FeaturePrefix} {
+		if err := factory.GetFidelityOptions().SetFidelity(feature, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// namespaces are declared on the elements that declared them in the
+	// original document, comments and processing instructions are kept
+	doc := `<a:r xmlns:a="urn:a" xmlns:b="urn:b"><!-- c --><b:e x="1"><?pi data?>t</b:e><a:e/><f xmlns="urn:c"><g/></f></a:r>`
+	want := `<a:r xmlns:a="urn:a" xmlns:b="urn:b"><!-- c --><b:e x="1"><?pi data?>t</b:e><a:e></a:e><f xmlns="urn:c"><g></g></f></a:r>`
+	if got := roundTrip(t, factory, doc); got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+}
+
+func TestPreferredPrefixes(t *testing.T) {
+	doc := `<s:Envelope xmlns:s="urn:soap" xmlns:x="urn:x"><s:Body><x:op/></s:Body></s:Envelope>`
+	factory := core.NewDefaultEXIFactory()
+	factory.SetPreferredPrefixes(map[string]string{"urn:soap": "soap"})
+
+	got := roundTrip(t, factory, doc)
+	for _, name := range []string{"<soap:Envelope", "<soap:Body", "</soap:Body>", "</soap:Envelope>"} {
+		if !strings.Contains(got, name) {
+			t.Errorf("%s lacks %s", got, name)
+		}
+	}
+	// namespaces without preferred prefix keep their generated one
+	if strings.Contains(got, "<x:op") || !strings.Contains(got, ":op") {
+		t.Errorf("%s: unexpected prefix of op", got)
+	}
+
+	// the decoder keeps them for streams with an options header
+	if err := factory.GetEncodingOptions().SetOption(core.OptionIncludeOptions); err != nil {
+		t.Fatal(err)
+	}
+	if got := roundTrip(t, factory, doc); !strings.Contains(got, "<soap:Envelope") {
+		t.Errorf("options header: %s lacks <soap:Envelope", got)
+	}
+}
+
+func TestGeneratedRootPrefix(t *testing.T) {
+	// the EXI options document is in the schema target namespace
+	doc := `<header xmlns="http://www.w3.org/2009/exi"><lesscommon><uncommon>` +
+		`<alignment><byte/></alignment></uncommon></lesscommon><strict/></header>`
+	newFactory := func(preferred map[string]string) core.EXIFactory {
+		grammars, err := core.NewEXIOptionsHeaderGrammars()
+		if err != nil {
+			t.Fatal(err)
+		}
+		factory := core.NewDefaultEXIFactory()
+		factory.SetGrammars(grammars)
+		if preferred != nil {
+			factory.SetPreferredPrefixes(preferred)
+		}
+		return factory
+	}
+
+	for _, preferred := range []map[string]string{nil, {"http://www.w3.org/2009/exi": "exi"}} {
+		got := roundTrip(t, newFactory(preferred), doc)
+		start, _, _ := strings.Cut(got, ">")
+		prefix, _, ok := strings.Cut(strings.TrimPrefix(start, "<"), ":header ")
+		if !ok {
+			t.Fatalf("root of %s has no prefix", got)
+		}
+		if preferred != nil && prefix != "exi" {
+			t.Errorf("root of %s does not use the preferred prefix", got)
+		}
+		if !strings.Contains(start, ` xmlns:`+prefix+`="http://www.w3.org/2009/exi"`) {
+			t.Errorf("root of %s does not declare %s", got, prefix)
+		}
+		if strings.Count(got, "<"+prefix+":") != 6 || strings.Count(got, "xmlns:"+prefix+"=") != 1 {
+			t.Errorf("descendants of %s do not share the prefix %s", got, prefix)
+		}
+		assertRoundTrip(t, newFactory(preferred), doc)
+	}
+}
+
+// schemaFactory returns a factory informed by the given XML schema.
+func schemaFactory(t *testing.T, schema string) core.EXIFactory {
+	t.Helper()
+	grammars, err := xsd.CreateGrammars(strings.NewReader(schema), "test")
+	if err != nil {
+		t.Fatalf("schema: %v", err)
+	}
+	factory := core.NewDefaultEXIFactory()
+	factory.SetGrammars(grammars)
+	return factory
+}
+
+const orderSchema = `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema"
+	xmlns="urn:order" targetNamespace="urn:order" elementFormDefault="qualified">
+	<xs:element name="order">
+		<xs:complexType>
+			<xs:sequence>
+				<xs:element name="created" type="xs:dateTime"/>
+				<xs:element name="item" type="Item" maxOccurs="unbounded"/>
+				<xs:choice>
+					<xs:element name="paid" type="xs:boolean"/>
+					<xs:element name="note" type="xs:string"/>
+				</xs:choice>
+				<xs:element name="tags" minOccurs="0">
+					<xs:simpleType>
+						<xs:list itemType="xs:int"/>
+					</xs:simpleType>
+				</xs:element>
+				<xs:element ref="extra" minOccurs="0"/>
+				<xs:any namespace="##other" processContents="lax" minOccurs="0"/>
+			</xs:sequence>
+			<xs:attribute name="id" type="xs:long" use="required"/>
+		</xs:complexType>
+	</xs:element>
+	<xs:element name="extra" type="xs:string"/>
+	<xs:element name="bonus" type="xs:string" substitutionGroup="extra"/>
+	<xs:complexType name="Item">
+		<xs:sequence>
+			<xs:element name="price" type="xs:decimal"/>
+			<xs:element name="weight" type="xs:double" minOccurs="0"/>
+			<xs:element name="empty" minOccurs="0" nillable="true">
+				<xs:complexType/>
+			</xs:element>
+		</xs:sequence>
+		<xs:attribute name="size" type="Size"/>
+		<xs:attribute name="count" type="Count"/>
+	</xs:complexType>
+	<xs:complexType name="GiftItem">
+		<xs:complexContent>
+			<xs:extension base="Item">
+				<xs:sequence>
+					<xs:element name="message" type="xs:string"/>
+				</xs:sequence>
+			</xs:extension>
+		</xs:complexContent>
+	</xs:complexType>
+	<xs:simpleType name="Size">
+		<xs:restriction base="xs:string">
+			<xs:enumeration value="S"/>
+			<xs:enumeration value="M"/>
+			<xs:enumeration value="L"/>
+		</xs:restriction>
+	</xs:simpleType>
+	<xs:simpleType name="Count">
+		<xs:restriction base="xs:int">
+			<xs:minInclusive value="1"/>
+			<xs:maxInclusive value="100"/>
+		</xs:restriction>
+	</xs:simpleType>
+</xs:schema>`
+
+func TestSchemaInformedRoundTrip(t *testing.T) {
+	// want is the canonical form of doc, or empty if doc is canonical
+	tests := []struct {
+		doc, want string
+	}{
+		{doc: `<order xmlns="urn:order" id="1"><created>2024-02-29T12:30:00Z</created><item><price>9.99</price></item><paid>true</paid></order>`},
+		{
+			doc: `<order xmlns="urn:order" id="-90000"><created>2024-01-01T00:00:00.5</created>` +
+				`<item size="S" count="1"><price>0.5</price><weight>1.5E1</weight></item>` +
+				`<item size="L" count="100"><price>100</price><empty/></item>` +
+				`<note>no payment</note><tags>1 -2 3</tags><extra>x</extra></order>`,
+			want: `<order xmlns="urn:order" id="-90000"><created>2024-01-01T00:00:00.5</created>` +
+				`<item size="S" count="1"><price>0.5</price><weight>15E0</weight></item>` +
+				`<item size="L" count="100"><price>100.0</price><empty/></item>` +
+				`<note>no payment</note><tags>1 -2 3</tags><extra>x</extra></order>`,
+		},
+		{
+			doc: `<order xmlns="urn:order" id="2"><created>2024-01-01T00:00:00</created>` +
+				`<item><price>1.0</price><empty xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:nil="true"/></item>` +
+				`<paid>false</paid><bonus>y</bonus><any a="b">text</any></order>`,
+		},
+		{
+			doc: `<order xmlns="urn:order" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" id="3"><created>2024-01-01T00:00:00Z</created>` +
+				`<item xsi:type="GiftItem" size="M"><price>2.0</price><message>hi</message></item><paid>true</paid></order>`,
+			want: `<order xmlns="urn:order" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" id="3"><created>2024-01-01T00:00:00Z</created>` +
+				`<item xsi:type="ns4:GiftItem" size="M"><price>2.0</price><message>hi</message></item><paid>true</paid></order>`,
+		},
+		{doc: `<order xmlns="urn:order" id="4"><created>2024-01-01T00:00:00Z</created><item><price>-0.5</price></item><item><price>-1.25</price></item><paid>true</paid></order>`},
+		{doc: `<order xmlns="urn:order" id="-9000000000"><created>2024-01-01T00:00:00Z</created><item><price>1</price></item><paid>true</paid></order>`,
+			want: `<order xmlns="urn:order" id="-9000000000"><created>2024-01-01T00:00:00Z</created><item><price>1.0</price></item><paid>true</paid></order>`},
+		{doc: `<order xmlns="urn:order" id="5"><created>2024-06-30T23:59:59.125+02:00</created><item><price>1.0</price></item><paid>true</paid></order>`},
+		{doc: `<order xmlns="urn:order" id="6"><created>2024-01-01T00:00:00Z</created><item><price>1.0</price></item><paid>true</paid>` +
+			`<o:any xmlns:o="urn:other" o:a="1"><o:e>x</o:e></o:any></order>`},
+	}
+	for _, mode := range []core.CodingMode{core.CodingModeBitPacked, core.CodingModeBytePacked, core.CodingModeCompression} {
+		factory := schemaFactory(t, orderSchema)
+		factory.SetCodingMode(mode)
+		for _, test := range tests {
+			want := test.want
+			if want == "" {
+				want = test.doc
+			}
+			got := roundTrip(t, factory, test.doc)
+			if have, want := events(t, got), events(t, want); !slices.Equal(have, want) {
+				t.Errorf("mode %d: round trip of %s:\n got %q\nwant %q", mode, test.doc, have, want)
+			}
+		}
+	}
+
+	// typed values are smaller than strings in the schema-less encoding
+	schemaInformed := encode(t, schemaFactory(t, orderSchema), tests[1].doc)
+	schemaLess := encode(t, core.NewDefaultEXIFactory(), tests[1].doc)
+	if len(schemaInformed) >= len(schemaLess) {
+		t.Errorf("schema-informed %d bytes, schema-less %d bytes", len(schemaInformed), len(schemaLess))
+	}
+}
+
+// TestMaxIntegerDigitsHeaderOptions checks that the integer digit limit of
+// the decoder also applies to streams with an options header.
+func TestMaxIntegerDigitsHeaderOptions(t *testing.T) {
+	const schema = `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema">
+<xs:element name="i" type="xs:integer"/></xs:schema>`
+	factory := schemaFactory(t, schema)
+	if err := factory.GetEncodingOptions().SetOption(core.OptionIncludeOptions); err != nil {
+		t.Fatal(err)
+	}
+	exi := encode(t, factory, "<i>123456789012345678901234567890</i>")
+
+	for _, test := range []struct {
+		maxDigits int
+		ok        bool
+	}{
+		{30, true},
+		{20, false},
+	} {
+		decoder := schemaFactory(t, schema)
+		decoder.SetMaxIntegerDigits(test.maxDigits)
+		err := sax.DecodeXML(decoder, bytes.NewReader(exi), io.Discard)
+		if test.ok && err != nil {
+			t.Errorf("%d digits: %v", test.maxDigits, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%d digits: want error", test.maxDigits)
+		}
+	}
+}
+
+func TestSchemaInformedSpecificationStreams(t *testing.T) {
+	// <r>t</r> with a global element r of type xs:string and default
+	// options, worked out by hand from the EXI 1.0 specification: header
+	// 10 0 00000, SE(r) (0 of SE(r), SE(*)), CH (0 of CH and the escape to
+	// undeclared productions) with value miss "t", EE (0 of EE and the
+	// escape). Pre-compression has the byte-aligned structure channel,
+	// followed by the value channel of r.
+	const schema = `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema">
+<xs:element name="r" type="xs:string"/></xs:schema>`
+	const doc = "<r>t</r>"
+	tests := []struct {
+		mode core.CodingMode
+		exi  []byte
+	}{
+		{core.CodingModeBitPacked, []byte{0x80, 0x00, 0xdd, 0x00}},
+		{core.CodingModeBytePacked, []byte{0x80, 0x00, 0x00, 0x03, 0x74, 0x00}},
+		{core.CodingModePreCompression, []byte{0x80, 0x00, 0x00, 0x00, 0x03, 0x74}},
+	}
+	for _, test := range tests {
+		factory := schemaFactory(t, schema)
+		factory.SetCodingMode(test.mode)
+		if exi := encode(t, factory, doc); !bytes.Equal(exi, test.exi) {
+			t.Errorf("mode %d: encoded % x, want % x", test.mode, exi, test.exi)
+		}
+		var out bytes.Buffer
+		if err := sax.DecodeXML(factory, bytes.NewReader(test.exi), &out); err != nil {
+			t.Fatalf("mode %d: %v", test.mode, err)
+		}
+		if got, want := events(t, out.String()), events(t, doc); !slices.Equal(got, want) {
+			t.Errorf("mode %d: decoded %q, want %q", test.mode, got, want)
+		}
+	}
+}
+
+func TestNonEvolvingGrammarsProfile(t *testing.T) {
+	const schema = `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema">
+<xs:element name="r" type="xs:string"/></xs:schema>`
+	// x is undeclared and gets the schema-informed element fragment grammar,
+	// which is not a built-in grammar to be counted
+	for _, maxElementGrammars := range []int{-1, 0} {
+		factory := schemaFactory(t, schema)
+		factory.SetUsingNonEvolvingGrammars(true)
+		factory.SetMaximumNumberOfBuiltInProductions(0)
+		factory.SetMaximumNumberOfBuiltInElementGrammars(maxElementGrammars)
+		assertRoundTrip(t, factory, "<x>t</x>")
+	}
+}
+
+func TestSchemaInformedList(t *testing.T) {
+	factory := schemaFactory(t, `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema">
+		<xs:element name="r">
+			<xs:complexType>
+				<xs:sequence>
+					<xs:element name="ints" type="Ints"/>
+					<xs:element name="names" type="Names"/>
+				</xs:sequence>
+			</xs:complexType>
+		</xs:element>
+		<xs:simpleType name="Ints">
+			<xs:list itemType="xs:int"/>
+		</xs:simpleType>
+		<xs:simpleType name="Names">
+			<xs:list itemType="xs:string"/>
+		</xs:simpleType>
+	</xs:schema>`)
+	// list items are separated by single spaces, without trailing delimiter
+	for _, doc := range []string{
+		`<r><ints>1 -2 300</ints><names>a bc</names></r>`,
+		`<r><ints>7</ints><names>a</names></r>`,
+		`<r><ints></ints><names></names></r>`,
+	} {
+		for _, mode := range []core.CodingMode{core.CodingModeBitPacked, core.CodingModeCompression} {
+			factory.SetCodingMode(mode)
+			got := roundTrip(t, factory, doc)
+			if have, want := events(t, got), events(t, doc); !slices.Equal(have, want) {
+				t.Errorf("mode %d: round trip of %s:\n got %q\nwant %q", mode, doc, have, want)
+			}
+		}
+	}
+}
+
+func TestSchemaIncludeImport(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"main.xsd": `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema" xmlns:a="urn:a"
+			targetNamespace="urn:m" elementFormDefault="qualified">
+			<xs:include schemaLocation="types/included.xsd"/>
+			<xs:import namespace="urn:a" schemaLocation="types/imported.xsd"/>
+			<xs:element name="r">
+				<xs:complexType>
+					<xs:sequence>
+						<xs:element name="n" type="xs:int"/>
+						<xs:element ref="a:v"/>
+					</xs:sequence>
+				</xs:complexType>
+			</xs:element>
+		</xs:schema>`,
+		// relative to the including schema, without target namespace
+		"types/included.xsd": `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema">
+			<xs:element name="i" type="xs:boolean"/>
+		</xs:schema>`,
+		"types/imported.xsd": `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema" targetNamespace="urn:a">
+			<xs:element name="v" type="xs:double"/>
+		</xs:schema>`,
+	}
+	for name, schema := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(schema), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	grammars, err := xsd.CreateGrammarsFromFile(filepath.Join(dir, "main.xsd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	factory := core.NewDefaultEXIFactory()
+	factory.SetGrammars(grammars)
+	assertRoundTrip(t, factory, `<r xmlns="urn:m"><n>42</n><v xmlns="urn:a">1E0</v></r>`)
+	assertRoundTrip(t, factory, `<i xmlns="urn:m">true</i>`)
+
+	if _, err := xsd.CreateGrammarsFromFile(filepath.Join(dir, "missing.xsd")); err == nil {
+		t.Error("missing schema: want error")
+	}
+}
+
+func TestSchemaIDResolvers(t *testing.T) {
+	const doc = `<order xmlns="urn:order" id="1"><created>2024-02-29T12:30:00Z</created><item><price>9.99</price></item><paid>true</paid></order>`
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "order.xsd"), []byte(orderSchema), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// encodeWithID returns doc encoded with a header carrying schemaID
+	encodeWithID := func(schemaID string) []byte {
+		grammars, err := xsd.CreateGrammars(strings.NewReader(orderSchema), schemaID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		factory := core.NewDefaultEXIFactory()
+		factory.SetGrammars(grammars)
+		for _, option := range []string{core.OptionIncludeOptions, core.OptionIncludeSchemaID} {
+			if err := factory.GetEncodingOptions().SetOption(option); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return encode(t, factory, doc)
+	}
+
+	registered, err := xsd.CreateGrammars(strings.NewReader(orderSchema), "order")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapResolver := core.NewMapSchemaIDResolver()
+	mapResolver.Register("order", registered)
+	resolvers := map[string]core.SchemaIDResolver{
+		"map":       mapResolver,
+		"directory": xsd.NewDirectorySchemaIDResolver(dir),
+	}
+	for name, resolver := range resolvers {
+		// the decoding factory has no grammars of its own
+		factory := core.NewDefaultEXIFactory()
+		factory.SetSchemaIDResolver(resolver)
+		var out bytes.Buffer
+		if err := sax.DecodeXML(factory, bytes.NewReader(encodeWithID("order")), &out); err != nil {
+			t.Errorf("%s: decode: %v", name, err)
+		} else if want, got := events(t, doc), events(t, out.String()); !slices.Equal(got, want) {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+
+		for _, schemaID := range []string{"unknown", "../order"} {
+			err := sax.DecodeXML(factory, bytes.NewReader(encodeWithID(schemaID)), io.Discard)
+			if err == nil || !strings.Contains(err.Error(), "unknown schema ID '"+schemaID+"'") {
+				t.Errorf("%s: schema ID %s: error %v", name, schemaID, err)
+			}
+		}
+	}
+}
+
+func TestCrossNamespaceLocalNames(t *testing.T) {
+	// same local-names in two namespaces, interleaved
+	doc := `<a:foo xmlns:a="urn:a" xmlns:b="urn:b" a:x="1" b:x="2">` +
+		`<b:foo a:x="3"><a:foo b:x="4">a</a:foo></b:foo><a:foo>b</a:foo><b:foo>c</b:foo></a:foo>`
+	for _, mode := range []core.CodingMode{core.CodingModeBitPacked, core.CodingModeBytePacked, core.CodingModePreCompression, core.CodingModeCompression} {
+		for _, prefixes := range []bool{true, false} {
+			factory := core.NewDefaultEXIFactory()
+			factory.SetCodingMode(mode)
+			if err := factory.GetFidelityOptions().SetFidelity(core.FeaturePrefix, prefixes); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := decodedEvents(t, factory, encode(t, factory, doc)), events(t, doc); !slices.Equal(got, want) {
+				t.Errorf("mode %d, prefixes %v:\n got %q\nwant %q", mode, prefixes, got, want)
+			}
+			assertRoundTrip(t, factory, doc)
+		}
+	}
+}
+
+func TestMultiLevelXsiType(t *testing.T) {
+	// C derives from B derives from A, e is declared as A
+	schema := `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema">
+		<xs:element name="root">
+			<xs:complexType>
+				<xs:sequence>
+					<xs:element name="e" type="A" maxOccurs="unbounded"/>
+				</xs:sequence>
+			</xs:complexType>
+		</xs:element>
+		<xs:complexType name="A">
+			<xs:sequence>
+				<xs:element name="a" type="xs:int"/>
+			</xs:sequence>
+			<xs:attribute name="x" type="xs:string"/>
+		</xs:complexType>
+		<xs:complexType name="B">
+			<xs:complexContent>
+				<xs:extension base="A">
+					<xs:sequence>
+						<xs:element name="b" type="xs:boolean"/>
+					</xs:sequence>
+				</xs:extension>
+			</xs:complexContent>
+		</xs:complexType>
+		<xs:complexType name="C">
+			<xs:complexContent>
+				<xs:extension base="B">
+					<xs:sequence>
+						<xs:element name="c" type="xs:date"/>
+					</xs:sequence>
+					<xs:attribute name="y" type="xs:int"/>
+				</xs:extension>
+			</xs:complexContent>
+		</xs:complexType>
+	</xs:schema>`
+	doc := `<root xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">` +
+		`<e xsi:type="C" x="1" y="2"><a>1</a><b>true</b><c>2024-01-02</c></e>` +
+		`<e xsi:type="B"><a>2</a><b>false</b></e><e x="3"><a>3</a></e></root>`
+	for _, mode := range []core.CodingMode{core.CodingModeBitPacked, core.CodingModeCompression} {
+		for _, strict := range []bool{false, true} {
+			factory := schemaFactory(t, schema)
+			factory.SetCodingMode(mode)
+			if err := factory.GetFidelityOptions().SetFidelity(core.FeatureStrict, strict); err != nil {
+				t.Fatal(err)
+			}
+			assertRoundTrip(t, factory, doc)
+
+			// the content of B needs xsi:type in strict mode
+			if strict {
+				invalid := `<root><e><a>1</a><b>true</b></e></root>`
+				if err := sax.EncodeXML(factory, strings.NewReader(invalid), io.Discard); err == nil {
+					t.Errorf("mode %d: B content without xsi:type encoded in strict mode", mode)
+				}
+			}
+		}
+	}
+}
+
+func TestPrefixPreservationNamespaces(t *testing.T) {
+	doc := `<a:r xmlns:a="urn:a" xmlns:b="urn:b" b:x="1"><b:e a:y="2">t</b:e><a:e/></a:r>`
+	factory := core.NewDefaultEXIFactory()
+	if err := factory.GetFidelityOptions().SetFidelity(core.FeaturePrefix, true); err != nil {
+		t.Fatal(err)
+	}
+	factory.SetPrefixPreservationNamespaces([]string{"urn:a"})
+	got := roundTrip(t, factory, doc)
+	if have, want := events(t, got), events(t, doc); !slices.Equal(have, want) {
+		t.Errorf("got %q, want %q", have, want)
+	}
+	if !strings.Contains(got, `<a:r xmlns:a="urn:a"`) || strings.Contains(got, "b:") {
+		t.Errorf("prefix a preserved, b replaced: %s", got)
+	}
+
+	// without restriction all prefixes are preserved
+	factory.SetPrefixPreservationNamespaces(nil)
+	if got := roundTrip(t, factory, doc); !strings.Contains(got, `<b:e a:y="2">`) {
+		t.Errorf("all prefixes preserved: %s", got)
+	}
+}
+
+func TestDurationRoundTrip(t *testing.T) {
+	factory := schemaFactory(t, `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema">
+<xs:element name="d" type="xs:duration"/></xs:schema>`)
+	factory.SetDatatypeRepresentationMap(&[]utils.QName{core.XsdDuration}, &[]utils.QName{core.DurationRepresentation})
+
+	for _, value := range []string{
+		"P1Y2M3DT4H5M6.7S",
+		"-PT1M",
+		"P10000DT0.001S",
+		"P34359738368Y",
+		"P99999999999Y",
+		"P123456789012345678901234567890DT99999999999999999999H",
+	} {
+		assertRoundTrip(t, factory, "<d>"+value+"</d>")
+	}
+
+	// without the representation map durations are strings
+	plain := schemaFactory(t, `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema">
+<xs:element name="d" type="xs:duration"/></xs:schema>`)
+	doc := "<d>P1Y2M3DT4H5M6.7S</d>"
+	if typed, untyped := encode(t, factory, doc), encode(t, plain, doc); len(typed) >= len(untyped) {
+		t.Errorf("duration %d bytes, string %d bytes", len(typed), len(untyped))
+	}
+}
+
+func TestXsiNilAndXsiType(t *testing.T) {
+	xsi := ` xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance"`
+
+	// schema-less xsi:nil and xsi:type, learned in either order
+	schemaLess := `<r` + xsi + `><e xsi:nil="true" xsi:type="xsd:string" xmlns:xsd="http://www.w3.org/2001/XMLSchema"/>` +
+		`<e xsi:type="xsd:int" xmlns:xsd="http://www.w3.org/2001/XMLSchema">1</e><e xsi:nil="false">x</e><e xsi:nil="true"/></r>`
+	for _, lexical := range []bool{false, true} {
+		factory := core.NewDefaultEXIFactory()
+		if err := factory.GetFidelityOptions().SetFidelity(core.FeaturePrefix, true); err != nil {
+			t.Fatal(err)
+		}
+		if err := factory.GetFidelityOptions().SetFidelity(core.FeatureLexicalValue, lexical); err != nil {
+			t.Fatal(err)
+		}
+		assertRoundTrip(t, factory, schemaLess)
+	}
+
+	// xsi:nil on a non-nillable element is coded by AT(*) in strict mode
+	schema := `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema">
+		<xs:element name="r">
+			<xs:complexType>
+				<xs:sequence>
+					<xs:element name="e" type="xs:string" minOccurs="0" maxOccurs="unbounded"/>
+					<xs:element name="b" type="xs:boolean" minOccurs="0"/>
+				</xs:sequence>
+				<xs:anyAttribute processContents="skip"/>
+			</xs:complexType>
+		</xs:element>
+	</xs:schema>`
+	for _, lexical := range []bool{false, true} {
+		factory := schemaFactory(t, schema)
+		if err := factory.GetFidelityOptions().SetFidelity(core.FeatureStrict, !lexical); err != nil {
+			t.Fatal(err)
+		}
+		if err := factory.GetFidelityOptions().SetFidelity(core.FeatureLexicalValue, lexical); err != nil {
+			t.Fatal(err)
+		}
+		assertRoundTrip(t, factory, `<r`+xsi+` xsi:nil="true"/>`)
+		assertRoundTrip(t, factory, `<r><e>a</e><b>true</b></r>`)
+	}
+}
+
+func TestSchemaLessXsiType(t *testing.T) {
+	xsi := ` xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance"`
+	tests := []struct {
+		doc string
+		// the type QName of prefixed types, they need preserved prefixes
+		// with lexical values
+		qname string
+	}{
+		{`<r` + xsi + ` xsi:type="something"><e xsi:type="something">x</e></r>`, ""},
+		{`<r` + xsi + ` xmlns:p="urn:p" xsi:type="p:T"/>`, "{urn:p}T"},
+		{`<r` + xsi + ` xsi:type="q:unbound"/>`, "{}q:unbound"},
+		{`<r` + xsi + ` xsi:type=""/>`, ""},
+		{`<r` + xsi + `><e xsi:type="something" xsi:nil="true"/></r>`, ""},
+	}
+	for _, mode := range []core.CodingMode{core.CodingModeBitPacked, core.CodingModeBytePacked, core.CodingModeCompression} {
+		for _, prefixes := range []bool{false, true} {
+			for _, lexical := range []bool{false, true} {
+				factory := core.NewDefaultEXIFactory()
+				factory.SetCodingMode(mode)
+				if err := factory.GetFidelityOptions().SetFidelity(core.FeaturePrefix, prefixes); err != nil {
+					t.Fatal(err)
+				}
+				if err := factory.GetFidelityOptions().SetFidelity(core.FeatureLexicalValue, lexical); err != nil {
+					t.Fatal(err)
+				}
+				for _, test := range tests {
+					switch {
+					case test.qname != "" && !prefixes && lexical:
+						if err := sax.EncodeXML(factory, strings.NewReader(test.doc), io.Discard); err == nil {
+							t.Errorf("mode %d: %s encoded with lexical values but no preserved prefixes", mode, test.doc)
+						}
+					case test.qname != "" && !prefixes:
+						// the prefix is not preserved, the QName is
+						want := []string{"SE {}r", "AT {http://www.w3.org/2001/XMLSchema-instance}type=" + test.qname, "EE"}
+						if got := decodedEvents(t, factory, encode(t, factory, test.doc)); !slices.Equal(got, want) {
+							t.Errorf("mode %d: %s decoded as %q, want %q", mode, test.doc, got, want)
+						}
+					default:
+						assertRoundTrip(t, factory, test.doc)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestMinimalDocuments(t *testing.T) {
+	schema := `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema">
+	<xs:element name="c"><xs:complexType/></xs:element>
+	<xs:element name="s" type="xs:string"/>
+</xs:schema>`
+	// the strict grammar of a simple type has no EE before CH, so empty
+	// simple content is an empty CH
+	tests := []struct {
+		doc        string
+		want       []string
+		wantStrict []string
+	}{
+		{`<c/>`, []string{"SE {}c", "EE"}, []string{"SE {}c", "EE"}},
+		{`<s/>`, []string{"SE {}s", "EE"}, []string{"SE {}s", "CH ", "EE"}},
+		{`<s>text</s>`, []string{"SE {}s", "CH text", "EE"}, []string{"SE {}s", "CH text", "EE"}},
+	}
+	modes := []core.CodingMode{core.CodingModeBitPacked, core.CodingModeBytePacked, core.CodingModePreCompression, core.CodingModeCompression}
+	for _, mode := range modes {
+		for _, setting := range []string{"schema-less", "schema-informed", "strict"} {
+			var factory core.EXIFactory = core.NewDefaultEXIFactory()
+			if setting != "schema-less" {
+				factory = schemaFactory(t, schema)
+			}
+			factory.SetCodingMode(mode)
+			if err := factory.GetFidelityOptions().SetFidelity(core.FeatureStrict, setting == "strict"); err != nil {
+				t.Fatal(err)
+			}
+			for _, test := range tests {
+				assertRoundTrip(t, factory, test.doc)
+				want := test.want
+				if setting == "strict" {
+					want = test.wantStrict
+				}
+				if got := decodedEvents(t, factory, encode(t, factory, test.doc)); !slices.Equal(got, want) {
+					t.Errorf("mode %d, %s, %s: decoded %q, want %q", mode, setting, test.doc, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestSchemaInformedWhitespace(t *testing.T) {
+	schema := `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema">
+	<xs:element name="r"><xs:complexType><xs:sequence>
+		<xs:element name="s" type="xs:string"/>
+		<xs:element name="k" type="xs:token"/>
+		<xs:element name="m"><xs:complexType mixed="true"><xs:sequence>
+			<xs:element name="e" minOccurs="0" maxOccurs="unbounded"/>
+		</xs:sequence></xs:complexType></xs:element>
+	</xs:sequence></xs:complexType></xs:element>
+</xs:schema>`
+	// whitespace is pruned in element-only content, kept in strings and mixed
+	// content and collapsed in tokens
+	doc := "<r>\n\t<s> a  b </s>\n\t<k>ab   </k>\n\t<m>\n\t<e/> <e/>t</m>\n</r>"
+	want := "<r><s> a  b </s><k>ab</k><m>\n\t<e/> <e/>t</m></r>"
+	for _, strict := range []bool{false, true} {
+		factory := schemaFactory(t, schema)
+		if err := factory.GetFidelityOptions().SetFidelity(core.FeatureStrict, strict); err != nil {
+			t.Fatal(err)
+		}
+		got := roundTrip(t, factory, doc)
+		if have, want := events(t, got), events(t, want); !slices.Equal(have, want) {
+			t.Errorf("strict %t: round trip of %q:\n got %q\nwant %q", strict, doc, have, want)
+		}
+	}
+}
+
+func TestDoubleRoundTrip(t *testing.T) {
+	factory := schemaFactory(t, `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema">
+<xs:element name="f" type="xs:double"/></xs:schema>`)
+
+	tests := map[string]string{
+		"1.5": "15E-1",
+		"-2":  "-2E0",
+		"INF": "INF",
+		// not a valid xsd:double, preserved as string
+		"-":  "-",
+		"+":  "+",
+		".":  ".",
+		"-.": "-.",
+		"1E": "1E",
+	}
+	for value, want := range tests {
+		got := roundTrip(t, factory, "<f>"+value+"</f>")
+		if !strings.HasSuffix(got, ">"+want+"</f>") {
+			t.Errorf("<f>%s</f>: got %s, want content %s", value, got, want)
+		}
+	}
+}
+
+func TestNonASCIINamesRoundTrip(t *testing.T) {
+	doc := `<été xmlns="urn:ünï" ñame="ça"><日本 größe="1">ß</日本><日本/><日本 größe="2"/></été>`
+	for _, mode := range []core.CodingMode{core.CodingModeBitPacked, core.CodingModeBytePacked, core.CodingModeCompression} {
+		factory := core.NewDefaultEXIFactory()
+		factory.SetCodingMode(mode)
+		assertRoundTrip(t, factory, doc)
+	}
+}
@@ -0,0 +1,106 @@
+package sax
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+/*
+	Shared strings collection
+*/
+
+// CollectSharedStrings reads the sample XML documents of a document family
+// and returns their most frequent attribute and character values, at most
+// maxCount (-1 for all), as shared strings for EXIFactory.SetSharedStrings.
+// Values occurring only once, empty values and whitespace are skipped. The
+// most frequent value comes first, values of equal frequency are ordered by
+// first occurrence.
+func CollectSharedStrings(maxCount int, documents ...io.Reader) ([]string, error) {
+	counts := map[string]int{}
+	values := []string{} // in order of first occurrence
+
+	add := func(value string) {
+		if strings.TrimSpace(value) == "" {
+			return
+		}
+		if _, exists := counts[value]; !exists {
+			values = append(values, value)
+		}
+		counts[value]++
+	}
+
+	for _, document := range documents {
+		dec := xml.NewDecoder(document)
+		var chars strings.Builder
+
+		for {
+			token, err := dec.Token()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			switch tok := token.(type) {
+			case xml.StartElement:
+				add(chars.String())
+				chars.Reset()
+				for _, attr := range tok.Attr {
+					if !isNamespaceDeclaration(&attr) {
+						add(attr.Value)
+					}
+				}
+			case xml.EndElement:
+				add(chars.String())
+				chars.Reset()
+			case xml.CharData:
+				chars.Write(tok)
+			}
+		}
+	}
+
+	sharedStrings := []string{}
+	for _, value := range values {
+		if counts[value] > 1 {
+			sharedStrings = append(sharedStrings, value)
+		}
+	}
+	// Note: stable sort keeps the order of first occurrence
+	slices.SortStableFunc(sharedStrings, func(a, b string) int {
+		return counts[b] - counts[a]
+	})
+	if maxCount >= 0 && len(sharedStrings) > maxCount {
+		sharedStrings = sharedStrings[:maxCount]
+	}
+
+	return sharedStrings, nil
+}
+
+// CollectSharedStringsFromDir is like CollectSharedStrings for the *.xml
+// files in dir, subdirectories are not scanned.
+func CollectSharedStringsFromDir(dir string, maxCount int) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	documents := []io.Reader{}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".xml" {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		documents = append(documents, bytes.NewReader(content))
+	}
+
+	return CollectSharedStrings(maxCount, documents...)
+}
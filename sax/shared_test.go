@@ -0,0 +1,64 @@
+package sax_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/sderkacs/go-exi/core"
+	"github.com/sderkacs/go-exi/sax"
+)
+
+func TestCollectSharedStrings(t *testing.T) {
+	samples := []string{
+		`<order status="open" currency="EUR"><item>widget</item><item>gadget</item><note>first order</note></order>`,
+		`<order status="open" currency="EUR"><item>widget</item><item>gizmo</item><note> </note></order>`,
+	}
+	dir := t.TempDir()
+	for i, sample := range samples {
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("sample%d.xml", i)), []byte(sample), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// neither other files nor subdirectories are scanned
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("widget widget"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "sub", "c.xml"), []byte(samples[0]), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	sharedStrings, err := sax.CollectSharedStringsFromDir(dir, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"open", "EUR", "widget"}; !slices.Equal(sharedStrings, want) {
+		t.Fatalf("got %q, want %q", sharedStrings, want)
+	}
+	limited, err := sax.CollectSharedStrings(2, strings.NewReader(samples[0]), strings.NewReader(samples[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := sharedStrings[:2]; !slices.Equal(limited, want) {
+		t.Errorf("max count 2: got %q, want %q", limited, want)
+	}
+	if _, err := sax.CollectSharedStrings(-1, strings.NewReader("<order>")); err == nil {
+		t.Error("malformed document: want error")
+	}
+
+	// encoder and decoder primed with the collected strings
+	plain := encode(t, core.NewDefaultEXIFactory(), samples[1])
+	factory := core.NewDefaultEXIFactory()
+	factory.SetSharedStrings(sharedStrings)
+	exi := encode(t, factory, samples[1])
+	if len(exi) >= len(plain) {
+		t.Errorf("%d bytes with shared strings, %d bytes without", len(exi), len(plain))
+	}
+	assertRoundTrip(t, factory, samples[1])
+}
@@ -0,0 +1,192 @@
+package sax
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/sderkacs/go-exi/core"
+)
+
+/*
+	TokenReader implementation
+*/
+
+// TokenReader presents the events of an EXI body decoder as encoding/xml
+// tokens, i.e. it implements xml.TokenReader. Tokens look like the ones of
+// xml.Decoder.Token: names carry the namespace URI in Space, namespace
+// declarations (only present if prefixes are preserved) are attributes in
+// the "xmlns" space or named "xmlns" for the default namespace. Wrap it with
+// xml.NewTokenDecoder to use code written against xml.Decoder.
+//
+// DOCTYPEs are reported as xml.Directive, entity references are dropped.
+type TokenReader struct {
+	decoder core.EXIBodyDecoder
+	start   *xml.StartElement // start element collecting NS and AT events
+	names   []xml.Name        // names of open elements
+	tokens  []xml.Token       // tokens ready to be returned
+	done    bool
+}
+
+func NewTokenReader(decoder core.EXIBodyDecoder) *TokenReader {
+	return &TokenReader{
+		decoder: decoder,
+		start:   nil,
+		names:   []xml.Name{},
+		tokens:  []xml.Token{},
+		done:    false,
+	}
+}
+
+// NewStreamTokenReader decodes the EXI header read from reader according to
+// noOptionsFactory and returns a TokenReader for the EXI body.
+func NewStreamTokenReader(noOptionsFactory core.EXIFactory, reader io.Reader) (*TokenReader, error) {
+	exiStream, err := noOptionsFactory.CreateEXIStreamDecoder()
+	if err != nil {
+		return nil, err
+	}
+	decoder, err := exiStream.DecodeHeader(bufio.NewReader(reader))
+	if err != nil {
+		return nil, err
+	}
+	return NewTokenReader(decoder), nil
+}
+
+// Token returns the next XML token, or nil and io.EOF after the end of the
+// EXI stream.
+func (r *TokenReader) Token() (xml.Token, error) {
+	for len(r.tokens) == 0 {
+		if r.done {
+			return nil, io.EOF
+		}
+		if err := r.decodeEvent(); err != nil {
+			return nil, err
+		}
+	}
+
+	token := r.tokens[0]
+	r.tokens = r.tokens[1:]
+	return token, nil
+}
+
+// decodeEvent decodes the next EXI event and queues the tokens it completes.
+func (r *TokenReader) decodeEvent() error {
+	ev, exists, err := r.decoder.DecodeEvent()
+	if err != nil {
+		return err
+	}
+	if !exists {
+		r.flushStartElement()
+		r.done = true
+		return nil
+	}
+
+	switch ev.EventType {
+	case core.EventTypeStartDocument, core.EventTypeSelfContained:
+		// nothing to report
+	case core.EventTypeEndDocument:
+		r.flushStartElement()
+		r.done = true
+	case core.EventTypeStartElement, core.EventTypeStartElementNS, core.EventTypeStartElementGeneric, core.EventTypeStartElementGenericUndeclared:
+		r.flushStartElement()
+		r.start = &xml.StartElement{
+			Name: tokenName(ev.QNameContext),
+			Attr: []xml.Attr{},
+		}
+	case core.EventTypeNamespaceDeclaration:
+		name := xml.Name{Space: core.XML_NS_Attribute, Local: ""}
+		if ev.NamespaceDeclaration.Prefix == nil || *ev.NamespaceDeclaration.Prefix == core.XMLDefaultNSPrefix {
+			name = xml.Name{Local: core.XML_NS_Attribute}
+		} else {
+			name.Local = *ev.NamespaceDeclaration.Prefix
+		}
+		r.addAttribute(xml.Attr{Name: name, Value: ev.NamespaceDeclaration.NamespaceURI})
+	case core.EventTypeAttributeXsiType, core.EventTypeAttributeXsiNil,
+		core.EventTypeAttribute,
+		core.EventTypeAttributeNS,
+		core.EventTypeAttributeGeneric,
+		core.EventTypeAttributeGenericUndeclared,
+		core.EventTypeAttributeInvalidValue,
+		core.EventTypeAttributeAnyInvalidValue:
+		value, err := ev.Value.ToString()
+		if err != nil {
+			return err
+		}
+		r.addAttribute(xml.Attr{Name: tokenName(ev.QNameContext), Value: value})
+	case core.EventTypeEndElement, core.EventTypeEndElementUndeclared:
+		r.flushStartElement()
+		// Note: end element has to match the name of its start element
+		name := tokenName(ev.QNameContext)
+		if n := len(r.names); n > 0 {
+			name = r.names[n-1]
+			r.names = r.names[:n-1]
+		}
+		r.tokens = append(r.tokens, xml.EndElement{Name: name})
+	case core.EventTypeCharacters, core.EventTypeCharactersGeneric, core.EventTypeCharactersGenericUndeclared:
+		r.flushStartElement()
+		value, err := ev.Value.ToString()
+		if err != nil {
+			return err
+		}
+		r.tokens = append(r.tokens, xml.CharData(value))
+	case core.EventTypeComment:
+		r.flushStartElement()
+		r.tokens = append(r.tokens, xml.Comment(ev.Comment.Text))
+	case core.EventTypeProcessingInstruction:
+		r.flushStartElement()
+		r.tokens = append(r.tokens, xml.ProcInst{
+			Target: ev.ProcessingInstruction.Target,
+			Inst:   []byte(ev.ProcessingInstruction.Data),
+		})
+	case core.EventTypeDocType:
+		r.flushStartElement()
+		r.tokens = append(r.tokens, docTypeDirective(ev.DocType))
+	case core.EventTypeEntityReference:
+		// Note: encoding/xml has no token for unresolved entity references
+		r.flushStartElement()
+	default:
+		return fmt.Errorf("unexpected EXI event: %s", ev.EventType)
+	}
+
+	return nil
+}
+
+func (r *TokenReader) addAttribute(attr xml.Attr) {
+	if r.start != nil {
+		r.start.Attr = append(r.start.Attr, attr)
+	}
+}
+
+// flushStartElement queues the start element once its attributes are
+// complete.
+func (r *TokenReader) flushStartElement() {
+	if r.start != nil {
+		r.tokens = append(r.tokens, *r.start)
+		r.names = append(r.names, r.start.Name)
+		r.start = nil
+	}
+}
+
+func tokenName(qnc *core.QNameContext) xml.Name {
+	return xml.Name{
+		Space: qnc.GetNamespaceUri(),
+		Local: qnc.GetLocalName(),
+	}
+}
+
+func docTypeDirective(docType *core.DocTypeContainer) xml.Directive {
+	var b strings.Builder
+	b.WriteString("DOCTYPE ")
+	b.WriteString(string(docType.Name))
+	if len(docType.PublicID) > 0 {
+		fmt.Fprintf(&b, ` PUBLIC "%s" "%s"`, string(docType.PublicID), string(docType.SystemID))
+	} else if len(docType.SystemID) > 0 {
+		fmt.Fprintf(&b, ` SYSTEM "%s"`, string(docType.SystemID))
+	}
+	if len(docType.Text) > 0 {
+		fmt.Fprintf(&b, " [%s]", string(docType.Text))
+	}
+	return xml.Directive(b.String())
+}
@@ -0,0 +1,136 @@
+package sax_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/sderkacs/go-exi/core"
+	"github.com/sderkacs/go-exi/sax"
+)
+
+// readTokens returns the tokens of reader in a comparable form.
+func readTokens(t *testing.T, reader xml.TokenReader) []string {
+	t.Helper()
+	var tokens []string
+	for {
+		token, err := reader.Token()
+		if errors.Is(err, io.EOF) {
+			return tokens
+		}
+		if err != nil {
+			t.Fatalf("token: %v", err)
+		}
+		tokens = append(tokens, fmt.Sprintf("%T %s", token, token))
+	}
+}
+
+func TestTokenReader(t *testing.T) {
+	doc := `<!--head--><r xmlns="urn:r" xmlns:p="urn:p" p:a="1" b="2">` +
+		`<p:e>text</p:e><?pi data?><e/>tail</r>`
+	factory := core.NewDefaultEXIFactory()
+	for _, feature := range []string{core.FeatureComment, core.FeaturePI, core.FeatureDTD, core.FeaturePrefix} {
+		if err := factory.GetFidelityOptions().SetFidelity(feature, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reader, err := sax.NewStreamTokenReader(factory, bytes.NewReader(encode(t, factory, doc)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the raw tokens of xml.Decoder carry prefixes instead of URIs
+	got := readTokens(t, xml.NewTokenDecoder(reader))
+	if want := readTokens(t, xml.NewDecoder(strings.NewReader(doc))); !slices.Equal(got, want) {
+		t.Errorf("got  %q\nwant %q", got, want)
+	}
+
+	// DOCTYPEs are directives
+	var exi bytes.Buffer
+	streamEncoder, err := factory.CreateEXIStreamEncoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := bufio.NewWriter(&exi)
+	encoder, err := streamEncoder.EncodeHeader(writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps := []func() error{
+		encoder.EncodeStartDocument,
+		func() error { return encoder.EncodeDocType("r", "-//R//EN", "r.dtd", "<!ENTITY e 'x'>") },
+		func() error { return encoder.EncodeStartElement("", "r", nil) },
+		encoder.EncodeEndElement,
+		encoder.EncodeEndDocument,
+		encoder.Flush,
+		writer.Flush,
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+	}
+	reader, err = sax.NewStreamTokenReader(factory, &exi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := reader.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	directive, _ := token.(xml.Directive)
+	if want := `DOCTYPE r PUBLIC "-//R//EN" "r.dtd" [<!ENTITY e 'x'>]`; string(directive) != want {
+		t.Errorf("got %T %s, want directive %s", token, token, want)
+	}
+}
+
+// namespaceStripper drops the namespace declarations of start elements.
+type namespaceStripper struct {
+	xml.TokenReader
+}
+
+func (s namespaceStripper) Token() (xml.Token, error) {
+	token, err := s.TokenReader.Token()
+	if start, ok := token.(xml.StartElement); ok {
+		start.Attr = slices.DeleteFunc(slices.Clone(start.Attr), func(attr xml.Attr) bool {
+			return attr.Name.Space == "xmlns" || attr.Name == xml.Name{Local: "xmlns"}
+		})
+		token = start
+	}
+	return token, err
+}
+
+func TestTokenReaderModes(t *testing.T) {
+	doc := `<r xmlns="urn:r" xmlns:p="urn:p" p:a="1" b="2"><p:e p:c="3">text</p:e><e/>tail</r>`
+	modes := []core.CodingMode{core.CodingModeBitPacked, core.CodingModeBytePacked, core.CodingModePreCompression, core.CodingModeCompression}
+	for _, mode := range modes {
+		for _, preservePrefixes := range []bool{false, true} {
+			factory := core.NewDefaultEXIFactory()
+			factory.SetCodingMode(mode)
+			if err := factory.GetFidelityOptions().SetFidelity(core.FeaturePrefix, preservePrefixes); err != nil {
+				t.Fatal(err)
+			}
+			reader, err := sax.NewStreamTokenReader(factory, bytes.NewReader(encode(t, factory, doc)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got, want []string
+			if preservePrefixes {
+				got = readTokens(t, reader)
+				want = readTokens(t, xml.NewDecoder(strings.NewReader(doc)))
+			} else {
+				// there are no namespace declarations to report
+				got = readTokens(t, namespaceStripper{reader})
+				want = readTokens(t, namespaceStripper{xml.NewDecoder(strings.NewReader(doc))})
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("mode %d, prefixes %t:\n got %q\nwant %q", mode, preservePrefixes, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package sax_test
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/sderkacs/go-exi/core"
+	"github.com/sderkacs/go-exi/utils"
+)
+
+// validate returns the issues ValidateStream reports for doc encoded
+// according to orderSchema, as "path: issue".
+func validate(t *testing.T, doc string) []string {
+	t.Helper()
+	factory := schemaFactory(t, orderSchema)
+	exi := encode(t, factory, doc)
+	var issues []string
+	err := core.ValidateStream(bytes.NewReader(exi), factory, func(path []utils.QName, issue string) {
+		var names []string
+		for _, qname := range path {
+			names = append(names, qname.Local)
+		}
+		issues = append(issues, strings.Join(names, "/")+": "+issue)
+	})
+	if err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	return issues
+}
+
+func TestValidateStream(t *testing.T) {
+	valid := `<order xmlns="urn:order" id="1"><created>2024-02-29T12:30:00Z</created><item><price>9.99</price></item><paid>true</paid></order>`
+	if issues := validate(t, valid); len(issues) != 0 {
+		t.Errorf("valid document: %q", issues)
+	}
+
+	invalid := `<order xmlns="urn:order" id="x1"><created>yesterday</created>` +
+		`<item size="XL" count="0"><price>abc</price></item><item></item>` +
+		`<item><price>1</price><unknown a="b"/></item><paid>true</paid></order>`
+	want := []string{
+		"order: invalid value 'x1' of attribute id",
+		"order/created: invalid or unexpected characters 'yesterday'",
+		"order/item: invalid value '0' of attribute count",
+		"order/item: invalid value 'XL' of attribute size",
+		"order/item/price: invalid or unexpected characters 'abc'",
+		"order/item: missing content",
+		"order/item/unknown: undeclared element",
+	}
+	if got := validate(t, invalid); !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -126,7 +126,7 @@ func (d *StructDecoder) decodeEXIEventsWithResolver(decoder core.EXIBodyDecoder,
 
 	for exists {
 		if d.debug {
-			fmt.Printf("[DEBUG] Processing event: %d\n", eventType)
+			fmt.Printf("[DEBUG] Processing event: %s\n", eventType)
 		}
 
 		switch eventType {
@@ -288,7 +288,7 @@ func (d *StructDecoder) decodeEXIEventsWithResolver(decoder core.EXIBodyDecoder,
 
 		default:
 			if d.debug {
-				fmt.Printf("[DEBUG] Skipping event type: %d\n", eventType)
+				fmt.Printf("[DEBUG] Skipping event type: %s\n", eventType)
 			}
 		}
 
@@ -312,7 +312,7 @@ func (d *StructDecoder) decodeEXIEvents(decoder core.EXIBodyDecoder, target refl
 
 	for exists {
 		if d.debug {
-			fmt.Printf("[DEBUG] Processing event: %d\n", eventType)
+			fmt.Printf("[DEBUG] Processing event: %s\n", eventType)
 		}
 
 		switch eventType {
@@ -449,7 +449,7 @@ func (d *StructDecoder) decodeEXIEvents(decoder core.EXIBodyDecoder, target refl
 		default:
 			// Skip other event types for now
 			if d.debug {
-				fmt.Printf("[DEBUG] Skipping event type: %d\n", eventType)
+				fmt.Printf("[DEBUG] Skipping event type: %s\n", eventType)
 			}
 		}
 
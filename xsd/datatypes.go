@@ -0,0 +1,503 @@
+package xsd
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/sderkacs/go-exi/core"
+	"github.com/sderkacs/go-exi/utils"
+)
+
+const (
+	anyType       string = "anyType"
+	anySimpleType string = "anySimpleType"
+
+	// integer types with a bounded range of at most 4096 values are encoded
+	// as n-bit unsigned integers, see EXI 1.0 section 7.1.5
+	nBitIntegerRange int64 = 4096
+)
+
+// builtInBase is the base type of each built-in type, see XML Schema Part 2
+// section 3.
+var builtInBase = map[string]string{
+	anySimpleType: anyType,
+
+	"string":           anySimpleType,
+	"normalizedString": "string",
+	"token":            "normalizedString",
+	"language":         "token",
+	"NMTOKEN":          "token",
+	"Name":             "token",
+	"NCName":           "Name",
+	"ID":               "NCName",
+	"IDREF":            "NCName",
+	"ENTITY":           "NCName",
+	"NMTOKENS":         anySimpleType,
+	"IDREFS":           anySimpleType,
+	"ENTITIES":         anySimpleType,
+
+	"boolean":      anySimpleType,
+	"base64Binary": anySimpleType,
+	"hexBinary":    anySimpleType,
+	"float":        anySimpleType,
+	"double":       anySimpleType,
+	"anyURI":       anySimpleType,
+	"QName":        anySimpleType,
+	"NOTATION":     anySimpleType,
+	"duration":     anySimpleType,
+	"dateTime":     anySimpleType,
+	"time":         anySimpleType,
+	"date":         anySimpleType,
+	"gYearMonth":   anySimpleType,
+	"gYear":        anySimpleType,
+	"gMonthDay":    anySimpleType,
+	"gDay":         anySimpleType,
+	"gMonth":       anySimpleType,
+
+	"decimal":            anySimpleType,
+	"integer":            "decimal",
+	"nonPositiveInteger": "integer",
+	"negativeInteger":    "nonPositiveInteger",
+	"long":               "integer",
+	"int":                "long",
+	"short":              "int",
+	"byte":               "short",
+	"nonNegativeInteger": "integer",
+	"unsignedLong":       "nonNegativeInteger",
+	"unsignedInt":        "unsignedLong",
+	"unsignedShort":      "unsignedInt",
+	"unsignedByte":       "unsignedShort",
+	"positiveInteger":    "nonNegativeInteger",
+}
+
+// builtInIntegerBounds holds the value space of the built-in integer types,
+// an empty string stands for an unbounded side.
+var builtInIntegerBounds = map[string][2]string{
+	"integer":            {"", ""},
+	"nonPositiveInteger": {"", "0"},
+	"negativeInteger":    {"", "-1"},
+	"long":               {"-9223372036854775808", "9223372036854775807"},
+	"int":                {"-2147483648", "2147483647"},
+	"short":              {"-32768", "32767"},
+	"byte":               {"-128", "127"},
+	"nonNegativeInteger": {"0", ""},
+	"unsignedLong":       {"0", "18446744073709551615"},
+	"unsignedInt":        {"0", "4294967295"},
+	"unsignedShort":      {"0", "65535"},
+	"unsignedByte":       {"0", "255"},
+	"positiveInteger":    {"1", ""},
+}
+
+var builtInDatetimes = map[string]core.DateTimeType{
+	"dateTime":   core.DateTimeDateTime,
+	"time":       core.DateTimeTime,
+	"date":       core.DateTimeDate,
+	"gYearMonth": core.DateTimeGYearMonth,
+	"gYear":      core.DateTimeGYear,
+	"gMonthDay":  core.DateTimeGMonthDay,
+	"gDay":       core.DateTimeGDay,
+	"gMonth":     core.DateTimeGMonth,
+}
+
+var builtInListItems = map[string]string{
+	"NMTOKENS": "NMTOKEN",
+	"IDREFS":   "IDREF",
+	"ENTITIES": "ENTITY",
+}
+
+func isBuiltInType(qname utils.QName) bool {
+	if qname.Space != core.XMLSchemaNS_URI {
+		return false
+	}
+	_, ok := builtInBase[qname.Local]
+	return ok || qname.Local == anyType
+}
+
+// simpleType is a compiled simple type definition
+type simpleType struct {
+	datatype core.Datatype
+	// integer types keep their value space to derive bounded types from it
+	integer      bool
+	lower, upper *big.Int
+	// QName and NOTATION values are never encoded as enumerations
+	noEnumeration bool
+	union         bool
+}
+
+// builtInSimpleType compiles the built-in simple type with the given local
+// name.
+func (c *compiler) builtInSimpleType(local string) (*simpleType, error) {
+	qname := utils.QName{Space: core.XMLSchemaNS_URI, Local: local}
+	if st, ok := c.simpleTypes[qname]; ok {
+		return st, nil
+	}
+
+	qnc := c.qnameContext(qname)
+	st := &simpleType{}
+
+	switch local {
+	case "base64Binary":
+		st.datatype = core.NewBinaryBase64Datatype(qnc)
+	case "hexBinary":
+		st.datatype = core.NewBinaryHexDatatype(qnc)
+	case "boolean":
+		st.datatype = core.NewBooleanDatatype(qnc)
+	case "decimal":
+		st.datatype = core.NewDecimalDatatype(qnc)
+	case "float", "double":
+		st.datatype = core.NewFloatDatatype(qnc)
+	case "string", anySimpleType:
+		st.datatype = core.NewStringDatatype(qnc)
+	case "normalizedString":
+		st.datatype = core.NewStringDatatypeWithWhiteSpace(qnc, core.WhiteSpaceReplace)
+	case "anyURI":
+		st.datatype = core.NewAnyURIDatatype(qnc)
+	case "QName", "NOTATION":
+		st.datatype = core.NewStringDatatypeWithWhiteSpace(qnc, core.WhiteSpaceCollapse)
+		st.noEnumeration = true
+	default:
+		if kind, ok := builtInDatetimes[local]; ok {
+			st.datatype = core.NewDatetimeDatatype(kind, qnc)
+		} else if item, ok := builtInListItems[local]; ok {
+			itemType, err := c.builtInSimpleType(item)
+			if err != nil {
+				return nil, err
+			}
+			st.datatype = core.NewListDatatype(itemType.datatype, qnc)
+		} else if bounds, ok := builtInIntegerBounds[local]; ok {
+			st.integer = true
+			st.lower = parseBound(bounds[0])
+			st.upper = parseBound(bounds[1])
+			dt, err := integerDatatype(st.lower, st.upper, qnc)
+			if err != nil {
+				return nil, err
+			}
+			st.datatype = dt
+		} else if _, ok := builtInBase[local]; ok {
+			// token and derived types and duration
+			st.datatype = core.NewStringDatatypeWithWhiteSpace(qnc, core.WhiteSpaceCollapse)
+		} else {
+			return nil, fmt.Errorf("unknown built-in simple type %s", local)
+		}
+	}
+
+	if base := builtInBase[local]; base != anyType {
+		baseType, err := c.builtInSimpleType(base)
+		if err != nil {
+			return nil, err
+		}
+		st.datatype.SetBaseDatatype(baseType.datatype)
+	}
+
+	c.simpleTypes[qname] = st
+	return st, nil
+}
+
+// namedSimpleType compiles the built-in or user-defined simple type qname.
+func (c *compiler) namedSimpleType(qname utils.QName) (*simpleType, error) {
+	if isBuiltInType(qname) {
+		if qname.Local == anyType {
+			return nil, fmt.Errorf("%s is not a simple type", qname.Local)
+		}
+		return c.builtInSimpleType(qname.Local)
+	}
+	if st, ok := c.simpleTypes[qname]; ok {
+		return st, nil
+	}
+	n, ok := c.types[qname]
+	if !ok {
+		return nil, fmt.Errorf("unknown type {%s}%s", qname.Space, qname.Local)
+	}
+	if n.name != "simpleType" {
+		return nil, fmt.Errorf("{%s}%s is not a simple type", qname.Space, qname.Local)
+	}
+	return c.simpleTypeDefinition(n)
+}
+
+// simpleTypeRef compiles the simple type referred to by attribute name of n,
+// e.g., type or base, or the anonymous simpleType child of n. If neither is
+// present anySimpleType is returned.
+func (c *compiler) simpleTypeRef(n *node, name string) (*simpleType, error) {
+	qname, ok, err := n.qnameAttr(name)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return c.namedSimpleType(qname)
+	}
+	if anonymous := n.child("simpleType"); anonymous != nil {
+		return c.simpleTypeDefinition(anonymous)
+	}
+	return c.builtInSimpleType(anySimpleType)
+}
+
+// simpleTypeDefinition compiles a simpleType element.
+func (c *compiler) simpleTypeDefinition(n *node) (*simpleType, error) {
+	key := c.typeKey(n)
+	if st, ok := c.simpleTypes[key]; ok {
+		return st, nil
+	}
+	if c.compiling[n] {
+		return nil, errors.New("circular simple type definition")
+	}
+	c.compiling[n] = true
+	defer delete(c.compiling, n)
+
+	qnc := c.definitionQNameContext(n)
+
+	var st *simpleType
+	var err error
+	if r := n.child("restriction"); r != nil {
+		var base *simpleType
+		base, err = c.simpleTypeRef(r, "base")
+		if err != nil {
+			return nil, err
+		}
+		st, err = c.restrictSimpleType(base, r, qnc)
+	} else if l := n.child("list"); l != nil {
+		var item *simpleType
+		item, err = c.simpleTypeRef(l, "itemType")
+		if err != nil {
+			return nil, err
+		}
+		if qnc == nil {
+			qnc = item.datatype.GetSchemaType()
+		}
+		var dt core.Datatype
+		dt, err = core.NewListDatatypeChecked(item.datatype, qnc)
+		st = &simpleType{datatype: dt}
+	} else if n.child("union") != nil {
+		if qnc == nil {
+			qnc = c.qnameContext(utils.QName{Space: core.XMLSchemaNS_URI, Local: anySimpleType})
+		}
+		st = &simpleType{
+			datatype: core.NewStringDatatypeWithDerive(qnc, true),
+			union:    true,
+		}
+	} else {
+		return nil, errors.New("simple type without restriction, list or union")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if st.datatype.GetBaseDatatype() == nil {
+		ast, err := c.builtInSimpleType(anySimpleType)
+		if err != nil {
+			return nil, err
+		}
+		st.datatype.SetBaseDatatype(ast.datatype)
+	}
+
+	c.simpleTypes[key] = st
+	return st, nil
+}
+
+// restrictSimpleType applies the facets of restriction r to base. qnc is the
+// schema type of the restricted type, nil for anonymous types.
+func (c *compiler) restrictSimpleType(base *simpleType, r *node, qnc *core.QNameContext) (*simpleType, error) {
+	if qnc == nil {
+		qnc = base.datatype.GetSchemaType()
+	}
+	st := &simpleType{
+		integer:       base.integer,
+		lower:         base.lower,
+		upper:         base.upper,
+		noEnumeration: base.noEnumeration,
+		union:         base.union,
+	}
+
+	enumeration := []string{}
+	hasPattern := false
+	for _, f := range r.children {
+		value := f.attrs["value"]
+		switch f.name {
+		case "enumeration":
+			enumeration = append(enumeration, value)
+		case "pattern":
+			hasPattern = true
+		case "minInclusive", "minExclusive":
+			if st.integer {
+				b, err := facetBound(value, f.name == "minExclusive", 1)
+				if err != nil {
+					return nil, err
+				}
+				if st.lower == nil || b.Cmp(st.lower) > 0 {
+					st.lower = b
+				}
+			}
+		case "maxInclusive", "maxExclusive":
+			if st.integer {
+				b, err := facetBound(value, f.name == "maxExclusive", -1)
+				if err != nil {
+					return nil, err
+				}
+				if st.upper == nil || b.Cmp(st.upper) < 0 {
+					st.upper = b
+				}
+			}
+		}
+	}
+
+	var dt core.Datatype
+	var err error
+	valueType := base.datatype
+	if enumDT, ok := valueType.(*core.EnumerationDatatype); ok {
+		valueType = enumDT.GetEnumValueDatatype()
+	}
+
+	switch {
+	case len(enumeration) > 0 && !st.noEnumeration && valueType.GetBuiltInType() != core.BuiltInTypeList:
+		values := make([]core.Value, len(enumeration))
+		for i, lexical := range enumeration {
+			values[i], err = parseValue(valueType, lexical)
+			if err != nil {
+				return nil, err
+			}
+		}
+		dt, err = core.NewEnumerationDatatypeChecked(values, valueType, qnc)
+	case st.integer:
+		dt, err = integerDatatype(st.lower, st.upper, qnc)
+	case hasPattern && valueType.GetBuiltInType() == core.BuiltInTypeBoolean:
+		dt = core.NewBooleanFacetDatatype(qnc)
+	default:
+		dt, err = retype(base.datatype, qnc)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	dt.SetBaseDatatype(base.datatype)
+	st.datatype = dt
+	return st, nil
+}
+
+// retype creates a datatype like dt for schema type qnc.
+func retype(dt core.Datatype, qnc *core.QNameContext) (core.Datatype, error) {
+	switch t := dt.(type) {
+	case *core.StringDatatype:
+		if t.IsDerivedByUnion() {
+			return core.NewStringDatatypeWithDerive(qnc, true), nil
+		}
+		if t.IsAnyURI() {
+			return core.NewAnyURIDatatype(qnc), nil
+		}
+		return core.NewStringDatatypeWithWhiteSpace(qnc, t.GetWhiteSpace()), nil
+	case *core.BooleanDatatype:
+		return core.NewBooleanDatatype(qnc), nil
+	case *core.BooleanFacetDatatype:
+		return core.NewBooleanFacetDatatype(qnc), nil
+	case *core.BinaryBase64Datatype:
+		return core.NewBinaryBase64Datatype(qnc), nil
+	case *core.BinaryHexDatatype:
+		return core.NewBinaryHexDatatype(qnc), nil
+	case *core.DecimalDatatype:
+		return core.NewDecimalDatatype(qnc), nil
+	case *core.FloatDatatype:
+		return core.NewFloatDatatype(qnc), nil
+	case *core.IntegerDatatype:
+		return core.NewIntegerDatatype(qnc), nil
+	case *core.UnsignedIntegerDatatype:
+		return core.NewUnsignedIntegerDatatype(qnc), nil
+	case *core.NBitUnsignedIntegerDatatype:
+		return core.NewNBitUnsignedIntegerDatatype(t.GetLowerBound(), t.GetUpperBound(), qnc), nil
+	case *core.DatetimeDatatype:
+		return core.NewDatetimeDatatype(t.GetDatetimeType(), qnc), nil
+	case *core.ListDatatype:
+		return core.NewListDatatypeChecked(t.GetListDatatype(), qnc)
+	case *core.EnumerationDatatype:
+		values := make([]core.Value, t.GetEnumerationSize())
+		for i := range values {
+			values[i] = t.GetEnumValue(i)
+		}
+		return core.NewEnumerationDatatypeChecked(values, t.GetEnumValueDatatype(), qnc)
+	default:
+		return nil, fmt.Errorf("unexpected datatype %T", dt)
+	}
+}
+
+// integerDatatype returns the EXI representation of an integer type with the
+// given bounds, nil standing for unbounded.
+func integerDatatype(lower, upper *big.Int, qnc *core.QNameContext) (core.Datatype, error) {
+	if lower != nil && upper != nil {
+		diff := new(big.Int).Sub(upper, lower)
+		if diff.Sign() >= 0 && diff.Cmp(big.NewInt(nBitIntegerRange)) < 0 {
+			lo, err := core.IntegerValueParse(lower.String())
+			if err != nil {
+				return nil, err
+			}
+			hi, err := core.IntegerValueParse(upper.String())
+			if err != nil {
+				return nil, err
+			}
+			return core.NewNBitUnsignedIntegerDatatype(lo, hi, qnc), nil
+		}
+	}
+	if lower != nil && lower.Sign() >= 0 {
+		return core.NewUnsignedIntegerDatatype(qnc), nil
+	}
+	return core.NewIntegerDatatype(qnc), nil
+}
+
+func parseBound(s string) *big.Int {
+	if s == "" {
+		return nil
+	}
+	b, _ := new(big.Int).SetString(s, 10)
+	return b
+}
+
+// facetBound parses the value of a range facet. Exclusive bounds are moved
+// by delta to become inclusive.
+func facetBound(value string, exclusive bool, delta int64) (*big.Int, error) {
+	b, ok := new(big.Int).SetString(strings.TrimPrefix(strings.TrimSpace(value), "+"), 10)
+	if !ok {
+		return nil, fmt.Errorf("invalid integer facet value %q", value)
+	}
+	if exclusive {
+		b.Add(b, big.NewInt(delta))
+	}
+	return b, nil
+}
+
+// parseValue parses an enumeration value in the lexical space of dt.
+func parseValue(dt core.Datatype, lexical string) (core.Value, error) {
+	var value core.Value
+	var err error
+
+	if dt.GetWhiteSpace() == core.WhiteSpaceCollapse {
+		lexical = strings.Join(strings.Fields(lexical), " ")
+	}
+
+	switch t := dt.(type) {
+	case *core.IntegerDatatype, *core.UnsignedIntegerDatatype, *core.NBitUnsignedIntegerDatatype:
+		value, err = core.IntegerValueParse(strings.TrimPrefix(lexical, "+"))
+	case *core.DecimalDatatype:
+		value, err = core.DecimalValueParseString(lexical)
+	case *core.FloatDatatype:
+		value, err = core.FloatValueParseString(lexical)
+	case *core.DatetimeDatatype:
+		value, err = core.DateTimeParse(lexical, t.GetDatetimeType())
+	case *core.BooleanDatatype, *core.BooleanFacetDatatype:
+		if b := core.BooleanValueParse(lexical); b != nil {
+			value = b
+		}
+	case *core.BinaryBase64Datatype:
+		if b := core.BinaryBase64ValueParse(lexical); b != nil {
+			value = b
+		}
+	case *core.BinaryHexDatatype:
+		if b := core.BinaryHexValueParse(lexical); b != nil {
+			value = b
+		}
+	default:
+		value = core.NewStringValueFromString(lexical)
+	}
+
+	if err != nil || value == nil {
+		return nil, fmt.Errorf("invalid enumeration value %q", lexical)
+	}
+	return value, nil
+}
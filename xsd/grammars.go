@@ -0,0 +1,1281 @@
+package xsd
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/sderkacs/go-exi/core"
+	"github.com/sderkacs/go-exi/utils"
+)
+
+type compiler struct {
+	schemas []*schemaDoc
+
+	// global definitions
+	elements        map[utils.QName]*node
+	attributes      map[utils.QName]*node
+	types           map[utils.QName]*node
+	groups          map[utils.QName]*node
+	attributeGroups map[utils.QName]*node
+	substitutions   map[utils.QName][]utils.QName
+	hasSubtypes     map[utils.QName]bool
+
+	grammarContext  *core.GrammarContext
+	simpleTypes     map[any]*simpleType
+	typeGrammars    map[any]*core.SchemaInformedFirstStartTag
+	elementGrammars map[*node]*core.SchemaInformedFirstStartTag
+	startElements   map[*node]*core.StartElement
+	pending         []*node
+	compiling       map[*node]bool
+
+	// end and endElement correspond to the end of an element before and
+	// after EE
+	end        *core.SchemaInformedElement
+	endElement *core.SchemaInformedElement
+}
+
+func (l *loader) compile(schemaID string) (*core.SchemaInformedGrammars, error) {
+	if !l.declares(core.XML_NS_URI) && l.refersTo(core.XML_NS_URI) {
+		if _, err := l.load(strings.NewReader(xmlSchema), "", nil); err != nil {
+			return nil, err
+		}
+	}
+
+	c := &compiler{
+		schemas:         l.schemas,
+		elements:        map[utils.QName]*node{},
+		attributes:      map[utils.QName]*node{},
+		types:           map[utils.QName]*node{},
+		groups:          map[utils.QName]*node{},
+		attributeGroups: map[utils.QName]*node{},
+		substitutions:   map[utils.QName][]utils.QName{},
+		hasSubtypes:     map[utils.QName]bool{},
+		simpleTypes:     map[any]*simpleType{},
+		typeGrammars:    map[any]*core.SchemaInformedFirstStartTag{},
+		elementGrammars: map[*node]*core.SchemaInformedFirstStartTag{},
+		startElements:   map[*node]*core.StartElement{},
+		pending:         []*node{},
+		compiling:       map[*node]bool{},
+		end:             core.NewSchemaInformedElement(),
+		endElement:      core.NewSchemaInformedElement(),
+	}
+	if err := c.endElement.AddProduction(core.NewEndElement(), c.end); err != nil {
+		return nil, err
+	}
+
+	if err := c.collectDefinitions(); err != nil {
+		return nil, err
+	}
+	if err := c.createGrammarContext(); err != nil {
+		return nil, err
+	}
+
+	return c.createGrammars(schemaID)
+}
+
+/*
+	Definitions and names
+*/
+
+func (c *compiler) collectDefinitions() error {
+	for _, s := range c.schemas {
+		for _, n := range s.root.children {
+			name, ok := n.attr("name")
+			if !ok {
+				continue
+			}
+			qname := utils.QName{Space: s.targetNamespace, Local: name}
+
+			var definitions map[utils.QName]*node
+			switch n.name {
+			case "element":
+				definitions = c.elements
+				if head, ok, err := n.qnameAttr("substitutionGroup"); err != nil {
+					return err
+				} else if ok {
+					c.substitutions[head] = append(c.substitutions[head], qname)
+				}
+			case "attribute":
+				definitions = c.attributes
+			case "complexType", "simpleType":
+				definitions = c.types
+				if base, ok, err := derivationBase(n); err != nil {
+					return err
+				} else if ok {
+					c.hasSubtypes[base] = true
+				}
+			case "group":
+				definitions = c.groups
+			case "attributeGroup":
+				definitions = c.attributeGroups
+			default:
+				continue
+			}
+
+			// Note: the first definition wins, e.g., for schemas that are
+			// included and imported
+			if _, ok := definitions[qname]; !ok {
+				definitions[qname] = n
+			}
+		}
+	}
+
+	for local, base := range builtInBase {
+		if local != anySimpleType || base == anyType {
+			c.hasSubtypes[utils.QName{Space: core.XMLSchemaNS_URI, Local: base}] = true
+		}
+	}
+
+	return nil
+}
+
+// derivationBase returns the base type of a type definition derived by
+// restriction or extension.
+func derivationBase(n *node) (utils.QName, bool, error) {
+	d := n
+	if content := n.child("simpleContent"); content != nil {
+		d = content
+	} else if content := n.child("complexContent"); content != nil {
+		d = content
+	}
+	for _, derivation := range []string{"restriction", "extension"} {
+		if r := d.child(derivation); r != nil {
+			return r.qnameAttr("base")
+		}
+	}
+	return utils.QName{}, false, nil
+}
+
+// declarationName returns the qualified name of an element or attribute
+// declaration.
+func declarationName(n *node) utils.QName {
+	qname := utils.QName{Local: n.attrs["name"]}
+
+	qualified := n.isGlobal()
+	if form, ok := n.attr("form"); ok {
+		qualified = form == "qualified"
+	} else if !qualified && n.name == "element" {
+		qualified = n.schema.elementFormQualified
+	} else if !qualified {
+		qualified = n.schema.attributeFormQualified
+	}
+	if qualified || n.isGlobal() {
+		qname.Space = n.schema.targetNamespace
+	}
+
+	return qname
+}
+
+// wildcardNamespaces returns the namespaces of an any or anyAttribute
+// wildcard. unrestricted is true if the wildcard is not restricted to a list
+// of namespaces. Note: ##other is treated like ##any.
+func wildcardNamespaces(n *node) (uris []string, unrestricted bool) {
+	namespace, ok := n.attr("namespace")
+	if !ok || namespace == "##any" || namespace == "##other" {
+		return nil, true
+	}
+	for _, uri := range strings.Fields(namespace) {
+		switch uri {
+		case "##targetNamespace":
+			uri = n.schema.targetNamespace
+		case "##local":
+			uri = ""
+		}
+		if !slices.Contains(uris, uri) {
+			uris = append(uris, uri)
+		}
+	}
+	return uris, false
+}
+
+// walk calls fn for all nodes of all schemas in document order.
+func (c *compiler) walk(fn func(n *node) error) error {
+	var walk func(n *node) error
+	walk = func(n *node) error {
+		if err := fn(n); err != nil {
+			return err
+		}
+		for _, child := range n.children {
+			if err := walk(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, s := range c.schemas {
+		if err := walk(s.root); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createGrammarContext pre-populates the string table with the target
+// namespaces and the local names of all elements, attributes and types of the
+// schema, see EXI 1.0 section D.
+func (c *compiler) createGrammarContext() error {
+	names := map[string][]string{
+		core.XMLNullNS_URI:           core.LocalNamesEmpty,
+		core.XML_NS_URI:              core.LocalNamesXML,
+		core.XMLSchemaInstanceNS_URI: core.LocalNamesXSI,
+		core.XMLSchemaNS_URI:         core.LocalNamesXSD,
+	}
+	addURI := func(uri string) {
+		if _, ok := names[uri]; !ok {
+			names[uri] = []string{}
+		}
+	}
+	for _, s := range c.schemas {
+		addURI(s.targetNamespace)
+	}
+	_ = c.walk(func(n *node) error {
+		switch n.name {
+		case "element", "attribute":
+			if _, ok := n.attr("name"); !ok {
+				return nil
+			}
+		case "complexType", "simpleType":
+			if _, ok := n.attr("name"); !ok || !n.isGlobal() {
+				return nil
+			}
+		case "any", "anyAttribute":
+			uris, _ := wildcardNamespaces(n)
+			for _, uri := range uris {
+				addURI(uri)
+			}
+			return nil
+		default:
+			return nil
+		}
+
+		qname := utils.QName{Space: n.schema.targetNamespace, Local: n.attrs["name"]}
+		if n.name == "element" || n.name == "attribute" {
+			qname = declarationName(n)
+		}
+		addURI(qname.Space)
+		if !slices.Contains(names[qname.Space], qname.Local) {
+			names[qname.Space] = append(slices.Clone(names[qname.Space]), qname.Local)
+		}
+		return nil
+	})
+
+	uris := []string{core.XMLNullNS_URI, core.XML_NS_URI, core.XMLSchemaInstanceNS_URI, core.XMLSchemaNS_URI}
+	others := []string{}
+	for uri := range names {
+		if !slices.Contains(uris, uri) {
+			others = append(others, uri)
+		}
+	}
+	slices.Sort(others)
+	uris = append(uris, others...)
+
+	prefixes := [][]string{core.PrefixesEmpty, core.PrefixesXML, core.PrefixesXSI, core.PrefixesXSD}
+	contexts := make([]*core.GrammarUriContext, len(uris))
+	numberOfQNames := 0
+	for id, uri := range uris {
+		locals := slices.Clone(names[uri])
+		slices.Sort(locals)
+
+		qncs := make([]*core.QNameContext, len(locals))
+		for i, local := range locals {
+			qncs[i] = core.NewQNameContext(id, i, utils.QName{Space: uri, Local: local})
+		}
+		numberOfQNames += len(qncs)
+
+		pfxs := []string{}
+		if id < len(prefixes) {
+			pfxs = prefixes[id]
+		}
+		contexts[id] = core.NewGrammarUriContext(id, uri, qncs, pfxs)
+	}
+	c.grammarContext = core.NewGrammarContext(contexts, numberOfQNames)
+
+	return nil
+}
+
+func (c *compiler) qnameContext(qname utils.QName) *core.QNameContext {
+	guc := c.grammarContext.GetGrammarUriContext(qname.Space)
+	if guc == nil {
+		return nil
+	}
+	return guc.GetQNameContextByLocalName(qname.Local)
+}
+
+// typeKey identifies a type definition, named types by their QName and
+// anonymous types by their node.
+func (c *compiler) typeKey(n *node) any {
+	if name, ok := n.attr("name"); ok && n.isGlobal() {
+		return utils.QName{Space: n.schema.targetNamespace, Local: name}
+	}
+	return n
+}
+
+// definitionQNameContext returns the QName context of a named type definition
+// or nil for anonymous types.
+func (c *compiler) definitionQNameContext(n *node) *core.QNameContext {
+	if qname, ok := c.typeKey(n).(utils.QName); ok {
+		return c.qnameContext(qname)
+	}
+	return nil
+}
+
+/*
+	Grammars
+*/
+
+func (c *compiler) createGrammars(schemaID string) (*core.SchemaInformedGrammars, error) {
+	// global elements and attributes
+	globalElements := []utils.QName{}
+	for qname, n := range c.elements {
+		c.qnameContext(qname).SetGlobalStartElement(c.startElement(n))
+		globalElements = append(globalElements, qname)
+	}
+	slices.SortFunc(globalElements, core.QNameCompareFunc)
+
+	for qname, n := range c.attributes {
+		st, err := c.simpleTypeRef(n, "type")
+		if err != nil {
+			return nil, fmt.Errorf("attribute %s: %w", qname.Local, err)
+		}
+		qnc := c.qnameContext(qname)
+		qnc.SetGlobalAttribute(core.NewAttributeWithDatatype(qnc, st.datatype))
+	}
+
+	// type grammars
+	for _, local := range core.LocalNamesXSD {
+		qname := utils.QName{Space: core.XMLSchemaNS_URI, Local: local}
+		g, err := c.typeGrammar(qname)
+		if err != nil {
+			return nil, err
+		}
+		c.qnameContext(qname).SetTypeGrammar(g)
+	}
+	for qname := range c.types {
+		g, err := c.typeGrammar(qname)
+		if err != nil {
+			return nil, fmt.Errorf("type %s: %w", qname.Local, err)
+		}
+		c.qnameContext(qname).SetTypeGrammar(g)
+	}
+
+	// all element and attribute declarations for fragments
+	elementDecls := map[utils.QName][]*node{}
+	attributeTypes := map[utils.QName][]core.Datatype{}
+	err := c.walk(func(n *node) error {
+		if _, ok := n.attr("name"); !ok || (n.name != "element" && n.name != "attribute") {
+			return nil
+		}
+		qname := declarationName(n)
+		if n.name == "element" {
+			elementDecls[qname] = append(elementDecls[qname], n)
+			_, err := c.elementGrammar(n)
+			return err
+		}
+		st, err := c.simpleTypeRef(n, "type")
+		if err != nil {
+			return fmt.Errorf("attribute %s: %w", qname.Local, err)
+		}
+		attributeTypes[qname] = append(attributeTypes[qname], st.datatype)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// document grammar
+	document := core.NewDocument()
+	docContent := core.NewSchemaInformedDocContent()
+	docEnd := core.NewDocEnd()
+	if err := document.AddProduction(core.NewStartDocument(), docContent); err != nil {
+		return nil, err
+	}
+	for _, qname := range globalElements {
+		if err := docContent.AddProduction(c.qnameContext(qname).GetGlobalStartElement(), docEnd); err != nil {
+			return nil, err
+		}
+	}
+	if err := docContent.AddProduction(core.NewStartElementGeneric(), docEnd); err != nil {
+		return nil, err
+	}
+	if err := docEnd.AddProduction(core.NewEndDocument(), c.end); err != nil {
+		return nil, err
+	}
+
+	// fragment grammars
+	elementFragment, fragmentElements, err := c.elementFragmentGrammar(elementDecls, attributeTypes)
+	if err != nil {
+		return nil, err
+	}
+	fragment := core.NewFragment()
+	fragmentContent := core.NewSchemaInformedFragmentContent()
+	if err := fragment.AddProduction(core.NewStartDocument(), fragmentContent); err != nil {
+		return nil, err
+	}
+	for _, se := range fragmentElements {
+		if err := fragmentContent.AddProduction(se, fragmentContent); err != nil {
+			return nil, err
+		}
+	}
+	if err := fragmentContent.AddProduction(core.NewStartElementGeneric(), fragmentContent); err != nil {
+		return nil, err
+	}
+	if err := fragmentContent.AddProduction(core.NewEndDocument(), c.end); err != nil {
+		return nil, err
+	}
+
+	// resolve element grammars, compiling them may add further elements
+	for i := 0; i < len(c.pending); i++ {
+		n := c.pending[i]
+		g, err := c.elementGrammar(n)
+		if err != nil {
+			return nil, err
+		}
+		c.startElements[n].SetGrammar(g)
+	}
+
+	grammars := core.NewSchemaInformedGrammars(c.grammarContext, document, fragment, elementFragment)
+	if err := grammars.SetSchemaID(&schemaID); err != nil {
+		return nil, err
+	}
+
+	return grammars, nil
+}
+
+// elementFragmentGrammar creates the relaxed grammar of fragment elements
+// and the SE events of all element declarations, see EXI 1.0 section 8.5.3.
+func (c *compiler) elementFragmentGrammar(elementDecls map[utils.QName][]*node, attributeTypes map[utils.QName][]core.Datatype) (*core.SchemaInformedFirstStartTag, []*core.StartElement, error) {
+	content := core.NewSchemaInformedElement()
+	g := core.NewSchemaInformedFirstStartTagWithEC2(content)
+	g.SetTypeCastable(true)
+	g.SetNillable(true)
+
+	attributes := slices.SortedFunc(func(yield func(utils.QName) bool) {
+		for qname := range attributeTypes {
+			if !yield(qname) {
+				return
+			}
+		}
+	}, core.QNameCompareFunc)
+	for _, qname := range attributes {
+		dt := attributeTypes[qname][0]
+		for _, other := range attributeTypes[qname][1:] {
+			if other != dt {
+				dt = core.BuiltInGetDefaultDatatype()
+				break
+			}
+		}
+		if err := g.AddProduction(core.NewAttributeWithDatatype(c.qnameContext(qname), dt), g); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := g.AddProduction(core.NewAttributeGeneric(), g); err != nil {
+		return nil, nil, err
+	}
+
+	elements := slices.SortedFunc(func(yield func(utils.QName) bool) {
+		for qname := range elementDecls {
+			if !yield(qname) {
+				return
+			}
+		}
+	}, core.QNameCompareFunc)
+	events := make([]*core.StartElement, len(elements))
+	for i, qname := range elements {
+		var global *node
+		var grammar *core.SchemaInformedFirstStartTag
+		for _, n := range elementDecls[qname] {
+			eg, err := c.elementGrammar(n)
+			if err != nil {
+				return nil, nil, err
+			}
+			if n.isGlobal() {
+				global = n
+			}
+			if grammar == nil {
+				grammar = eg
+			} else if grammar != eg {
+				grammar = g
+			}
+		}
+
+		if global != nil && grammar != g {
+			events[i] = c.startElement(global)
+		} else {
+			events[i] = core.NewStartElementWithGrammar(c.qnameContext(qname), grammar)
+		}
+	}
+
+	for _, state := range []core.SchemaInformedGrammar{g, content} {
+		for _, se := range events {
+			if err := state.AddProduction(se, content); err != nil {
+				return nil, nil, err
+			}
+		}
+		if err := state.AddProduction(core.NewStartElementGeneric(), content); err != nil {
+			return nil, nil, err
+		}
+		state.AddTerminalProduction(core.NewEndElement())
+		if err := state.AddProduction(core.NewCharactersGeneric(), content); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return g, events, nil
+}
+
+// startElement returns the SE event of an element declaration. Its grammar
+// is set once all type grammars are compiled.
+func (c *compiler) startElement(n *node) *core.StartElement {
+	if se, ok := c.startElements[n]; ok {
+		return se
+	}
+	se := core.NewStartElement(c.qnameContext(declarationName(n)))
+	c.startElements[n] = se
+	c.pending = append(c.pending, n)
+	return se
+}
+
+// elementGrammar returns the grammar of an element declaration, i.e., the
+// grammar of its type, made nillable if needed.
+func (c *compiler) elementGrammar(n *node) (*core.SchemaInformedFirstStartTag, error) {
+	if g, ok := c.elementGrammars[n]; ok {
+		return g, nil
+	}
+
+	key, err := c.elementTypeKey(n)
+	if err != nil {
+		return nil, err
+	}
+	tg, err := c.typeGrammar(key)
+	if err != nil {
+		return nil, fmt.Errorf("element %s: %w", n.attrs["name"], err)
+	}
+
+	g := tg
+	if n.attrs["nillable"] == "true" {
+		g = core.NewSchemaInformedFirstStartTagWithStartTag(tg)
+		g.SetTypeCastable(tg.IsTypeCastable())
+		g.SetNillable(true)
+	}
+
+	c.elementGrammars[n] = g
+	return g, nil
+}
+
+// elementTypeKey returns the type of an element declaration, see typeKey.
+func (c *compiler) elementTypeKey(n *node) (any, error) {
+	if qname, ok, err := n.qnameAttr("type"); err != nil || ok {
+		return qname, err
+	}
+	for _, child := range n.children {
+		if child.name == "complexType" || child.name == "simpleType" {
+			return c.typeKey(child), nil
+		}
+	}
+	if head, ok, err := n.qnameAttr("substitutionGroup"); err != nil {
+		return nil, err
+	} else if ok {
+		decl, ok := c.elements[head]
+		if !ok {
+			return nil, fmt.Errorf("unknown element {%s}%s", head.Space, head.Local)
+		}
+		if c.compiling[n] {
+			return nil, errors.New("circular substitution group")
+		}
+		c.compiling[n] = true
+		defer delete(c.compiling, n)
+		return c.elementTypeKey(decl)
+	}
+	return utils.QName{Space: core.XMLSchemaNS_URI, Local: anyType}, nil
+}
+
+// typeGrammar compiles the grammar of the type identified by key, see
+// typeKey.
+func (c *compiler) typeGrammar(key any) (*core.SchemaInformedFirstStartTag, error) {
+	if g, ok := c.typeGrammars[key]; ok {
+		return g, nil
+	}
+
+	var n *node
+	switch k := key.(type) {
+	case utils.QName:
+		if isBuiltInType(k) {
+			return c.builtInTypeGrammar(k.Local)
+		}
+		n = c.types[k]
+		if n == nil {
+			return nil, fmt.Errorf("unknown type {%s}%s", k.Space, k.Local)
+		}
+	case *node:
+		n = k
+	}
+
+	g := core.NewSchemaInformedFirstStartTag()
+	typeCastable := false
+	switch n.name {
+	case "simpleType":
+		st, err := c.simpleTypeDefinition(n)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.simpleTypeGrammar(g, st.datatype); err != nil {
+			return nil, err
+		}
+		typeCastable = st.union
+	case "complexType":
+		m, err := c.complexTypeModel(n)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.complexTypeGrammar(g, m); err != nil {
+			return nil, err
+		}
+	}
+	if qname, ok := key.(utils.QName); ok && c.hasSubtypes[qname] {
+		typeCastable = true
+	}
+	g.SetTypeCastable(typeCastable)
+
+	c.typeGrammars[key] = g
+	return g, nil
+}
+
+func (c *compiler) builtInTypeGrammar(local string) (*core.SchemaInformedFirstStartTag, error) {
+	qname := utils.QName{Space: core.XMLSchemaNS_URI, Local: local}
+	if g, ok := c.typeGrammars[qname]; ok {
+		return g, nil
+	}
+
+	var g *core.SchemaInformedFirstStartTag
+	if local == anyType {
+		// ur-type grammar, see EXI 1.0 section 8.5.4.1.3.3
+		content := core.NewSchemaInformedElement()
+		g = core.NewSchemaInformedFirstStartTagWithEC2(content)
+		if err := g.AddProduction(core.NewAttributeGeneric(), g); err != nil {
+			return nil, err
+		}
+		for _, state := range []core.SchemaInformedGrammar{g, content} {
+			if err := state.AddProduction(core.NewStartElementGeneric(), content); err != nil {
+				return nil, err
+			}
+			state.AddTerminalProduction(core.NewEndElement())
+			if err := state.AddProduction(core.NewCharactersGeneric(), content); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		st, err := c.builtInSimpleType(local)
+		if err != nil {
+			return nil, err
+		}
+		g = core.NewSchemaInformedFirstStartTag()
+		if err := c.simpleTypeGrammar(g, st.datatype); err != nil {
+			return nil, err
+		}
+	}
+	g.SetTypeCastable(c.hasSubtypes[qname])
+
+	c.typeGrammars[qname] = g
+	return g, nil
+}
+
+// simpleTypeGrammar fills the grammar of a simple type with datatype dt, see
+// EXI 1.0 section 8.5.4.1.3.1.
+func (c *compiler) simpleTypeGrammar(g *core.SchemaInformedFirstStartTag, dt core.Datatype) error {
+	content := core.NewSchemaInformedElement()
+	ch := core.NewCharacters(dt)
+	if err := content.AddProduction(ch, c.endElement); err != nil {
+		return err
+	}
+	g.SetElementContentGrammar(content)
+	return g.AddProduction(ch, c.endElement)
+}
+
+/*
+	Complex types
+*/
+
+// contentModel is the effective content of a complex type after resolving
+// derivations and group references.
+type contentModel struct {
+	attributes map[utils.QName]*attributeUse
+	wildcard   *node
+	particles  []*node
+	simple     *simpleType
+	mixed      bool
+}
+
+type attributeUse struct {
+	event    *core.Attribute
+	required bool
+}
+
+func (c *compiler) complexTypeModel(n *node) (*contentModel, error) {
+	if c.compiling[n] {
+		return nil, errors.New("circular type derivation")
+	}
+	c.compiling[n] = true
+	defer delete(c.compiling, n)
+
+	m := &contentModel{
+		attributes: map[utils.QName]*attributeUse{},
+		particles:  []*node{},
+		mixed:      n.attrs["mixed"] == "true",
+	}
+
+	derivation := n
+	if content := n.child("simpleContent"); content != nil {
+		derivation = derivationChild(content)
+		if derivation == nil {
+			return nil, errors.New("simpleContent without restriction or extension")
+		}
+		baseName, _, err := derivation.qnameAttr("base")
+		if err != nil {
+			return nil, err
+		}
+
+		var base *simpleType
+		if bn := c.types[baseName]; bn != nil && bn.name == "complexType" {
+			bm, err := c.complexTypeModel(bn)
+			if err != nil {
+				return nil, err
+			}
+			if bm.simple == nil {
+				return nil, fmt.Errorf("base type %s has no simple content", baseName.Local)
+			}
+			base = bm.simple
+			m.attributes = bm.attributes
+			m.wildcard = bm.wildcard
+		} else if base, err = c.namedSimpleType(baseName); err != nil {
+			return nil, err
+		}
+
+		m.simple = base
+		if derivation.name == "restriction" {
+			if anonymous := derivation.child("simpleType"); anonymous != nil {
+				if base, err = c.simpleTypeDefinition(anonymous); err != nil {
+					return nil, err
+				}
+			}
+			if m.simple, err = c.restrictSimpleType(base, derivation, c.definitionQNameContext(n)); err != nil {
+				return nil, err
+			}
+		}
+	} else if content := n.child("complexContent"); content != nil {
+		if mixed, ok := content.attr("mixed"); ok {
+			m.mixed = mixed == "true"
+		}
+		derivation = derivationChild(content)
+		if derivation == nil {
+			return nil, errors.New("complexContent without restriction or extension")
+		}
+		baseName, _, err := derivation.qnameAttr("base")
+		if err != nil {
+			return nil, err
+		}
+
+		if baseName != (utils.QName{Space: core.XMLSchemaNS_URI, Local: anyType}) {
+			bn := c.types[baseName]
+			if bn == nil || bn.name != "complexType" {
+				return nil, fmt.Errorf("unknown complex type {%s}%s", baseName.Space, baseName.Local)
+			}
+			bm, err := c.complexTypeModel(bn)
+			if err != nil {
+				return nil, err
+			}
+			m.attributes = bm.attributes
+			m.wildcard = bm.wildcard
+			if derivation.name == "extension" {
+				m.particles = bm.particles
+			}
+		}
+	}
+
+	if derivation.name == "restriction" {
+		m.wildcard = nil
+	}
+	for _, child := range derivation.children {
+		switch child.name {
+		case "sequence", "choice", "all", "group":
+			m.particles = append(slices.Clone(m.particles), child)
+		}
+	}
+	if err := c.collectAttributes(derivation, m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func derivationChild(n *node) *node {
+	if d := n.child("restriction"); d != nil {
+		return d
+	}
+	return n.child("extension")
+}
+
+// collectAttributes adds the attribute uses and the wildcard of n to m.
+// Prohibited attributes are removed.
+func (c *compiler) collectAttributes(n *node, m *contentModel) error {
+	m.attributes = maps.Clone(m.attributes)
+
+	for _, child := range n.children {
+		switch child.name {
+		case "attribute":
+			qname, use, err := c.attributeUse(child)
+			if err != nil {
+				return err
+			}
+			if use == nil {
+				delete(m.attributes, qname)
+			} else {
+				m.attributes[qname] = use
+			}
+		case "attributeGroup":
+			ref, _, err := child.qnameAttr("ref")
+			if err != nil {
+				return err
+			}
+			group, ok := c.attributeGroups[ref]
+			if !ok {
+				return fmt.Errorf("unknown attribute group {%s}%s", ref.Space, ref.Local)
+			}
+			if c.compiling[group] {
+				return errors.New("circular attribute group")
+			}
+			c.compiling[group] = true
+			err = c.collectAttributes(group, m)
+			delete(c.compiling, group)
+			if err != nil {
+				return err
+			}
+		case "anyAttribute":
+			m.wildcard = child
+		}
+	}
+
+	return nil
+}
+
+// attributeUse compiles a local attribute declaration or reference. The use
+// is nil for prohibited attributes.
+func (c *compiler) attributeUse(n *node) (utils.QName, *attributeUse, error) {
+	decl := n
+	qname := utils.QName{}
+	if ref, ok, err := n.qnameAttr("ref"); err != nil {
+		return qname, nil, err
+	} else if ok {
+		qname = ref
+		if decl, ok = c.attributes[ref]; !ok {
+			return qname, nil, fmt.Errorf("unknown attribute {%s}%s", ref.Space, ref.Local)
+		}
+	} else {
+		qname = declarationName(n)
+	}
+
+	switch n.attrs["use"] {
+	case "prohibited":
+		return qname, nil, nil
+	case "required", "optional", "":
+	default:
+		return qname, nil, fmt.Errorf("invalid attribute use %q", n.attrs["use"])
+	}
+
+	st, err := c.simpleTypeRef(decl, "type")
+	if err != nil {
+		return qname, nil, fmt.Errorf("attribute %s: %w", qname.Local, err)
+	}
+
+	return qname, &attributeUse{
+		event:    core.NewAttributeWithDatatype(c.qnameContext(qname), st.datatype),
+		required: n.attrs["use"] == "required",
+	}, nil
+}
+
+// complexTypeGrammar fills the grammar of a complex type. Attribute uses are
+// sorted by qualified name and each start tag state accepts the following
+// attributes up to the first required one, see EXI 1.0 section 8.5.4.1.3.2.
+func (c *compiler) complexTypeGrammar(g *core.SchemaInformedFirstStartTag, m *contentModel) error {
+	var content *core.SchemaInformedElement
+	if m.simple != nil {
+		content = core.NewSchemaInformedElement()
+		if err := content.AddProduction(core.NewCharacters(m.simple.datatype), c.endElement); err != nil {
+			return err
+		}
+	} else {
+		var err error
+		if content, err = c.particleGrammar(m); err != nil {
+			return err
+		}
+	}
+	g.SetElementContentGrammar(content)
+
+	uses := make([]*attributeUse, 0, len(m.attributes))
+	for _, use := range m.attributes {
+		uses = append(uses, use)
+	}
+	slices.SortFunc(uses, func(a, b *attributeUse) int {
+		return core.AttributeCompareFunc(a.event, b.event)
+	})
+
+	wildcards := []core.Event{}
+	if m.wildcard != nil {
+		uris, unrestricted := wildcardNamespaces(m.wildcard)
+		if unrestricted {
+			wildcards = append(wildcards, core.NewAttributeGeneric())
+		}
+		for _, uri := range uris {
+			id := c.grammarContext.GetGrammarUriContext(uri).GetNamespaceUriID()
+			wildcards = append(wildcards, core.NewAttributeNS(id, uri))
+		}
+	}
+
+	states := make([]core.SchemaInformedStartTagGrammar, len(uses)+1)
+	states[0] = g
+	for i := 1; i < len(states); i++ {
+		states[i] = core.NewSchemaInformedStartTagWithEC2(content)
+	}
+	for i, state := range states {
+		contentAllowed := true
+		for k := i; k < len(uses); k++ {
+			if err := state.AddProduction(uses[k].event, states[k+1]); err != nil {
+				return err
+			}
+			if uses[k].required {
+				contentAllowed = false
+				break
+			}
+		}
+		for _, w := range wildcards {
+			if err := state.AddProduction(w, state); err != nil {
+				return err
+			}
+		}
+		if contentAllowed {
+			for ec := 0; ec < content.GetNumberOfEvents(); ec++ {
+				p := content.GetProductionByEventCode(ec)
+				if err := state.AddProduction(p.GetEvent(), p.GetNextGrammar()); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+/*
+	Content models
+
+	Particles are compiled into a Glushkov automaton: each element or
+	wildcard term is a position and each position is a state of the content
+	grammar. Productions of a state are added in position order, which keeps
+	SE events in schema order.
+*/
+
+type termKind int
+
+const (
+	termPosition termKind = iota
+	termSequence
+	termChoice
+	termRepeat
+)
+
+type term struct {
+	kind     termKind
+	position int
+	children []*term
+}
+
+type automaton struct {
+	events []core.Event
+	follow [][]int
+}
+
+func (a *automaton) newPosition(event core.Event) *term {
+	a.events = append(a.events, event)
+	a.follow = append(a.follow, []int{})
+	return &term{kind: termPosition, position: len(a.events) - 1}
+}
+
+// analyse computes whether t accepts the empty word, the positions t may
+// start and end with and updates the follow positions.
+func (a *automaton) analyse(t *term) (nullable bool, first, last []int) {
+	switch t.kind {
+	case termPosition:
+		return false, []int{t.position}, []int{t.position}
+	case termSequence:
+		nullable = true
+		for _, child := range t.children {
+			n, f, l := a.analyse(child)
+			for _, p := range last {
+				a.follow[p] = union(a.follow[p], f)
+			}
+			if nullable {
+				first = union(first, f)
+			}
+			if n {
+				last = union(last, l)
+			} else {
+				last = l
+			}
+			nullable = nullable && n
+		}
+	case termChoice:
+		for _, child := range t.children {
+			n, f, l := a.analyse(child)
+			nullable = nullable || n
+			first = union(first, f)
+			last = union(last, l)
+		}
+	case termRepeat:
+		_, first, last = a.analyse(t.children[0])
+		for _, p := range last {
+			a.follow[p] = union(a.follow[p], first)
+		}
+		nullable = true
+	}
+	return nullable, first, last
+}
+
+func union(a, b []int) []int {
+	u := append(slices.Clone(a), b...)
+	slices.Sort(u)
+	return slices.Compact(u)
+}
+
+// particleGrammar compiles the particles of m into content grammars and
+// returns the first one.
+func (c *compiler) particleGrammar(m *contentModel) (*core.SchemaInformedElement, error) {
+	a := &automaton{}
+	t := &term{kind: termSequence}
+	for _, p := range m.particles {
+		pt, err := c.particleTerm(a, p)
+		if err != nil {
+			return nil, err
+		}
+		t.children = append(t.children, pt)
+	}
+
+	nullable, first, last := a.analyse(t)
+
+	states := make([]*core.SchemaInformedElement, len(a.events)+1)
+	for i := range states {
+		states[i] = core.NewSchemaInformedElement()
+	}
+	addProductions := func(state *core.SchemaInformedElement, positions []int, accepting bool) error {
+		for _, p := range positions {
+			if err := state.AddProduction(a.events[p], states[p+1]); err != nil {
+				return fmt.Errorf("ambiguous content model: %w", err)
+			}
+		}
+		if accepting {
+			state.AddTerminalProduction(core.NewEndElement())
+		}
+		if m.mixed {
+			return state.AddProduction(core.NewCharactersGeneric(), state)
+		}
+		return nil
+	}
+
+	if err := addProductions(states[0], first, nullable); err != nil {
+		return nil, err
+	}
+	for p := range a.events {
+		if err := addProductions(states[p+1], a.follow[p], slices.Contains(last, p)); err != nil {
+			return nil, err
+		}
+	}
+
+	return states[0], nil
+}
+
+// particleTerm compiles a particle with its occurrence constraints. Bounded
+// repetitions are unrolled.
+func (c *compiler) particleTerm(a *automaton, n *node) (*term, error) {
+	minOccurs, maxOccurs, err := occurrence(n)
+	if err != nil {
+		return nil, err
+	}
+
+	build := func() (*term, error) {
+		switch n.name {
+		case "element":
+			return c.elementTerm(a, n)
+		case "any":
+			return c.wildcardTerm(a, n), nil
+		case "group":
+			ref, _, err := n.qnameAttr("ref")
+			if err != nil {
+				return nil, err
+			}
+			group, ok := c.groups[ref]
+			if !ok {
+				return nil, fmt.Errorf("unknown group {%s}%s", ref.Space, ref.Local)
+			}
+			if c.compiling[group] {
+				return nil, errors.New("circular group")
+			}
+			c.compiling[group] = true
+			defer delete(c.compiling, group)
+			for _, child := range group.children {
+				switch child.name {
+				case "sequence", "choice", "all":
+					return c.modelGroupTerm(a, child)
+				}
+			}
+			return &term{kind: termSequence}, nil
+		default:
+			return c.modelGroupTerm(a, n)
+		}
+	}
+
+	if minOccurs == 1 && maxOccurs == 1 {
+		return build()
+	}
+
+	t := &term{kind: termSequence}
+	for i := 0; i < minOccurs; i++ {
+		child, err := build()
+		if err != nil {
+			return nil, err
+		}
+		t.children = append(t.children, child)
+	}
+	if maxOccurs < 0 {
+		child, err := build()
+		if err != nil {
+			return nil, err
+		}
+		t.children = append(t.children, &term{kind: termRepeat, children: []*term{child}})
+	} else {
+		optional := []*term{}
+		for i := minOccurs; i < maxOccurs; i++ {
+			child, err := build()
+			if err != nil {
+				return nil, err
+			}
+			optional = append(optional, child)
+		}
+		var tail *term
+		for i := len(optional) - 1; i >= 0; i-- {
+			inner := optional[i]
+			if tail != nil {
+				inner = &term{kind: termSequence, children: []*term{inner, tail}}
+			}
+			tail = &term{kind: termChoice, children: []*term{inner, {kind: termSequence}}}
+		}
+		if tail != nil {
+			t.children = append(t.children, tail)
+		}
+	}
+
+	return t, nil
+}
+
+// occurrence returns minOccurs and maxOccurs of a particle, -1 standing for
+// unbounded.
+func occurrence(n *node) (int, int, error) {
+	minOccurs, maxOccurs := 1, 1
+	var err error
+	if v, ok := n.attr("minOccurs"); ok {
+		if minOccurs, err = strconv.Atoi(strings.TrimSpace(v)); err != nil || minOccurs < 0 {
+			return 0, 0, fmt.Errorf("invalid minOccurs %q", v)
+		}
+	}
+	if v, ok := n.attr("maxOccurs"); ok {
+		if strings.TrimSpace(v) == "unbounded" {
+			return minOccurs, -1, nil
+		}
+		if maxOccurs, err = strconv.Atoi(strings.TrimSpace(v)); err != nil || maxOccurs < minOccurs {
+			return 0, 0, fmt.Errorf("invalid maxOccurs %q", v)
+		}
+	}
+	return minOccurs, maxOccurs, nil
+}
+
+// modelGroupTerm compiles the particles of a sequence, choice or all group.
+// All groups accept their particles in any order, see EXI 1.0 section
+// 8.5.4.1.8.
+func (c *compiler) modelGroupTerm(a *automaton, n *node) (*term, error) {
+	kind := termSequence
+	if n.name == "choice" || n.name == "all" {
+		kind = termChoice
+	}
+	t := &term{kind: kind}
+	for _, child := range n.children {
+		switch child.name {
+		case "element", "any", "group", "sequence", "choice":
+			ct, err := c.particleTerm(a, child)
+			if err != nil {
+				return nil, err
+			}
+			t.children = append(t.children, ct)
+		}
+	}
+	if n.name == "all" {
+		return &term{kind: termRepeat, children: []*term{t}}, nil
+	}
+	return t, nil
+}
+
+// elementTerm compiles an element particle. References to the head of a
+// substitution group accept all members sorted by qualified name.
+func (c *compiler) elementTerm(a *automaton, n *node) (*term, error) {
+	ref, ok, err := n.qnameAttr("ref")
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return a.newPosition(c.startElement(n)), nil
+	}
+
+	members := []utils.QName{}
+	queue := []utils.QName{ref}
+	for len(queue) > 0 {
+		qname := queue[0]
+		queue = queue[1:]
+		if slices.Contains(members, qname) {
+			continue
+		}
+		members = append(members, qname)
+		queue = append(queue, c.substitutions[qname]...)
+	}
+	slices.SortFunc(members, core.QNameCompareFunc)
+
+	t := &term{kind: termChoice}
+	for _, qname := range members {
+		decl, ok := c.elements[qname]
+		if !ok {
+			return nil, fmt.Errorf("unknown element {%s}%s", qname.Space, qname.Local)
+		}
+		if decl.attrs["abstract"] == "true" {
+			continue
+		}
+		t.children = append(t.children, a.newPosition(c.startElement(decl)))
+	}
+	if len(t.children) == 1 {
+		return t.children[0], nil
+	}
+	return t, nil
+}
+
+// wildcardTerm compiles an element wildcard into SE(*) or SE(uri:*) events,
+// see EXI 1.0 section 8.5.4.1.7.
+func (c *compiler) wildcardTerm(a *automaton, n *node) *term {
+	uris, unrestricted := wildcardNamespaces(n)
+	if unrestricted {
+		return a.newPosition(core.NewStartElementGeneric())
+	}
+	t := &term{kind: termChoice}
+	for _, uri := range uris {
+		id := c.grammarContext.GetGrammarUriContext(uri).GetNamespaceUriID()
+		t.children = append(t.children, a.newPosition(core.NewStartElementNS(id, uri)))
+	}
+	return t
+}
@@ -0,0 +1,61 @@
+package xsd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/sderkacs/go-exi/core"
+)
+
+// DirectorySchemaIDResolver resolves the schema ID of EXI headers to the
+// schema file <dir>/<schemaID> or <dir>/<schemaID>.xsd. Schemas are compiled
+// on first use and cached, the resolver may be shared by decoders running in
+// parallel.
+type DirectorySchemaIDResolver struct {
+	dir      string
+	mu       sync.Mutex
+	grammars map[string]*core.SchemaInformedGrammars
+}
+
+func NewDirectorySchemaIDResolver(dir string) *DirectorySchemaIDResolver {
+	return &DirectorySchemaIDResolver{
+		dir:      dir,
+		grammars: map[string]*core.SchemaInformedGrammars{},
+	}
+}
+
+func (r *DirectorySchemaIDResolver) ResolveSchemaID(schemaID string) (core.Grammars, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if g, ok := r.grammars[schemaID]; ok {
+		return g, nil
+	}
+
+	// schema IDs come from the EXI stream and must not escape the directory
+	if schemaID == "" || !filepath.IsLocal(schemaID) {
+		return nil, fmt.Errorf("unknown schema ID '%s'", schemaID)
+	}
+	path := filepath.Join(r.dir, schemaID)
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		path += ".xsd"
+	}
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("unknown schema ID '%s'", schemaID)
+	}
+
+	l := newLoader()
+	if err := l.loadFile(path, nil); err != nil {
+		return nil, fmt.Errorf("schema ID '%s': %w", schemaID, err)
+	}
+	g, err := l.compile(schemaID)
+	if err != nil {
+		return nil, fmt.Errorf("schema ID '%s': %w", schemaID, err)
+	}
+
+	r.grammars[schemaID] = g
+	return g, nil
+}
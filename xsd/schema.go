@@ -0,0 +1,355 @@
+// Package xsd compiles XML Schema documents into schema-informed EXI grammars.
+//
+// Supported are global and local element and attribute declarations, named
+// and anonymous complex and simple types, sequence, choice and all model
+// groups, group and attributeGroup references, wildcards, substitution
+// groups, complexContent and simpleContent derivations, simple type
+// restrictions, lists and unions as well as include and import.
+//
+// Pattern facets are not evaluated, i.e., strings restricted by a pattern are
+// encoded as plain strings instead of restricted character sets. Identity
+// constraints, redefine and override are not supported.
+package xsd
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sderkacs/go-exi/core"
+	"github.com/sderkacs/go-exi/utils"
+)
+
+// CreateGrammars compiles the schema read from reader into schema-informed
+// grammars to be used with core.EXIFactory.SetGrammars. schemaID identifies
+// the schema in EXI headers that include the schemaId option.
+//
+// Relative schema locations of include and import are resolved against the
+// working directory.
+func CreateGrammars(reader io.Reader, schemaID string) (*core.SchemaInformedGrammars, error) {
+	l := newLoader()
+	if _, err := l.load(reader, "", nil); err != nil {
+		return nil, err
+	}
+	return l.compile(schemaID)
+}
+
+// CreateGrammarsFromFile is like CreateGrammars but reads the schema from the
+// file at path and uses path as schema ID. Relative schema locations are
+// resolved against the directory of the including schema.
+func CreateGrammarsFromFile(path string) (*core.SchemaInformedGrammars, error) {
+	l := newLoader()
+	if err := l.loadFile(path, nil); err != nil {
+		return nil, err
+	}
+	return l.compile(path)
+}
+
+/*
+	Schema documents
+*/
+
+// node is an element of a schema document in the XML Schema namespace.
+// Annotations and foreign elements are dropped while parsing.
+type node struct {
+	name     string
+	attrs    map[string]string
+	parent   *node
+	children []*node
+	ns       map[string]string
+	schema   *schemaDoc
+}
+
+func (n *node) attr(name string) (string, bool) {
+	v, ok := n.attrs[name]
+	return v, ok
+}
+
+// isGlobal reports whether n is a top-level definition of its schema.
+func (n *node) isGlobal() bool {
+	return n.parent != nil && n.parent.parent == nil
+}
+
+func (n *node) child(name string) *node {
+	for _, c := range n.children {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// resolveQName resolves a QName valued attribute, e.g., type="tns:T", with
+// the namespace declarations in scope of n.
+func (n *node) resolveQName(value string) (utils.QName, error) {
+	value = strings.TrimSpace(value)
+	prefix, local, found := strings.Cut(value, ":")
+	if !found {
+		uri := n.ns[""]
+		if uri == "" && n.schema.chameleon {
+			// Note: unqualified references of an included schema without
+			// target namespace adopt the namespace of the including schema
+			uri = n.schema.targetNamespace
+		}
+		return utils.QName{Space: uri, Local: value}, nil
+	}
+	if prefix == "xml" {
+		return utils.QName{Space: core.XML_NS_URI, Local: local}, nil
+	}
+	uri, ok := n.ns[prefix]
+	if !ok {
+		return utils.QName{}, fmt.Errorf("unbound prefix in QName %q", value)
+	}
+	return utils.QName{Space: uri, Local: local}, nil
+}
+
+func (n *node) qnameAttr(name string) (utils.QName, bool, error) {
+	v, ok := n.attrs[name]
+	if !ok {
+		return utils.QName{}, false, nil
+	}
+	qname, err := n.resolveQName(v)
+	return qname, true, err
+}
+
+type schemaDoc struct {
+	targetNamespace        string
+	elementFormQualified   bool
+	attributeFormQualified bool
+	// chameleon is set for included schemas without target namespace
+	chameleon bool
+	root      *node
+}
+
+// parseSchema reads a schema document. chameleonNS is the target namespace
+// of the including schema and is adopted by schemas without one.
+func parseSchema(reader io.Reader, chameleonNS *string) (*schemaDoc, error) {
+	dec := xml.NewDecoder(reader)
+	doc := &schemaDoc{}
+	stack := []*node{}
+
+	for {
+		token, err := dec.Token()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+
+		switch tok := token.(type) {
+		case xml.StartElement:
+			if tok.Name.Space != core.XMLSchemaNS_URI || tok.Name.Local == "annotation" {
+				if len(stack) == 0 {
+					return nil, fmt.Errorf("not a schema document: %s", tok.Name.Local)
+				}
+				if err := dec.Skip(); err != nil {
+					return nil, err
+				}
+				continue
+			}
+
+			var parent *node
+			ns := map[string]string{}
+			if len(stack) > 0 {
+				parent = stack[len(stack)-1]
+				ns = parent.ns
+			}
+			n := &node{
+				name:   tok.Name.Local,
+				attrs:  map[string]string{},
+				parent: parent,
+				ns:     ns,
+				schema: doc,
+			}
+			copied := false
+			for _, attr := range tok.Attr {
+				switch {
+				case attr.Name.Space == "xmlns", attr.Name.Space == "" && attr.Name.Local == "xmlns":
+					if !copied {
+						n.ns = make(map[string]string, len(ns)+1)
+						for k, v := range ns {
+							n.ns[k] = v
+						}
+						copied = true
+					}
+					if attr.Name.Space == "" {
+						n.ns[""] = attr.Value
+					} else {
+						n.ns[attr.Name.Local] = attr.Value
+					}
+				case attr.Name.Space == "":
+					n.attrs[attr.Name.Local] = attr.Value
+				}
+			}
+
+			if parent == nil {
+				if n.name != "schema" {
+					return nil, fmt.Errorf("not a schema document: %s", n.name)
+				}
+				doc.root = n
+			} else {
+				parent.children = append(parent.children, n)
+			}
+			stack = append(stack, n)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		}
+	}
+
+	if doc.root == nil {
+		return nil, errors.New("not a schema document: no schema element")
+	}
+
+	doc.targetNamespace = doc.root.attrs["targetNamespace"]
+	if _, ok := doc.root.attrs["targetNamespace"]; !ok && chameleonNS != nil {
+		doc.targetNamespace = *chameleonNS
+		doc.chameleon = true
+	}
+	doc.elementFormQualified = doc.root.attrs["elementFormDefault"] == "qualified"
+	doc.attributeFormQualified = doc.root.attrs["attributeFormDefault"] == "qualified"
+
+	return doc, nil
+}
+
+/*
+	Loading
+*/
+
+// xmlSchema declares the attributes of the XML namespace. It is used when a
+// schema refers to xml:lang and friends without importing the namespace.
+const xmlSchema = `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema" targetNamespace="http://www.w3.org/XML/1998/namespace">
+	<xs:attribute name="base" type="xs:anyURI"/>
+	<xs:attribute name="id" type="xs:ID"/>
+	<xs:attribute name="lang">
+		<xs:simpleType>
+			<xs:union memberTypes="xs:language">
+				<xs:simpleType>
+					<xs:restriction base="xs:string">
+						<xs:enumeration value=""/>
+					</xs:restriction>
+				</xs:simpleType>
+			</xs:union>
+		</xs:simpleType>
+	</xs:attribute>
+	<xs:attribute name="space">
+		<xs:simpleType>
+			<xs:restriction base="xs:NCName">
+				<xs:enumeration value="default"/>
+				<xs:enumeration value="preserve"/>
+			</xs:restriction>
+		</xs:simpleType>
+	</xs:attribute>
+</xs:schema>`
+
+type loader struct {
+	schemas []*schemaDoc
+	loaded  map[string]bool
+}
+
+func newLoader() *loader {
+	return &loader{
+		schemas: []*schemaDoc{},
+		loaded:  map[string]bool{},
+	}
+}
+
+func (l *loader) loadFile(path string, chameleonNS *string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	key := abs
+	if chameleonNS != nil {
+		key += "#" + *chameleonNS
+	}
+	if l.loaded[key] {
+		return nil
+	}
+	l.loaded[key] = true
+
+	f, err := os.Open(abs)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := l.load(f, filepath.Dir(abs), chameleonNS); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// load parses a schema document and the documents it includes or imports.
+// Schema locations are resolved against baseDir.
+func (l *loader) load(reader io.Reader, baseDir string, chameleonNS *string) (*schemaDoc, error) {
+	doc, err := parseSchema(reader, chameleonNS)
+	if err != nil {
+		return nil, err
+	}
+	l.schemas = append(l.schemas, doc)
+
+	for _, c := range doc.root.children {
+		switch c.name {
+		case "include", "import":
+			location, ok := c.attr("schemaLocation")
+			if !ok {
+				// e.g., import of a namespace known by other means
+				continue
+			}
+			var chameleon *string
+			if c.name == "include" {
+				chameleon = &doc.targetNamespace
+			}
+			if !filepath.IsAbs(location) {
+				location = filepath.Join(baseDir, location)
+			}
+			if err := l.loadFile(location, chameleon); err != nil {
+				return nil, err
+			}
+		case "redefine", "override":
+			return nil, fmt.Errorf("%s is not supported", c.name)
+		}
+	}
+
+	return doc, nil
+}
+
+// declares reports whether a loaded schema has targetNamespace uri.
+func (l *loader) declares(uri string) bool {
+	for _, s := range l.schemas {
+		if s.targetNamespace == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// refersTo reports whether any QName valued reference of the loaded schemas
+// lies in namespace uri.
+func (l *loader) refersTo(uri string) bool {
+	var walk func(n *node) bool
+	walk = func(n *node) bool {
+		for _, a := range []string{"ref", "type", "base", "itemType"} {
+			if qname, ok, err := n.qnameAttr(a); ok && err == nil && qname.Space == uri {
+				return true
+			}
+		}
+		for _, c := range n.children {
+			if walk(c) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, s := range l.schemas {
+		if walk(s.root) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,375 @@
+package xsd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sderkacs/go-exi/core"
+)
+
+const schemaHead = `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema" xmlns:t="urn:t" targetNamespace="urn:t">`
+
+func compile(t *testing.T, definitions string) *core.SchemaInformedGrammars {
+	t.Helper()
+	grammars, err := CreateGrammars(strings.NewReader(schemaHead+definitions+`</xs:schema>`), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return grammars
+}
+
+// globalElement returns the grammar of the global element {uri}local.
+func globalElement(t *testing.T, grammars *core.SchemaInformedGrammars, uri, local string) core.Grammar {
+	t.Helper()
+	uc := grammars.GetGrammarContext().GetGrammarUriContext(uri)
+	if uc == nil {
+		t.Fatalf("no namespace %s", uri)
+	}
+	qnc := uc.GetQNameContextByLocalName(local)
+	if qnc == nil || qnc.GetGlobalStartElement() == nil {
+		t.Fatalf("no global element {%s}%s", uri, local)
+	}
+	return qnc.GetGlobalStartElement().GetGrammar()
+}
+
+// contentDatatype returns the datatype of the characters of the global
+// element local in namespace urn:t.
+func contentDatatype(t *testing.T, grammars *core.SchemaInformedGrammars, local string) core.Datatype {
+	t.Helper()
+	p := globalElement(t, grammars, "urn:t", local).GetProduction(core.EventTypeCharacters)
+	if p == nil {
+		t.Fatalf("%s: no characters", local)
+	}
+	return p.GetEvent().(interface{ GetDatatype() core.Datatype }).GetDatatype()
+}
+
+func TestIntegerFacets(t *testing.T) {
+	grammars := compile(t, `
+		<xs:element name="small">
+			<xs:simpleType>
+				<xs:restriction base="xs:int">
+					<xs:minInclusive value="-3"/>
+					<xs:maxExclusive value="+10"/>
+				</xs:restriction>
+			</xs:simpleType>
+		</xs:element>
+		<xs:simpleType name="positive">
+			<xs:restriction base="xs:integer">
+				<xs:minExclusive value="0"/>
+			</xs:restriction>
+		</xs:simpleType>
+		<xs:element name="positive" type="t:positive"/>
+		<xs:element name="narrowed">
+			<xs:simpleType>
+				<xs:restriction base="t:positive">
+					<xs:maxInclusive value="4095"/>
+				</xs:restriction>
+			</xs:simpleType>
+		</xs:element>
+		<xs:element name="wide">
+			<xs:simpleType>
+				<xs:restriction base="xs:long">
+					<xs:minInclusive value="-1"/>
+					<xs:maxInclusive value="4095"/>
+				</xs:restriction>
+			</xs:simpleType>
+		</xs:element>
+		<xs:element name="byte" type="xs:unsignedByte"/>`)
+
+	for _, test := range []struct {
+		element      string
+		lower, upper string
+	}{
+		{"small", "-3", "9"},
+		{"narrowed", "1", "4095"},
+		{"byte", "0", "255"},
+	} {
+		dt, ok := contentDatatype(t, grammars, test.element).(*core.NBitUnsignedIntegerDatatype)
+		if !ok {
+			t.Errorf("%s: got %T, want n-bit integer", test.element, contentDatatype(t, grammars, test.element))
+			continue
+		}
+		if lower, upper := dt.GetLowerBound().String(), dt.GetUpperBound().String(); lower != test.lower || upper != test.upper {
+			t.Errorf("%s: bounds [%s, %s], want [%s, %s]", test.element, lower, upper, test.lower, test.upper)
+		}
+	}
+
+	if dt := contentDatatype(t, grammars, "positive"); dt.GetBuiltInType() != core.BuiltInTypeUnsignedInteger {
+		t.Errorf("positive: got %T", dt)
+	}
+	// 4097 values do not fit the n-bit range
+	if dt := contentDatatype(t, grammars, "wide"); dt.GetBuiltInType() != core.BuiltInTypeInteger {
+		t.Errorf("wide: got %T", dt)
+	}
+}
+
+func TestEnumerationAndPatternFacets(t *testing.T) {
+	grammars := compile(t, `
+		<xs:simpleType name="color">
+			<xs:restriction base="xs:token">
+				<xs:enumeration value="red"/>
+				<xs:enumeration value=" green "/>
+				<xs:enumeration value="blue"/>
+			</xs:restriction>
+		</xs:simpleType>
+		<xs:element name="color" type="t:color"/>
+		<xs:element name="primary">
+			<xs:simpleType>
+				<xs:restriction base="t:color">
+					<xs:enumeration value="red"/>
+				</xs:restriction>
+			</xs:simpleType>
+		</xs:element>
+		<xs:element name="digit">
+			<xs:simpleType>
+				<xs:restriction base="xs:decimal">
+					<xs:enumeration value="1.5"/>
+					<xs:enumeration value="12.25"/>
+				</xs:restriction>
+			</xs:simpleType>
+		</xs:element>
+		<xs:element name="qname">
+			<xs:simpleType>
+				<xs:restriction base="xs:QName">
+					<xs:enumeration value="t:a"/>
+				</xs:restriction>
+			</xs:simpleType>
+		</xs:element>
+		<xs:element name="flag">
+			<xs:simpleType>
+				<xs:restriction base="xs:boolean">
+					<xs:pattern value="true|false"/>
+				</xs:restriction>
+			</xs:simpleType>
+		</xs:element>
+		<xs:element name="code">
+			<xs:simpleType>
+				<xs:restriction base="xs:string">
+					<xs:pattern value="[A-Z]+"/>
+				</xs:restriction>
+			</xs:simpleType>
+		</xs:element>`)
+
+	for _, test := range []struct {
+		element string
+		values  []string
+	}{
+		// enumeration values are whitespace collapsed like tokens
+		{"color", []string{"red", "green", "blue"}},
+		{"primary", []string{"red"}},
+		{"digit", []string{"1.5", "12.25"}},
+	} {
+		dt, ok := contentDatatype(t, grammars, test.element).(*core.EnumerationDatatype)
+		if !ok {
+			t.Errorf("%s: got %T, want enumeration", test.element, contentDatatype(t, grammars, test.element))
+			continue
+		}
+		values := make([]string, dt.GetEnumerationSize())
+		for i := range values {
+			s, err := dt.GetEnumValue(i).ToString()
+			if err != nil {
+				t.Fatal(err)
+			}
+			values[i] = s
+		}
+		if strings.Join(values, ",") != strings.Join(test.values, ",") {
+			t.Errorf("%s: values %q, want %q", test.element, values, test.values)
+		}
+	}
+
+	// QName values are never encoded as enumerations
+	if dt := contentDatatype(t, grammars, "qname"); dt.GetBuiltInType() != core.BuiltInTypeString {
+		t.Errorf("qname: got %T", dt)
+	}
+	if _, ok := contentDatatype(t, grammars, "flag").(*core.BooleanFacetDatatype); !ok {
+		t.Errorf("flag: got %T, want boolean with pattern", contentDatatype(t, grammars, "flag"))
+	}
+	// other patterns are not evaluated
+	if dt := contentDatatype(t, grammars, "code"); dt.GetBuiltInType() != core.BuiltInTypeString {
+		t.Errorf("code: got %T", dt)
+	}
+}
+
+func writeSchemas(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, schema := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(schema), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestIncludeImport(t *testing.T) {
+	dir := writeSchemas(t, map[string]string{
+		"main.xsd": `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema" xmlns:t="urn:t" xmlns:a="urn:a" targetNamespace="urn:t">
+			<xs:include schemaLocation="common.xsd"/>
+			<xs:include schemaLocation="sub/chameleon.xsd"/>
+			<xs:import namespace="urn:a" schemaLocation="sub/imported.xsd"/>
+			<xs:element name="main" type="t:common"/>
+			<xs:element name="other" type="a:imported"/>
+		</xs:schema>`,
+		// includes main.xsd in turn
+		"common.xsd": `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema" targetNamespace="urn:t">
+			<xs:include schemaLocation="main.xsd"/>
+			<xs:simpleType name="common">
+				<xs:restriction base="xs:unsignedByte"/>
+			</xs:simpleType>
+		</xs:schema>`,
+		// takes on the target namespace of the including schema
+		"sub/chameleon.xsd": `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema">
+			<xs:simpleType name="local">
+				<xs:restriction base="xs:boolean"/>
+			</xs:simpleType>
+			<xs:element name="chameleon" type="local"/>
+		</xs:schema>`,
+		// relative to the importing schema
+		"sub/imported.xsd": `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema" targetNamespace="urn:a">
+			<xs:simpleType name="imported">
+				<xs:restriction base="xs:date"/>
+			</xs:simpleType>
+			<xs:element name="imported" type="xs:string"/>
+		</xs:schema>`,
+	})
+
+	grammars, err := CreateGrammarsFromFile(filepath.Join(dir, "main.xsd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := grammars.GetSchemaID(); id == nil || *id != filepath.Join(dir, "main.xsd") {
+		t.Errorf("schema ID %v", id)
+	}
+	if dt := contentDatatype(t, grammars, "main"); dt.GetBuiltInType() != core.BuiltInTypeNBitUnsignedInteger {
+		t.Errorf("main: got %T", dt)
+	}
+	if dt := contentDatatype(t, grammars, "chameleon"); dt.GetBuiltInType() != core.BuiltInTypeBoolean {
+		t.Errorf("chameleon: got %T", dt)
+	}
+	if dt := contentDatatype(t, grammars, "other"); dt.GetBuiltInType() != core.BuiltInTypeDateTime {
+		t.Errorf("other: got %T", dt)
+	}
+	globalElement(t, grammars, "urn:a", "imported")
+	if uc := grammars.GetGrammarContext().GetGrammarUriContext(""); uc != nil && uc.GetQNameContextByLocalName("chameleon") != nil {
+		t.Error("chameleon element in the empty namespace")
+	}
+}
+
+func TestSubstitutionGroups(t *testing.T) {
+	grammars := compile(t, `
+		<xs:element name="shape" type="xs:string" abstract="true"/>
+		<xs:element name="circle" type="xs:string" substitutionGroup="t:shape"/>
+		<xs:element name="square" type="xs:string" substitutionGroup="t:shape"/>
+		<xs:element name="rounded" type="xs:string" substitutionGroup="t:circle"/>
+		<xs:element name="drawing">
+			<xs:complexType>
+				<xs:sequence>
+					<xs:element ref="t:shape" maxOccurs="unbounded"/>
+				</xs:sequence>
+			</xs:complexType>
+		</xs:element>`)
+
+	drawing := globalElement(t, grammars, "urn:t", "drawing")
+	for _, member := range []string{"circle", "square", "rounded"} {
+		if drawing.GetStartElementProduction("urn:t", member) == nil {
+			t.Errorf("no production for member %s", member)
+		}
+	}
+	// abstract heads cannot occur themselves
+	if drawing.GetStartElementProduction("urn:t", "shape") != nil {
+		t.Error("production for abstract head")
+	}
+}
+
+func TestMalformedSchemas(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		schema string
+		err    string
+	}{
+		{
+			"no schema",
+			`<schema/>`,
+			"not a schema document",
+		},
+		{
+			"no schema element",
+			``,
+			"no schema element",
+		},
+		{
+			"redefine",
+			schemaHead + `<xs:redefine schemaLocation="other.xsd"/></xs:schema>`,
+			"redefine is not supported",
+		},
+		{
+			"missing include",
+			schemaHead + `<xs:include schemaLocation="missing.xsd"/></xs:schema>`,
+			"missing.xsd",
+		},
+		{
+			"unknown type",
+			schemaHead + `<xs:element name="e" type="t:missing"/></xs:schema>`,
+			"unknown type {urn:t}missing",
+		},
+		{
+			"unbound prefix",
+			schemaHead + `<xs:element name="e" type="u:missing"/></xs:schema>`,
+			"unbound prefix",
+		},
+		{
+			"unknown element",
+			schemaHead + `<xs:element name="e" substitutionGroup="t:missing"/></xs:schema>`,
+			"unknown element {urn:t}missing",
+		},
+		{
+			"circular simple type",
+			schemaHead + `
+				<xs:simpleType name="a"><xs:restriction base="t:b"/></xs:simpleType>
+				<xs:simpleType name="b"><xs:restriction base="t:a"/></xs:simpleType>
+			</xs:schema>`,
+			"circular simple type definition",
+		},
+		{
+			"empty simple type",
+			schemaHead + `<xs:simpleType name="a"/></xs:schema>`,
+			"simple type without restriction, list or union",
+		},
+		{
+			"complex base of simple type",
+			schemaHead + `<xs:simpleType name="a"><xs:restriction base="xs:anyType"/></xs:simpleType></xs:schema>`,
+			"anyType is not a simple type",
+		},
+		{
+			"invalid facet",
+			schemaHead + `<xs:simpleType name="a"><xs:restriction base="xs:int"><xs:maxInclusive value="ten"/></xs:restriction></xs:simpleType></xs:schema>`,
+			`invalid integer facet value "ten"`,
+		},
+		{
+			"invalid enumeration value",
+			schemaHead + `<xs:simpleType name="a"><xs:restriction base="xs:int"><xs:enumeration value="one"/></xs:restriction></xs:simpleType></xs:schema>`,
+			`invalid enumeration value "one"`,
+		},
+		{
+			"invalid occurrence",
+			schemaHead + `<xs:element name="e"><xs:complexType><xs:sequence><xs:element name="c" minOccurs="-1"/></xs:sequence></xs:complexType></xs:element></xs:schema>`,
+			`invalid minOccurs "-1"`,
+		},
+		{
+			"malformed XML",
+			schemaHead + `<xs:element name="e">`,
+			"",
+		},
+	} {
+		_, err := CreateGrammars(strings.NewReader(test.schema), "test")
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+		}
+	}
+}